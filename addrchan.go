@@ -0,0 +1,73 @@
+// +build go1.18
+
+package portmap
+
+import "net/netip"
+
+// Implemented by Mappings returned by New where net/netip is available.
+type AddrChanner interface {
+	// Returns a channel on which each distinct external endpoint of the
+	// mapping is sent as it is learned or changes, so that an application can
+	// publish its address with a simple range loop. If the consumer falls
+	// behind, only the latest endpoint is sent. Endpoints whose IP address is
+	// not known are not sent. The channel is closed when the mapping is
+	// deleted; for a mapping shared between callers of New, this is when the
+	// reference returned by the call to New which returned this value is
+	// released.
+	AddrChan() <-chan netip.AddrPort
+}
+
+func (r *mappingRef) AddrChan() <-chan netip.AddrPort {
+	m := r.mapping
+	m.mutex.Lock()
+	changed := m.watchers.add()
+	r.watchers = append(r.watchers, changed)
+	m.mutex.Unlock()
+
+	return watchAddr(changed, m.abortChan, r.done, m.ExternalAddr)
+}
+
+func (bm *brokerMapping) AddrChan() <-chan netip.AddrPort {
+	bm.mutex.Lock()
+	changed := bm.watchers.add()
+	bm.mutex.Unlock()
+
+	return watchAddr(changed, bm.doneChan, nil, bm.ExternalAddr)
+}
+
+// Sends the endpoint given by addr each time it differs from the last one
+// sent, rechecking whenever changed is signalled, until done or refDone is
+// closed. refDone may be nil.
+func watchAddr(changed, done, refDone <-chan struct{}, addr func() string) <-chan netip.AddrPort {
+	c := make(chan netip.AddrPort)
+	go func() {
+		defer close(c)
+
+		var last, pending netip.AddrPort
+		for {
+			if ap, err := netip.ParseAddrPort(addr()); err == nil {
+				pending = ap
+				if ap == last {
+					pending = netip.AddrPort{}
+				}
+			}
+
+			var sendChan chan<- netip.AddrPort
+			if pending.IsValid() {
+				sendChan = c
+			}
+
+			select {
+			case sendChan <- pending:
+				last, pending = pending, netip.AddrPort{}
+			case <-changed:
+			case <-done:
+				return
+			case <-refDone:
+				return
+			}
+		}
+	}()
+
+	return c
+}
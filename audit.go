@@ -0,0 +1,69 @@
+package portmap
+
+import "encoding/json"
+import "io"
+import "sync"
+import "time"
+
+var auditMutex sync.Mutex
+var auditWriter io.Writer
+
+// Sets a writer to which a record of every mapping operation performed
+// against a gateway is appended. This covers NAT-PMP map requests (including
+// those with a zero lifetime, which delete a mapping), UPnP AddPortMapping
+// and DeletePortMapping requests, and calls to the Map and Unmap methods of a
+// Backend, whether or not they succeed. For a Backend, the gateway recorded
+// is the name of the backend.
+//
+// Each record is written as a single line of JSON. Writes are serialized, so
+// w need not be safe for concurrent use. Pass nil to disable the audit log,
+// which is the default.
+func SetAuditLog(w io.Writer) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	auditWriter = w
+}
+
+// Lifetimes are recorded in seconds.
+type auditRecord struct {
+	Time           time.Time `json:"time"`
+	Operation      string    `json:"op"`
+	Gateway        string    `json:"gateway"`
+	Protocol       string    `json:"protocol"`
+	InternalPort   uint16    `json:"internalPort,omitempty"`
+	ExternalPort   uint16    `json:"externalPort"`
+	Lifetime       int64     `json:"lifetime"`
+	Name           string    `json:"name,omitempty"`
+	ResultPort     uint16    `json:"resultPort,omitempty"`
+	ResultLifetime int64     `json:"resultLifetime,omitempty"`
+	Error          string    `json:"error,omitempty"`
+}
+
+const (
+	auditNATPMPMap    = "natpmp-map"
+	auditUPnPAdd      = "upnp-add"
+	auditUPnPDelete   = "upnp-delete"
+	auditBackendMap   = "backend-map"
+	auditBackendUnmap = "backend-unmap"
+)
+
+func audit(r auditRecord, err error) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	if auditWriter == nil {
+		return
+	}
+
+	r.Time = time.Now().UTC()
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	b, err := json.Marshal(&r)
+	if err != nil {
+		return
+	}
+
+	auditWriter.Write(append(b, '\n')) // ignore errors
+}
@@ -0,0 +1,191 @@
+package portmap
+
+import "errors"
+import "net"
+import "time"
+
+// A custom means of obtaining an external endpoint for a mapping, used in
+// place of NAT-PMP and UPnP when set in Config.Backend, or when they fail if
+// set in Config.Fallback. For example, a backend might request a NodePort or
+// LoadBalancer port from a cluster orchestrator, so that applications can use
+// the same Mapping abstraction whether they are running on a host behind a
+// NAT gateway or in a cluster.
+//
+// The mapping process calls Map to create the mapping and again halfway
+// through each lifetime to renew it, with the usual backoff on failure, and
+// calls Unmap when the mapping is deleted. Calls are never made concurrently
+// for the same mapping.
+type Backend interface {
+	// A short name for the backend, used in logs.
+	Name() string
+
+	// Creates or renews the mapping.
+	Map(req BackendRequest) (BackendResult, error)
+
+	// Removes the mapping. prev is the result of the last successful call to
+	// Map.
+	Unmap(req BackendRequest, prev BackendResult) error
+}
+
+// Describes the mapping a Backend is asked to create or remove.
+type BackendRequest struct {
+	Protocol     Protocol
+	Name         string
+	InternalPort uint16
+
+	// The external port requested. On renewal, this is the port previously
+	// granted. Zero if any port is acceptable.
+	ExternalPort uint16
+
+	// The lifetime requested.
+	Lifetime time.Duration
+
+	// True if the mapping is currently active and is being renewed.
+	Renewal bool
+}
+
+// Describes the mapping created by a Backend.
+type BackendResult struct {
+	// The external IP address. May be nil if the backend doesn't know it, in
+	// which case ExternalAddr returns ":port".
+	ExternalIP net.IP
+
+	// The external port. Must not be zero.
+	ExternalPort uint16
+
+	// The lifetime granted. If zero, the requested lifetime is assumed.
+	Lifetime time.Duration
+}
+
+func (m *mapping) backendRequest() BackendRequest {
+	return BackendRequest{
+		Protocol:     m.cfg.Protocol,
+		Name:         m.cfg.Name,
+		InternalPort: m.state.internalPort,
+		ExternalPort: m.state.externalPort,
+		Lifetime:     m.cfg.Lifetime,
+		Renewal:      m.lIsActive(),
+	}
+}
+
+// Returns the backend in use: Config.Backend if set, otherwise
+// Config.Fallback.
+func (m *mapping) backend() Backend {
+	if m.cfg.Backend != nil {
+		return m.cfg.Backend
+	}
+
+	return m.cfg.Fallback
+}
+
+func (m *mapping) tryBackend() bool {
+	b := m.backend()
+	req := m.backendRequest()
+
+	err := m.checkPolicy(Operation{
+		Method:       MethodBackend,
+		Gateway:      b.Name(),
+		Protocol:     req.Protocol,
+		InternalPort: req.InternalPort,
+		ExternalPort: req.ExternalPort,
+		Lifetime:     req.Lifetime,
+		Renewal:      req.Renewal,
+	})
+	if err != nil {
+		log.Infof("%s mapping denied by policy: %v", b.Name(), err)
+		m.setLastError(err)
+		return false
+	}
+
+	beginOp()
+	start := m.now()
+	res, err := b.Map(req)
+	m.recordTiming(stepBackend, start)
+	endOp()
+	audit(auditRecord{
+		Operation:      auditBackendMap,
+		Gateway:        b.Name(),
+		Protocol:       req.Protocol.String(),
+		InternalPort:   req.InternalPort,
+		ExternalPort:   req.ExternalPort,
+		Lifetime:       int64(req.Lifetime / time.Second),
+		Name:           req.Name,
+		ResultPort:     res.ExternalPort,
+		ResultLifetime: int64(res.Lifetime / time.Second),
+	}, err)
+	if err == nil && res.ExternalPort == 0 {
+		err = errBackendNoPort
+	}
+	if err != nil {
+		log.Infof("%s failed: %v", b.Name(), err)
+		m.setLastError(err)
+		return false
+	}
+
+	lifetime := res.Lifetime
+	if lifetime == 0 {
+		lifetime = req.Lifetime
+	} else if lifetime < minUsableLifetime {
+		log.Infof("%s granted an unusable lifetime of %v", b.Name(), lifetime)
+		m.setLastError(lifetimeTooShort(lifetime))
+		return false
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.backendResult = res
+	m.externalAddr = ""
+	if res.ExternalIP != nil {
+		m.externalAddr = res.ExternalIP.String()
+	}
+
+	m.setGrantedPort(MethodBackend, res.ExternalPort)
+	m.setGrantedLifetime(MethodBackend, lifetime)
+	m.expireTime = m.now().Add(lifetime)
+	m.method = MethodBackend
+	m.standbyMapped = false
+	m.dmz = false
+	m.gateway = nil
+	m.scopeEnforced = m.cfg.Scope.Kind == ScopeAny
+	m.upnpService = nil
+	m.lastErr = nil
+	return true
+}
+
+// Returns the delay until the mapping should be renewed, which is half the
+// lifetime granted, or less if the gateway has proven unreliable. See
+// GatewayReliability.
+func (m *mapping) renewDelay() time.Duration {
+	m.mutex.Lock()
+	gateway := m.reliabilityKey()
+	remaining := m.expireTime.Sub(m.now())
+	m.mutex.Unlock()
+
+	return time.Duration(float64(remaining) * m.renewFraction(gateway))
+}
+
+func (m *mapping) teardownBackend() {
+	m.mutex.Lock()
+	prev := m.backendResult
+	m.mutex.Unlock()
+
+	req := m.backendRequest()
+	req.ExternalPort = prev.ExternalPort
+	b := m.backend()
+	beginOp()
+	err := b.Unmap(req, prev)
+	endOp()
+	audit(auditRecord{
+		Operation:    auditBackendUnmap,
+		Gateway:      b.Name(),
+		Protocol:     req.Protocol.String(),
+		InternalPort: req.InternalPort,
+		ExternalPort: req.ExternalPort,
+	}, err)
+	if err != nil {
+		log.Infof("%s unmap failed: %v", b.Name(), err)
+	}
+}
+
+var errBackendNoPort = errors.New("backend did not return an external port")
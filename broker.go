@@ -0,0 +1,569 @@
+package portmap
+
+import "encoding/json"
+import "net"
+import "sync"
+import "time"
+
+var brokerMutex sync.Mutex
+var brokerNetwork, brokerAddress string
+
+// Causes New to delegate mappings to a broker process listening at the given
+// address, as served by ServeBroker. This avoids duplicated SSDP traffic and
+// conflicting gateway transactions when many processes on a host map ports.
+// The network is usually "unix", in which case address is the path of a Unix
+// domain socket; this is also supported on recent versions of Windows.
+//
+// If the broker cannot be reached when New is called, or does not respond in
+// time, the mapping is negotiated by this process as usual. Pass empty
+// strings to stop using a broker, which is the default.
+//
+// The Backoff and Policy fields of Config are not passed to the broker; the
+// broker applies its own policy. Mappings which set Config.Backend or
+// Config.Fallback are always negotiated by this process.
+func SetBroker(network, address string) {
+	brokerMutex.Lock()
+	defer brokerMutex.Unlock()
+	brokerNetwork, brokerAddress = network, address
+}
+
+func getBroker() (network, address string) {
+	brokerMutex.Lock()
+	defer brokerMutex.Unlock()
+	return brokerNetwork, brokerAddress
+}
+
+// Accepts connections from processes which have called SetBroker and
+// negotiates mappings on their behalf. Each connection carries a single
+// mapping, which is deleted when the connection is closed. Returns when l
+// fails, for example because it has been closed.
+//
+// Mappings requested by different processes with the same protocol and
+// internal port are coalesced as described for New.
+func ServeBroker(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go serveBrokerConn(conn)
+	}
+}
+
+// Interval at which a broker checks for changes in the expiry times of the
+// mappings it maintains on behalf of other processes.
+const brokerPollInterval = 5 * time.Second
+
+// Time allowed to connect to a broker and to receive its first update, after
+// which the mapping is made locally instead. The broker sends its first
+// update once the mapping is created, which may involve resolving gateway
+// hints.
+const (
+	brokerDialTimeout      = 5 * time.Second
+	brokerHandshakeTimeout = 20 * time.Second
+)
+
+// Wire format. A client sends a single brokerRequest, after which the broker
+// sends a brokerUpdate whenever the mapping changes. Both are encoded as
+// JSON. The client may then send brokerSignal bytes.
+
+const brokerSignal = 'S'
+
+type brokerRequest struct {
+	Protocol     Protocol      `json:"protocol"`
+	Name         string        `json:"name,omitempty"`
+	InternalPort uint16        `json:"internalPort"`
+	ExternalPort uint16        `json:"externalPort,omitempty"`
+	Lifetime     time.Duration `json:"lifetime,omitempty"`
+	ScopeKind    ScopeKind     `json:"scopeKind,omitempty"`
+	ScopePeer    net.IP        `json:"scopePeer,omitempty"`
+	UPnPTrust    UPnPTrust     `json:"upnpTrust,omitempty"`
+	Wait         bool          `json:"waitForGateway,omitempty"`
+	AllGateways  bool          `json:"allGateways,omitempty"`
+	Standby      bool          `json:"standby,omitempty"`
+	GatewayHints []net.IP      `json:"gatewayHints,omitempty"`
+	HintNames    []string      `json:"gatewayHintNames,omitempty"`
+	FastStart    bool          `json:"fastStart,omitempty"`
+	Hairpin      bool          `json:"detectHairpin,omitempty"`
+
+	MinGrantedLifetime time.Duration `json:"minGrantedLifetime,omitempty"`
+	MinLifetime        time.Duration `json:"minLifetime,omitempty"`
+	MaxLifetime        time.Duration `json:"maxLifetime,omitempty"`
+
+	// Not omitempty, since nil and empty differ.
+	ExcludedExternalPorts []uint16 `json:"excludedExternalPorts"`
+}
+
+type brokerUpdate struct {
+	Error       string       `json:"error,omitempty"`
+	Status      *Status      `json:"status,omitempty"`
+	UPnPService *UPnPService `json:"upnpService,omitempty"`
+	Endpoints   []Endpoint   `json:"endpoints,omitempty"`
+	Event       *brokerEvent `json:"event,omitempty"`
+}
+
+// Events are tagged with their type. Events of types not listed here are not
+// forwarded.
+type brokerEvent struct {
+	Type                string               `json:"type"`
+	BackendSwitched     *BackendSwitched     `json:"backendSwitched,omitempty"`
+	ExternalPortChanged *ExternalPortChanged `json:"externalPortChanged,omitempty"`
+	Resumed             *Resumed             `json:"resumed,omitempty"`
+	LifetimeCapped      *LifetimeCapped      `json:"lifetimeCapped,omitempty"`
+	Inactive            *Inactive            `json:"inactive,omitempty"`
+	FailedOver          *FailedOver          `json:"failedOver,omitempty"`
+	HairpinTested       *HairpinTested       `json:"hairpinTested,omitempty"`
+}
+
+func encodeBrokerEvent(ev Event) *brokerEvent {
+	switch e := ev.(type) {
+	case BackendSwitched:
+		return &brokerEvent{Type: "backendSwitched", BackendSwitched: &e}
+	case ExternalPortChanged:
+		return &brokerEvent{Type: "externalPortChanged", ExternalPortChanged: &e}
+	case Resumed:
+		return &brokerEvent{Type: "resumed", Resumed: &e}
+	case LifetimeCapped:
+		return &brokerEvent{Type: "lifetimeCapped", LifetimeCapped: &e}
+	case Inactive:
+		return &brokerEvent{Type: "inactive", Inactive: &e}
+	case FailedOver:
+		return &brokerEvent{Type: "failedOver", FailedOver: &e}
+	case HairpinTested:
+		return &brokerEvent{Type: "hairpinTested", HairpinTested: &e}
+	default:
+		return nil
+	}
+}
+
+func (be *brokerEvent) decode() Event {
+	switch {
+	case be.BackendSwitched != nil:
+		return *be.BackendSwitched
+	case be.ExternalPortChanged != nil:
+		return *be.ExternalPortChanged
+	case be.Resumed != nil:
+		return *be.Resumed
+	case be.LifetimeCapped != nil:
+		return *be.LifetimeCapped
+	case be.Inactive != nil:
+		return *be.Inactive
+	case be.FailedOver != nil:
+		return *be.FailedOver
+	case be.HairpinTested != nil:
+		return *be.HairpinTested
+	default:
+		return nil
+	}
+}
+
+func serveBrokerConn(conn net.Conn) {
+	defer conn.Close()
+
+	enc := json.NewEncoder(conn)
+	dec := json.NewDecoder(conn)
+
+	var req brokerRequest
+	err := dec.Decode(&req)
+	if err != nil {
+		return
+	}
+
+	m, err := newLocal(Config{
+		Protocol:       req.Protocol,
+		Name:           req.Name,
+		InternalPort:   req.InternalPort,
+		ExternalPort:   req.ExternalPort,
+		Lifetime:       req.Lifetime,
+		Scope:          Scope{Kind: req.ScopeKind, Peer: req.ScopePeer},
+		UPnPTrust:      req.UPnPTrust,
+		WaitForGateway: req.Wait,
+		AllGateways:    req.AllGateways,
+		Standby:        req.Standby,
+		GatewayHints:   req.GatewayHints,
+		FastStart:      req.FastStart,
+		DetectHairpin:  req.Hairpin,
+
+		GatewayHintNames: req.HintNames,
+
+		MinGrantedLifetime: req.MinGrantedLifetime,
+		MinLifetime:        req.MinLifetime,
+		MaxLifetime:        req.MaxLifetime,
+
+		ExcludedExternalPorts: req.ExcludedExternalPorts,
+	}, nil)
+	if err != nil {
+		enc.Encode(&brokerUpdate{Error: err.Error()})
+		return
+	}
+	defer m.Delete()
+
+	// After the request, the client only sends brokerSignal bytes, which
+	// relay calls to SignalConnectivityChange, until it closes the connection.
+	closedChan := make(chan struct{})
+	go func() {
+		defer close(closedChan)
+
+		r := dec.Buffered()
+		var b [1]byte
+		for {
+			_, err := r.Read(b[:])
+			if err != nil {
+				_, err = conn.Read(b[:])
+				if err != nil {
+					return
+				}
+			}
+
+			if b[0] == brokerSignal {
+				m.SignalConnectivityChange()
+			}
+		}
+	}()
+
+	// Renewals don't cause notifications, so the status is also polled in
+	// order to pass on new expiry times.
+	ticker := time.NewTicker(brokerPollInterval)
+	defer ticker.Stop()
+
+	var last Status
+	var lastEndpoints []Endpoint
+	sendStatus := func(force bool) error {
+		s := m.Status()
+		eps := m.Endpoints()
+		if !force && s.Active == last.Active && s.ExpireTime.Equal(last.ExpireTime) &&
+			s.Transition == last.Transition && endpointsEqual(eps, lastEndpoints) {
+			return nil
+		}
+
+		last, lastEndpoints = s, eps
+		u := brokerUpdate{Status: &s, Endpoints: eps}
+		if us, ok := m.UPnPService(); ok {
+			u.UPnPService = &us
+		}
+		return enc.Encode(&u)
+	}
+
+	err = sendStatus(true)
+	for err == nil {
+		select {
+		case <-m.NotifyChan():
+			err = sendStatus(true)
+		case <-ticker.C:
+			err = sendStatus(false)
+		case ev := <-m.Events():
+			if bev := encodeBrokerEvent(ev); bev != nil {
+				err = enc.Encode(&brokerUpdate{Event: bev})
+			}
+		case <-closedChan:
+			return
+		}
+	}
+}
+
+func endpointsEqual(a, b []Endpoint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !a[i].Gateway.Equal(b[i].Gateway) || a[i].ExternalAddr != b[i].ExternalAddr || a[i].Method != b[i].Method {
+			return false
+		}
+	}
+
+	return true
+}
+
+// A mapping negotiated by a broker on behalf of this process.
+type brokerMapping struct {
+	conn       net.Conn
+	notifyChan chan struct{}
+	eventChan  chan Event
+	deleteOnce sync.Once
+
+	mutex       sync.Mutex
+	deleted     bool         // m
+	status      Status       // m
+	upnpService *UPnPService // m
+	endpoints   []Endpoint   // m
+	watchers    watchers     // m
+	tags        map[string]string
+
+	// Closed when the connection to the broker ends.
+	doneChan chan struct{}
+
+	protocol     Protocol
+	internalPort uint16
+}
+
+// Asks the broker, if one is configured, to negotiate the mapping. Returns
+// nil if no broker is configured or it cannot be reached or times out.
+func newBrokerMapping(cfg Config) (Mapping, error) {
+	network, address := getBroker()
+	if address == "" {
+		return nil, nil
+	}
+
+	conn, err := net.DialTimeout(network, address, brokerDialTimeout)
+	if err != nil {
+		log.Infof("cannot connect to mapping broker, mapping locally: %v", err)
+		return nil, nil
+	}
+
+	conn.SetDeadline(time.Now().Add(brokerHandshakeTimeout))
+
+	err = json.NewEncoder(conn).Encode(&brokerRequest{
+		Protocol:           cfg.Protocol,
+		Name:               cfg.Name,
+		InternalPort:       cfg.InternalPort,
+		ExternalPort:       cfg.ExternalPort,
+		Lifetime:           cfg.Lifetime,
+		ScopeKind:          cfg.Scope.Kind,
+		ScopePeer:          cfg.Scope.Peer,
+		UPnPTrust:          cfg.UPnPTrust,
+		Wait:               cfg.WaitForGateway,
+		AllGateways:        cfg.AllGateways,
+		Standby:            cfg.Standby,
+		GatewayHints:       cfg.GatewayHints,
+		HintNames:          cfg.GatewayHintNames,
+		FastStart:          cfg.FastStart,
+		Hairpin:            cfg.DetectHairpin,
+		MinGrantedLifetime: cfg.MinGrantedLifetime,
+		MinLifetime:        cfg.MinLifetime,
+		MaxLifetime:        cfg.MaxLifetime,
+
+		ExcludedExternalPorts: cfg.ExcludedExternalPorts,
+	})
+	if err != nil {
+		conn.Close()
+		log.Infof("cannot send request to mapping broker, mapping locally: %v", err)
+		return nil, nil
+	}
+
+	dec := json.NewDecoder(conn)
+
+	var u brokerUpdate
+	err = dec.Decode(&u)
+	if err != nil {
+		conn.Close()
+		log.Infof("no response from mapping broker, mapping locally: %v", err)
+		return nil, nil
+	}
+
+	if u.Error != "" {
+		// The broker couldn't create the mapping and this process wouldn't be
+		// able to either.
+		conn.Close()
+		return nil, &BrokerError{Message: u.Error}
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	bm := &brokerMapping{
+		conn:       conn,
+		notifyChan: make(chan struct{}, 1),
+		eventChan:  make(chan Event, eventBufferSize),
+		tags:       copyTags(cfg.Tags),
+		doneChan:   make(chan struct{}),
+
+		protocol:     cfg.Protocol,
+		internalPort: cfg.InternalPort,
+	}
+	bm.update(&u)
+
+	go bm.recvLoop(dec)
+	return bm, nil
+}
+
+// An error reported by a mapping broker.
+type BrokerError struct {
+	Message string
+}
+
+func (e *BrokerError) Error() string {
+	return "mapping broker: " + e.Message
+}
+
+func (bm *brokerMapping) recvLoop(dec *json.Decoder) {
+	for {
+		var u brokerUpdate
+		err := dec.Decode(&u)
+		if err != nil {
+			break
+		}
+
+		bm.update(&u)
+	}
+
+	// The connection has been closed, either by Delete or because the broker
+	// has gone away. Either way, the mapping is no longer maintained.
+	bm.mutex.Lock()
+	wasActive := bm.status.Active
+	version := bm.status.Version
+	if wasActive {
+		version++
+	}
+	deleted := bm.deleted
+	reason := InactiveBrokerLost
+	if deleted {
+		reason = InactiveDeleted
+	}
+	bm.status = Status{Version: version, InactiveSince: time.Now(), InactiveReason: reason}
+	bm.upnpService = nil
+	bm.endpoints = nil
+	bm.mutex.Unlock()
+	close(bm.doneChan)
+
+	if wasActive {
+		bm.notify()
+	}
+
+	if !deleted {
+		select {
+		case bm.eventChan <- Inactive{Reason: reason}:
+		default:
+		}
+	}
+}
+
+func (bm *brokerMapping) update(u *brokerUpdate) {
+	if u.Event != nil {
+		if ev := u.Event.decode(); ev != nil {
+			select {
+			case bm.eventChan <- ev:
+			default:
+			}
+		}
+	}
+
+	if u.Status == nil {
+		return
+	}
+
+	bm.mutex.Lock()
+	changed := bm.status.Active != u.Status.Active || bm.status.ExternalAddr != u.Status.ExternalAddr
+	// The broker's version counts changes seen by all of its clients, so a
+	// version is kept for this client.
+	version := bm.status.Version
+	if changed {
+		version++
+	}
+	bm.status = *u.Status
+	bm.status.Version = version
+	bm.upnpService = u.UPnPService
+	bm.endpoints = u.Endpoints
+	if changed {
+		bm.watchers.signal()
+	}
+	bm.mutex.Unlock()
+
+	if changed {
+		bm.notify()
+	}
+}
+
+func (bm *brokerMapping) notify() {
+	select {
+	case bm.notifyChan <- struct{}{}:
+	default:
+	}
+}
+
+func (bm *brokerMapping) NotifyChan() <-chan struct{} {
+	return bm.notifyChan
+}
+
+func (bm *brokerMapping) Events() <-chan Event {
+	return bm.eventChan
+}
+
+// Rate limiting is left to the broker.
+func (bm *brokerMapping) SignalConnectivityChange() {
+	bm.conn.Write([]byte{brokerSignal}) // ignore errors
+}
+
+func (bm *brokerMapping) Delete() {
+	bm.deleteOnce.Do(func() {
+		bm.mutex.Lock()
+		bm.deleted = true
+		bm.mutex.Unlock()
+		bm.conn.Close()
+	})
+}
+
+func (bm *brokerMapping) Detach() (*Handle, error) {
+	return nil, ErrCannotDetach
+}
+
+func (bm *brokerMapping) Update(internalPort uint16) error {
+	if internalPort == bm.internalPort {
+		return nil
+	}
+
+	return ErrCannotUpdate
+}
+
+func (bm *brokerMapping) Disable() error {
+	return ErrCannotDisable
+}
+
+func (bm *brokerMapping) Enable() error {
+	return nil
+}
+
+func (bm *brokerMapping) Close() error {
+	bm.Delete()
+	return nil
+}
+
+// Expiry is checked here in case the broker has stopped renewing the mapping
+// without closing the connection.
+func (bm *brokerMapping) currentStatus() Status {
+	s := bm.status
+	if s.Active && !s.ExpireTime.IsZero() && !s.ExpireTime.After(time.Now()) {
+		s = Status{Version: s.Version + 1, InactiveSince: s.ExpireTime, InactiveReason: InactiveExpired}
+	}
+	return s
+}
+
+func (bm *brokerMapping) ExternalAddr() string {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+	return bm.currentStatus().ExternalAddr
+}
+
+func (bm *brokerMapping) UPnPService() (svc UPnPService, ok bool) {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+
+	if bm.upnpService == nil || !bm.currentStatus().Active {
+		return
+	}
+
+	return *bm.upnpService, true
+}
+
+func (bm *brokerMapping) Endpoints() []Endpoint {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+
+	if !bm.currentStatus().Active {
+		return nil
+	}
+
+	return append([]Endpoint(nil), bm.endpoints...)
+}
+
+func (bm *brokerMapping) Status() Status {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+	s := bm.currentStatus()
+	s.Tags = bm.tags
+	return s
+}
+
+func (bm *brokerMapping) Tags() map[string]string {
+	return bm.tags
+}
@@ -0,0 +1,238 @@
+package portmap
+
+import "encoding/json"
+import "errors"
+import "io/ioutil"
+import "net"
+import "net/url"
+import "os"
+import "sync"
+import "time"
+import "github.com/hlandau/portmap/upnp"
+
+var coordMutex sync.Mutex
+var coordPath string
+
+// Enables coordination of external ports between processes on this machine
+// which use portmap, by means of a file at the given path. Every process
+// which is to take part must use the same path. Pass an empty string to
+// disable coordination, which is the default.
+//
+// The file records which process owns which external port on which gateway.
+// A process will not request an external port owned by another process, nor
+// delete a mapping for such a port, for example when resolving a UPnP
+// conflict. Entries lapse when the mapping they record expires, so a process
+// which exits without deleting its mappings does not hold its ports forever.
+//
+// The file is locked while it is read and updated. Locking is advisory and
+// is not supported on all platforms; where it is not, the file is used
+// without locking.
+func SetCoordinationFile(path string) {
+	coordMutex.Lock()
+	defer coordMutex.Unlock()
+	coordPath = path
+}
+
+var errLockNotSupported = errors.New("file locking is not supported on this platform")
+
+// The period for which a port chosen by coordPickPort is reserved for this
+// process before the mapping is claimed with coordClaim.
+const coordProvisionalLifetime = 1 * time.Minute
+
+// An entry in the coordination file. Lifetimes are recorded as expiry times.
+// Gateways are identified by IP address regardless of the method used, so
+// that ports claimed via NAT-PMP are respected when mapping via UPnP on the
+// same gateway, and vice versa.
+type coordEntry struct {
+	Gateway      string    `json:"gateway"`
+	Protocol     string    `json:"protocol"`
+	InternalPort uint16    `json:"internalPort"`
+	ExternalPort uint16    `json:"externalPort"`
+	PID          int       `json:"pid"`
+	Expires      time.Time `json:"expires"`
+}
+
+func (e *coordEntry) ours() bool {
+	return e.PID == os.Getpid()
+}
+
+// Opens and locks the coordination file, if one is configured, and calls fn
+// with its unexpired entries. If fn returns true, the entries are written
+// back. Returns false if coordination is not enabled.
+func withCoordFile(fn func(entries []coordEntry) ([]coordEntry, bool)) bool {
+	coordMutex.Lock()
+	defer coordMutex.Unlock()
+
+	if coordPath == "" {
+		return false
+	}
+
+	f, err := os.OpenFile(coordPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		log.Infof("cannot open coordination file: %v", err)
+		return false
+	}
+	defer f.Close()
+
+	err = lockFile(f)
+	if err != nil && err != errLockNotSupported {
+		log.Infof("cannot lock coordination file: %v", err)
+		return false
+	}
+	defer unlockFile(f)
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		log.Infof("cannot read coordination file: %v", err)
+		return false
+	}
+
+	var entries []coordEntry
+	if len(b) > 0 {
+		err = json.Unmarshal(b, &entries)
+		if err != nil {
+			// A corrupt file is discarded rather than disabling coordination
+			// permanently.
+			log.Infof("discarding malformed coordination file: %v", err)
+			entries = nil
+		}
+	}
+
+	now := time.Now()
+	live := entries[:0]
+	for _, e := range entries {
+		if e.Expires.After(now) {
+			live = append(live, e)
+		}
+	}
+
+	entries, write := fn(live)
+	if !write {
+		return true
+	}
+
+	b, err = json.Marshal(entries)
+	if err != nil {
+		return true
+	}
+
+	_, err = f.Seek(0, 0)
+	if err == nil {
+		err = f.Truncate(0)
+	}
+	if err == nil {
+		_, err = f.Write(b)
+	}
+	if err != nil {
+		log.Infof("cannot write coordination file: %v", err)
+	}
+
+	return true
+}
+
+// Returns the gateway under which a mapping is recorded in the coordination
+// file. gateway is either an IP address or the URL of a UPnP device, as used
+// for Handle.Gateway; for a URL, the host is used, which for
+// ssdp.Service.PreferredLocation is the address of the SSDP responder.
+func coordGateway(gateway string) string {
+	if ip := net.ParseIP(gateway); ip != nil {
+		return ip.String()
+	}
+
+	u, err := url.Parse(gateway)
+	if err != nil {
+		return gateway
+	}
+
+	if ip := net.ParseIP(u.Hostname()); ip != nil {
+		return ip.String()
+	}
+	return u.Hostname()
+}
+
+// Returns true if the given external port on the given gateway is owned by
+// another process.
+func coordOwnedByOther(gateway string, proto Protocol, externalPort uint16) bool {
+	owned := false
+	withCoordFile(func(entries []coordEntry) ([]coordEntry, bool) {
+		for i := range entries {
+			e := &entries[i]
+			if e.Gateway == gateway && e.Protocol == proto.String() && e.ExternalPort == externalPort && !e.ours() {
+				owned = true
+				break
+			}
+		}
+		return entries, false
+	})
+	return owned
+}
+
+// Chooses the next external port from src which is not owned by another
+// process, and reserves it for the given internal port until it is claimed,
+// so that another process does not choose it in the meantime.
+func coordPickPort(gateway string, proto Protocol, internalPort uint16, src *upnp.PortSource) uint16 {
+	var port uint16
+	enabled := withCoordFile(func(entries []coordEntry) ([]coordEntry, bool) {
+		owned := map[uint16]bool{}
+		for i := range entries {
+			e := &entries[i]
+			if e.Gateway == gateway && e.Protocol == proto.String() && !e.ours() {
+				owned[e.ExternalPort] = true
+			}
+		}
+
+		for {
+			port = src.Next()
+			if !owned[port] {
+				break
+			}
+		}
+
+		entries = coordRemove(entries, gateway, proto, internalPort)
+		return append(entries, coordEntry{
+			Gateway:      gateway,
+			Protocol:     proto.String(),
+			InternalPort: internalPort,
+			ExternalPort: port,
+			PID:          os.Getpid(),
+			Expires:      time.Now().Add(coordProvisionalLifetime),
+		}), true
+	})
+	if !enabled {
+		port = src.Next()
+	}
+	return port
+}
+
+// Records that this process owns the given mapping until it expires.
+func coordClaim(gateway string, proto Protocol, internalPort, externalPort uint16, expires time.Time) {
+	withCoordFile(func(entries []coordEntry) ([]coordEntry, bool) {
+		entries = coordRemove(entries, gateway, proto, internalPort)
+		return append(entries, coordEntry{
+			Gateway:      gateway,
+			Protocol:     proto.String(),
+			InternalPort: internalPort,
+			ExternalPort: externalPort,
+			PID:          os.Getpid(),
+			Expires:      expires,
+		}), true
+	})
+}
+
+// Records that this process no longer owns the given mapping.
+func coordRelease(gateway string, proto Protocol, internalPort uint16) {
+	withCoordFile(func(entries []coordEntry) ([]coordEntry, bool) {
+		return coordRemove(entries, gateway, proto, internalPort), true
+	})
+}
+
+func coordRemove(entries []coordEntry, gateway string, proto Protocol, internalPort uint16) []coordEntry {
+	kept := entries[:0]
+	for _, e := range entries {
+		if e.ours() && e.Gateway == gateway && e.Protocol == proto.String() && e.InternalPort == internalPort {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	return kept
+}
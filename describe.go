@@ -0,0 +1,111 @@
+package portmap
+
+import "fmt"
+import "net"
+import "strconv"
+import "strings"
+
+// Layout used for times in one-line summaries. Times within the next day are
+// unambiguous without a date.
+const describeTimeLayout = "15:04"
+
+// Returns a one-line summary of the configuration, such as
+// "tcp 8080→8080 (myapp)". Credentials and policy are never included, so the
+// summary is safe to log.
+func (cfg Config) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v %d→", cfg.Protocol, cfg.InternalPort)
+	if cfg.ExternalPort != 0 {
+		b.WriteString(strconv.FormatUint(uint64(cfg.ExternalPort), 10))
+	} else {
+		b.WriteString("any")
+	}
+
+	if cfg.Name != "" {
+		fmt.Fprintf(&b, " (%s)", cfg.Name)
+	}
+
+	if cfg.Backend != nil {
+		fmt.Fprintf(&b, " via %s", cfg.Backend.Name())
+	}
+
+	return b.String()
+}
+
+// Returns a one-line summary of the status, such as
+// "active at 203.0.113.5:8080 via UPnP, expires 14:32".
+func (s Status) String() string {
+	switch {
+	case s.Active:
+		var b strings.Builder
+		b.WriteString("active")
+		if s.ExternalAddr != "" {
+			fmt.Fprintf(&b, " at %s", s.ExternalAddr)
+		}
+		fmt.Fprintf(&b, " via %v", s.Method)
+		if !s.ExpireTime.IsZero() {
+			fmt.Fprintf(&b, ", expires %s", s.ExpireTime.Local().Format(describeTimeLayout))
+		}
+		return b.String()
+
+	case s.Pending:
+		return "waiting for a gateway"
+
+	default:
+		d := "inactive since " + s.InactiveSince.Local().Format(describeTimeLayout)
+		if s.InactiveReason != InactiveNone && s.InactiveReason != InactiveNeverActive {
+			d += " (" + s.InactiveReason.String() + ")"
+		}
+		return d
+	}
+}
+
+// Returns a one-line summary of a mapping, such as
+// "tcp 8080→203.0.113.5:8080 via UPnP on 192.168.1.1, expires 14:32".
+func describeMapping(proto Protocol, internalPort uint16, s Status, gw net.IP) string {
+	prefix := fmt.Sprintf("%v %d", proto, internalPort)
+	if !s.Active {
+		return prefix + " " + s.String()
+	}
+
+	var b strings.Builder
+	b.WriteString(prefix)
+	b.WriteString("→")
+	if s.ExternalAddr != "" {
+		b.WriteString(s.ExternalAddr)
+	} else {
+		b.WriteString("?")
+	}
+
+	fmt.Fprintf(&b, " via %v", s.Method)
+	if gw != nil {
+		fmt.Fprintf(&b, " on %v", gw)
+	}
+
+	if !s.ExpireTime.IsZero() {
+		fmt.Fprintf(&b, ", expires %s", s.ExpireTime.Local().Format(describeTimeLayout))
+	}
+
+	return b.String()
+}
+
+func (m *mapping) String() string {
+	s := m.Status()
+
+	m.mutex.Lock()
+	gw := m.gateway
+	m.mutex.Unlock()
+
+	return describeMapping(m.cfg.Protocol, s.InternalPort, s, gw)
+}
+
+func (bm *brokerMapping) String() string {
+	s := bm.Status()
+
+	var gw net.IP
+	if eps := bm.Endpoints(); len(eps) > 0 {
+		gw = eps[0].Gateway
+	}
+
+	return describeMapping(bm.protocol, bm.internalPort, s, gw)
+}
@@ -0,0 +1,181 @@
+package portmap
+
+import "errors"
+import "net"
+import "net/url"
+import "time"
+import "github.com/hlandau/portmap/ssdp"
+
+// Describes a mapping which has been detached from the process which created
+// it, so that another process, or a later run of the same program, can
+// attach to it with Attach and continue renewing it without the mapping
+// being removed in the meantime. A Handle can be serialised with
+// encoding/json.
+type Handle struct {
+	Protocol     Protocol          `json:"protocol"`
+	Name         string            `json:"name,omitempty"`
+	InternalPort uint16            `json:"internalPort"`
+	ExternalPort uint16            `json:"externalPort"`
+	ExternalIP   string            `json:"externalIP,omitempty"`
+	Lifetime     time.Duration     `json:"lifetime"`
+	Method       Method            `json:"method"`
+	Tags         map[string]string `json:"tags,omitempty"`
+
+	// The settings of the same names in the Config of the mapping, so that
+	// the attaching process maintains the mapping in the same way.
+	Scope            Scope     `json:"scope"`
+	UPnPTrust        UPnPTrust `json:"upnpTrust,omitempty"`
+	GatewayHints     []net.IP  `json:"gatewayHints,omitempty"`
+	GatewayHintNames []string  `json:"gatewayHintNames,omitempty"`
+
+	// For NAT-PMP, the IP address of the gateway. For UPnP, the URL of the
+	// device.
+	Gateway string `json:"gateway"`
+
+	// The time at which the mapping expires unless it is renewed.
+	Expires time.Time `json:"expires"`
+}
+
+// Returned by Detach if the mapping is not active.
+var ErrNotActive = errors.New("mapping is not active")
+
+// Returned by Detach if the mapping was returned by more than one call to
+// New, was created using a Backend, Config.AllGateways or Config.Standby, is
+// disabled, or is maintained by a broker.
+var ErrCannotDetach = errors.New("mapping cannot be detached")
+
+func (r *mappingRef) Detach() (*Handle, error) {
+	m := r.mapping
+
+	registryMutex.Lock()
+	m.mutex.Lock()
+
+	h, err := m.handle()
+	if h != nil {
+		h.Tags = r.tags
+	}
+	if err == nil && m.refs > 1 {
+		err = ErrCannotDetach
+	}
+	if err != nil {
+		m.mutex.Unlock()
+		registryMutex.Unlock()
+		return nil, err
+	}
+
+	m.detached = true
+	m.refs = 0
+	if registry[m.key()] == m {
+		delete(registry, m.key())
+	}
+	close(m.abortChan)
+	m.aborted = true
+
+	m.mutex.Unlock()
+	registryMutex.Unlock()
+
+	// Later calls to Delete have no effect.
+	r.once.Do(r.detachStreams)
+
+	// The attaching process will claim the port for itself.
+	coordRelease(coordGateway(h.Gateway), h.Protocol, h.InternalPort)
+	return h, nil
+}
+
+// Must be called with the mutex held.
+func (m *mapping) handle() (*Handle, error) {
+	if m.aborted {
+		return nil, ErrNotActive
+	}
+
+	if m.cfg.Backend != nil || len(m.children) > 0 || m.disabled {
+		return nil, ErrCannotDetach
+	}
+
+	if !m.isActive() || m.grantedPort == 0 {
+		return nil, ErrNotActive
+	}
+
+	h := &Handle{
+		Protocol:     m.cfg.Protocol,
+		Name:         m.cfg.Name,
+		InternalPort: m.state.internalPort,
+		ExternalPort: m.grantedPort,
+		ExternalIP:   m.externalAddr,
+		Lifetime:     m.cfg.Lifetime,
+		Method:       m.method,
+		Expires:      m.expireTime,
+
+		Scope:            m.cfg.Scope,
+		UPnPTrust:        m.cfg.UPnPTrust,
+		GatewayHints:     m.cfg.GatewayHints,
+		GatewayHintNames: m.cfg.GatewayHintNames,
+	}
+
+	switch m.method {
+	case MethodNATPMP:
+		h.Gateway = m.gateway.String()
+	case MethodUPnP:
+		if m.upnpService == nil {
+			return nil, ErrCannotDetach
+		}
+		h.Gateway = m.upnpService.PreferredLocation().String()
+	default:
+		return nil, ErrCannotDetach
+	}
+
+	return h, nil
+}
+
+func (m *mapping) lIsDetached() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.detached
+}
+
+// Resumes maintenance of a mapping detached by Mapping.Detach. The mapping is
+// reported as active immediately, using the state recorded in the handle,
+// and is renewed straight away via the same method and gateway, requesting
+// the same external port.
+//
+// The Config used is derived from the handle. Config.Resolver is not
+// recorded in the handle, so GatewayHintNames are resolved as though it were
+// nil. The broker set with SetBroker is not used.
+func Attach(h *Handle) (Mapping, error) {
+	if h.Method != MethodNATPMP && h.Method != MethodUPnP {
+		return nil, ErrCannotDetach
+	}
+
+	return newLocal(Config{
+		Protocol:     h.Protocol,
+		Name:         h.Name,
+		InternalPort: h.InternalPort,
+		ExternalPort: h.ExternalPort,
+		Lifetime:     h.Lifetime,
+		Tags:         h.Tags,
+
+		Scope:            h.Scope,
+		UPnPTrust:        h.UPnPTrust,
+		GatewayHints:     h.GatewayHints,
+		GatewayHintNames: h.GatewayHintNames,
+	}, h)
+}
+
+// Restores the state recorded in a handle. Must be called before the
+// mapping's goroutine is started.
+func (m *mapping) restore(h *Handle) {
+	m.attached = h
+	m.method = h.Method
+	m.grantedPort = h.ExternalPort
+	m.externalAddr = h.ExternalIP
+	m.expireTime = h.Expires
+
+	switch h.Method {
+	case MethodNATPMP:
+		m.gateway = net.ParseIP(h.Gateway)
+	case MethodUPnP:
+		if u, err := url.Parse(h.Gateway); err == nil {
+			m.upnpService = &UPnPService{Service: ssdp.Service{Location: u}}
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package portmap
+
+import "io/ioutil"
+import "net"
+import "os"
+import "strconv"
+import "strings"
+import "time"
+import "github.com/hlandau/portmap/gateway"
+import "github.com/hlandau/portmap/natpmp"
+import "github.com/hlandau/portmap/ssdp"
+import "github.com/hlandau/portmap/upnp"
+
+// The result of Diagnose.
+type Diagnosis struct {
+	// The IP address of this host used for outbound traffic. nil if it could
+	// not be determined.
+	LocalIP net.IP
+
+	// Whether LocalIP is globally routable, in which case port mapping is not
+	// required.
+	GloballyRoutable bool
+
+	// Whether this process appears to be running in a container.
+	Container bool
+
+	// The IPv4 transition mechanism in use, such as DS-Lite or NAT64, under
+	// which IPv4 port mapping is impossible. For NAT64, NAT64Prefix is the
+	// translation prefix discovered via DNS64.
+	Transition  Transition
+	NAT64Prefix *net.IPNet
+
+	// The default gateways of this host.
+	Gateways []GatewayDiagnosis
+
+	// The UPnP WANIPConnection services currently known. This is only
+	// populated if SSDP discovery is running, for example because a mapping
+	// exists.
+	UPnPServices []ssdp.Service
+
+	// The result of probing each distinct device providing one of
+	// UPnPServices.
+	UPnPDevices []UPnPDiagnosis
+
+	// The circuit breakers of UPnP devices which have recently failed to
+	// respond. See upnp.BreakerConfig.
+	UPnPBreakers []upnp.BreakerState
+
+	// What has been learned about the reliability of gateways with which
+	// mappings have been renewed. See GatewayReliability.
+	Reliability []GatewayReliability
+
+	// Human-readable descriptions of any problems found.
+	Problems []string
+}
+
+// Describes a default gateway examined by Diagnose.
+type GatewayDiagnosis struct {
+	IP net.IP
+
+	// The zone of an IPv6 link-local gateway, which is the interface via
+	// which it is reached. Empty otherwise.
+	Zone string
+
+	// The name of the local interface on the gateway's subnet. Empty if not
+	// known.
+	Interface string
+
+	// Whether the gateway appears to be a virtual bridge provided by a
+	// container or virtual machine host, such as docker0 or virbr0, rather
+	// than a router. Mappings made against such a gateway only traverse the
+	// host's NAT, not that of the network the host is on.
+	LocalBridge bool
+
+	// Whether the gateway answered a NAT-PMP request, and how quickly.
+	NATPMP    bool
+	NATPMPRTT time.Duration
+
+	// The gateway's answer to the NAT-PMP request. nil if it did not answer.
+	NATPMPProbe *natpmp.ProbeResult
+}
+
+// Describes a UPnP device examined by Diagnose.
+type UPnPDiagnosis struct {
+	// The device URL.
+	Location string
+
+	// The result of probing the device with upnp.Probe. nil if the probe
+	// failed, in which case Err is set.
+	Probe *upnp.ProbeResult
+	Err   error
+
+	// The device's DMZ host, to which traffic on every unmapped port is
+	// forwarded, if the device reports one. See upnp.DMZHost.
+	DMZHost net.IP
+}
+
+// Examines the network environment of this host and reports on its
+// suitability for port mapping. This performs network requests and may take
+// a moment to complete.
+func Diagnose() (*Diagnosis, error) {
+	d := &Diagnosis{
+		Container: inContainer(),
+	}
+
+	d.GloballyRoutable, d.LocalIP = isGloballyRoutable()
+	if d.GloballyRoutable {
+		d.Problems = append(d.Problems, "this host has a globally routable address, so port mapping is not required")
+	}
+
+	d.Transition, d.NAT64Prefix = probeTransition()
+	switch d.Transition {
+	case TransitionDSLite:
+		d.Problems = append(d.Problems, "this host is behind DS-Lite, so IPv4 port mapping is impossible; "+
+			"accept incoming connections over IPv6 instead")
+	case TransitionNAT64:
+		d.Problems = append(d.Problems, "this host is behind NAT64 (prefix "+d.NAT64Prefix.String()+
+			"), so IPv4 port mapping is impossible; accept incoming connections over IPv6 instead")
+	}
+
+	gwaddrs, err := gateway.GetAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var gwa []net.IP
+	for _, a := range gwaddrs {
+		gwa = append(gwa, a.IP)
+	}
+
+	if len(gwa) == 0 && d.Transition == TransitionNone {
+		d.Problems = append(d.Problems, "no default gateway found")
+	}
+
+	for _, gw := range gwa {
+		gd := GatewayDiagnosis{IP: gw, Zone: gateway.Zone(gw), Interface: interfaceNameFor(gw)}
+		gd.LocalBridge = isLocalBridge(gw, gd.Interface, d.Container)
+		if r, err := natpmp.Probe(gw, gatewayProbeTimeout); err == nil {
+			gd.NATPMP = true
+			gd.NATPMPRTT = r.RTT
+			gd.NATPMPProbe = r
+			switch r.Code {
+			case natpmp.ResultSuccess:
+			case natpmp.ResultNotAuthorized:
+				d.Problems = append(d.Problems, "gateway "+gw.String()+" has NAT-PMP disabled")
+			default:
+				d.Problems = append(d.Problems, "gateway "+gw.String()+" answered NAT-PMP with result code "+
+					strconv.Itoa(int(r.Code)))
+			}
+		}
+
+		if gd.LocalBridge {
+			d.Problems = append(d.Problems, "gateway "+gw.String()+" is a container or virtual machine bridge; "+
+				"mappings will not traverse the NAT of the network the host is on. "+
+				"Set Config.GatewayHints to the address of that network's gateway to map there instead")
+		}
+
+		d.Gateways = append(d.Gateways, gd)
+	}
+
+	for _, st := range []string{upnp.WANIPConnection1, upnp.WANIPConnection2} {
+		d.UPnPServices = append(d.UPnPServices, ssdp.GetServicesByType(st)...)
+	}
+
+	// Breakers are examined before probing, so that the probes don't mask
+	// the failures which caused them to open.
+	d.UPnPBreakers = upnp.BreakerStates()
+	for _, b := range d.UPnPBreakers {
+		if b.Open {
+			d.Problems = append(d.Problems, "UPnP device at "+b.Host+" has stopped responding ("+
+				b.LastErr.Error()+"); requests to it are suspended until "+b.RetryAt.Format(time.Kitchen))
+		}
+	}
+
+	d.Reliability = GatewayReliabilities()
+	for _, r := range d.Reliability {
+		if f := r.RenewFraction(); f < 0.5 {
+			d.Problems = append(d.Problems, "gateway "+r.Gateway+" has been unreliable ("+
+				strconv.Itoa(int(r.SuccessRatio()*100))+"% of renewals succeeded); mappings with it are renewed after "+
+				strconv.Itoa(int(f*100))+"% of their lifetime")
+		}
+	}
+
+	seen := map[string]bool{}
+	for i := range d.UPnPServices {
+		loc := d.UPnPServices[i].PreferredLocation().String()
+		if seen[loc] {
+			continue
+		}
+
+		seen[loc] = true
+		ud := UPnPDiagnosis{Location: loc}
+		ud.Probe, ud.Err = upnp.Probe(loc)
+		if ud.Err != nil {
+			d.Problems = append(d.Problems, "UPnP device at "+loc+" could not be probed: "+ud.Err.Error())
+		} else {
+			ud.DMZHost = dmzHost(loc)
+			if self, err := upnp.LocalIP(loc); err == nil && self.Equal(ud.DMZHost) {
+				d.Problems = append(d.Problems, "this host is the DMZ host of the UPnP device at "+loc+
+					", so every port is forwarded to it already and port mapping is unnecessary")
+			}
+		}
+
+		d.UPnPDevices = append(d.UPnPDevices, ud)
+	}
+
+	if err := ssdp.Degraded(); err != nil {
+		d.Problems = append(d.Problems, "SSDP discovery is not working, so UPnP devices may not be found: "+err.Error())
+	}
+
+	return d, nil
+}
+
+// Returns the DMZ host reported by the UPnP device at loc for either protocol,
+// or nil.
+func dmzHost(loc string) net.IP {
+	for _, proto := range []upnp.Protocol{upnp.TCP, upnp.UDP} {
+		if host, err := upnp.DMZHost(loc, proto); err == nil && host != nil {
+			return host
+		}
+	}
+
+	return nil
+}
+
+// Returns the name of the interface whose subnet contains ip, or an empty
+// string.
+func interfaceNameFor(ip net.IP) string {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+
+	for _, ifi := range ifs {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok && ipn.Contains(ip) {
+				return ifi.Name
+			}
+		}
+	}
+
+	return ""
+}
+
+// Name prefixes of bridge interfaces created by container and virtual machine
+// managers.
+var bridgePrefixes = []string{"docker", "br-", "virbr", "lxcbr", "lxdbr", "cni", "podman", "vboxnet", "vmnet"}
+
+// Default subnets used by Docker and libvirt for their bridges.
+var bridgeSubnets = []string{"172.17.0.0/16", "192.168.122.0/24"}
+
+func isLocalBridge(gw net.IP, ifname string, container bool) bool {
+	for _, p := range bridgePrefixes {
+		if strings.HasPrefix(ifname, p) {
+			return true
+		}
+	}
+
+	// Inside a container, the bridge is on the host, so the interface name
+	// gives no clue, but the default subnets are recognisable.
+	if container {
+		for _, s := range bridgeSubnets {
+			_, ipn, _ := net.ParseCIDR(s)
+			if ipn.Contains(gw) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Determines whether this process appears to be running in a container.
+func inContainer() bool {
+	for _, fn := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if _, err := os.Stat(fn); err == nil {
+			return true
+		}
+	}
+
+	b, err := ioutil.ReadFile("/proc/1/cgroup")
+	if err != nil {
+		return false
+	}
+
+	s := string(b)
+	for _, marker := range []string{"docker", "kubepods", "lxc", "containerd", "libpod"} {
+		if strings.Contains(s, marker) {
+			return true
+		}
+	}
+
+	return false
+}
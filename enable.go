@@ -0,0 +1,75 @@
+package portmap
+
+import "errors"
+
+// Returned by Disable if the mapping is not maintained via UPnP, is provided
+// by the gateway's DMZ, is shared with other callers of New, or is maintained
+// by a broker.
+var ErrCannotDisable = errors.New("mapping cannot be disabled")
+
+func (r *mappingRef) Disable() error {
+	return r.setEnabled(false)
+}
+
+func (r *mappingRef) Enable() error {
+	return r.setEnabled(true)
+}
+
+// Records whether the mapping is to be enabled and re-validates it, so that
+// the mapping is re-added with the new value of NewEnabled straight away.
+func (m *mapping) setEnabled(enabled bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.disabled != enabled {
+		return nil
+	}
+
+	if m.aborted || m.detached || m.refs > 1 {
+		return ErrCannotDisable
+	}
+
+	if !enabled {
+		if !m.isActive() {
+			return ErrNotActive
+		}
+
+		if m.method != MethodUPnP || m.dmz {
+			return ErrCannotDisable
+		}
+
+		log.Infof("disabling mapping for internal port %d", m.state.internalPort)
+	} else {
+		log.Infof("enabling mapping for internal port %d", m.state.internalPort)
+	}
+
+	m.disabled = !enabled
+	if len(m.children) == 0 {
+		m.revalidate()
+		return nil
+	}
+
+	for _, c := range m.children {
+		c.mutex.Lock()
+		c.disabled = m.disabled
+		c.revalidate()
+		c.mutex.Unlock()
+	}
+
+	return nil
+}
+
+func (m *mapping) lIsDisabled() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.disabled
+}
+
+// Returns true if the mapping is to be added with NewEnabled set to 0,
+// because Disable has been called or because it is a standby mapping. See
+// Config.Standby.
+func (m *mapping) lAddDisabled() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.disabled || m.standby
+}
@@ -0,0 +1,76 @@
+package portmap
+
+import "context"
+
+// As for New, but the mapping is deleted when ctx is done, as though Delete
+// had been called. This suits temporary forwarding, such as for the duration
+// of a remote debugging session. Use DeleteWait to wait for the mapping to
+// be removed once ctx is done.
+//
+// Returns ctx.Err() without creating a mapping if ctx is already done.
+func NewWithContext(ctx context.Context, cfg Config) (Mapping, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	released, done := mappingDone(m)
+	go func() {
+		select {
+		case <-ctx.Done():
+			m.Delete()
+		case <-released:
+		case <-done:
+		}
+	}()
+
+	return m, nil
+}
+
+// Returns a channel which is closed once the reference m is deleted or
+// detached, and one which is closed once the mapping has been torn down. A
+// mapping shared with other references outlives the deletion of any one of
+// them. Either channel may be nil.
+func mappingDone(m Mapping) (released, done <-chan struct{}) {
+	switch m := m.(type) {
+	case *mappingRef:
+		return m.done, m.doneChan
+	case *brokerMapping:
+		return nil, m.doneChan
+	default:
+		return nil, nil
+	}
+}
+
+func (r *mappingRef) DeleteWait(ctx context.Context) error {
+	r.Delete()
+
+	r.mutex.Lock()
+	aborted := r.aborted
+	r.mutex.Unlock()
+
+	if !aborted {
+		// other references remain
+		return nil
+	}
+
+	return waitDone(ctx, r.doneChan)
+}
+
+func (bm *brokerMapping) DeleteWait(ctx context.Context) error {
+	bm.Delete()
+	return waitDone(ctx, bm.doneChan)
+}
+
+func waitDone(ctx context.Context, done <-chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,121 @@
+package portmap
+
+import "errors"
+import "fmt"
+import "net"
+import "time"
+import "github.com/hlandau/portmap/internal/parse"
+import "github.com/hlandau/portmap/natpmp"
+import "github.com/hlandau/portmap/upnp"
+
+// Classes of failure. The errors reported in Status.LastError and returned
+// by New wrap one of these where the failure falls into a class, so that
+// callers can test for them with errors.Is. The underlying error remains
+// available via errors.As, for example as a *UPnPError or *NATPMPError.
+var (
+	// No default gateway could be found.
+	ErrNoGateway = errors.New("no default gateway")
+
+	// The gateway did not respond in time, or has stopped responding.
+	ErrTimeout = errors.New("gateway did not respond")
+
+	// The gateway does not support the protocol, or has port mapping
+	// disabled.
+	ErrUnsupported = errors.New("gateway does not support port mapping or has it disabled")
+
+	// The gateway granted a lifetime too short to be usable.
+	ErrLifetimeTooShort = errors.New("gateway granted an unusably short lifetime")
+)
+
+// An error returned by a UPnP device.
+type UPnPError = upnp.Error
+
+// A nonzero result code returned by a NAT-PMP gateway.
+type NATPMPError = natpmp.ResultError
+
+// An error which belongs to one of the classes above.
+type classifiedError struct {
+	class error
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+func (e *classifiedError) Is(target error) bool {
+	return target == e.class
+}
+
+// Returns the error recorded when a gateway grants an unusably short
+// lifetime.
+func lifetimeTooShort(lifetime time.Duration) error {
+	return &classifiedError{
+		class: ErrLifetimeTooShort,
+		err:   fmt.Errorf("gateway granted an unusable lifetime of %v", lifetime),
+	}
+}
+
+// Wraps err in its class, if it has one.
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var ce *classifiedError
+	if errors.As(err, &ce) {
+		return err
+	}
+
+	if class := errorClass(err); class != nil {
+		return &classifiedError{class: class, err: err}
+	}
+
+	return err
+}
+
+func errorClass(err error) error {
+	var ne net.Error
+	if errors.Is(err, natpmp.ErrTimeout) || errors.Is(err, upnp.ErrCircuitOpen) ||
+		(errors.As(err, &ne) && ne.Timeout()) {
+		return ErrTimeout
+	}
+
+	var re *natpmp.ResultError
+	if errors.As(err, &re) {
+		switch re.Code {
+		case natpmp.ResultUnsupportedVersion, natpmp.ResultNotAuthorized, natpmp.ResultUnsupportedOpcode:
+			return ErrUnsupported
+		}
+		return nil
+	}
+
+	// ICMP port unreachable, from a gateway which doesn't listen for NAT-PMP
+	if isConnRefused(err) || errors.Is(err, upnp.ErrNoService) ||
+		upnp.IsErrorCode(err, upnp.ErrCodeInvalidAction) || upnp.IsErrorCode(err, upnp.ErrCodeNotAuthorized) {
+		return ErrUnsupported
+	}
+
+	return nil
+}
+
+// Records the error from a failed attempt, for Status.LastError.
+func (m *mapping) setLastError(err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.lastErr = classifyError(err)
+}
+
+// Sets a function which is called with each SSDP datagram, SOAP response or
+// UPnP device description received from a device and rejected as malformed.
+// kind is "ssdp", "soap" or "description". This allows malformed output seen
+// from real routers to be collected, for example to seed the fuzz targets in
+// internal/parse. The data may be retained. Pass nil to remove the hook.
+func SetMalformedInputHook(fn func(kind string, data []byte)) {
+	parse.SetRejectHook(fn)
+}
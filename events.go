@@ -0,0 +1,126 @@
+package portmap
+
+import "fmt"
+import "net"
+import "time"
+
+// Identifies the protocol used to negotiate a mapping with a gateway.
+type Method int
+
+const (
+	MethodNATPMP  Method = iota // NAT-PMP
+	MethodUPnP                  // UPnP IGDv1
+	MethodBackend               // Config.Backend
+)
+
+func (m Method) String() string {
+	switch m {
+	case MethodNATPMP:
+		return "NAT-PMP"
+	case MethodUPnP:
+		return "UPnP"
+	case MethodBackend:
+		return "backend"
+	default:
+		return fmt.Sprintf("Method(%d)", int(m))
+	}
+}
+
+// An event relating to a Mapping. Use a type switch to determine the kind of
+// event.
+//
+// Events are delivered on the channel returned by Mapping.Events().
+type Event interface {
+	isEvent()
+}
+
+// Sent when the mapping process switches from one method to another.
+//
+// Frequent switching between methods usually indicates a problem with the
+// gateway.
+type BackendSwitched struct {
+	From, To Method
+	Reason   string
+}
+
+func (BackendSwitched) isEvent() {}
+
+// Sent when a gateway grants a different external port to the one it
+// previously granted, for example because the gateway has rebooted and the
+// previous port was no longer available. ExternalAddr() returns the new port
+// by the time the event is sent.
+type ExternalPortChanged struct {
+	Method   Method
+	From, To uint16
+}
+
+func (ExternalPortChanged) isEvent() {}
+
+// Sent when a gateway grants a lifetime shorter than Config.MinGrantedLifetime.
+// The mapping is renewed more often than usual as a result. Some routers cap
+// lifetimes at a few minutes regardless of what is requested.
+type LifetimeCapped struct {
+	Method             Method
+	Requested, Granted time.Duration
+}
+
+func (LifetimeCapped) isEvent() {}
+
+// Sent when the wall clock is found to have moved relative to the monotonic
+// clock, which usually means the system was suspended and has resumed. The
+// mapping is verified and recreated immediately after this is sent, since it
+// may have expired during the suspension.
+type Resumed struct {
+	// The amount by which the wall clock moved relative to the monotonic
+	// clock. Approximately the time for which the system was suspended.
+	Gap time.Duration
+}
+
+func (Resumed) isEvent() {}
+
+// Sent when SSDP discovery stops working because its socket failed, for
+// example because an interface went down. UPnP devices which appear or move
+// are not found until DiscoveryRestored is sent.
+type DiscoveryDegraded struct {
+	Err error
+}
+
+func (DiscoveryDegraded) isEvent() {}
+
+// Sent when SSDP discovery recovers after DiscoveryDegraded was sent.
+type DiscoveryRestored struct{}
+
+func (DiscoveryRestored) isEvent() {}
+
+// Sent when a mapping using Config.Standby moves from one gateway to the
+// other, either because the first gateway has stopped responding or because
+// it has recovered.
+type FailedOver struct {
+	From, To net.IP
+}
+
+func (FailedOver) isEvent() {}
+
+// Number of events which may be buffered for a mapping before further events
+// are dropped.
+const eventBufferSize = 16
+
+// Sends ev to every subscription. Events from a child are sent to the
+// subscriptions of its parent.
+func (m *mapping) emit(ev Event) {
+	if m.parent != nil {
+		m.parent.emit(ev)
+		return
+	}
+
+	m.subsMutex.Lock()
+	defer m.subsMutex.Unlock()
+
+	for _, s := range m.subs {
+		select {
+		case s.eventChan <- ev:
+		default:
+			// events not being waited for are dropped
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package portmap
 
 import "net"
-import "github.com/hlandau/portmap/gateway"
 import "github.com/hlandau/portmap/natpmp"
 
 // Attempt to obtain the external IP address from the default gateway.
@@ -19,7 +18,7 @@ func ExternalAddr() (net.IP, error) {
 		return ip, nil
 	}
 
-	gwa, err := gateway.GetIPs()
+	gwa, err := ipv4Gateways()
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,153 @@
+package portmap
+
+import "sync"
+import "time"
+
+// An entry in a StatusFeed snapshot.
+type FeedEntry struct {
+	// The name under which the mapping was added to the feed.
+	Name string
+
+	// The mapping.
+	Mapping Mapping
+
+	// The status of the mapping at the time the snapshot was taken.
+	Status Status
+}
+
+// Aggregates the status of a set of mappings and reports changes to a
+// callback, for consumption by user interfaces such as tray applications.
+//
+// Entries are always reported in the order in which they were added. Changes
+// are coalesced so that the callback is called at most once per interval.
+type StatusFeed struct {
+	interval time.Duration
+	callback func(entries []FeedEntry)
+
+	mutex    sync.Mutex
+	entries  []FeedEntry
+	changed  bool
+	stopChan chan struct{}
+	stopped  bool
+}
+
+// Default minimum interval between calls to a StatusFeed callback.
+const DefaultFeedInterval = 1 * time.Second
+
+// Creates a status feed which calls callback with a snapshot of all mappings
+// in the feed whenever any of them changes, but no more than once every
+// interval. If interval is zero, DefaultFeedInterval is used.
+//
+// The callback is called from a goroutine owned by the feed and must not
+// block for long. Call Close to stop the feed.
+func NewStatusFeed(interval time.Duration, callback func(entries []FeedEntry)) *StatusFeed {
+	if interval == 0 {
+		interval = DefaultFeedInterval
+	}
+
+	f := &StatusFeed{
+		interval: interval,
+		callback: callback,
+		stopChan: make(chan struct{}),
+	}
+
+	go f.loop()
+	return f
+}
+
+// Adds a mapping to the feed under the given name. The name is for the
+// consumer's use and need not be unique.
+func (f *StatusFeed) Add(name string, m Mapping) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.entries = append(f.entries, FeedEntry{Name: name, Mapping: m, Status: m.Status()})
+	f.changed = true
+}
+
+// Removes a mapping from the feed.
+func (f *StatusFeed) Remove(m Mapping) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for i := range f.entries {
+		if f.entries[i].Mapping == m {
+			f.entries = append(f.entries[:i], f.entries[i+1:]...)
+			f.changed = true
+			return
+		}
+	}
+}
+
+// Returns the most recently observed status of every mapping in the feed.
+func (f *StatusFeed) Snapshot() []FeedEntry {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.snapshot()
+}
+
+func (f *StatusFeed) snapshot() []FeedEntry {
+	entries := make([]FeedEntry, len(f.entries))
+	copy(entries, f.entries)
+	return entries
+}
+
+// Stops the feed. The callback will not be called after Close returns,
+// unless a call is already in progress.
+func (f *StatusFeed) Close() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.stopped {
+		return
+	}
+
+	close(f.stopChan)
+	f.stopped = true
+}
+
+func (f *StatusFeed) loop() {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-f.stopChan:
+			return
+		}
+
+		entries, changed := f.refresh()
+		if changed && f.callback != nil {
+			f.callback(entries)
+		}
+	}
+}
+
+func (f *StatusFeed) refresh() ([]FeedEntry, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.stopped {
+		return nil, false
+	}
+
+	for i := range f.entries {
+		s := f.entries[i].Mapping.Status()
+		if !statusDisplayEqual(s, f.entries[i].Status) {
+			f.changed = true
+		}
+		f.entries[i].Status = s
+	}
+
+	changed := f.changed
+	f.changed = false
+	return f.snapshot(), changed
+}
+
+// Determines whether two statuses would be displayed identically. Renewals
+// alone do not count as a change.
+func statusDisplayEqual(a, b Status) bool {
+	return a.Active == b.Active && a.ExternalAddr == b.ExternalAddr && a.Method == b.Method
+}
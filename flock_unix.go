@@ -0,0 +1,14 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package portmap
+
+import "os"
+import "syscall"
+
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,13 @@
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd,!windows
+
+package portmap
+
+import "os"
+
+func lockFile(f *os.File) error {
+	return errLockNotSupported
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,99 @@
+package gateway
+
+import "bufio"
+import "net"
+import "os"
+import "path/filepath"
+import "strings"
+
+// Lease files written by ISC dhclient, in which routers are given by an
+// "option routers" statement.
+var dhclientLeaseGlobs = []string{
+	"/var/lib/dhcp/dhclient*.leases",
+	"/var/lib/dhclient/*.lease",
+	"/var/lib/dhclient/*.leases",
+	"/var/lib/NetworkManager/dhclient-*.lease",
+}
+
+// Lease files written by systemd-networkd and the internal DHCP client of
+// NetworkManager, in which routers are given by a ROUTER= line.
+var keyValueLeaseGlobs = []string{
+	"/run/systemd/netif/leases/*",
+	"/var/lib/NetworkManager/internal-*.lease",
+}
+
+// A Source which reads the router option from the lease files of common
+// DHCP clients. This is useful where the routing table cannot be read, such
+// as in some restricted containers.
+//
+// The routers from every lease file found are returned, so a router may be
+// returned more than once; GetIPs returns each only once. Lease files are not
+// removed when a lease expires, so the results may be stale.
+func DHCPLeases() ([]net.IP, error) {
+	var ips []net.IP
+	for _, g := range dhclientLeaseGlobs {
+		ips = appendFromLeaseFiles(ips, g, parseDhclientLeases)
+	}
+	for _, g := range keyValueLeaseGlobs {
+		ips = appendFromLeaseFiles(ips, g, parseKeyValueLease)
+	}
+
+	return ips, nil
+}
+
+func appendFromLeaseFiles(ips []net.IP, glob string, parse func(f *os.File) []net.IP) []net.IP {
+	fns, _ := filepath.Glob(glob)
+	for _, fn := range fns {
+		f, err := os.Open(fn)
+		if err != nil {
+			continue
+		}
+
+		ips = append(ips, parse(f)...)
+		f.Close()
+	}
+
+	return ips
+}
+
+// Returns the routers given by the last lease in a dhclient lease file, which
+// is the most recent.
+func parseDhclientLeases(f *os.File) []net.IP {
+	var ips []net.IP
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if !strings.HasPrefix(line, "option routers ") {
+			continue
+		}
+
+		v := strings.TrimSuffix(strings.TrimPrefix(line, "option routers "), ";")
+		ips = parseIPList(v, ",")
+	}
+
+	return ips
+}
+
+// Returns the routers given by the ROUTER= line of a key-value lease file.
+func parseKeyValueLease(f *os.File) []net.IP {
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "ROUTER=") {
+			return parseIPList(strings.TrimPrefix(line, "ROUTER="), " ")
+		}
+	}
+
+	return nil
+}
+
+func parseIPList(v, sep string) []net.IP {
+	var ips []net.IP
+	for _, s := range strings.Split(v, sep) {
+		if ip := net.ParseIP(strings.TrimSpace(s)); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+
+	return ips
+}
@@ -1,11 +1,263 @@
 package gateway
 
+import "bytes"
+import "errors"
 import "net"
+import "sort"
+import "sync"
+
+// Returned by GetIPs if the routing table cannot be read on this platform
+// and no fallback source yields a gateway.
+var ErrNotSupported = errors.New("reading the routing table is not supported on this platform")
 
 // Get the IPs of default gateways for this host.
 //
 // Both IPv4 and IPv6 default gateways are returned and each protocol may have
 // more than one default gateway.
+//
+// Gateways rejected by the filter set with SetFilter are not returned. By
+// default, DefaultFilter is used.
+//
+// The routing table is consulted first. If it cannot be read or yields no
+// gateways, the sources set with SetFallbackSources are consulted in turn.
+//
+// Addresses are returned in their 16-byte form, as returned by To16, whether
+// they are IPv4 or IPv6 addresses. IPv6 link-local addresses are only
+// meaningful together with the interface via which they are reached; use
+// GetAddrs to obtain it, or Zone.
+//
+// Each gateway is returned once, even if it is reachable via more than one
+// interface. The order is stable: IPv4 gateways come first, then those of
+// routes with lower metrics, then those reached via interfaces with lower
+// indices, with ties broken by address.
 func GetIPs() ([]net.IP, error) {
-	return getGatewayAddrs()
+	addrs, err := GetAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, len(addrs))
+	for i := range addrs {
+		ips[i] = addrs[i].IP
+	}
+
+	return ips, nil
+}
+
+// Like GetIPs, but each IPv6 link-local address is returned with its zone,
+// the name of the interface via which it is reached.
+func GetAddrs() ([]net.IPAddr, error) {
+	configMutex.Lock()
+	f := filter
+	fallbacks := fallbackSources
+	configMutex.Unlock()
+
+	gws, err := getGatewayAddrs()
+	ips := filterGateways(gws, f)
+	for _, src := range fallbacks {
+		if len(ips) > 0 {
+			break
+		}
+
+		sips, serr := src()
+		if serr != nil {
+			continue
+		}
+
+		var sgws []gatewayAddr
+		for _, ip := range sips {
+			sgws = append(sgws, gatewayAddr{ip: ip, ifIndex: interfaceForIP(ip)})
+		}
+
+		ips = filterGateways(sgws, f)
+		if len(ips) > 0 {
+			err = nil
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	configMutex.Lock()
+	zones = map[string]string{}
+	for _, a := range ips {
+		if a.Zone != "" {
+			zones[a.IP.String()] = a.Zone
+		}
+	}
+	configMutex.Unlock()
+
+	return ips, nil
+}
+
+// The zones of the link-local gateways returned by the last call to GetAddrs,
+// keyed by address.
+var zones map[string]string
+
+// Returns the zone of an IPv6 link-local gateway address returned by the last
+// call to GetIPs or GetAddrs, so that it can be contacted via the right
+// interface. Returns an empty string if ip is not a link-local address so
+// returned.
+func Zone(ip net.IP) string {
+	if !ip.IsLinkLocalUnicast() || ip.To4() != nil {
+		return ""
+	}
+
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	return zones[ip.String()]
+}
+
+// A source of gateway addresses other than the routing table.
+type Source func() ([]net.IP, error)
+
+var fallbackSources []Source
+
+// Sets the sources consulted by GetIPs when the routing table cannot be read
+// or yields no gateways. None are used by default. DHCPLeases is provided
+// as a source.
+func SetFallbackSources(srcs ...Source) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	fallbackSources = srcs
+}
+
+// Returns the index of the interface with an address on the same subnet as ip,
+// or zero if there is none.
+func interfaceForIP(ip net.IP) int {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return 0
+	}
+
+	for _, ifi := range ifs {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok && ipn.Contains(ip) {
+				return ifi.Index
+			}
+		}
+	}
+
+	return 0
+}
+
+// Orders gateways as described by GetIPs.
+func sortGateways(gws []gatewayAddr) {
+	sort.SliceStable(gws, func(i, j int) bool {
+		a, b := gws[i], gws[j]
+		a4, b4 := a.ip.To4() != nil, b.ip.To4() != nil
+		switch {
+		case a4 != b4:
+			return a4
+		case a.metric != b.metric:
+			return a.metric < b.metric
+		case a.ifIndex != b.ifIndex:
+			return a.ifIndex < b.ifIndex
+		default:
+			return bytes.Compare(a.ip.To16(), b.ip.To16()) < 0
+		}
+	})
+}
+
+func filterGateways(gws []gatewayAddr, f Filter) []net.IPAddr {
+	gws = append([]gatewayAddr(nil), gws...)
+	sortGateways(gws)
+
+	var addrs []net.IPAddr
+	for _, gw := range gws {
+		var ifi *net.Interface
+		if gw.ifIndex != 0 {
+			ifi, _ = net.InterfaceByIndex(gw.ifIndex)
+		}
+
+		ip := gw.ip.To16()
+		if ip == nil {
+			continue
+		}
+
+		if !f(ip, ifi) {
+			continue
+		}
+
+		a := net.IPAddr{IP: ip}
+		if ip.To4() == nil && ip.IsLinkLocalUnicast() {
+			if ifi == nil {
+				// unreachable without knowing the interface
+				continue
+			}
+			a.Zone = ifi.Name
+		}
+
+		addrs = append(addrs, a)
+	}
+
+	// The same gateway is often listed once per adapter.
+	return dedupAddrs(addrs)
+}
+
+// Removes repeated addresses, keeping the first of each. Link-local addresses
+// with different zones, which are reached via different interfaces, are
+// distinct.
+func dedupAddrs(addrs []net.IPAddr) []net.IPAddr {
+	var out []net.IPAddr
+	seen := map[string]bool{}
+	for _, a := range addrs {
+		key := a.String()
+		if !seen[key] {
+			seen[key] = true
+			out = append(out, a)
+		}
+	}
+
+	return out
+}
+
+// A gateway found in the routing table, and the index of the interface via
+// which it is reached, or zero if not known.
+type gatewayAddr struct {
+	ip      net.IP
+	ifIndex int
+
+	// The metric of the route, or zero if not known.
+	metric int
+}
+
+// Determines whether a gateway address found in the routing table should be
+// returned by GetIPs. ifi is the interface via which the gateway is reached,
+// or nil if it is not known.
+type Filter func(ip net.IP, ifi *net.Interface) bool
+
+// The default filter. Rejects addresses which cannot be those of a gateway,
+// such as unspecified (0.0.0.0), loopback and multicast addresses, and
+// gateways reached via interfaces which are down.
+func DefaultFilter(ip net.IP, ifi *net.Interface) bool {
+	if ip == nil || ip.IsUnspecified() || ip.IsLoopback() || ip.IsMulticast() {
+		return false
+	}
+
+	if ifi != nil && ifi.Flags&net.FlagUp == 0 {
+		return false
+	}
+
+	return true
+}
+
+var configMutex sync.Mutex
+var filter Filter = DefaultFilter
+
+// Sets the filter used by GetIPs. Pass nil to restore DefaultFilter.
+func SetFilter(f Filter) {
+	if f == nil {
+		f = DefaultFilter
+	}
+
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	filter = f
 }
@@ -4,9 +4,28 @@ package gateway
 
 import "net"
 import "syscall"
+import "unsafe"
 
-func getGatewayAddrs() (gwaddr []net.IP, err error) {
-	rib, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, syscall.AF_INET)
+// IPv4 gateways are listed before IPv6 gateways.
+func getGatewayAddrs() (gwaddr []gatewayAddr, err error) {
+	gwaddr, err = getFamilyGatewayAddrs(syscall.AF_INET, net.IPv4len)
+	if err != nil {
+		return
+	}
+
+	// IPv6 may be disabled, in which case only IPv4 gateways are returned
+	gw6, err6 := getFamilyGatewayAddrs(syscall.AF_INET6, net.IPv6len)
+	if err6 == nil {
+		gwaddr = append(gwaddr, gw6...)
+	}
+
+	return
+}
+
+// Returns the gateways of routes of the given address family, whose
+// addresses are of the given length.
+func getFamilyGatewayAddrs(family, addrLen int) (gwaddr []gatewayAddr, err error) {
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, family)
 	if err != nil {
 		return
 	}
@@ -25,16 +44,35 @@ loop:
 				continue
 			}
 
+			var gw gatewayAddr
 			for _, a := range ra {
 				switch a.Attr.Type {
 				case syscall.RTA_GATEWAY:
-					var ip net.IP = a.Value[0:4]
-					gwaddr = append(gwaddr, ip.To16())
+					if len(a.Value) < addrLen {
+						continue
+					}
+					gw.ip = append(net.IP(nil), a.Value[0:addrLen]...).To16()
+
+				case syscall.RTA_OIF:
+					if len(a.Value) < 4 {
+						continue
+					}
+					gw.ifIndex = int(*(*uint32)(unsafe.Pointer(&a.Value[0])))
+
+				case syscall.RTA_PRIORITY:
+					if len(a.Value) < 4 {
+						continue
+					}
+					gw.metric = int(*(*uint32)(unsafe.Pointer(&a.Value[0])))
 
 				default:
 				}
 			}
 
+			if gw.ip != nil {
+				gwaddr = append(gwaddr, gw)
+			}
+
 		case syscall.NLMSG_DONE:
 			break loop
 		}
@@ -2,11 +2,6 @@
 
 package gateway
 
-import "net"
-import "errors"
-
-var errNotSupportedGw = errors.New("GetGatewayAddrs is not supported on this platform")
-
-func getGatewayAddrs() (gwaddr []net.IP, err error) {
-	return nil, errNotSupportedGw
+func getGatewayAddrs() (gwaddr []gatewayAddr, err error) {
+	return nil, ErrNotSupported
 }
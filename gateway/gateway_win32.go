@@ -4,6 +4,7 @@ package gateway
 
 // Adapted from go:net/interface_windows.go
 // TODO: IPv6
+import "bytes"
 import "net"
 import "syscall"
 import "unsafe"
@@ -28,7 +29,7 @@ func getAdapterList() (*syscall.IpAdapterInfo, error) {
 	return a, nil
 }
 
-func getGatewayAddrs() (gwaddr []net.IP, err error) {
+func getGatewayAddrs() (gwaddr []gatewayAddr, err error) {
 	ai, err := getAdapterList()
 	if err != nil {
 		return
@@ -37,9 +38,18 @@ func getGatewayAddrs() (gwaddr []net.IP, err error) {
 	for ; ai != nil; ai = ai.Next {
 		g := &ai.GatewayList
 		for ; g != nil; g = g.Next {
-			s := string(g.IpAddress.String[:])
-			ip := net.ParseIP(s)
-			gwaddr = append(gwaddr, ip)
+			// The address is NUL-terminated.
+			b := g.IpAddress.String[:]
+			if i := bytes.IndexByte(b, 0); i >= 0 {
+				b = b[:i]
+			}
+
+			ip := net.ParseIP(string(b))
+			if ip == nil {
+				continue
+			}
+
+			gwaddr = append(gwaddr, gatewayAddr{ip: ip, ifIndex: int(ai.Index)})
 		}
 	}
 
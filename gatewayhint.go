@@ -0,0 +1,69 @@
+package portmap
+
+import "context"
+import "net"
+import "time"
+import "github.com/hlandau/portmap/internal/localnet"
+
+// Resolves the names in Config.GatewayHintNames. *net.Resolver satisfies
+// this interface.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Time allowed to resolve each name in Config.GatewayHintNames.
+const gatewayHintLookupTimeout = 5 * time.Second
+
+// Returns the IPv4 addresses of the gateways named in Config.GatewayHintNames.
+// Names which can't be resolved are logged and skipped, so that a gateway
+// which is down or renumbered doesn't prevent the others being used.
+func resolveGatewayHints(cfg *Config) []net.IP {
+	var gwa []net.IP
+	for _, name := range cfg.GatewayHintNames {
+		ips, err := resolveGatewayHint(cfg, name)
+		if err != nil {
+			log.Infof("cannot resolve gateway hint %q: %v", name, err)
+			continue
+		}
+
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil && !isGatewayIP(ip4, gwa) {
+				gwa = append(gwa, ip4)
+			}
+		}
+	}
+
+	return gwa
+}
+
+func resolveGatewayHint(cfg *Config, name string) ([]net.IP, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	r := cfg.Resolver
+	if r == nil {
+		// In local-only mode, a name may only be resolved by a resolver
+		// supplied by the caller, such as one consulting a hosts file.
+		if localnet.Enabled() {
+			return nil, ErrNotLocal
+		}
+
+		r = net.DefaultResolver
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gatewayHintLookupTimeout)
+	defer cancel()
+
+	addrs, err := r.LookupIPAddr(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, len(addrs))
+	for i := range addrs {
+		ips[i] = addrs[i].IP
+	}
+
+	return ips, nil
+}
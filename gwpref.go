@@ -0,0 +1,82 @@
+package portmap
+
+import "net"
+import "sort"
+import "sync"
+import "time"
+import "github.com/hlandau/portmap/gateway"
+import "github.com/hlandau/portmap/natpmp"
+
+// Maximum time to wait for a gateway to answer a probe.
+const gatewayProbeTimeout = 500 * time.Millisecond
+
+// Returns the IPv4 default gateways of this host. Only these are used for
+// mappings, since NAT-PMP and SSDP discovery are IPv4-only.
+func ipv4Gateways() ([]net.IP, error) {
+	gwa, err := gateway.GetIPs()
+	if err != nil {
+		return nil, err
+	}
+
+	var v4 []net.IP
+	for _, gw := range gwa {
+		if gw.To4() != nil {
+			v4 = append(v4, gw)
+		}
+	}
+
+	return v4, nil
+}
+
+// Orders gateways so that those which answer a NAT-PMP probe come first, in
+// order of increasing round trip time. Gateways which don't answer keep their
+// relative order from the routing table and are still tried, since they may
+// support UPnP only. This avoids waiting on a dead gateway, such as that of a
+// disconnected VPN, which happens to be listed first.
+func orderGateways(gwa []net.IP) []net.IP {
+	if len(gwa) < 2 {
+		return gwa
+	}
+
+	rtts := make([]time.Duration, len(gwa))
+	var wg sync.WaitGroup
+	for i := range gwa {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			beginOp()
+			defer endOp()
+			rtt, err := natpmp.Ping(gwa[i], gatewayProbeTimeout)
+			if err != nil {
+				rtt = -1
+			}
+			rtts[i] = rtt
+		}(i)
+	}
+	wg.Wait()
+
+	idx := make([]int, len(gwa))
+	for i := range idx {
+		idx[i] = i
+	}
+
+	sort.SliceStable(idx, func(a, b int) bool {
+		ra, rb := rtts[idx[a]], rtts[idx[b]]
+		switch {
+		case ra < 0:
+			return false
+		case rb < 0:
+			return true
+		default:
+			return ra < rb
+		}
+	})
+
+	ordered := make([]net.IP, len(gwa))
+	for i, j := range idx {
+		ordered[i] = gwa[j]
+	}
+
+	log.Debugf("gateway order after probing: %v", ordered)
+	return ordered
+}
@@ -0,0 +1,95 @@
+package portmap
+
+import "context"
+import "fmt"
+import "net"
+import "github.com/hlandau/portmap/internal/localnet"
+
+// Whether the gateway supports hairpin NAT, also called NAT loopback, for a
+// mapping: that is, whether connecting to the mapping's external address
+// from inside the local network reaches the mapping. Where it doesn't, peers
+// on the local network must be given the internal address instead. See
+// Config.DetectHairpin.
+type Hairpin int
+
+const (
+	HairpinUnknown     Hairpin = iota // not tested, or the test has not finished
+	HairpinSupported                  // the external address is reachable from this host
+	HairpinUnsupported                // the external address is unreachable from this host
+)
+
+func (h Hairpin) String() string {
+	switch h {
+	case HairpinUnknown:
+		return "unknown"
+	case HairpinSupported:
+		return "supported"
+	case HairpinUnsupported:
+		return "unsupported"
+	default:
+		return fmt.Sprintf("Hairpin(%d)", int(h))
+	}
+}
+
+// Sent when the hairpin test requested by Config.DetectHairpin finishes.
+// Status.Hairpin returns the result by the time the event is sent.
+type HairpinTested struct {
+	ExternalAddr string
+	Hairpin      Hairpin
+}
+
+func (HairpinTested) isEvent() {}
+
+// Starts a hairpin test of the mapping's external address if one is wanted
+// and the address has not been tested already. Called after each successful
+// attempt.
+func (m *mapping) checkHairpin() {
+	if !m.cfg.DetectHairpin {
+		return
+	}
+
+	m.mutex.Lock()
+	addr := m.externalAddrStr()
+	if addr == "" || addr == m.hairpinAddr || m.standbyMapped || m.dmz {
+		m.mutex.Unlock()
+		return
+	}
+
+	m.hairpinAddr = addr
+	m.hairpin = HairpinUnknown
+	m.mutex.Unlock()
+
+	if host, _, err := net.SplitHostPort(addr); err != nil || net.ParseIP(host) == nil {
+		// the external IP is not known, so there is nothing to connect to
+		return
+	} else if localnet.Check(host) != nil {
+		// the external IP is public, so can't be contacted in local-only mode
+		return
+	}
+
+	go m.testHairpin(addr)
+}
+
+func (m *mapping) testHairpin(addr string) {
+	h := HairpinUnsupported
+	if reachableLocally(context.Background(), addr, m.cfg.Protocol) {
+		h = HairpinSupported
+	}
+
+	m.mutex.Lock()
+	if m.hairpinAddr != addr {
+		// the address has changed since, and is being tested again
+		m.mutex.Unlock()
+		return
+	}
+
+	m.hairpin = h
+	m.mutex.Unlock()
+
+	log.Debugf("hairpin test of %v: %v", addr, h)
+	if m.parent != nil {
+		m.parent.syncChildren()
+	}
+
+	m.emit(HairpinTested{ExternalAddr: addr, Hairpin: h})
+}
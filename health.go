@@ -0,0 +1,82 @@
+package portmap
+
+import "fmt"
+import "net/http"
+import "sync"
+import "time"
+
+// An http.Handler suitable for use as a liveness endpoint (e.g. /healthz).
+//
+// Responds with 200 if every mapping added to it is healthy and 503
+// otherwise. A mapping is unhealthy if it has been inactive for longer than
+// Threshold. This allows process supervisors and container orchestrators to
+// restart or alert on a process which has lost its port forwarding.
+//
+// The zero value is ready to use and reports healthy until mappings are
+// added. Threshold should be set before the handler is used.
+type HealthCheck struct {
+	// The period for which a mapping may be inactive before it is considered
+	// unhealthy. If zero, DefaultHealthThreshold is used.
+	Threshold time.Duration
+
+	mutex    sync.Mutex
+	mappings map[Mapping]struct{}
+}
+
+const DefaultHealthThreshold = 5 * time.Minute
+
+// Adds a mapping which must be active for the check to report healthy.
+func (h *HealthCheck) Add(m Mapping) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.mappings == nil {
+		h.mappings = map[Mapping]struct{}{}
+	}
+
+	h.mappings[m] = struct{}{}
+}
+
+// Removes a mapping previously added with Add.
+func (h *HealthCheck) Remove(m Mapping) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	delete(h.mappings, m)
+}
+
+// Returns the number of mappings which are currently unhealthy and the total
+// number of mappings.
+func (h *HealthCheck) Check() (unhealthy, total int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	threshold := h.Threshold
+	if threshold == 0 {
+		threshold = DefaultHealthThreshold
+	}
+
+	now := time.Now()
+	for m := range h.mappings {
+		s := m.Status()
+		if !s.Active && now.Sub(s.InactiveSince) > threshold {
+			unhealthy++
+		}
+	}
+
+	return unhealthy, len(h.mappings)
+}
+
+func (h *HealthCheck) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	unhealthy, total := h.Check()
+
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-cache")
+	if unhealthy > 0 {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(rw, "%d of %d mappings inactive\n", unhealthy, total)
+		return
+	}
+
+	fmt.Fprintf(rw, "ok\n")
+}
@@ -0,0 +1,189 @@
+package portmap
+
+import "net"
+import "sort"
+import "sync"
+import "time"
+import "github.com/hlandau/portmap/ssdp"
+import "github.com/hlandau/portmap/upnp"
+
+// Describes a UPnP WANIPConnection service, as ranked by DiscoverGateways.
+type GatewayCandidate struct {
+	Service ssdp.Service
+
+	// Whether the service is provided by one of this host's default
+	// gateways.
+	DefaultGateway bool
+
+	// The WAN connection status reported by GetStatusInfo, and the time taken
+	// for the request. Status is nil if the request failed, in which case
+	// StatusErr is set.
+	Status    *upnp.StatusInfo
+	StatusErr error
+	RTT       time.Duration
+
+	// The index in the host's default gateways of the one providing the
+	// service, or the number of gateways if none does.
+	gatewayIndex int
+	onInterface  bool
+}
+
+// Returns true if the service's WAN connection is known to be up.
+func (c *GatewayCandidate) Connected() bool {
+	return c.Status != nil && c.Status.Connected()
+}
+
+// Returns 2 if the WAN connection is up, 0 if it is known to be down, and 1
+// if the status could not be determined, since some devices don't implement
+// GetStatusInfo.
+func (c *GatewayCandidate) connectedRank() int {
+	switch {
+	case c.Status == nil:
+		return 1
+	case c.Status.Connected():
+		return 2
+	default:
+		return 0
+	}
+}
+
+// Searches for UPnP devices and returns the WANIPConnection services found,
+// most preferred first. This is the order in which mappings try them, before
+// UPnPTrust is applied:
+//
+//   - Services provided by a default gateway come first, in the order of
+//     the routing table, since a device which is not this host's gateway may
+//     not be able to forward traffic to it. Among the rest, services on the
+//     interface of the default route are preferred.
+//   - Then services whose WAN connection is up come before those whose
+//     status is unknown, which come before those which are disconnected.
+//   - Then services which answer GetStatusInfo more quickly come first.
+//
+// This blocks for a couple of seconds while devices respond.
+func DiscoverGateways() ([]GatewayCandidate, error) {
+	gwa, err := ipv4Gateways()
+	if err != nil {
+		return nil, err
+	}
+
+	err = ssdp.Acquire()
+	defer ssdp.Release()
+	if err != nil {
+		return nil, err
+	}
+
+	ssdp.SearchMX(fastStartMX)
+	time.Sleep(fastStartUPnPWait)
+
+	svcs := ssdp.GetServicesByType(upnp.WANIPConnection1)
+	svcs = append(svcs, ssdp.GetServicesByType(upnp.WANIPConnection2)...)
+	return rankServices(svcs, gwa), nil
+}
+
+// Probes and ranks services as described for DiscoverGateways.
+func rankServices(svcs []ssdp.Service, gwa []net.IP) []GatewayCandidate {
+	var onIf map[string]bool
+	if len(gwa) > 0 {
+		onIf = servicesOnInterface(interfaceNameFor(gwa[0]))
+	}
+
+	// A device providing both versions of WANIPConnection is only probed
+	// once.
+	statuses := map[string]*igdStatus{}
+	for i := range svcs {
+		statuses[svcs[i].PreferredLocation().String()] = nil
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for loc := range statuses {
+		wg.Add(1)
+		go func(loc string) {
+			defer wg.Done()
+			st := getIGDStatus(loc)
+			mutex.Lock()
+			statuses[loc] = &st
+			mutex.Unlock()
+		}(loc)
+	}
+	wg.Wait()
+
+	cands := make([]GatewayCandidate, len(svcs))
+	for i := range svcs {
+		c := &cands[i]
+		c.Service = svcs[i]
+		c.gatewayIndex = serviceGateway(&c.Service, gwa)
+		c.DefaultGateway = c.gatewayIndex < len(gwa)
+		c.onInterface = onIf[c.Service.USN]
+
+		st := statuses[c.Service.PreferredLocation().String()]
+		c.Status, c.StatusErr, c.RTT = st.status, st.err, st.rtt
+	}
+
+	// The registry is a map, so the USN is used as a final tiebreak to keep
+	// the order stable between calls.
+	sort.Slice(cands, func(i, j int) bool {
+		a, b := &cands[i], &cands[j]
+		switch {
+		case a.gatewayIndex != b.gatewayIndex:
+			return a.gatewayIndex < b.gatewayIndex
+		case a.onInterface != b.onInterface:
+			return a.onInterface
+		case a.connectedRank() != b.connectedRank():
+			return a.connectedRank() > b.connectedRank()
+		case (a.StatusErr == nil) != (b.StatusErr == nil):
+			return a.StatusErr == nil
+		case a.RTT != b.RTT:
+			return a.RTT < b.RTT
+		default:
+			return a.Service.USN < b.Service.USN
+		}
+	})
+
+	return cands
+}
+
+// How long the result of GetStatusInfo is reused for, so that ranking does
+// not add a request to every attempt.
+const igdStatusCacheTime = 1 * time.Minute
+
+type igdStatus struct {
+	status *upnp.StatusInfo
+	err    error
+	rtt    time.Duration
+	time   time.Time
+}
+
+var igdStatusMutex sync.Mutex
+var igdStatusCache = map[string]igdStatus{}
+
+// Returns the status of the device at the given URL, from the cache where
+// possible.
+func getIGDStatus(loc string) igdStatus {
+	igdStatusMutex.Lock()
+	st, ok := igdStatusCache[loc]
+	igdStatusMutex.Unlock()
+	if ok && time.Since(st.time) < igdStatusCacheTime {
+		return st
+	}
+
+	beginOp()
+	start := time.Now()
+	st.status, st.err = upnp.GetStatusInfo(loc)
+	st.rtt = time.Since(start)
+	endOp()
+	st.time = time.Now()
+
+	igdStatusMutex.Lock()
+	defer igdStatusMutex.Unlock()
+
+	// drop stale entries so that devices which have gone away are forgotten
+	for k, v := range igdStatusCache {
+		if time.Since(v.time) >= igdStatusCacheTime {
+			delete(igdStatusCache, k)
+		}
+	}
+
+	igdStatusCache[loc] = st
+	return st
+}
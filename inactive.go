@@ -0,0 +1,93 @@
+package portmap
+
+import "errors"
+import "fmt"
+
+// Identifies why a mapping is inactive. See Status.InactiveReason.
+type InactiveReason int
+
+const (
+	InactiveNone        InactiveReason = iota // The mapping is active.
+	InactiveNeverActive                       // No attempt has succeeded yet.
+	InactiveExpired                           // The mapping lapsed because renewal failed.
+	InactiveRefused                           // The gateway does not support or refuses port mapping.
+	InactiveNoGateway                         // No default gateway was found.
+	InactiveMaxTries                          // Attempts stopped after Config.Backoff.MaxTries.
+	InactiveDeleted                           // The mapping was deleted.
+	InactiveDetached                          // The mapping was detached with Detach.
+	InactiveBrokerLost                        // The connection to the broker ended.
+)
+
+func (r InactiveReason) String() string {
+	switch r {
+	case InactiveNone:
+		return "none"
+	case InactiveNeverActive:
+		return "never active"
+	case InactiveExpired:
+		return "expired"
+	case InactiveRefused:
+		return "refused"
+	case InactiveNoGateway:
+		return "no gateway"
+	case InactiveMaxTries:
+		return "max tries"
+	case InactiveDeleted:
+		return "deleted"
+	case InactiveDetached:
+		return "detached"
+	case InactiveBrokerLost:
+		return "broker lost"
+	default:
+		return fmt.Sprintf("InactiveReason(%d)", int(r))
+	}
+}
+
+// Sent when a mapping becomes inactive, and when attempts to create a mapping
+// which never became active stop because Config.Backoff.MaxTries was
+// reached.
+type Inactive struct {
+	Reason InactiveReason
+
+	// The error from the last attempt, if any. See Status.LastError. Not
+	// sent by a broker.
+	Err error `json:"-"`
+}
+
+func (Inactive) isEvent() {}
+
+// Returns the reason the mapping is inactive. A reason recorded when the
+// mapping stopped being maintained takes precedence; otherwise the reason is
+// inferred from the last attempt. Must be called with the mutex held.
+func (m *mapping) inactiveReason() InactiveReason {
+	switch {
+	case m.isActive():
+		return InactiveNone
+	case m.stopReason != InactiveNone:
+		return m.stopReason
+	case errors.Is(m.lastErr, ErrUnsupported):
+		return InactiveRefused
+	case m.pending || errors.Is(m.lastErr, ErrNoGateway):
+		return InactiveNoGateway
+	case m.timeToActive != 0:
+		return InactiveExpired
+	default:
+		return InactiveNeverActive
+	}
+}
+
+// Returns the reason to record when the lease runner gives up on the
+// mapping: it was either deleted or detached, or ran out of attempts.
+func (m *mapping) lapseReason() InactiveReason {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	switch {
+	case m.detached:
+		return InactiveDetached
+	case m.aborted:
+		return InactiveDeleted
+	default:
+		return InactiveMaxTries
+	}
+}
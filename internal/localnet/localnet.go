@@ -0,0 +1,114 @@
+// Package localnet enforces the local-only mode set by portmap.SetLocalOnly,
+// in which no DNS lookups are made and nothing outside the local network is
+// dialled. It is used by every package which makes network requests.
+package localnet
+
+import "context"
+import "errors"
+import "fmt"
+import "net"
+import "strings"
+import "sync/atomic"
+import "time"
+
+var enabled int32
+
+// Enables or disables local-only mode.
+func SetEnabled(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&enabled, v)
+}
+
+// Returns true if local-only mode is enabled.
+func Enabled() bool {
+	return atomic.LoadInt32(&enabled) != 0
+}
+
+// Returned in local-only mode when an operation would make a DNS lookup or
+// contact a host outside the local network.
+var ErrNotLocal = errors.New("refusing to contact a host outside the local network in local-only mode")
+
+// Ranges regarded as local: the private ranges of RFC 1918 and their IPv6
+// counterpart, unique local addresses. Loopback and link-local addresses are
+// also local.
+var localSubnets = []*net.IPNet{
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+	mustParseCIDR("fc00::/7"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, ipn, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return ipn
+}
+
+// Returns true if ip is loopback, link-local, or in a private range.
+func IsLocal(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return true
+	}
+
+	for _, ipn := range localSubnets {
+		if ipn.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns ErrNotLocal if local-only mode is enabled and ip is not local.
+func CheckIP(ip net.IP) error {
+	if !Enabled() || IsLocal(ip) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %v", ErrNotLocal, ip)
+}
+
+// Like CheckIP, but takes a host or "host:port". A hostname is refused in
+// local-only mode, since resolving it would require a DNS lookup.
+func Check(addr string) error {
+	if !Enabled() {
+		return nil
+	}
+
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+
+	// IPv6 zones don't affect whether an address is local
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: %q would need to be resolved", ErrNotLocal, host)
+	}
+
+	return CheckIP(ip)
+}
+
+// Timeout for connections made by DialContext.
+const dialTimeout = 10 * time.Second
+
+// Dials addr after checking it with Check. Suitable for use as the
+// DialContext of an http.Transport.
+func DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	err := Check(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	d := net.Dialer{Timeout: dialTimeout}
+	return d.DialContext(ctx, network, addr)
+}
@@ -0,0 +1,63 @@
+// +build gofuzz
+
+package parse
+
+import "encoding/xml"
+
+// Entry points for go-fuzz (github.com/dvyukov/go-fuzz), for example:
+//
+//   go-fuzz-build -func FuzzSSDP github.com/hlandau/portmap/internal/parse
+//   mkdir -p fuzz/ssdp && cp -r testdata/corpus/ssdp fuzz/ssdp/corpus
+//   go-fuzz -bin parse-fuzz.zip -workdir fuzz/ssdp
+//
+// testdata/corpus holds a seed corpus for each entry point, which TestCorpus
+// checks is still accepted; inputs collected with SetRejectHook make good
+// additions. Each returns 1 if the input was accepted, so that go-fuzz
+// favours inputs which reach further into the parser.
+
+func FuzzSSDP(data []byte) int {
+	if _, err := SSDP(data); err != nil {
+		return 0
+	}
+
+	return 1
+}
+
+func FuzzSOAP(data []byte) int {
+	res, err := SOAP(data)
+	if err != nil {
+		return 0
+	}
+
+	var v struct {
+		XMLName           xml.Name
+		ExternalIPAddress string `xml:"NewExternalIPAddress"`
+		ExternalPort      uint16 `xml:"NewExternalPort"`
+		PortListing       string `xml:"NewPortListing"`
+	}
+	SOAPBody(res.Body, &v)
+	return 1
+}
+
+type fuzzDevice struct {
+	DeviceType string       `xml:"deviceType"`
+	UDN        string       `xml:"UDN"`
+	Devices    []fuzzDevice `xml:"deviceList>device"`
+	Services   []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+}
+
+func FuzzDescription(data []byte) int {
+	var v struct {
+		XMLName xml.Name   `xml:"root"`
+		URLBase string     `xml:"URLBase"`
+		Device  fuzzDevice `xml:"device"`
+	}
+	if err := Description(data, "urn:schemas-upnp-org:device-1-0", &v); err != nil {
+		return 0
+	}
+
+	return 1
+}
@@ -0,0 +1,236 @@
+package parse
+
+import "bytes"
+import "errors"
+import "net/http"
+import "net/textproto"
+import "net/url"
+import "strconv"
+import "strings"
+import "time"
+
+// Maximum size of an HTTPU datagram which will be parsed: the largest
+// possible UDP payload.
+const MaxDatagramSize = 65507
+
+// Maximum number of header lines in an HTTPU datagram.
+const maxHeaderLines = 100
+
+// A response received over HTTPU (HTTP over UDP), as sent by devices in reply
+// to a discovery beacon.
+type HTTPUResponse struct {
+	StatusCode int
+	Header     http.Header
+}
+
+var errNotHTTPUResponse = errors.New("not an HTTPU response")
+var errTooManyHeaders = errors.New("HTTPU response has too many header lines")
+
+// Parses an HTTPU response. This is more tolerant than net/http, since devices
+// commonly send responses which are slightly malformed: status lines without
+// a reason phrase, LF rather than CRLF line endings, no space after header
+// colons, and no terminating blank line. Header names are canonicalised. Any
+// body is ignored.
+//
+// Nothing returned refers to buf.
+func HTTPU(buf []byte) (*HTTPUResponse, error) {
+	res, err := parseHTTPU(buf)
+	if err != nil {
+		return nil, reject(KindSSDP, buf, err)
+	}
+
+	return res, nil
+}
+
+func parseHTTPU(buf []byte) (*HTTPUResponse, error) {
+	if len(buf) > MaxDatagramSize {
+		return nil, ErrTooLarge
+	}
+
+	line, rest := nextLine(buf)
+
+	// HTTP/1.1 200 OK
+	if !bytes.HasPrefix(line, []byte("HTTP/")) {
+		return nil, errNotHTTPUResponse
+	}
+
+	fields := bytes.Fields(line)
+	if len(fields) < 2 {
+		return nil, errNotHTTPUResponse
+	}
+
+	code, err := strconv.Atoi(string(fields[1]))
+	if err != nil || code < 100 || code > 999 {
+		return nil, errNotHTTPUResponse
+	}
+
+	res := &HTTPUResponse{StatusCode: code, Header: http.Header{}}
+
+	var lastKey string
+	for lines := 0; len(rest) > 0; lines++ {
+		if lines == maxHeaderLines {
+			return nil, errTooManyHeaders
+		}
+
+		line, rest = nextLine(rest)
+		if len(line) == 0 {
+			break
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			// obsolete line folding
+			if lastKey != "" {
+				vs := res.Header[lastKey]
+				vs[len(vs)-1] += " " + string(bytes.TrimSpace(line))
+			}
+			continue
+		}
+
+		i := bytes.IndexByte(line, ':')
+		if i <= 0 {
+			// not a header; skip it rather than rejecting the response
+			lastKey = ""
+			continue
+		}
+
+		lastKey = textproto.CanonicalMIMEHeaderKey(string(bytes.TrimSpace(line[0:i])))
+		res.Header.Add(lastKey, string(bytes.TrimSpace(line[i+1:])))
+	}
+
+	return res, nil
+}
+
+// Splits off the first line of buf, without its line ending, which may be
+// CRLF or LF.
+func nextLine(buf []byte) (line, rest []byte) {
+	i := bytes.IndexByte(buf, '\n')
+	if i < 0 {
+		line, rest = buf, nil
+	} else {
+		line, rest = buf[0:i], buf[i+1:]
+	}
+
+	return bytes.TrimRight(line, "\r"), rest
+}
+
+// An SSDP search response.
+type SSDPResponse struct {
+	Location *url.URL
+	ST       string
+	USN      string
+	Server   string
+
+	// From the CACHE-CONTROL max-age directive. Zero if not specified.
+	MaxAge time.Duration
+
+	// From the UPnP 1.1 BOOTID.UPNP.ORG and CONFIGID.UPNP.ORG headers. -1 if
+	// not specified.
+	BootID, ConfigID int64
+
+	// From the UPnP 1.1 SEARCHPORT.UPNP.ORG header. Zero if not specified or
+	// outside the permitted range of 49152 to 65535.
+	SearchPort int
+}
+
+var errNotSSDPResponse = errors.New("not a valid SSDP search response")
+
+// Parses an SSDP search response. The response must have status 200, an ST
+// header and an absolute LOCATION. If there is no USN, the location is used
+// in its place.
+func SSDP(buf []byte) (*SSDPResponse, error) {
+	res, err := parseHTTPU(buf)
+	if err == nil {
+		var r *SSDPResponse
+		r, err = ssdpResponse(res)
+		if err == nil {
+			return r, nil
+		}
+	}
+
+	return nil, reject(KindSSDP, buf, err)
+}
+
+func ssdpResponse(res *HTTPUResponse) (*SSDPResponse, error) {
+	if res.StatusCode != 200 {
+		return nil, errNotSSDPResponse
+	}
+
+	st := res.Header.Get("ST")
+	if st == "" {
+		return nil, errNotSSDPResponse
+	}
+
+	loc, err := location(res.Header.Get("Location"))
+	if err != nil {
+		return nil, err
+	}
+
+	usn := res.Header.Get("USN")
+	if usn == "" {
+		usn = loc.String()
+	}
+
+	r := &SSDPResponse{
+		Location: loc,
+		ST:       st,
+		USN:      usn,
+		Server:   res.Header.Get("SERVER"),
+		MaxAge:   parseMaxAge(res.Header.Get("CACHE-CONTROL")),
+		BootID:   parseIntHeader(res.Header.Get("BOOTID.UPNP.ORG")),
+		ConfigID: parseIntHeader(res.Header.Get("CONFIGID.UPNP.ORG")),
+	}
+
+	if sp := parseIntHeader(res.Header.Get("SEARCHPORT.UPNP.ORG")); sp >= 49152 && sp <= 65535 {
+		r.SearchPort = int(sp)
+	}
+
+	return r, nil
+}
+
+// Parses a LOCATION header, which must be an absolute URL.
+func location(v string) (*url.URL, error) {
+	if v == "" {
+		return nil, http.ErrNoLocation
+	}
+
+	u, err := url.Parse(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if !u.IsAbs() || u.Host == "" {
+		return nil, errors.New("LOCATION is not an absolute URL")
+	}
+
+	return u, nil
+}
+
+// Parses the max-age directive of a CACHE-CONTROL header.
+func parseMaxAge(cc string) time.Duration {
+	for _, d := range strings.Split(cc, ",") {
+		d = strings.TrimSpace(d)
+		if len(d) < 8 || !strings.EqualFold(d[0:8], "max-age=") {
+			continue
+		}
+
+		n, err := strconv.ParseUint(strings.TrimSpace(d[8:]), 10, 31)
+		if err != nil {
+			return 0
+		}
+
+		return time.Duration(n) * time.Second
+	}
+
+	return 0
+}
+
+// Parses a non-negative integer header value, returning -1 if it is absent or
+// invalid.
+func parseIntHeader(v string) int64 {
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 32)
+	if err != nil || n < 0 {
+		return -1
+	}
+
+	return n
+}
@@ -0,0 +1,127 @@
+package parse
+
+import "bytes"
+import "strings"
+import "testing"
+import "time"
+
+func TestSSDP(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		ok   bool
+		st   string
+		loc  string
+		age  time.Duration
+		boot int64
+	}{
+		{
+			name: "well-formed",
+			in: "HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=120\r\nST: upnp:rootdevice\r\n" +
+				"USN: uuid:1\r\nLOCATION: http://192.168.1.1:5000/rootDesc.xml\r\nBOOTID.UPNP.ORG: 7\r\n\r\n",
+			ok: true, st: "upnp:rootdevice", loc: "http://192.168.1.1:5000/rootDesc.xml", age: 120 * time.Second, boot: 7,
+		},
+		{
+			name: "LF endings, no reason phrase, no space after colons, no blank line",
+			in:   "HTTP/1.1 200\nST:upnp:rootdevice\nLocation:http://10.0.0.1/igd.xml\ncache-control:MAX-AGE=60",
+			ok:   true, st: "upnp:rootdevice", loc: "http://10.0.0.1/igd.xml", age: 60 * time.Second, boot: -1,
+		},
+		{
+			name: "folded header",
+			in:   "HTTP/1.1 200 OK\r\nST: upnp:\r\n rootdevice\r\nLOCATION: http://10.0.0.1/\r\n\r\n",
+			ok:   true, st: "upnp: rootdevice", loc: "http://10.0.0.1/", boot: -1,
+		},
+		{name: "empty", in: ""},
+		{name: "request rather than response", in: "M-SEARCH * HTTP/1.1\r\nST: ssdp:all\r\n\r\n"},
+		{name: "not 200", in: "HTTP/1.1 404 Not Found\r\nST: upnp:rootdevice\r\nLOCATION: http://10.0.0.1/\r\n\r\n"},
+		{name: "bad status code", in: "HTTP/1.1 2x0 OK\r\n\r\n"},
+		{name: "status line only", in: "HTTP/1.1\r\n"},
+		{name: "no ST", in: "HTTP/1.1 200 OK\r\nLOCATION: http://10.0.0.1/\r\n\r\n"},
+		{name: "no LOCATION", in: "HTTP/1.1 200 OK\r\nST: upnp:rootdevice\r\n\r\n"},
+		{name: "relative LOCATION", in: "HTTP/1.1 200 OK\r\nST: upnp:rootdevice\r\nLOCATION: /rootDesc.xml\r\n\r\n"},
+		{name: "unparsable LOCATION", in: "HTTP/1.1 200 OK\r\nST: upnp:rootdevice\r\nLOCATION: http://[::1\r\n\r\n"},
+	}
+
+	for _, tt := range tests {
+		res, err := SSDP([]byte(tt.in))
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: accepted", tt.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: rejected: %v", tt.name, err)
+			continue
+		}
+
+		if res.ST != tt.st || res.Location.String() != tt.loc || res.MaxAge != tt.age || res.BootID != tt.boot {
+			t.Errorf("%s: got ST %q, LOCATION %q, max-age %v, BOOTID %d", tt.name, res.ST, res.Location, res.MaxAge, res.BootID)
+		}
+	}
+}
+
+func TestHTTPULimits(t *testing.T) {
+	head := "HTTP/1.1 200 OK\r\nST: upnp:rootdevice\r\nLOCATION: http://10.0.0.1/\r\n"
+
+	var b strings.Builder
+	b.WriteString(head)
+	for b.Len() <= MaxDatagramSize {
+		b.WriteString("X-Padding: 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef\r\n")
+	}
+	if _, err := HTTPU([]byte(b.String())); err != ErrTooLarge {
+		t.Errorf("datagram of %d bytes: got %v, expected ErrTooLarge", b.Len(), err)
+	}
+
+	lines := func(n int) []byte {
+		var b bytes.Buffer
+		b.WriteString("HTTP/1.1 200 OK\r\n")
+		for i := 0; i < n; i++ {
+			b.WriteString("X: y\r\n")
+		}
+		return b.Bytes()
+	}
+
+	if _, err := HTTPU(lines(maxHeaderLines)); err != nil {
+		t.Errorf("%d header lines rejected: %v", maxHeaderLines, err)
+	}
+	if _, err := HTTPU(lines(maxHeaderLines + 1)); err != errTooManyHeaders {
+		t.Errorf("%d header lines: got %v, expected errTooManyHeaders", maxHeaderLines+1, err)
+	}
+}
+
+func TestSSDPHeaderValues(t *testing.T) {
+	tests := []struct {
+		cc  string
+		age time.Duration
+	}{
+		{"max-age=1800", 1800 * time.Second},
+		{"no-cache, max-age=30", 30 * time.Second},
+		{"Max-Age= 5", 5 * time.Second},
+		{"max-age=-1", 0},
+		{"max-age=99999999999", 0},
+		{"no-cache", 0},
+		{"", 0},
+	}
+
+	for _, tt := range tests {
+		if age := parseMaxAge(tt.cc); age != tt.age {
+			t.Errorf("CACHE-CONTROL %q: got max-age %v, expected %v", tt.cc, age, tt.age)
+		}
+	}
+
+	for _, sp := range []struct {
+		v    string
+		port int
+	}{{"49152", 49152}, {"65535", 65535}, {"1900", 0}, {"65536", 0}, {"x", 0}} {
+		in := "HTTP/1.1 200 OK\r\nST: a\r\nLOCATION: http://10.0.0.1/\r\nSEARCHPORT.UPNP.ORG: " + sp.v + "\r\n\r\n"
+		res, err := SSDP([]byte(in))
+		if err != nil {
+			t.Fatalf("SEARCHPORT %q: rejected: %v", sp.v, err)
+		}
+		if res.SearchPort != sp.port {
+			t.Errorf("SEARCHPORT %q: got %d, expected %d", sp.v, res.SearchPort, sp.port)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Package parse implements the parsers for data received from gateways:
+// SSDP datagrams, SOAP responses and UPnP device descriptions.
+//
+// Each parser is a pure function of a byte slice whose size has already been
+// limited, so that it can be fuzzed in isolation; see fuzz.go. Malformed
+// input is rejected with an error and never causes a panic or unbounded
+// work, since a router which sends garbage must not be able to stop a
+// mapping from being maintained.
+package parse
+
+import "errors"
+import "io"
+import "io/ioutil"
+import "sync"
+
+// Kinds of input, as passed to the hook set with SetRejectHook.
+const (
+	KindSSDP        = "ssdp"
+	KindSOAP        = "soap"
+	KindDescription = "description"
+)
+
+var hookMutex sync.RWMutex
+var rejectHook func(kind string, data []byte) // hookMutex
+
+// Sets a function which is called with each input which a parser rejects,
+// so that malformed output seen from real devices can be collected into a
+// fuzzing corpus. The data passed is a copy and may be retained. Pass nil to
+// remove the hook.
+func SetRejectHook(fn func(kind string, data []byte)) {
+	hookMutex.Lock()
+	defer hookMutex.Unlock()
+	rejectHook = fn
+}
+
+// Passes data to the reject hook, if any, and returns err.
+func reject(kind string, data []byte, err error) error {
+	hookMutex.RLock()
+	fn := rejectHook
+	hookMutex.RUnlock()
+
+	if fn != nil {
+		fn(kind, append([]byte(nil), data...))
+	}
+
+	return err
+}
+
+// Returned when input exceeds the size permitted for it.
+var ErrTooLarge = errors.New("input too large")
+
+// Reads all of r, failing with ErrTooLarge if it is longer than max bytes,
+// rather than silently truncating it.
+func ReadLimited(r io.Reader, max int) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) > max {
+		return nil, ErrTooLarge
+	}
+
+	return b, nil
+}
@@ -0,0 +1,103 @@
+package parse
+
+import "bytes"
+import "encoding/xml"
+import "io/ioutil"
+import "path/filepath"
+import "strings"
+import "testing"
+
+func TestReadLimited(t *testing.T) {
+	for _, tt := range []struct {
+		n, max int
+		err    error
+	}{
+		{0, 0, nil},
+		{10, 10, nil},
+		{11, 10, ErrTooLarge},
+		{1 << 16, 1 << 10, ErrTooLarge},
+	} {
+		b, err := ReadLimited(strings.NewReader(strings.Repeat("x", tt.n)), tt.max)
+		if err != tt.err {
+			t.Errorf("%d bytes, limit %d: got %v, expected %v", tt.n, tt.max, err, tt.err)
+		} else if err == nil && len(b) != tt.n {
+			t.Errorf("%d bytes, limit %d: read %d", tt.n, tt.max, len(b))
+		}
+	}
+}
+
+func TestRejectHook(t *testing.T) {
+	type rejection struct {
+		kind string
+		data []byte
+	}
+
+	var got []rejection
+	SetRejectHook(func(kind string, data []byte) {
+		got = append(got, rejection{kind, data})
+	})
+	defer SetRejectHook(nil)
+
+	bad := []byte("garbage")
+	SSDP(bad)
+	SOAP(bad)
+	var v struct{}
+	Description(bad, "", &v)
+	SSDP([]byte("HTTP/1.1 200 OK\r\nST: a\r\nLOCATION: http://10.0.0.1/\r\n\r\n"))
+
+	want := []string{KindSSDP, KindSOAP, KindDescription}
+	if len(got) != len(want) {
+		t.Fatalf("hook called %d times, expected %d", len(got), len(want))
+	}
+
+	for i, r := range got {
+		if r.kind != want[i] || !bytes.Equal(r.data, bad) {
+			t.Errorf("rejection %d: got kind %q, data %q", i, r.kind, r.data)
+		}
+	}
+
+	// The data passed is a copy.
+	bad[0] = 'G'
+	if got[0].data[0] != 'g' {
+		t.Error("hook was passed the parser's input rather than a copy")
+	}
+}
+
+// Runs the seed corpus for go-fuzz (see fuzz.go) through the parsers, each
+// of which it is expected to pass.
+func TestCorpus(t *testing.T) {
+	parsers := map[string]func([]byte) error{
+		"ssdp": func(b []byte) error {
+			_, err := SSDP(b)
+			return err
+		},
+		"soap": func(b []byte) error {
+			_, err := SOAP(b)
+			return err
+		},
+		"description": func(b []byte) error {
+			var v struct {
+				XMLName xml.Name `xml:"root"`
+			}
+			return Description(b, "urn:schemas-upnp-org:device-1-0", &v)
+		},
+	}
+
+	for dir, parse := range parsers {
+		fns, err := filepath.Glob(filepath.Join("testdata", "corpus", dir, "*"))
+		if err != nil || len(fns) == 0 {
+			t.Fatalf("no corpus for %s", dir)
+		}
+
+		for _, fn := range fns {
+			b, err := ioutil.ReadFile(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := parse(b); err != nil {
+				t.Errorf("%s rejected: %v", fn, err)
+			}
+		}
+	}
+}
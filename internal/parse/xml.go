@@ -0,0 +1,122 @@
+package parse
+
+import "bytes"
+import "encoding/xml"
+import "errors"
+import "io"
+
+// Maximum size of a SOAP response or device description which will be
+// parsed.
+const MaxDocumentSize = 1 << 20
+
+// Maximum element nesting depth accepted. Legitimate documents nest a few
+// levels deep; older versions of encoding/xml recurse once per level and can
+// exhaust the stack on deeply nested input.
+const maxDepth = 64
+
+var errTooDeep = errors.New("XML nested too deeply")
+
+// Decodes a device description into v, as for xml.Unmarshal. If
+// defaultSpace is not empty, it is the namespace of elements which don't
+// specify one.
+func Description(b []byte, defaultSpace string, v interface{}) error {
+	err := decodeXML(b, defaultSpace, v)
+	if err != nil {
+		return reject(KindDescription, b, err)
+	}
+
+	return nil
+}
+
+func decodeXML(b []byte, defaultSpace string, v interface{}) error {
+	err := checkXML(b)
+	if err != nil {
+		return err
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(b))
+	d.DefaultSpace = defaultSpace
+	return d.Decode(v)
+}
+
+// Ensures that b is no larger than MaxDocumentSize and its elements are
+// nested no deeper than maxDepth.
+func checkXML(b []byte) error {
+	if len(b) > MaxDocumentSize {
+		return ErrTooLarge
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(b))
+	depth := 0
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch t.(type) {
+		case xml.StartElement:
+			depth++
+			if depth > maxDepth {
+				return errTooDeep
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
+
+type xSoapEnvelope struct {
+	XMLName xml.Name `xml:"Envelope"`
+	Body    struct {
+		Data  []byte `xml:",innerxml"`
+		Fault struct {
+			Detail struct {
+				UPnPError struct {
+					ErrorCode        int    `xml:"errorCode"`
+					ErrorDescription string `xml:"errorDescription"`
+				} `xml:"UPnPError"`
+			} `xml:"detail"`
+		} `xml:"Fault"`
+	} `xml:"Body"`
+}
+
+// A SOAP response.
+type SOAPResponse struct {
+	// The XML contained in the Body element.
+	Body []byte
+
+	// The UPnP error given in a SOAP fault. FaultCode is zero if there is
+	// none.
+	FaultCode        int
+	FaultDescription string
+}
+
+// Parses a SOAP response envelope.
+func SOAP(b []byte) (*SOAPResponse, error) {
+	var env xSoapEnvelope
+	err := decodeXML(b, "", &env)
+	if err != nil {
+		return nil, reject(KindSOAP, b, err)
+	}
+
+	ue := env.Body.Fault.Detail.UPnPError
+	return &SOAPResponse{
+		Body:             env.Body.Data,
+		FaultCode:        ue.ErrorCode,
+		FaultDescription: ue.ErrorDescription,
+	}, nil
+}
+
+// Decodes the body of a SOAP response into v, as for xml.Unmarshal.
+func SOAPBody(b []byte, v interface{}) error {
+	err := decodeXML(b, "", v)
+	if err != nil {
+		return reject(KindSOAP, b, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package parse
+
+import "encoding/xml"
+import "strings"
+import "testing"
+
+const testEnvelope = `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>%s</s:Body></s:Envelope>`
+
+func envelope(body string) []byte {
+	return []byte(strings.Replace(testEnvelope, "%s", body, 1))
+}
+
+func nested(depth int) string {
+	return strings.Repeat("<a>", depth) + strings.Repeat("</a>", depth)
+}
+
+func TestSOAP(t *testing.T) {
+	res, err := SOAP(envelope(`<u:R xmlns:u="urn:x"><NewExternalIPAddress>203.0.113.7</NewExternalIPAddress></u:R>`))
+	if err != nil {
+		t.Fatalf("rejected: %v", err)
+	}
+
+	var v struct {
+		IP string `xml:"NewExternalIPAddress"`
+	}
+	err = SOAPBody(res.Body, &v)
+	if err != nil || v.IP != "203.0.113.7" || res.FaultCode != 0 {
+		t.Errorf("got %q, fault %d, error %v", v.IP, res.FaultCode, err)
+	}
+
+	res, err = SOAP(envelope(`<s:Fault><detail><UPnPError><errorCode>718</errorCode><errorDescription>ConflictInMappingEntry</errorDescription></UPnPError></detail></s:Fault>`))
+	if err != nil || res.FaultCode != 718 || res.FaultDescription != "ConflictInMappingEntry" {
+		t.Errorf("fault: got %+v, error %v", res, err)
+	}
+}
+
+func TestXMLMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		err  error
+	}{
+		{name: "empty", in: nil},
+		{name: "truncated", in: envelope(`<u:R>`)[:60]},
+		{name: "mismatched tags", in: envelope(`<a></b>`)},
+		{name: "not XML", in: []byte("HTTP/1.1 200 OK\r\n\r\n")},
+		{name: "too deep", in: envelope(nested(maxDepth)), err: errTooDeep},
+		{name: "too large", in: envelope(strings.Repeat("x", MaxDocumentSize)), err: ErrTooLarge},
+	}
+
+	for _, tt := range tests {
+		_, err := SOAP(tt.in)
+		if err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		} else if tt.err != nil && err != tt.err {
+			t.Errorf("%s: got %v, expected %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestXMLLimits(t *testing.T) {
+	// The envelope and body account for two levels.
+	if _, err := SOAP(envelope(nested(maxDepth - 2))); err != nil {
+		t.Errorf("nesting at the limit rejected: %v", err)
+	}
+
+	var v struct {
+		XMLName xml.Name `xml:"root"`
+	}
+
+	pad := "<root><x>" + strings.Repeat("x", MaxDocumentSize-len("<root><x></x></root>")) + "</x></root>"
+	if err := Description([]byte(pad), "", &v); err != nil {
+		t.Errorf("description of exactly MaxDocumentSize bytes rejected: %v", err)
+	}
+	if err := Description([]byte(pad+" "), "", &v); err != ErrTooLarge {
+		t.Errorf("description over MaxDocumentSize: got %v, expected ErrTooLarge", err)
+	}
+}
+
+func TestDescriptionDefaultSpace(t *testing.T) {
+	const ns = "urn:schemas-upnp-org:device-1-0"
+	var v struct {
+		XMLName    xml.Name `xml:"urn:schemas-upnp-org:device-1-0 root"`
+		DeviceType string   `xml:"device>deviceType"`
+	}
+
+	err := Description([]byte(`<root><device><deviceType>d</deviceType></device></root>`), ns, &v)
+	if err != nil || v.DeviceType != "d" {
+		t.Errorf("got %q, error %v", v.DeviceType, err)
+	}
+}
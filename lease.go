@@ -0,0 +1,369 @@
+package portmap
+
+import "reflect"
+import "sync"
+import "time"
+import denet "github.com/hlandau/degoutils/net"
+
+// Grants leases which must be renewed periodically, such as relay
+// reservations or TURN allocations. A Lessor can be passed to NewLease to have
+// the lease acquired, renewed and released using the same renewal, backoff
+// and notification machinery used for port mappings.
+type Lessor interface {
+	// Acquires a lease, or renews it if prev is not nil. prev is the result of
+	// the last successful call, and is only passed while that lease is still
+	// current.
+	Acquire(prev *LeaseInfo) (LeaseInfo, error)
+
+	// Releases the lease. info is the result of the last successful call to
+	// Acquire.
+	Release(info LeaseInfo) error
+}
+
+// Describes a lease granted by a Lessor.
+type LeaseInfo struct {
+	// The time at which the lease expires unless it is renewed. The lease is
+	// renewed halfway through the time remaining. A lease which has already
+	// expired, or which expires within 10 seconds, is treated as a failure to
+	// acquire it, and acquisition is retried according to the backoff.
+	Expires time.Time
+
+	// A description of what was leased, such as a relayed address. Its
+	// meaning is defined by the Lessor.
+	Value interface{}
+}
+
+// A lease maintained in the background. See NewLease.
+type Lease interface {
+	// Returns a channel. One value will be sent on the channel whenever the
+	// lease becomes current, lapses, or its Value changes, unless the value
+	// previously sent on the channel has yet to be consumed.
+	NotifyChan() <-chan struct{}
+
+	// Returns a channel on which events relating to the lease are sent, as for
+	// Mapping.Events.
+	Events() <-chan Event
+
+	// Returns the current lease. ok is false if there is no current lease.
+	Info() (info LeaseInfo, ok bool)
+
+	// As for Mapping.SignalConnectivityChange.
+	SignalConnectivityChange()
+
+	// Releases the lease and stops renewing it. Doesn't block.
+	Release()
+}
+
+// Creates a lease using the given lessor. The lease is acquired and then
+// maintained in the background; the Lease interface is returned immediately.
+// The backoff determines the delays between failed attempts; see
+// Config.Backoff.
+func NewLease(l Lessor, backoff denet.Backoff) Lease {
+	ls := &lease{
+		lessor:     l,
+		backoff:    backoff,
+		abortChan:  make(chan struct{}),
+		notifyChan: make(chan struct{}, 1),
+		eventChan:  make(chan Event, eventBufferSize),
+		signalChan: make(chan struct{}, 1),
+	}
+
+	r := leaseRunner{
+		backoff:    &ls.backoff,
+		abortChan:  ls.abortChan,
+		signalChan: ls.signalChan,
+		acquire:    ls.acquire,
+		release:    ls.release,
+		lapse:      ls.lapse,
+		notify:     func() {},
+		emit:       ls.emit,
+	}
+
+	go r.run()
+	return ls
+}
+
+type lease struct {
+	lessor  Lessor
+	backoff denet.Backoff
+
+	abortChan  chan struct{}
+	notifyChan chan struct{}
+	eventChan  chan Event
+	signalChan chan struct{}
+
+	mutex      sync.Mutex
+	info       LeaseInfo // m
+	current    bool      // m
+	lastSignal time.Time // m
+	released   bool      // m
+}
+
+func (ls *lease) NotifyChan() <-chan struct{} {
+	return ls.notifyChan
+}
+
+func (ls *lease) Events() <-chan Event {
+	return ls.eventChan
+}
+
+func (ls *lease) Info() (LeaseInfo, bool) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	if !ls.isCurrent() {
+		return LeaseInfo{}, false
+	}
+
+	return ls.info, true
+}
+
+func (ls *lease) isCurrent() bool {
+	return ls.current && ls.info.Expires.After(time.Now().Round(0))
+}
+
+func (ls *lease) SignalConnectivityChange() {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	if time.Since(ls.lastSignal) < SignalMinInterval {
+		return
+	}
+
+	ls.lastSignal = time.Now()
+	select {
+	case ls.signalChan <- struct{}{}:
+	default:
+	}
+}
+
+func (ls *lease) Release() {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	if !ls.released {
+		close(ls.abortChan)
+		ls.released = true
+	}
+}
+
+func (ls *lease) acquire() (time.Duration, bool) {
+	ls.mutex.Lock()
+	var prev *LeaseInfo
+	if ls.isCurrent() {
+		p := ls.info
+		prev = &p
+	}
+	ls.mutex.Unlock()
+
+	info, err := ls.lessor.Acquire(prev)
+	if err != nil {
+		log.Infof("lease acquisition failed: %v", err)
+		return 0, false
+	}
+
+	// Renewing halfway through a lease about to expire would retry in a
+	// tight loop.
+	remaining := time.Until(info.Expires)
+	if remaining < minUsableLifetime {
+		log.Infof("lessor granted an unusable lease expiring in %v", remaining)
+		return 0, false
+	}
+
+	ls.mutex.Lock()
+	changed := prev == nil || !reflect.DeepEqual(prev.Value, info.Value)
+	ls.info = info
+	ls.current = true
+	ls.mutex.Unlock()
+
+	if changed {
+		ls.notify()
+	}
+
+	return remaining / 2, true
+}
+
+func (ls *lease) release() {
+	ls.mutex.Lock()
+	info, current := ls.info, ls.isCurrent()
+	ls.mutex.Unlock()
+
+	if !current {
+		return
+	}
+
+	err := ls.lessor.Release(info)
+	if err != nil {
+		log.Infof("lease release failed: %v", err)
+	}
+}
+
+func (ls *lease) lapse() {
+	ls.mutex.Lock()
+	wasCurrent := ls.current
+	ls.current = false
+	ls.mutex.Unlock()
+
+	if wasCurrent {
+		ls.notify()
+	}
+}
+
+func (ls *lease) notify() {
+	select {
+	case ls.notifyChan <- struct{}{}:
+	default:
+	}
+}
+
+func (ls *lease) emit(ev Event) {
+	select {
+	case ls.eventChan <- ev:
+	default:
+	}
+}
+
+// The renewal, backoff and notification machinery shared by mappings and
+// leases. acquire is called to acquire or renew the lease, and returns the
+// delay until it should next be called. If it fails, it is retried according
+// to the backoff. If the backoff is exhausted, lapse is called and run
+// returns. When abortChan is closed, release and then lapse are called and
+// run returns.
+type leaseRunner struct {
+	sim        *Simulation // nil unless simulated
+	backoff    *denet.Backoff
+	abortChan  <-chan struct{}
+	signalChan <-chan struct{}
+
+	acquire func() (time.Duration, bool)
+	release func()
+	lapse   func()
+	notify  func()
+	emit    func(Event)
+
+	// Returns the time remaining until the lease lapses unless renewed, or
+	// zero if it is not held. notify is called when it lapses during a wait,
+	// so that the lapse is reported without waiting for the next attempt.
+	// May be nil.
+	remaining func() time.Duration
+}
+
+func (r *leaseRunner) run() {
+	for {
+		d, ok := r.acquire()
+
+		// Backoff
+		if ok {
+			r.backoff.Reset()
+		} else {
+			// failed, do retry delay
+			d = r.backoff.NextDelay()
+			if d == 0 {
+				// max tries occurred
+				r.lapse()
+				return
+			}
+		}
+
+		r.notify()
+
+		// wait until we need to renew
+		if !r.wait(d) {
+			r.release()
+			r.lapse()
+			return
+		}
+	}
+}
+
+// Interval at which the clocks are compared while waiting, and the
+// discrepancy between them which is taken to mean that the system was
+// suspended or the wall clock was stepped.
+const (
+	clockCheckInterval = 30 * time.Second
+	clockJumpThreshold = 10 * time.Second
+)
+
+// Waits for d. Returns false if aborted first. The wait ends early if a
+// connectivity change is signalled. If the lease lapses during the wait,
+// notify is called.
+//
+// Timers use the monotonic clock, which on most systems does not advance
+// while the system is suspended, so a lease can expire while the system is
+// asleep long before the timer fires. The wall clock is therefore compared
+// with the monotonic clock periodically, and if they disagree, the wait ends
+// early so that the lease is verified and reacquired immediately.
+func (r *leaseRunner) wait(d time.Duration) bool {
+	var lapse time.Duration
+	if r.remaining != nil {
+		lapse = r.remaining()
+	}
+
+	if r.sim != nil {
+		if lapse > 0 && lapse < d {
+			switch r.sim.sleep(lapse, r.abortChan, r.signalChan) {
+			case simAborted:
+				return false
+			case simSignalled:
+				log.Debugf("connectivity change signalled, revalidating")
+				r.backoff.Reset()
+				return true
+			}
+
+			r.notify()
+			d -= lapse
+		}
+
+		switch r.sim.sleep(d, r.abortChan, r.signalChan) {
+		case simAborted:
+			return false
+		case simSignalled:
+			log.Debugf("connectivity change signalled, revalidating")
+			r.backoff.Reset()
+		}
+		return true
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	var lapseChan <-chan time.Time
+	if lapse > 0 && lapse < d {
+		lapseTimer := time.NewTimer(lapse)
+		defer lapseTimer.Stop()
+		lapseChan = lapseTimer.C
+	}
+
+	ticker := time.NewTicker(clockCheckInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-r.abortChan:
+			return false
+
+		case <-timer.C:
+			return true
+
+		case <-lapseChan:
+			lapseChan = nil
+			r.notify()
+
+		case <-r.signalChan:
+			log.Debugf("connectivity change signalled, revalidating")
+			r.backoff.Reset()
+			return true
+
+		case <-ticker.C:
+			now := time.Now()
+			gap := now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+			last = now
+			if gap > clockJumpThreshold || gap < -clockJumpThreshold {
+				log.Infof("clock jumped by %v, probably due to suspend, reacquiring", gap)
+				r.emit(Resumed{Gap: gap})
+				return true
+			}
+		}
+	}
+}
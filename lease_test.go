@@ -0,0 +1,51 @@
+package portmap
+
+import "testing"
+import "time"
+import denet "github.com/hlandau/degoutils/net"
+
+type expiredLessor struct {
+	callChan chan time.Time
+}
+
+func (l *expiredLessor) Acquire(prev *LeaseInfo) (LeaseInfo, error) {
+	select {
+	case l.callChan <- time.Now():
+	default:
+	}
+
+	return LeaseInfo{Expires: time.Now().Add(-time.Minute)}, nil
+}
+
+func (l *expiredLessor) Release(info LeaseInfo) error {
+	return nil
+}
+
+// A lessor granting leases which have already expired should be retried
+// according to the backoff rather than in a tight loop. The interval between
+// the first two attempts is measured, so that the result doesn't depend on
+// how promptly the test itself is scheduled.
+func TestLeaseAlreadyExpired(t *testing.T) {
+	l := &expiredLessor{callChan: make(chan time.Time, 2)}
+	ls := NewLease(l, denet.Backoff{InitialDelay: time.Second})
+	defer ls.Release()
+
+	var calls []time.Time
+	timeout := time.After(30 * time.Second)
+	for len(calls) < 2 {
+		select {
+		case at := <-l.callChan:
+			calls = append(calls, at)
+		case <-timeout:
+			t.Fatalf("lessor called %d times in 30 seconds, expected a retry", len(calls))
+		}
+	}
+
+	if gap := calls[1].Sub(calls[0]); gap < 500*time.Millisecond {
+		t.Errorf("lessor retried after %v, expected to back off for about a second", gap)
+	}
+
+	if _, ok := ls.Info(); ok {
+		t.Error("expired lease reported as current")
+	}
+}
@@ -0,0 +1,51 @@
+package portmap
+
+import "sync"
+
+// The default for SetMaxConcurrentOperations.
+const DefaultMaxConcurrentOperations = 8
+
+var opMutex sync.Mutex
+var opCond = sync.NewCond(&opMutex)
+var opLimit = DefaultMaxConcurrentOperations // opMutex
+var opActive int                             // opMutex
+
+// Sets the maximum number of operations with gateways which this process
+// performs at once across all mappings. An operation is a single attempt to
+// create, renew or remove a mapping on one gateway by NAT-PMP, UPnP or a
+// Backend, or a probe made while choosing a gateway. Further operations
+// wait for one to finish, so that an application which creates many
+// mappings at once does not flood the local network or overwhelm a fragile
+// router.
+//
+// If n is zero or negative, there is no limit. The default is
+// DefaultMaxConcurrentOperations.
+func SetMaxConcurrentOperations(n int) {
+	opMutex.Lock()
+	defer opMutex.Unlock()
+
+	opLimit = n
+	opCond.Broadcast()
+}
+
+// Waits until an operation may be started. endOp must be called once it has
+// finished. Operations must not be nested, since a nested operation could
+// wait forever for a slot held by its caller.
+func beginOp() {
+	opMutex.Lock()
+	defer opMutex.Unlock()
+
+	for opLimit > 0 && opActive >= opLimit {
+		opCond.Wait()
+	}
+
+	opActive++
+}
+
+func endOp() {
+	opMutex.Lock()
+	defer opMutex.Unlock()
+
+	opActive--
+	opCond.Signal()
+}
@@ -0,0 +1,22 @@
+package portmap
+
+import "github.com/hlandau/portmap/internal/localnet"
+
+// Returned in local-only mode when an operation would make a DNS lookup or
+// contact a host outside the local network. See SetLocalOnly.
+var ErrNotLocal = localnet.ErrNotLocal
+
+// Enables or disables local-only mode, for applications which must not
+// generate traffic beyond the local network. In this mode, no DNS lookups are
+// made, and no host is contacted unless it has a loopback, link-local or
+// private (RFC 1918 or unique local) address. This covers NAT-PMP, SSDP,
+// device descriptions, SOAP requests, router APIs and TR-064. URLs naming a
+// host rather than an address are refused, as is any gateway with a public
+// address.
+//
+// In particular, the local address is determined relative to the default
+// gateway rather than a public address, NAT64 is not detected, and
+// TestReachability and TURN fail with ErrNotLocal.
+func SetLocalOnly(on bool) {
+	localnet.SetEnabled(on)
+}
@@ -0,0 +1,63 @@
+// +build go1.21
+
+package portmap
+
+import "log/slog"
+
+// Implements slog.LogValuer. As with String, credentials and policy are never
+// included.
+func (cfg Config) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("protocol", cfg.Protocol.String()),
+		slog.Int("internalPort", int(cfg.InternalPort)),
+		slog.Int("externalPort", int(cfg.ExternalPort)),
+	}
+	if cfg.Name != "" {
+		attrs = append(attrs, slog.String("name", cfg.Name))
+	}
+	if cfg.Backend != nil {
+		attrs = append(attrs, slog.String("backend", cfg.Backend.Name()))
+	}
+
+	return slog.GroupValue(attrs...)
+}
+
+// Implements slog.LogValuer.
+func (s Status) LogValue() slog.Value {
+	attrs := []slog.Attr{slog.Bool("active", s.Active)}
+	switch {
+	case s.Active:
+		attrs = append(attrs,
+			slog.String("externalAddr", s.ExternalAddr),
+			slog.String("method", s.Method.String()))
+		if !s.ExpireTime.IsZero() {
+			attrs = append(attrs, slog.Time("expires", s.ExpireTime))
+		}
+	case s.Pending:
+		attrs = append(attrs, slog.Bool("pending", true))
+	default:
+		attrs = append(attrs,
+			slog.Time("inactiveSince", s.InactiveSince),
+			slog.String("reason", s.InactiveReason.String()))
+	}
+
+	return slog.GroupValue(attrs...)
+}
+
+func mappingLogValue(proto Protocol, internalPort uint16, s Status) slog.Value {
+	return slog.GroupValue(
+		slog.String("protocol", proto.String()),
+		slog.Int("internalPort", int(internalPort)),
+		slog.Any("status", s))
+}
+
+// Implements slog.LogValuer.
+func (m *mapping) LogValue() slog.Value {
+	s := m.Status()
+	return mappingLogValue(m.cfg.Protocol, s.InternalPort, s)
+}
+
+// Implements slog.LogValuer.
+func (bm *brokerMapping) LogValue() slog.Value {
+	return mappingLogValue(bm.protocol, bm.internalPort, bm.Status())
+}
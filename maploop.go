@@ -1,5 +1,6 @@
 package portmap
 
+import "errors"
 import "net"
 import "time"
 import "github.com/hlandau/portmap/ssdp"
@@ -9,100 +10,303 @@ import "github.com/hlandau/xlog"
 
 var log, Log = xlog.NewQuiet("portmap")
 
-type mode int
-
-const (
-	modeNATPMP mode = iota
-	modeUPnP
-)
-
 func (m *mapping) portMappingLoop(gwa []net.IP) {
-	aborting := false
-	mode := modeNATPMP
-	var ok bool
-	var d time.Duration
-	for {
-		// Already inactive (e.g. expired or was never active), so no need to do anything.
-		if aborting && !m.lIsActive() {
+	if m.lIsPending() {
+		gwa = m.waitForGateway()
+		if gwa == nil {
+			// deleted while pending
+			m.setInactive(InactiveDeleted)
 			return
 		}
+	}
+
+	var fastDone <-chan bool
+	if m.cfg.Backend == nil {
+		if m.cfg.FastStart || m.attached != nil {
+			ssdp.SearchMX(fastStartMX)
+		}
+
+		fastDone = m.fastStart(gwa)
+	}
+
+	gwa = orderGateways(gwa)
+
+	mode := MethodNATPMP
+	if m.cfg.Backend != nil {
+		mode = MethodBackend
+	} else if m.attached != nil {
+		mode = m.attached.Method
+	}
+
+	// An attached mapping is renewed via UPnP as soon as the device is
+	// rediscovered.
+	awaitUPnP := m.cfg.FastStart || m.attached != nil
+
+	r := leaseRunner{
+		sim:        m.cfg.sim,
+		backoff:    &m.backoff,
+		abortChan:  m.abortChan,
+		signalChan: m.signalChan,
+		emit:       m.emit,
+		notify:     m.notify,
+		lapse: func() {
+			m.setInactive(m.lapseReason())
+		},
+		release: func() {
+			if !m.lIsDetached() {
+				m.teardown(gwa)
+			}
+		},
+		remaining: m.remaining,
+	}
 
-		switch mode {
-		case modeNATPMP:
-			ok = m.tryNATPMP(gwa, aborting)
+	r.acquire = func() (time.Duration, bool) {
+		if fastDone != nil {
+			ok := <-fastDone
+			fastDone = nil
 			if ok {
-				d = m.cfg.Lifetime / 2
-			} else {
-				svc := ssdp.GetServicesByType(upnpWANIPConnectionURN)
+				return m.renewDelay(), true
+			}
+		}
+
+		m.applyUpdate(gwa)
+
+		for {
+			switch mode {
+			case MethodNATPMP:
+				// Both methods are tried on the primary gateway before either is
+				// tried on any other, so that the mapping is made on the
+				// router which actually carries this host's traffic where
+				// possible.
+				primary, others := gwa, []net.IP(nil)
+				if len(gwa) > 1 {
+					primary, others = gwa[:1], gwa[1:]
+				}
+
+				if m.tryNATPMP(primary, false) {
+					return m.renewDelay(), true
+				}
+
+				svc := m.upnpServices(gwa)
+				if len(svc) == 0 && awaitUPnP {
+					svc = m.awaitUPnPServices(gwa)
+				}
+				if len(others) > 0 && len(svc) > 0 && serviceGateway(&svc[0], primary) == 0 {
+					m.switchMethod(&mode, MethodUPnP, "NAT-PMP failed and UPnP is available on the primary gateway")
+					continue
+				}
+
+				if m.tryNATPMP(others, false) {
+					return m.renewDelay(), true
+				}
+
 				if len(svc) > 0 {
 					// NAT-PMP failed and UPnP is available, so switch to it
-					mode = modeUPnP
-					log.Debug("NAT-PMP failed and UPnP is available, switching to UPnP")
+					m.switchMethod(&mode, MethodUPnP, "NAT-PMP failed and UPnP is available")
 					continue
 				}
-			}
 
-		case modeUPnP:
-			svcs := ssdp.GetServicesByType(upnpWANIPConnectionURN)
-			if len(svcs) == 0 {
-				mode = modeNATPMP
-				log.Debug("UPnP not available, switching to NAT-PMP")
-				continue
+				// Neither NAT-PMP nor UPnP is available, so ask SSDP to look again
+				// rather than waiting for the next periodic broadcast.
+				ssdp.Search()
+				if len(gwa) == 0 {
+					m.setLastError(ErrNoGateway)
+				}
+
+				if m.cfg.Fallback != nil {
+					m.switchMethod(&mode, MethodBackend, "NAT-PMP and UPnP not available, using "+m.cfg.Fallback.Name())
+					continue
+				}
+
+				// Retrying is pointless if the carrier translates IPv4, so
+				// just check occasionally whether that is still the case.
+				// The backoff is reset so that attempts resume promptly if
+				// the host moves to another network.
+				if m.checkTransition() {
+					return transitionRecheckInterval, true
+				}
+
+			case MethodUPnP:
+				svcs := m.upnpServices(gwa)
+				if len(svcs) == 0 && awaitUPnP {
+					svcs = m.awaitUPnPServices(gwa)
+				}
+				if len(svcs) == 0 {
+					m.switchMethod(&mode, MethodNATPMP, "UPnP not available")
+					continue
+				}
+
+				if m.tryUPnP(svcs) {
+					return m.renewDelay(), true
+				}
+
+			case MethodBackend:
+				if m.tryBackend() {
+					return m.renewDelay(), true
+				}
+
+				if m.cfg.Backend == nil {
+					// the fallback failed, so try NAT traversal again next time
+					m.switchMethod(&mode, MethodNATPMP, m.cfg.Fallback.Name()+" failed")
+				}
 			}
 
-			ok = m.tryUPnP(svcs, aborting)
-			d = 1 * time.Hour
+			// gateways may have come up or gone down before the retry
+			gwa = orderGateways(gwa)
+			return 0, false
 		}
+	}
 
-		// If we are aborting, then the call we just made was to remove the mapping,
-		// not set it, and we're done.
-		if aborting {
-			m.setInactive()
-			return
+	// Renewals are recorded so that gateways which fail them are renewed
+	// earlier in future, and each attempt is timed.
+	acquire := r.acquire
+	r.acquire = func() (time.Duration, bool) {
+		before := m.lRenewalState()
+		start := m.beginAttempt()
+		d, ok := acquire()
+		m.endAttempt(start)
+		m.mutex.Lock()
+		m.attemptFailed = !ok
+		m.mutex.Unlock()
+		if ok {
+			m.checkHairpin()
 		}
+		m.recordRenewal(before, ok)
+		return d, ok
+	}
 
-		// Backoff
-		if ok {
-			m.cfg.Backoff.Reset()
-		} else {
-			// failed, do retry delay
-			d = m.cfg.Backoff.NextDelay()
-			if d == 0 {
-				// max tries occurred
-				m.setInactive()
-				return
-			}
+	r.run()
+}
+
+// The MX value used for the discovery beacon sent when a mapping using
+// Config.FastStart is created.
+const fastStartMX = 1
+
+// How long a mapping using Config.FastStart waits for a UPnP device to be
+// discovered after NAT-PMP fails.
+const fastStartUPnPWait = fastStartMX*time.Second + 500*time.Millisecond
+
+// Waits up to fastStartUPnPWait for a usable UPnP service to be discovered.
+// Returns nil if none is found or the mapping is deleted first.
+func (m *mapping) awaitUPnPServices(gwa []net.IP) []ssdp.Service {
+	defer m.recordTiming(stepSSDPWait, m.now())
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	deadline := time.Now().Add(fastStartUPnPWait)
+	for time.Now().Before(deadline) {
+		select {
+		case <-m.abortChan:
+			return nil
+		case <-ticker.C:
 		}
 
-		m.notify()
+		if svcs := m.upnpServices(gwa); len(svcs) > 0 {
+			return svcs
+		}
+	}
+
+	return nil
+}
+
+// Interval at which a pending mapping checks for a default gateway.
+const gatewayPollInterval = 5 * time.Second
+
+func (m *mapping) lIsPending() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.pending
+}
+
+// Waits until a default gateway appears and returns the gateways. Returns nil
+// if the mapping is deleted first.
+func (m *mapping) waitForGateway() []net.IP {
+	log.Debugf("no default gateway, waiting for one to appear")
+
+	ticker := time.NewTicker(gatewayPollInterval)
+	defer ticker.Stop()
 
+	for {
 		select {
 		case <-m.abortChan:
-			aborting = true
+			return nil
+		case <-ticker.C:
+		}
 
-		case <-time.After(d):
-			// wait until we need to renew
+		gwa, _ := ipv4Gateways()
+		gwa = append(gwa, resolveGatewayHints(&m.cfg)...)
+		if len(gwa) > 0 {
+			m.mutex.Lock()
+			m.pending = false
+			m.gatewayWait = m.now().Sub(m.created)
+			m.mutex.Unlock()
+			return gwa
 		}
 	}
 }
 
+func (m *mapping) switchMethod(mode *Method, to Method, reason string) {
+	log.Debugf("%s, switching to %v", reason, to)
+	m.emit(BackendSwitched{From: *mode, To: to, Reason: reason})
+	*mode = to
+}
+
+// The state which is compared to determine whether to notify. Whether the
+// mapping is active is tracked separately from its address, so that a mapping
+// whose port is not yet known does not appear to flap.
+type notifyState struct {
+	active bool
+	addr   string
+}
+
 func (m *mapping) notify() {
-	ea := m.ExternalAddr()
+	if m.parent != nil {
+		m.parent.syncChildren()
+		return
+	}
 
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	if m.prevValue == ea {
+	m.updateVersion()
+}
+
+// Returns the time until the mapping lapses unless renewed, or zero if it is
+// not active.
+func (m *mapping) remaining() time.Duration {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.isActive() {
+		return 0
+	}
+
+	return m.expireTime.Sub(m.now().Round(0))
+}
+
+// Increments the state version and notifies if the state has changed since
+// the version was last incremented. Must be called with the mutex held.
+func (m *mapping) updateVersion() {
+	ns := notifyState{active: m.isActive(), addr: m.externalAddrStr()}
+	if m.notified == ns {
 		// no change
 		return
 	}
 
-	m.prevValue = ea
+	if m.notified.active && !ns.active {
+		m.emit(Inactive{Reason: m.inactiveReason(), Err: m.lastErr})
+	}
 
-	select {
-	case m.notifyChan <- struct{}{}:
-	default:
+	m.notified = ns
+	m.version++
+	if ns.active && m.timeToActive == 0 {
+		m.timeToActive = m.now().Sub(m.created)
+		log.Debugf("mapping active after %v", m.timeToActive)
 	}
+
+	m.signalNotify()
+	m.watchers.signal()
 }
 
 // NAT-PMP
@@ -117,42 +321,106 @@ func (m *mapping) tryNATPMP(gwa []net.IP, destroy bool) bool {
 }
 
 func (m *mapping) tryNATPMPGW(gw net.IP, destroy bool) bool {
+	beginOp()
+	defer endOp()
+
 	var externalPort uint16
 	var actualLifetime time.Duration
 	var err error
 
 	var preferredLifetime time.Duration
+	standby := m.lIsStandby()
 	if destroy && !m.lIsActive() {
 		// no point destroying if we're not active
 		return true
 	} else if !destroy {
 		// lifetime is zero if we're destroying
-		preferredLifetime = m.cfg.Lifetime
+		preferredLifetime = m.requestLifetime(MethodNATPMP, standby)
+	}
+
+	if !destroy {
+		if m.lIsDisabled() {
+			// the mapping would forward traffic, so UPnP must be used
+			log.Debugf("not using NAT-PMP while the mapping is disabled")
+			return false
+		}
+
+		if m.state.externalPort != 0 && coordOwnedByOther(gw.String(), m.cfg.Protocol, m.state.externalPort) {
+			// let the gateway choose
+			m.mutex.Lock()
+			m.state.externalPort = 0
+			m.mutex.Unlock()
+		}
+
+		err = m.checkPolicy(Operation{
+			Method:       MethodNATPMP,
+			Gateway:      gw.String(),
+			Protocol:     m.cfg.Protocol,
+			InternalPort: m.state.internalPort,
+			ExternalPort: m.state.externalPort,
+			Lifetime:     preferredLifetime,
+			Renewal:      m.lIsActive(),
+		})
+		if err != nil {
+			log.Infof("NAT-PMP mapping denied by policy: %v", err)
+			m.setLastError(err)
+			return false
+		}
+	}
+
+	// With FastStart, the first mapping is attempted with a short
+	// retransmission schedule; renewals use the usual one.
+	mapFunc, getExternalAddr := natpmp.Map, natpmp.GetExternalAddr
+	if m.cfg.FastStart && !destroy && !m.lIsActive() {
+		mapFunc, getExternalAddr = natpmp.MapFast, natpmp.GetExternalAddrFast
 	}
 
 	// attempt mapping
-	externalPort, actualLifetime, err = natpmp.Map(gw,
-		natpmp.Protocol(m.cfg.Protocol), m.cfg.InternalPort, m.cfg.ExternalPort, preferredLifetime)
+	start := m.now()
+	externalPort, actualLifetime, err = mapFunc(gw,
+		natpmp.Protocol(m.cfg.Protocol), m.state.internalPort, m.state.externalPort, preferredLifetime)
+	m.recordTiming(stepNATPMP, start)
+	audit(auditRecord{
+		Operation:      auditNATPMPMap,
+		Gateway:        gw.String(),
+		Protocol:       m.cfg.Protocol.String(),
+		InternalPort:   m.state.internalPort,
+		ExternalPort:   m.state.externalPort,
+		Lifetime:       int64(preferredLifetime / time.Second),
+		ResultPort:     externalPort,
+		ResultLifetime: int64(actualLifetime / time.Second),
+	}, err)
 	if err != nil {
 		log.Infof("NAT-PMP failed: %v", err)
+		if !destroy {
+			m.setLastError(err)
+		}
+		return false
+	}
+
+	if preferredLifetime != 0 && actualLifetime < minUsableLifetime {
+		log.Infof("NAT-PMP gateway granted an unusable lifetime of %v", actualLifetime)
+		m.setLastError(lifetimeTooShort(actualLifetime))
 		return false
 	}
 
-	m.mutex.Lock()
-	m.cfg.ExternalPort = externalPort
-	m.cfg.Lifetime = actualLifetime
-	m.mutex.Unlock()
 	if preferredLifetime == 0 {
 		// we have finished tearing down the mapping by mapping it with a
 		// lifetime of zero, so return
+		coordRelease(gw.String(), m.cfg.Protocol, m.state.internalPort)
 		return true
 	}
 
-	expireTime := time.Now().Add(actualLifetime)
+	expireTime := m.now().Add(actualLifetime)
+	coordClaim(gw.String(), m.cfg.Protocol, m.state.internalPort, externalPort, expireTime)
 
 	// Now attempt to get the external IP.
-	extIP, err := natpmp.GetExternalAddr(gw)
+	start = m.now()
+	extIP, err := getExternalAddr(gw)
+	m.recordTiming(stepNATPMP, start)
 
+	// The port, lifetime and address are updated together so that observers
+	// never see a new port with a stale expiry time or address.
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
@@ -161,54 +429,178 @@ func (m *mapping) tryNATPMPGW(gw net.IP, destroy bool) bool {
 		m.externalAddr = extIP.String()
 	}
 
+	m.setGrantedPort(MethodNATPMP, externalPort)
+	if standby {
+		// the short lifetime was asked for, so isn't reported as capped
+		m.state.lifetime = actualLifetime
+	} else {
+		m.setGrantedLifetime(MethodNATPMP, actualLifetime)
+	}
+	m.standbyMapped = standby
+	m.dmz = false
 	m.expireTime = expireTime
+	stateCacheStore(m.cfg.Protocol, m.state.internalPort, externalPort, MethodNATPMP, gw.String())
+
+	m.method = MethodNATPMP
+	m.gateway = gw
+	m.scopeEnforced = m.cfg.Scope.natpmpEnforced()
+	m.upnpService = nil
+	m.lastErr = nil
 	return true
 }
 
 // UPnP
 
-func (m *mapping) tryUPnP(svcs []ssdp.Service, destroy bool) bool {
-	for _, svc := range svcs {
-		if m.tryUPnPSvc(svc, destroy) {
+func (m *mapping) tryUPnP(svcs []ssdp.Service) bool {
+	for _, svc := range m.orderUPnPServices(svcs) {
+		if m.tryUPnPSvc(svc) {
+			m.pinUPnPService(svc)
 			return true
 		}
 	}
 	return false
 }
 
-const upnpWANIPConnectionURN = "urn:schemas-upnp-org:service:WANIPConnection:1"
+// Moves the pinned service, if any, to the front of the list so that
+// renewals keep using the same IGD. If the pinned service is no longer
+// advertised, it is unpinned.
+func (m *mapping) orderUPnPServices(svcs []ssdp.Service) []ssdp.Service {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
-func (m *mapping) tryUPnPSvc(svc ssdp.Service, destroy bool) bool {
-	if destroy {
-		// unmapping
-		if !m.lIsActive() {
-			return true
+	if m.upnpService == nil {
+		return svcs
+	}
+
+	for i := range svcs {
+		if svcs[i].USN == m.upnpService.USN {
+			ordered := make([]ssdp.Service, 0, len(svcs))
+			ordered = append(ordered, svcs[i])
+			ordered = append(ordered, svcs[:i]...)
+			return append(ordered, svcs[i+1:]...)
 		}
+	}
+
+	log.Debugf("pinned UPnP service %q has disappeared", m.upnpService.USN)
+	m.upnpService = nil
+	return svcs
+}
+
+func (m *mapping) pinUPnPService(svc ssdp.Service) {
+	loc := svc.PreferredLocation().String()
+	quirks := upnp.EffectiveQuirks(loc).Names()
+
+	m.mutex.Lock()
+	us := m.upnpService
+	m.mutex.Unlock()
+
+	if us == nil || us.USN != svc.USN {
+		us = &UPnPService{Service: svc}
+		if desc, err := ssdp.DescribeURL(loc); err == nil {
+			us.DeviceName = desc.Device.FriendlyName
+			us.Icons = desc.Device.Icons
+			us.PresentationURL = desc.Device.PresentationURL
+		}
+	} else {
+		nus := *us
+		us = &nus
+	}
+
+	us.Quirks = quirks
+
+	m.mutex.Lock()
+	m.upnpService = us
+	m.mutex.Unlock()
+}
+
+func (m *mapping) tryUPnPSvc(svc ssdp.Service) bool {
+	beginOp()
+	defer endOp()
+
+	if svc.LocationMismatch {
+		log.Infof("UPnP service %q advertised by %v has location %v on another host, using responder address",
+			svc.USN, svc.Responder, svc.Location)
+	}
+
+	loc := svc.PreferredLocation().String()
+	cgw := coordGateway(loc)
+	upnp.SetServerHeader(loc, svc.Server)
+	remoteHost, scopeEnforced := m.cfg.Scope.upnpRemoteHost()
+
+	// The description is retrieved first, so that the time taken to do so
+	// is distinguished from that of the requests which follow. It is cached,
+	// so the requests don't retrieve it again.
+	start := m.now()
+	ssdp.DescribeURL(loc)
+	m.recordTiming(stepDescription, start)
+	defer m.recordTiming(stepSOAP, m.now())
+
+	if m.state.externalPort == 0 || coordOwnedByOther(cgw, m.cfg.Protocol, m.state.externalPort) {
+		port := coordPickPort(cgw, m.cfg.Protocol, m.state.internalPort, m.ports)
+		m.mutex.Lock()
+		m.state.externalPort = port
+		m.mutex.Unlock()
+	}
+
+	err := m.checkPolicy(Operation{
+		Method:       MethodUPnP,
+		Gateway:      loc,
+		Protocol:     m.cfg.Protocol,
+		InternalPort: m.state.internalPort,
+		ExternalPort: m.state.externalPort,
+		Lifetime:     m.cfg.Lifetime,
+		Renewal:      m.lIsActive(),
+	})
+	if err != nil {
+		log.Infof("UPnP mapping denied by policy: %v", err)
+		m.setLastError(err)
+		return false
+	}
 
-		err := upnp.Unmap(svc.Location.String(), upnp.Protocol(m.cfg.Protocol), m.cfg.ExternalPort)
-		return err == nil
+	// Renewals reissue AddPortMapping with the same parameters, which refreshes
+	// the existing mapping in place without removing it first.
+	lifetime := m.cfg.Lifetime
+	standby := m.lIsStandby()
+	actualExternalPort, err := m.upnpAdd(loc, remoteHost)
+	conflict := upnp.IsErrorCode(err, upnp.ErrCodeConflictInMappingEntry)
+	if conflict && m.state.externalPort != 0 {
+		actualExternalPort, lifetime, err = m.resolveUPnPConflict(loc, remoteHost)
 	}
 
-	// mapping
-	actualExternalPort, err := upnp.Map(svc.Location.String(), upnp.Protocol(m.cfg.Protocol),
-		m.cfg.InternalPort,
-		m.cfg.ExternalPort, m.cfg.Name, m.cfg.Lifetime)
+	// Some gateways refuse to map ports to their DMZ host, which already
+	// receives traffic on every port, so the mapping is unnecessary.
+	dmz := false
+	if err != nil && conflict && m.isDMZHost(loc) {
+		log.Infof("this host is the DMZ host of UPnP device %v, so all ports are forwarded to it already; not mapping explicitly", loc)
+		actualExternalPort, lifetime, err = m.state.internalPort, m.cfg.Lifetime, nil
+		dmz = true
+	}
 
 	if err != nil {
+		m.setLastError(err)
 		return false
 	}
 
+	expireTime := m.now().Add(lifetime)
+	if !dmz {
+		coordClaim(cgw, m.cfg.Protocol, m.state.internalPort, actualExternalPort, expireTime)
+		stateCacheStore(m.cfg.Protocol, m.state.internalPort, actualExternalPort, MethodUPnP, loc)
+	}
+
 	m.mutex.Lock()
-	m.expireTime = time.Now().Add(m.cfg.Lifetime)
-	m.cfg.ExternalPort = actualExternalPort
+	m.expireTime = expireTime
+	m.state.lifetime = lifetime
+	m.method = MethodUPnP
+	m.gateway = svc.Responder
+	m.scopeEnforced = scopeEnforced
+	m.setGrantedPort(MethodUPnP, actualExternalPort)
+	m.standbyMapped = standby
+	m.dmz = dmz
+	m.lastErr = nil
 	m.mutex.Unlock()
 
 	// Now attempt to get the external IP.
-	if destroy {
-		return true
-	}
-
-	extIP, err := upnp.GetExternalAddr(svc.Location.String())
+	extIP, err := upnp.GetExternalAddr(loc)
 	if err != nil {
 		// mapping till succeeded
 		return true
@@ -222,12 +614,256 @@ func (m *mapping) tryUPnPSvc(svc ssdp.Service, destroy bool) bool {
 	return true
 }
 
+// Adds the mapping, disabled if Mapping.Disable has been called or it is a
+// standby mapping.
+func (m *mapping) upnpAdd(loc string, remoteHost net.IP) (uint16, error) {
+	mapFunc := upnp.MapRemoteHost
+	if m.lAddDisabled() {
+		mapFunc = upnp.MapDisabled
+	}
+
+	actualExternalPort, err := mapFunc(loc, upnp.Protocol(m.cfg.Protocol),
+		remoteHost, m.state.internalPort,
+		m.state.externalPort, m.cfg.Name, m.cfg.Lifetime)
+	audit(auditRecord{
+		Operation:    auditUPnPAdd,
+		Gateway:      loc,
+		Protocol:     m.cfg.Protocol.String(),
+		InternalPort: m.state.internalPort,
+		ExternalPort: m.state.externalPort,
+		Lifetime:     int64(m.cfg.Lifetime / time.Second),
+		Name:         m.cfg.Name,
+		ResultPort:   actualExternalPort,
+	}, err)
+	return actualExternalPort, err
+}
+
+func (m *mapping) upnpDelete(loc string, remoteHost net.IP, port uint16) error {
+	err := upnp.UnmapRemoteHost(loc, upnp.Protocol(m.cfg.Protocol), remoteHost, port)
+	audit(auditRecord{
+		Operation:    auditUPnPDelete,
+		Gateway:      loc,
+		Protocol:     m.cfg.Protocol.String(),
+		ExternalPort: port,
+	}, err)
+	return err
+}
+
+var errUPnPPortTaken = errors.New("external port is mapped to another host")
+
+// Returns true if the UPnP device at loc reports this host as its DMZ host
+// for the mapping's protocol. See upnp.DMZHost.
+func (m *mapping) isDMZHost(loc string) bool {
+	host, err := upnp.DMZHost(loc, upnp.Protocol(m.cfg.Protocol))
+	if err != nil || host == nil {
+		return false
+	}
+
+	self, err := upnp.LocalIP(loc)
+	return err == nil && self.Equal(host)
+}
+
+// Handles a ConflictInMappingEntry error from AddPortMapping. Some firmwares
+// return this when a mapping which is still live is re-added at renewal time.
+// Returns the external port and remaining lifetime of the mapping if it can
+// be kept or was replaced.
 //
+// The existing entry is examined with GetSpecificPortMappingEntry. If it is
+// our mapping, it is kept as is, unless it is close to expiry, in which case
+// it is deleted and re-added. If it points to this host but otherwise differs
+// (e.g. it was left behind by a previous run), it is replaced. If it belongs to
+// another host, it is left alone and a different external port is chosen on
+// the next attempt.
+func (m *mapping) resolveUPnPConflict(loc string, remoteHost net.IP) (uint16, time.Duration, error) {
+	pm, err := upnp.GetPortMapping(loc, upnp.Protocol(m.cfg.Protocol), remoteHost, m.state.externalPort)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	selfIP, err := upnp.LocalIP(loc)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	otherProcess := coordOwnedByOther(coordGateway(loc), m.cfg.Protocol, m.state.externalPort)
+	if otherProcess || !selfIP.Equal(net.ParseIP(pm.InternalClient)) {
+		if otherProcess {
+			log.Infof("UPnP external port %d is owned by another process, choosing another port", m.state.externalPort)
+		} else {
+			log.Infof("UPnP external port %d is mapped to %s, choosing another port", m.state.externalPort, pm.InternalClient)
+		}
+		m.mutex.Lock()
+		m.state.externalPort = 0
+		m.mutex.Unlock()
+		return 0, 0, errUPnPPortTaken
+	}
 
-func (m *mapping) setInactive() {
+	// A disabled or standby mapping is kept only while it is disabled, and
+	// any other mapping only while it is enabled.
+	if pm.InternalPort == m.state.internalPort && pm.Enabled != m.lAddDisabled() {
+		lifetime := pm.LeaseDuration
+		if lifetime == 0 {
+			// permanent
+			lifetime = m.cfg.Lifetime
+		}
+
+		if lifetime >= m.cfg.Lifetime/2 {
+			log.Debugf("UPnP gateway refused to re-add live mapping for port %d, keeping existing mapping", m.state.externalPort)
+			return m.state.externalPort, lifetime, nil
+		}
+	}
+
+	log.Debugf("replacing existing UPnP mapping for port %d", m.state.externalPort)
+	return m.replaceUPnPMapping(loc, remoteHost, selfIP)
+}
+
+// Deletes the existing mapping for our external port and adds it again. The
+// add is issued immediately after the delete and then verified, so that the
+// mapping is only absent for the duration of a single request. If the mapping
+// cannot be recreated on the same port, a new port is mapped straight away
+// rather than leaving the mapping absent until the next attempt.
+func (m *mapping) replaceUPnPMapping(loc string, remoteHost, selfIP net.IP) (uint16, time.Duration, error) {
+	err := m.upnpDelete(loc, remoteHost, m.state.externalPort)
+	if err != nil && !upnp.IsErrorCode(err, upnp.ErrCodeNoSuchEntryInArray) {
+		return 0, 0, err
+	}
+
+	port, err := m.upnpAdd(loc, remoteHost)
+	if err == nil {
+		err = m.verifyUPnPMapping(loc, remoteHost, selfIP, port)
+		if err == nil {
+			return port, m.cfg.Lifetime, nil
+		}
+	}
+
+	log.Infof("could not recreate UPnP mapping for port %d, choosing another port: %v", m.state.externalPort, err)
+	port = coordPickPort(coordGateway(loc), m.cfg.Protocol, m.state.internalPort, m.ports)
+	m.mutex.Lock()
+	m.state.externalPort = port
+	m.mutex.Unlock()
+
+	port, err = m.upnpAdd(loc, remoteHost)
+	return port, m.cfg.Lifetime, err
+}
+
+var errUPnPNotMapped = errors.New("UPnP mapping not present after being added")
+
+// Checks that the gateway has a mapping for the given external port which
+// points to this host.
+func (m *mapping) verifyUPnPMapping(loc string, remoteHost, selfIP net.IP, port uint16) error {
+	pm, err := upnp.GetPortMapping(loc, upnp.Protocol(m.cfg.Protocol), remoteHost, port)
+	if upnp.IsErrorCode(err, upnp.ErrCodeNoSuchEntryInArray) {
+		return errUPnPNotMapped
+	} else if err != nil {
+		// Not all gateways implement GetSpecificPortMappingEntry, so only a
+		// definite answer is treated as failure.
+		return nil
+	}
+
+	if pm.InternalPort != m.state.internalPort || !selfIP.Equal(net.ParseIP(pm.InternalClient)) {
+		return errUPnPNotMapped
+	}
+
+	return nil
+}
+
+// Teardown
+
+// Removes the mapping from the gateway by the method which created it. Called
+// once when the mapping is deleted.
+func (m *mapping) teardown(gwa []net.IP) {
 	m.mutex.Lock()
+	active := m.isActive()
+	method := m.method
+	us := m.upnpService
+	port := m.grantedPort
+	dmz := m.dmz
+	m.mutex.Unlock()
+
+	if !active || dmz {
+		// Already inactive (e.g. expired or was never active), so no need to do
+		// anything.
+		return
+	}
+
+	switch method {
+	case MethodNATPMP:
+		m.tryNATPMP(gwa, true)
+	case MethodUPnP:
+		if us != nil {
+			m.teardownUPnP(us.Service, port)
+		}
+	case MethodBackend:
+		m.teardownBackend()
+	}
+}
+
+// Number of times DeletePortMapping is attempted when tearing down a mapping.
+const upnpTeardownTries = 2
+
+// Deletes a UPnP mapping from the service which created it and confirms that
+// it has been removed.
+func (m *mapping) teardownUPnP(svc ssdp.Service, port uint16) {
+	beginOp()
+	defer endOp()
+
+	loc := svc.PreferredLocation().String()
+	remoteHost, _ := m.cfg.Scope.upnpRemoteHost()
+
+	cgw := coordGateway(loc)
+	defer coordRelease(cgw, m.cfg.Protocol, m.state.internalPort)
+	if coordOwnedByOther(cgw, m.cfg.Protocol, port) {
+		log.Infof("UPnP external port %d is now owned by another process, not deleting", port)
+		return
+	}
+
+	for i := 0; i < upnpTeardownTries; i++ {
+		err := m.upnpDelete(loc, remoteHost, port)
+		if upnp.IsErrorCode(err, upnp.ErrCodeNoSuchEntryInArray) {
+			return
+		} else if err != nil {
+			log.Infof("UPnP DeletePortMapping for port %d failed: %v", port, err)
+			continue
+		}
+
+		_, err = upnp.GetPortMapping(loc, upnp.Protocol(m.cfg.Protocol), remoteHost, port)
+		if err != nil {
+			// Either the entry is gone, or the gateway doesn't support
+			// GetSpecificPortMappingEntry, in which case the successful delete
+			// has to be trusted.
+			return
+		}
+
+		log.Infof("UPnP mapping for port %d still present after DeletePortMapping", port)
+	}
+}
+
+//
+
+// Makes the mapping inactive once it is no longer maintained, recording
+// why.
+func (m *mapping) setInactive(reason InactiveReason) {
+	m.mutex.Lock()
+	wasActive := m.isActive()
+	since := m.inactiveSince()
+	if since.IsZero() {
+		since = m.now()
+	}
+	m.deactivatedTime = since
 	m.expireTime = time.Time{}
+	m.stopReason = reason
 	m.mutex.Unlock()
 
+	if !wasActive && reason == InactiveMaxTries {
+		// there is no transition for updateVersion to report
+		m.emit(Inactive{Reason: reason, Err: m.lLastError()})
+	}
+
 	m.notify()
 }
+
+func (m *mapping) lLastError() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.lastErr
+}
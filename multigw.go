@@ -0,0 +1,174 @@
+package portmap
+
+import "net"
+import "sync"
+import "time"
+
+// Describes an external endpoint of a mapping.
+type Endpoint struct {
+	// The gateway on which the mapping was created. May be nil if it is not
+	// known.
+	Gateway net.IP
+
+	// The external address in "IP:port" format, as for
+	// Mapping.ExternalAddr.
+	ExternalAddr string
+
+	// The method by which the mapping was created on this gateway.
+	Method Method
+}
+
+func (m *mapping) Endpoints() []Endpoint {
+	if len(m.children) == 0 {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		return m.endpoints(nil)
+	}
+
+	var eps []Endpoint
+	for _, c := range m.children {
+		c.mutex.Lock()
+		if !c.standbyMapped {
+			eps = c.endpoints(eps)
+		}
+		c.mutex.Unlock()
+	}
+	return eps
+}
+
+// Appends the endpoint of the mapping to eps if it is active. Must be called
+// with the mutex held.
+func (m *mapping) endpoints(eps []Endpoint) []Endpoint {
+	ea := m.externalAddrStr()
+	if ea == "" {
+		return eps
+	}
+
+	return append(eps, Endpoint{Gateway: m.gateway, ExternalAddr: ea, Method: m.method})
+}
+
+// Creates a child mapping which maintains the mapping on a single gateway.
+// Events from children are sent to the parent's subscriptions.
+func (m *mapping) newChild() *mapping {
+	return &mapping{
+		cfg:             m.cfg,
+		state:           m.state,
+		backoff:         m.cfg.Backoff,
+		updatePort:      m.updatePort,
+		created:         m.created,
+		ports:           m.ports,
+		deactivatedTime: m.deactivatedTime,
+		abortChan:       make(chan struct{}),
+		signalChan:      make(chan struct{}, 1),
+		refs:            1,
+		parent:          m,
+	}
+}
+
+// Runs a mapping loop for each child until the parent mapping is deleted.
+func (m *mapping) multiGatewayLoop() {
+	var wg sync.WaitGroup
+	for i, c := range m.children {
+		wg.Add(1)
+		go func(c *mapping, gw net.IP) {
+			defer wg.Done()
+			c.portMappingLoop([]net.IP{gw})
+		}(c, m.childGWs[i])
+	}
+
+	var probe <-chan time.Time
+	if m.cfg.Standby {
+		ticker := time.NewTicker(standbyProbeInterval)
+		defer ticker.Stop()
+		probe = ticker.C
+	}
+
+	failures := 0
+	for {
+		select {
+		case <-probe:
+			if m.probePrimary() {
+				failures = 0
+			} else {
+				failures++
+			}
+			m.setPrimaryDown(failures >= standbyProbeFailures)
+
+		case <-m.signalChan:
+			// Signals are rate limited by the parent, so are passed to every
+			// child directly.
+			for _, c := range m.children {
+				select {
+				case c.signalChan <- struct{}{}:
+				default:
+				}
+			}
+
+		case <-m.abortChan:
+			for _, c := range m.children {
+				c.abort()
+			}
+
+			wg.Wait()
+			m.setInactive(InactiveDeleted)
+			return
+		}
+	}
+}
+
+func (m *mapping) abort() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.aborted {
+		close(m.abortChan)
+		m.aborted = true
+	}
+}
+
+// Mirrors the state of the first active child into the parent and notifies
+// if it has changed. Called by children when their state changes. A child
+// holding a standby mapping is never mirrored, and with Config.Standby, the
+// second child is preferred once it has been promoted.
+func (m *mapping) syncChildren() {
+	children := m.children
+	if m.cfg.Standby && m.failover() {
+		children = []*mapping{m.children[1], m.children[0]}
+	}
+
+	var primary *mapping
+	for _, c := range children {
+		if c.lIsActive() && !c.lIsStandbyMapped() {
+			primary = c
+			break
+		}
+	}
+
+	m.mutex.Lock()
+	if primary != nil {
+		primary.mutex.Lock()
+		m.expireTime = primary.expireTime
+		m.method = primary.method
+		m.scopeEnforced = primary.scopeEnforced
+		m.grantedPort = primary.grantedPort
+		m.state = primary.state
+		m.gateway = primary.gateway
+		m.externalAddr = primary.externalAddr
+		m.upnpService = primary.upnpService
+		m.hairpin = primary.hairpin
+		primary.mutex.Unlock()
+	} else {
+		if m.isActive() {
+			m.deactivatedTime = m.now()
+			m.expireTime = time.Time{}
+		}
+
+		c := m.children[0]
+		c.mutex.Lock()
+		m.lastErr = c.lastErr
+		c.mutex.Unlock()
+	}
+	m.mutex.Unlock()
+
+	m.notify()
+}
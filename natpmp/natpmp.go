@@ -5,9 +5,11 @@ import gnet "net"
 import "errors"
 import "fmt"
 import "time"
+import "sync"
 import "github.com/hlandau/degoutils/net"
-import "bytes"
 import "encoding/binary"
+import "github.com/hlandau/portmap/gateway"
+import "github.com/hlandau/portmap/internal/localnet"
 
 // Opcodes
 type opcodeNo byte
@@ -47,22 +49,91 @@ var backoff = net.Backoff{
 	MaxDelayAfterTries: 8,
 }
 
-var natpmpErrTimeout = errors.New("Request timed out.")
+// A retransmission schedule which gives up after about 1.5 seconds, for use
+// where a quick answer matters more than tolerating packet loss.
+var fastBackoff = net.Backoff{
+	MaxTries:           4,
+	InitialDelay:       100 * time.Millisecond,
+	MaxDelay:           800 * time.Millisecond,
+	MaxDelayAfterTries: 3,
+}
+
+// Result codes defined by RFC 6886.
+const (
+	ResultSuccess            = 0
+	ResultUnsupportedVersion = 1
+	ResultNotAuthorized      = 2 // e.g. NAT-PMP is disabled on the gateway
+	ResultNetworkFailure     = 3 // e.g. the gateway has no external address
+	ResultOutOfResources     = 4
+	ResultUnsupportedOpcode  = 5
+)
+
+// Returned when the gateway responds with a nonzero result code.
+type ResultError struct {
+	// The result code sent by the gateway. See the Result constants.
+	Code uint16
+
+	// The epoch sent by the gateway, or zero if the response was too short to
+	// carry one. See MapResult.
+	Epoch uint32
+}
+
+func (e *ResultError) Error() string {
+	return fmt.Sprintf("NAT-PMP: default gateway responded with nonzero error code %d", e.Code)
+}
+
+// Returned when the gateway does not respond, which usually means it does
+// not support NAT-PMP.
+var ErrTimeout = errors.New("NAT-PMP request timed out")
+
+// Returned when a mapping is requested for a protocol other than TCP or UDP.
+var ErrUnsupportedProtocol = errors.New("NAT-PMP does not support the protocol")
+
+var errShortResponse = errors.New("short NAT-PMP response")
+
+// Size of the buffers in which responses are received. The largest NAT-PMP
+// response is 16 bytes, but a gateway may send something longer, which
+// should be received whole rather than truncated.
+const recvBufferSize = 1100
+
+// Receive buffers are reused, so that a process maintaining many mappings
+// does not allocate one for every renewal.
+var recvBuffers = sync.Pool{
+	New: func() interface{} {
+		return new([recvBufferSize]byte)
+	},
+}
 
-func makeRequest(dst gnet.IP, opcode opcodeNo, data []byte) ([]byte, error) {
-	conn, err := gnet.DialUDP("udp", nil, &gnet.UDPAddr{dst, hostToGatewayPort, ""})
+// The body of a successful response, following the version, opcode and
+// result code. The longest is that of a Map Port response.
+type responseBody [12]byte
+
+// Returns the address of the NAT-PMP server on a gateway. A link-local IPv6
+// gateway is contacted via the interface on which package gateway found it.
+func gatewayAddr(gw gnet.IP) *gnet.UDPAddr {
+	return &gnet.UDPAddr{IP: gw, Port: hostToGatewayPort, Zone: gateway.Zone(gw)}
+}
+
+// Sends msg, whose second byte is the opcode, and waits for a successful
+// response, retransmitting according to rconf. Returns the body of the
+// response and its length.
+func makeRequest(dst gnet.IP, msg []byte, rconf net.Backoff) (body responseBody, n int, err error) {
+	err = localnet.CheckIP(dst)
 	if err != nil {
-		return nil, err
+		return
+	}
+
+	conn, err := gnet.DialUDP("udp", nil, gatewayAddr(dst))
+	if err != nil {
+		return
 	}
 
 	defer conn.Close()
 
-	msg := make([]byte, 2)
-	msg[0] = version0     // Version 0
-	msg[1] = byte(opcode) // Opcode
-	msg = append(msg, data...)
+	buf := recvBuffers.Get().(*[recvBufferSize]byte)
+	defer recvBuffers.Put(buf)
 
-	rconf := backoff
+	opcode := msg[1]
 	rconf.Reset()
 
 	for {
@@ -75,58 +146,195 @@ func makeRequest(dst gnet.IP, opcode opcodeNo, data []byte) ([]byte, error) {
 
 		err = conn.SetDeadline(time.Now().Add(maxtime))
 		if err != nil {
-			return nil, err
+			return
 		}
 
 		_, err = conn.Write(msg)
 		if err != nil {
-			return nil, err
+			return
 		}
 
-		var res []byte
-		var uaddr *gnet.UDPAddr
-		res, uaddr, err = net.ReadDatagramFromUDP(conn)
+		// The socket is connected, so only datagrams from the gateway's
+		// NAT-PMP port are received.
+		var rn int
+		rn, err = conn.Read(buf[:])
 		if err != nil {
-			if err.(gnet.Error).Timeout() {
+			if ne, ok := err.(gnet.Error); ok && ne.Timeout() {
 				// try again
 				continue
 			}
-			return nil, err
-		}
-
-		if !uaddr.IP.Equal(dst) || uaddr.Port != hostToGatewayPort {
-			continue
+			return
 		}
 
+		res := buf[0:rn]
 		if len(res) < 4 {
 			continue
 		}
 
-		if res[0] != 0 || res[1] != (0x80|byte(opcode)) {
+		if res[0] != 0 || res[1] != (0x80|opcode) {
 			continue
 		}
 
 		rc := binary.BigEndian.Uint16(res[2:])
 
 		if rc != 0 {
-			return nil, fmt.Errorf("NAT-PMP: default gateway responded with nonzero error code %d", rc)
+			rerr := &ResultError{Code: rc}
+			if len(res) >= 8 {
+				rerr.Epoch = binary.BigEndian.Uint32(res[4:8])
+			}
+			err = rerr
+			return
 		}
 
-		return res[4:], nil
+		n = copy(body[:], res[4:])
+		return body, n, nil
 	}
 
-	return nil, natpmpErrTimeout
+	err = ErrTimeout
+	return
 }
 
 // Performs a NAT-PMP transaction to get the external address.
 func GetExternalAddr(gwaddr gnet.IP) (gnet.IP, error) {
-	r, err := makeRequest(gwaddr, opcGetExternalAddr, []byte{})
+	return getExternalAddr(gwaddr, backoff)
+}
+
+// Like GetExternalAddr, but uses the same retransmission schedule as MapFast.
+func GetExternalAddrFast(gwaddr gnet.IP) (gnet.IP, error) {
+	return getExternalAddr(gwaddr, fastBackoff)
+}
+
+func getExternalAddr(gwaddr gnet.IP, rconf net.Backoff) (gnet.IP, error) {
+	msg := [2]byte{version0, byte(opcGetExternalAddr)}
+	r, n, err := makeRequest(gwaddr, msg[:], rconf)
 	if err != nil {
 		return nil, err
 	}
 
+	if n < 8 {
+		return nil, errShortResponse
+	}
+
 	//time = r[0:4]
-	return r[4:8], nil
+	return gnet.IPv4(r[4], r[5], r[6], r[7]).To4(), nil
+}
+
+// Sends a single external address request to the gateway and returns the
+// time taken for it to respond. Unlike the other functions in this package,
+// the request is not retried, so this can be used to determine quickly
+// whether a gateway is alive and supports NAT-PMP.
+func Ping(gwaddr gnet.IP, timeout time.Duration) (time.Duration, error) {
+	r, err := Probe(gwaddr, timeout)
+	if err != nil {
+		return 0, err
+	}
+
+	return r.RTT, nil
+}
+
+// The response to the external address request made by Probe.
+type ProbeResult struct {
+	// The time taken for the gateway to respond.
+	RTT time.Duration
+
+	// The result code sent by the gateway. A gateway with NAT-PMP disabled
+	// may respond with ResultNotAuthorized rather than not responding at
+	// all. See the Result constants.
+	Code uint16
+
+	// Seconds since the gateway's port mapping table was initialised. See
+	// MapResult.
+	Epoch uint32
+
+	// The external address reported by the gateway. nil if Code is nonzero.
+	// May be 0.0.0.0 if the gateway does not yet have an external address.
+	ExternalIP gnet.IP
+}
+
+// Like Ping, but returns the whole response. A response with a nonzero result
+// code is not treated as an error, since it still shows that the gateway
+// implements NAT-PMP. No mappings are created or changed.
+func Probe(gwaddr gnet.IP, timeout time.Duration) (*ProbeResult, error) {
+	err := localnet.CheckIP(gwaddr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := gnet.DialUDP("udp", nil, gatewayAddr(gwaddr))
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	start := time.Now()
+	err = conn.SetDeadline(start.Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write([]byte{version0, byte(opcGetExternalAddr)})
+	if err != nil {
+		return nil, err
+	}
+
+	buf := recvBuffers.Get().(*[recvBufferSize]byte)
+	defer recvBuffers.Put(buf)
+
+	for {
+		n, err := conn.Read(buf[:])
+		if err != nil {
+			if ne, ok := err.(gnet.Error); ok && ne.Timeout() {
+				return nil, ErrTimeout
+			}
+			return nil, err
+		}
+
+		res := buf[0:n]
+		if len(res) < 4 || res[0] != 0 || res[1] != 0x80|byte(opcGetExternalAddr) {
+			continue
+		}
+
+		r := &ProbeResult{
+			RTT:  time.Since(start),
+			Code: binary.BigEndian.Uint16(res[2:]),
+		}
+		if len(res) >= 8 {
+			r.Epoch = binary.BigEndian.Uint32(res[4:8])
+		}
+		if r.Code == ResultSuccess && len(res) >= 12 {
+			r.ExternalIP = gnet.IP(append([]byte(nil), res[8:12]...))
+		}
+
+		return r, nil
+	}
+}
+
+// The fields of a Map Port response, as sent by the gateway.
+type MapResult struct {
+	// Seconds since the gateway's port mapping table was initialised. If this
+	// decreases between responses, or increases by less than the time
+	// elapsed, the gateway has probably rebooted and lost its mappings.
+	Epoch uint32
+
+	InternalPort uint16
+	ExternalPort uint16
+
+	// The lifetime granted, which may differ from that requested.
+	Lifetime time.Duration
+}
+
+// Like Map, but returns every field of the response. If the gateway responds
+// with a nonzero result code, the error is a *ResultError.
+func MapDetailed(gwaddr gnet.IP, proto Protocol,
+	internalPort, suggestedExternalPort uint16,
+	lifetime time.Duration) (*MapResult, error) {
+	res, err := mapDetailed(gwaddr, proto, internalPort, suggestedExternalPort, lifetime, backoff)
+	if err != nil {
+		return nil, err
+	}
+
+	return &res, nil
 }
 
 // Performs a single Map Port NAT-PMP transaction. This is a low-level function
@@ -136,35 +344,67 @@ func GetExternalAddr(gwaddr gnet.IP) (gnet.IP, error) {
 func Map(gwaddr gnet.IP, proto Protocol,
 	internalPort, suggestedExternalPort uint16,
 	lifetime time.Duration) (externalPort uint16, actualLifetime time.Duration, err error) {
+	return mapPort(gwaddr, proto, internalPort, suggestedExternalPort, lifetime, backoff)
+}
 
-	opc, ok := proto.opcode()
-	if !ok {
-		err = errors.New("unsupported protocol")
+// Like Map, but gives up after about 1.5 seconds rather than retransmitting
+// for about two minutes as RFC 6886 recommends. This suits callers which
+// would rather try another method than wait for a gateway which may not
+// support NAT-PMP.
+func MapFast(gwaddr gnet.IP, proto Protocol,
+	internalPort, suggestedExternalPort uint16,
+	lifetime time.Duration) (externalPort uint16, actualLifetime time.Duration, err error) {
+	return mapPort(gwaddr, proto, internalPort, suggestedExternalPort, lifetime, fastBackoff)
+}
+
+func mapPort(gwaddr gnet.IP, proto Protocol,
+	internalPort, suggestedExternalPort uint16,
+	lifetime time.Duration, rconf net.Backoff) (externalPort uint16, actualLifetime time.Duration, err error) {
+	res, err := mapDetailed(gwaddr, proto, internalPort, suggestedExternalPort, lifetime, rconf)
+	if err != nil {
 		return
 	}
 
-	b := bytes.NewBuffer(make([]byte, 0, 10))
-	binary.Write(b, binary.BigEndian, struct {
-		Reserved                            uint16
-		InternalPort, SuggestedExternalPort uint16
-		Lifetime                            uint32
-	}{0, internalPort, suggestedExternalPort, uint32(lifetime.Seconds())})
+	return res.ExternalPort, res.Lifetime, nil
+}
+
+func mapDetailed(gwaddr gnet.IP, proto Protocol,
+	internalPort, suggestedExternalPort uint16,
+	lifetime time.Duration, rconf net.Backoff) (MapResult, error) {
+
+	opc, ok := proto.opcode()
+	if !ok {
+		return MapResult{}, ErrUnsupportedProtocol
+	}
 
-	r, err := makeRequest(gwaddr, opc, b.Bytes())
+	// msg[ 2: 4] // reserved
+	// msg[ 4: 6] // internal port
+	// msg[ 6: 8] // suggested external port
+	// msg[ 8:12] // lifetime
+	var msg [12]byte
+	msg[0] = version0
+	msg[1] = byte(opc)
+	binary.BigEndian.PutUint16(msg[4:6], internalPort)
+	binary.BigEndian.PutUint16(msg[6:8], suggestedExternalPort)
+	binary.BigEndian.PutUint32(msg[8:12], uint32(lifetime.Seconds()))
+
+	r, n, err := makeRequest(gwaddr, msg[:], rconf)
 	if err != nil {
-		return
+		return MapResult{}, err
 	}
 
-	if len(r) < 12 {
-		err = errors.New("short response")
-		return
+	if n < 12 {
+		return MapResult{}, errShortResponse
 	}
 
 	// r[0: 4] // time
 	// r[4: 6] // internal port
 	// r[6: 8] // mapped external port
 	// r[8:12] // lifetime
-	externalPort = binary.BigEndian.Uint16(r[6:8])
-	actualLifetime = time.Duration(binary.BigEndian.Uint32(r[8:12])) * time.Second
-	return
+	return MapResult{
+		Epoch:        binary.BigEndian.Uint32(r[0:4]),
+		InternalPort: binary.BigEndian.Uint16(r[4:6]),
+		ExternalPort: binary.BigEndian.Uint16(r[6:8]),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(r[8:12])) * time.Second,
+	}, nil
 }
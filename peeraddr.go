@@ -0,0 +1,90 @@
+package portmap
+
+import "net"
+import "strconv"
+import "github.com/hlandau/portmap/internal/localnet"
+
+// Returns the address of the interface whose subnet contains ip, or nil.
+func localSubnetIP(ip net.IP) net.IP {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	for _, ifi := range ifs {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok && ipn.Contains(ip) {
+				return ipn.IP
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns the address this host would use to send to ip. No traffic is sent.
+func sourceIPFor(ip net.IP) net.IP {
+	if localnet.CheckIP(ip) != nil {
+		return nil
+	}
+
+	c, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: 9})
+	if err != nil {
+		return nil
+	}
+
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP
+}
+
+// Recommends the address which a peer at the given IP should use to reach
+// this host via the mapping: either the address of this host on the local
+// network with the mapping's internal port, in which case local is true, or
+// the mapping's external address. Returns an empty string if neither is
+// usable, for example because the peer is elsewhere on the Internet and the
+// mapping is not active.
+//
+// A peer on one of this host's subnets, or at a private address, is given the
+// local address, since traffic to the external address only reaches the
+// mapping if the gateway supports hairpin NAT. So is a peer whose address is
+// the mapping's external IP, which is behind the same gateway, unless the
+// gateway is known to support hairpin NAT (see Config.DetectHairpin), in which
+// case either address works and the external one is given. Any other peer is
+// given the external address.
+func PeerAddr(m Mapping, peer net.IP) (addr string, local bool) {
+	st := m.Status()
+	localAddr := func() (string, bool) {
+		ip := localSubnetIP(peer)
+		if ip == nil {
+			ip = sourceIPFor(peer)
+		}
+		if ip == nil {
+			return "", false
+		}
+
+		return net.JoinHostPort(ip.String(), strconv.FormatUint(uint64(st.InternalPort), 10)), true
+	}
+
+	// Hosts at private addresses are on the same private network as this
+	// host if they can reach it at all. The shared address space of
+	// carrier-grade NAT is not regarded as private, since hosts there may be
+	// other customers of the carrier.
+	if localSubnetIP(peer) != nil || localnet.IsLocal(peer) {
+		return localAddr()
+	}
+
+	if host, _, err := net.SplitHostPort(st.ExternalAddr); err == nil && peer.Equal(net.ParseIP(host)) {
+		if st.Hairpin == HairpinSupported {
+			return st.ExternalAddr, false
+		}
+
+		return localAddr()
+	}
+
+	return st.ExternalAddr, false
+}
@@ -0,0 +1,191 @@
+package portmap
+
+import "errors"
+import "net"
+import "net/http"
+import "strconv"
+
+// A Backend which creates port forwards on a pfSense firewall through version
+// 2 of the pfSense REST API package. RouterAPIConfig.APIKey is sent in the
+// X-API-Key header if set; otherwise Username and Password are used with
+// basic authentication.
+//
+// RouterAPIConfig.WANInterface gives the pfSense name of the interface on
+// which forwarded traffic arrives, and defaults to "wan". Forwards are
+// created with a pass filter association, so no separate firewall rule is
+// needed.
+//
+// pfSense forwards have no lifetime, so the forward persists until Unmap is
+// called. Each renewal checks that the forward still exists and recreates it
+// if not. Forwards are identified by their description, since the IDs pfSense
+// assigns change when other forwards are deleted. A PfSenseBackend must not
+// be shared between mappings.
+type PfSenseBackend struct {
+	api *routerAPIClient
+}
+
+// Creates a pfSense backend for the given firewall.
+func NewPfSenseBackend(cfg RouterAPIConfig) (*PfSenseBackend, error) {
+	if cfg.WANInterface == "" {
+		cfg.WANInterface = "wan"
+	}
+
+	api, err := newRouterAPIClient(cfg, func(cfg *RouterAPIConfig, req *http.Request) {
+		if cfg.APIKey != "" {
+			req.Header.Set("X-API-Key", cfg.APIKey)
+		} else {
+			req.SetBasicAuth(cfg.Username, cfg.Password)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &PfSenseBackend{api: api}, nil
+}
+
+func (b *PfSenseBackend) Name() string {
+	return "pfSense"
+}
+
+type pfSenseForward struct {
+	ID               *int   `json:"id,omitempty"`
+	Interface        string `json:"interface"`
+	IPProtocol       string `json:"ipprotocol"`
+	Protocol         string `json:"protocol"`
+	Source           string `json:"source"`
+	Destination      string `json:"destination"`
+	DestinationPort  string `json:"destination_port"`
+	Target           string `json:"target"`
+	LocalPort        string `json:"local_port"`
+	Descr            string `json:"descr"`
+	AssociatedRuleID string `json:"associated_rule_id,omitempty"`
+}
+
+// All responses are wrapped in an envelope.
+type pfSenseResponse struct {
+	Message string      `json:"message"`
+	Data    interface{} `json:"data"`
+}
+
+var errPfSenseNotIPv4 = errors.New("pfSense backend supports IPv4 forwards only")
+
+func (b *PfSenseBackend) Map(req BackendRequest) (BackendResult, error) {
+	ip, err := b.api.internalIP()
+	if err != nil {
+		return BackendResult{}, err
+	}
+
+	if ip.To4() == nil {
+		return BackendResult{}, errPfSenseNotIPv4
+	}
+
+	want := pfSenseForward{
+		Interface:        b.api.cfg.WANInterface,
+		IPProtocol:       "inet",
+		Protocol:         req.Protocol.String(),
+		Source:           "any",
+		Destination:      b.api.cfg.WANInterface + ":ip",
+		DestinationPort:  strconv.Itoa(int(routerAPIExternalPort(&req))),
+		Target:           ip.String(),
+		LocalPort:        strconv.Itoa(int(req.InternalPort)),
+		Descr:            routerAPIDescription(&req),
+		AssociatedRuleID: "pass",
+	}
+
+	have, err := b.find(want.Descr)
+	if err != nil {
+		return BackendResult{}, err
+	}
+
+	if have != nil && !samePfSenseForward(have, &want) {
+		// Replaced rather than patched, since the previous forward may have
+		// been left behind by a differently configured run.
+		err = b.delete(*have.ID)
+		if err != nil {
+			return BackendResult{}, err
+		}
+		have = nil
+	}
+
+	if have == nil {
+		err = b.api.do("POST", "/api/v2/firewall/nat/port_forward", &want, nil)
+		if err != nil {
+			return BackendResult{}, err
+		}
+
+		err = b.apply()
+		if err != nil {
+			return BackendResult{}, err
+		}
+	}
+
+	port, _ := strconv.ParseUint(want.DestinationPort, 10, 16)
+	return BackendResult{ExternalIP: b.externalIP(), ExternalPort: uint16(port)}, nil
+}
+
+func (b *PfSenseBackend) Unmap(req BackendRequest, prev BackendResult) error {
+	have, err := b.find(routerAPIDescription(&req))
+	if err != nil || have == nil {
+		return err
+	}
+
+	err = b.delete(*have.ID)
+	if err != nil {
+		return err
+	}
+
+	return b.apply()
+}
+
+func samePfSenseForward(a, b *pfSenseForward) bool {
+	return a.Interface == b.Interface && a.Protocol == b.Protocol &&
+		a.DestinationPort == b.DestinationPort && a.Target == b.Target && a.LocalPort == b.LocalPort
+}
+
+// Returns the forward with the given description, or nil.
+func (b *PfSenseBackend) find(descr string) (*pfSenseForward, error) {
+	var fwds []pfSenseForward
+	err := b.api.do("GET", "/api/v2/firewall/nat/port_forwards", nil, &pfSenseResponse{Data: &fwds})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range fwds {
+		if fwds[i].Descr == descr && fwds[i].ID != nil {
+			return &fwds[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (b *PfSenseBackend) delete(id int) error {
+	return b.api.do("DELETE", "/api/v2/firewall/nat/port_forward?id="+strconv.Itoa(id), nil, nil)
+}
+
+// Changes to NAT configuration only take effect once applied.
+func (b *PfSenseBackend) apply() error {
+	return b.api.do("POST", "/api/v2/firewall/apply", struct{}{}, nil)
+}
+
+// Returns the address of the WAN interface, or nil if it cannot be
+// determined.
+func (b *PfSenseBackend) externalIP() net.IP {
+	var ifaces []struct {
+		Name   string `json:"name"`
+		IPAddr string `json:"ipaddr"`
+	}
+	err := b.api.do("GET", "/api/v2/status/interfaces", nil, &pfSenseResponse{Data: &ifaces})
+	if err != nil {
+		return nil
+	}
+
+	for _, ifi := range ifaces {
+		if ifi.Name == b.api.cfg.WANInterface {
+			return net.ParseIP(ifi.IPAddr)
+		}
+	}
+
+	return nil
+}
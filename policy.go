@@ -0,0 +1,72 @@
+package portmap
+
+import "sync"
+import "time"
+
+// Describes a mapping operation which is about to be performed against a
+// gateway.
+type Operation struct {
+	// The method which will be used.
+	Method Method
+
+	// The gateway the operation will be performed against. For NAT-PMP, this
+	// is the gateway IP; for UPnP, the device description URL.
+	Gateway string
+
+	Protocol     Protocol
+	InternalPort uint16
+
+	// The requested external port. Zero if any port may be allocated.
+	ExternalPort uint16
+
+	// The requested lifetime.
+	Lifetime time.Duration
+
+	// True if the operation renews a mapping which is currently active.
+	Renewal bool
+}
+
+// A policy determines whether mapping operations may be performed. Policies
+// are consulted before every mapping is created or renewed, but never before
+// a mapping is deleted.
+type Policy interface {
+	// Returns nil if the operation is allowed, or an error explaining why it
+	// is denied.
+	Check(op Operation) error
+}
+
+// Adapts a function to the Policy interface.
+type PolicyFunc func(op Operation) error
+
+func (f PolicyFunc) Check(op Operation) error {
+	return f(op)
+}
+
+var policyMutex sync.RWMutex
+var globalPolicy Policy
+
+// Sets a policy which is applied to all mappings in the process, in addition
+// to any Config.Policy. Pass nil to remove it.
+func SetPolicy(p Policy) {
+	policyMutex.Lock()
+	defer policyMutex.Unlock()
+	globalPolicy = p
+}
+
+func (m *mapping) checkPolicy(op Operation) error {
+	policyMutex.RLock()
+	gp := globalPolicy
+	policyMutex.RUnlock()
+
+	if gp != nil {
+		if err := gp.Check(op); err != nil {
+			return err
+		}
+	}
+
+	if m.cfg.Policy != nil {
+		return m.cfg.Policy.Check(op)
+	}
+
+	return nil
+}
@@ -9,13 +9,17 @@
 package portmap
 
 import "net"
+import "context"
 import "fmt"
 import "time"
 import "sync"
 import "strconv"
+import "strings"
+import "net/url"
 import denet "github.com/hlandau/degoutils/net"
-import "github.com/hlandau/portmap/gateway"
+import "github.com/hlandau/portmap/internal/localnet"
 import "github.com/hlandau/portmap/ssdp"
+import "github.com/hlandau/portmap/upnp"
 
 // Identifies a transport layer protocol.
 type Protocol int
@@ -25,6 +29,17 @@ const (
 	UDP          = 17 // Map a UDP port
 )
 
+func (p Protocol) String() string {
+	switch p {
+	case TCP:
+		return "tcp"
+	case UDP:
+		return "udp"
+	default:
+		return fmt.Sprintf("Protocol(%d)", int(p))
+	}
+}
+
 // Specifies a port mapping which will be created.
 type Config struct {
 	// The protocol for which the port should be mapped.
@@ -58,6 +73,26 @@ type Config struct {
 	// not deleted beforehand.
 	Lifetime time.Duration
 
+	// If the gateway grants a lifetime shorter than this, LifetimeCapped is
+	// sent. The mapping is still renewed halfway through the lifetime
+	// actually granted, which Status reports. If zero,
+	// DefaultMinGrantedLifetime is used. Values above Lifetime are treated
+	// as Lifetime.
+	MinGrantedLifetime time.Duration
+
+	// The bounds within which Lifetime must lie. A Lifetime outside them is
+	// replaced with the nearer bound, since some gateways reject or
+	// misbehave with very short or very long lifetimes. If zero,
+	// DefaultMinLifetime and DefaultMaxLifetime are used. New returns
+	// ErrInvalidLifetime if MinLifetime exceeds MaxLifetime.
+	MinLifetime, MaxLifetime time.Duration
+
+	// Ports which are never chosen when portmap chooses an external port
+	// itself, because ExternalPort is zero or the requested port is taken. If
+	// nil, upnp.DefaultExcludedPorts is used; set this to an empty slice to
+	// exclude no ports. This does not affect ports chosen by the gateway.
+	ExcludedExternalPorts []uint16
+
 	// Determines the backoff delays used between NAT-PMP or UPnP mapping
 	// attempts. Note that if you set MaxTries to a nonzero value, the mapping
 	// process will give up after that many tries.
@@ -65,35 +100,300 @@ type Config struct {
 	// It is recommended that you use the nil value for this struct, which will
 	// cause sensible defaults to be used with no limit on retries.
 	Backoff denet.Backoff
+
+	// Restricts which remote hosts may use the mapping, where the method used
+	// supports it. See Scope.
+	Scope Scope
+
+	// Determines which UPnP devices may be used to create the mapping. The
+	// default, UPnPTrustGateway, only permits devices which are a default
+	// gateway of this host.
+	UPnPTrust UPnPTrust
+
+	// If set, New succeeds even if no default gateway can be determined, for
+	// example because the network is not yet up when a daemon is started. The
+	// mapping is then pending, as reported by Status, and mapping is attempted
+	// once a gateway appears.
+	WaitForGateway bool
+
+	// Additional gateways to try after the default gateways of this host. This
+	// is useful where the default gateway is a container or virtual machine
+	// bridge (see Diagnose) and the gateway of the network beyond it is
+	// known. UPnP devices at these addresses are trusted as if they were
+	// default gateways.
+	GatewayHints []net.IP
+
+	// Like GatewayHints, but naming the gateways, for example "fritz.box",
+	// so that a configuration survives the gateway being renumbered. Each
+	// name may also be an IPv4 address. The names are resolved with Resolver
+	// when New is called, and again while waiting for a gateway if
+	// WaitForGateway is set; names which can't be resolved are skipped.
+	GatewayHintNames []string
+
+	// Resolves GatewayHintNames. If nil, net.DefaultResolver is used, except
+	// in local-only mode (see SetLocalOnly), in which names are only resolved
+	// if a resolver is supplied. Not used when mapping via a broker, which
+	// resolves the names itself.
+	Resolver Resolver
+
+	// If set, and the host has more than one default gateway, for example
+	// because it has several WAN links, the mapping is created and maintained
+	// on every gateway rather than only the first which accepts it. Use
+	// Mapping.Endpoints to obtain every external address. ExternalAddr returns
+	// the address on the first gateway, in the order returned by package
+	// gateway, on which the mapping is active.
+	//
+	// Only the gateways known when New is called are used.
+	AllGateways bool
+
+	// If set, and the host has more than one default gateway, the mapping is
+	// maintained on the first gateway and a standby mapping for the same
+	// internal port is kept on the second, so that the mapping can be moved
+	// to the second gateway within seconds if the first stops responding.
+	// Via UPnP, the standby mapping is added disabled; via NAT-PMP, which
+	// can't disable a mapping, it is kept with a short lifetime. Once the
+	// first gateway recovers, the mapping moves back to it. A FailedOver event
+	// is sent each time the mapping moves.
+	//
+	// Ignored if AllGateways or Backend is set. Only the first two gateways
+	// known when New is called are used.
+	Standby bool
+
+	// If set, the mapping is created using this backend instead of NAT-PMP or
+	// UPnP, and the gateway-related fields of Config are ignored. See
+	// Backend.
+	Backend Backend
+
+	// If set, this backend is used when neither NAT-PMP nor UPnP is
+	// available, for example a TURNBackend. The mapping continues to be
+	// maintained via the fallback until it fails, after which NAT-PMP and UPnP
+	// are tried again.
+	Fallback Backend
+
+	// If set, the time taken for the mapping to become active is minimised at
+	// the expense of network politeness. NAT-PMP requests are retransmitted
+	// more rapidly and abandoned after about 1.5 seconds, SSDP discovery is
+	// started immediately with a short MX, and if NAT-PMP fails, UPnP devices
+	// are waited for briefly rather than the attempt being retried later.
+	// Status.TimeToActive reports the effect.
+	FastStart bool
+
+	// If set, once the mapping becomes active, and again whenever its
+	// external address changes, this host connects to the external address
+	// to find out whether the gateway supports hairpin NAT. Status.Hairpin
+	// reports the result, and HairpinTested is sent when it is known. Peers
+	// on the local network can only use the external address if it does.
+	//
+	// Something must be listening on the internal port for the test to
+	// succeed. For UDP, it must reply to datagrams, since otherwise there is
+	// no way to tell that a datagram arrived.
+	//
+	// The test is not made in local-only mode if the external address is
+	// public. See SetLocalOnly.
+	DetectHairpin bool
+
+	// Arbitrary labels, such as a tenant or service name, which are reported
+	// by Mapping.Tags and Status so that an application managing many
+	// mappings can correlate them with its own objects. Unlike the rest of
+	// Config, tags are kept even if New returns an existing mapping; each
+	// Mapping returned by New reports the tags it was created with.
+	Tags map[string]string
+
+	// If set, consulted before the mapping is created or renewed. If the
+	// policy denies an operation, the attempt is treated as having failed.
+	// See also SetPolicy.
+	Policy Policy
+
+	// Set by Simulation.New.
+	sim *Simulation
 }
 
 // A mapping is active if its ExternalAddr() function returns a non-empty string.
+// A mapping may also be active while its external port is not yet known, in
+// which case ExternalAddr() returns an empty string but Status() reports it
+// as active.
 //
 // The value returned by ExternalAddr() may change over time. The mapping may
 // go from inactive to active, active to inactive, or may change external addresses
 // while remaining active.
+//
+// Mappings returned by New implement fmt.Stringer, giving a one-line summary
+// suitable for logging, slog.LogValuer where log/slog is available, and
+// AddrChanner where net/netip is available.
 type Mapping interface {
 	// Returns a channel. One value will be sent on the channel whenever the
-	// value returned by ExternalAddr() changes, unless the value previously sent
-	// on the channel has yet to be consumed.
+	// value returned by ExternalAddr() changes or the mapping becomes active or
+	// inactive, unless the value previously sent on the channel has yet to be
+	// consumed.
+	//
+	// Since several changes may be coalesced into one value, consumers should
+	// call Status() on receipt rather than calling ExternalAddr() and
+	// inspecting the state piecemeal. Status.Version identifies the state
+	// returned, so a consumer can tell whether it has already acted on it.
+	//
+	// If the mapping was returned by more than one call to New, each value
+	// returned has its own channel, which is no longer signalled once Delete
+	// is called on that value.
 	NotifyChan() <-chan struct{}
 
+	// Returns a channel on which events relating to the mapping are sent. See
+	// Event for the kinds of event which may be sent. If the channel is not
+	// drained, events which do not fit in its buffer are dropped. As with
+	// NotifyChan, each value returned by New has its own channel.
+	Events() <-chan Event
+
 	// Deletes the mapping. Doesn't block until the mapping is destroyed.
+	//
+	// If the mapping was returned by more than one call to New, this releases
+	// the reference obtained by the call to New which returned this value, and
+	// the mapping is only deleted when the last reference is released. Calling
+	// Delete more than once on the same value has no further effect.
 	Delete()
 
+	// Calls Delete and returns nil, so that a Mapping can be used as an
+	// io.Closer.
+	Close() error
+
+	// Calls Delete and then waits until the mapping has been removed from the
+	// gateway, or until ctx is done, in which case ctx.Err() is returned and
+	// removal continues in the background. Returns immediately if other
+	// references to the mapping remain. For a mapping maintained by a
+	// broker, removal is left to the broker, and this waits only until the
+	// broker has been told.
+	DeleteWait(ctx context.Context) error
+
+	// Stops maintaining the mapping without removing it from the gateway, and
+	// returns a handle which can be passed to Attach, possibly by another
+	// process, to continue maintaining it. This allows a server to be
+	// restarted without its port ceasing to be forwarded. The handle must be
+	// attached before the mapping expires.
+	//
+	// Returns ErrNotActive if the mapping is not active, and ErrCannotDetach
+	// if it cannot be detached. Once a mapping has been detached, the Mapping
+	// is inactive and Delete has no effect.
+	Detach() (*Handle, error)
+
+	// Moves the mapping so that it forwards to a different local port, for
+	// example because a server has restarted on a new ephemeral port. The
+	// external port is kept where the gateway allows it. Doesn't block until
+	// the mapping has been moved; NotifyChan is signalled if the external
+	// address changes as a result.
+	//
+	// Returns ErrInternalPortInUse if another mapping in this process already
+	// forwards to the port, and ErrCannotUpdate if the mapping is shared with
+	// other callers of New or is maintained by a broker.
+	Update(internalPort uint16) error
+
+	// Stops the gateway forwarding traffic for the mapping without giving up
+	// the external port, by adding the mapping again via UPnP with NewEnabled
+	// set to 0. The mapping remains active and continues to be renewed while
+	// disabled, but only via UPnP, since NAT-PMP can't disable a mapping.
+	// Doesn't block until the gateway has been told. Not all gateways honour
+	// NewEnabled.
+	//
+	// Returns ErrNotActive if the mapping is not active, and ErrCannotDisable
+	// if it is not maintained via UPnP, is provided by the gateway's DMZ (see
+	// Status.DMZ), is shared with other callers of New or is maintained by a
+	// broker.
+	Disable() error
+
+	// Resumes forwarding of a mapping stopped by Disable. Does nothing if the
+	// mapping is not disabled.
+	Enable() error
+
 	// Returns the external address in "IP:port" format.
 	// If the mapping is not active, returns an empty string.
 	// The IP address may not be globally routable, for example in double-NAT cases.
 	// If the external port has been mapped but the external IP cannot be determined,
 	// returns ":port".
 	ExternalAddr() string
+
+	// Returns the UPnP service which was used to create the mapping. ok is
+	// false if the mapping is not currently maintained via UPnP.
+	//
+	// Once a service has been used successfully, it continues to be used for
+	// renewals until it is no longer advertised.
+	UPnPService() (svc UPnPService, ok bool)
+
+	// Returns the current status of the mapping.
+	Status() Status
+
+	// Returns the tags given in Config.Tags. The map must not be modified.
+	Tags() map[string]string
+
+	// Returns the external endpoints at which the mapping is currently
+	// active. Unless Config.AllGateways is set, there is at most one. A
+	// standby mapping kept for Config.Standby is not included.
+	Endpoints() []Endpoint
+
+	// Informs the mapping that the application suspects the mapping is no
+	// longer working, for example because expected inbound traffic has
+	// stopped. The mapping is re-validated immediately rather than at the
+	// next renewal or retry. Doesn't block.
+	//
+	// Signals are rate limited; signals received within
+	// SignalMinInterval of a signal which was acted upon are ignored.
+	SignalConnectivityChange()
+}
+
+// The minimum interval between re-validations triggered by
+// SignalConnectivityChange.
+const SignalMinInterval = 30 * time.Second
+
+// Describes a UPnP service used to create a mapping.
+type UPnPService struct {
+	ssdp.Service
+
+	// The friendly name of the device providing the service. May be empty if
+	// it could not be determined.
+	DeviceName string
+
+	// The icons of the device providing the service, as listed in its
+	// description, for display alongside the mapping's status. Use
+	// ssdp.FetchIcon to retrieve one.
+	Icons []ssdp.Icon
+
+	// The URL of the device's web interface, from its description. nil if the
+	// device does not specify one.
+	PresentationURL *url.URL
+
+	// The names of the device quirks which were in effect when the mapping was
+	// last created or renewed. See upnp.Quirks.
+	Quirks []string
+}
+
+// Retrieves the image data and MIME type of one of the service's Icons. See
+// ssdp.FetchIcon.
+func (s *UPnPService) FetchIcon(icon *ssdp.Icon) (data []byte, mimeType string, err error) {
+	desc, err := ssdp.DescribeURL(s.PreferredLocation().String())
+	if err != nil {
+		return nil, "", err
+	}
+
+	return ssdp.FetchIcon(desc, icon)
 }
 
 const DefaultLifetime = 2 * time.Hour
 
+// The default value of Config.MinGrantedLifetime.
+const DefaultMinGrantedLifetime = 10 * time.Minute
+
+// The default values of Config.MinLifetime and Config.MaxLifetime.
+const (
+	DefaultMinLifetime = 1 * time.Minute
+	DefaultMaxLifetime = 7 * 24 * time.Hour
+)
+
+// Granted lifetimes shorter than this are treated as failures, since renewing
+// at half the lifetime would otherwise make requests in a tight loop. Some
+// gateways grant a lifetime of zero rather than returning an error.
+const minUsableLifetime = 10 * time.Second
+
 // Creates a port mapping. The mapping process is continually attempted and
 // maintained in the background, but the Mapping interface is returned
-// immediately without blocking.
+// without waiting for it. If a broker is configured, New waits at most 25
+// seconds for it to respond (5 to connect and 20 for its reply), after which
+// the mapping is negotiated by this process instead.
 //
 // As the mapping is attempted asynchronously in the background, the mapping
 // will not be active when this function returns. Use the Mapping interface
@@ -101,35 +401,238 @@ const DefaultLifetime = 2 * time.Hour
 //
 // A successful mapping is not guaranteed.
 //
+// If a mapping with the same protocol and internal port already exists in
+// this process, that mapping is returned instead of creating a new one, and
+// the rest of cfg is ignored. The mapping is only deleted once Delete has
+// been called as many times as the mapping has been returned by New.
+//
+// If a broker has been configured with SetBroker, the mapping is delegated to
+// it where possible, unless Config.Backend or Config.Fallback is set, since
+// backends cannot be passed to the broker.
+//
 // See the Config struct and the Mapping interface for more information.
 func New(cfg Config) (Mapping, error) {
+	err := setLifetimeDefaults(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Backend == nil && cfg.Fallback == nil {
+		bm, err := newBrokerMapping(cfg)
+		if bm != nil || err != nil {
+			return bm, err
+		}
+	}
+
+	return newLocal(cfg, nil)
+}
+
+// Creates a mapping negotiated by this process. If h is not nil, the mapping
+// resumes the detached mapping it describes.
+func newLocal(cfg Config, h *Handle) (Mapping, error) {
+	err := setLifetimeDefaults(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// The gateways are gathered before the registry is locked, since
+	// resolving gateway hints may take several seconds and the registry is
+	// also used by the SSDP handlers, which must not block.
+	gwa, gwErr := gatherGateways(&cfg)
+
+	// SSDP discovery is acquired only once the registry has been unlocked,
+	// since the discovery loop calls into the registry.
+	registryMutex.Lock()
+	m, gwa, shared, err := registerMapping(cfg, h, gwa, gwErr)
+	registryMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if shared {
+		return m.newRef(cfg.Tags), nil
+	}
+
+	// Discovery only continues while mappings exist, so that a process with no
+	// mappings generates no background traffic.
+	usesSSDP := cfg.Backend == nil
+	if usesSSDP {
+		err := ssdp.Acquire()
+		if err != nil {
+			log.Infof("SSDP discovery unavailable, UPnP will not be used: %v", err)
+		}
+	}
+
+	if cfg.sim != nil {
+		cfg.sim.mutex.Lock()
+		cfg.sim.enter()
+		cfg.sim.mutex.Unlock()
+	}
+
+	// subscribed before the loop starts, so that no events are missed
+	ref := m.newRef(cfg.Tags)
+
+	go func() {
+		if len(m.children) > 0 {
+			m.multiGatewayLoop()
+		} else {
+			m.portMappingLoop(gwa)
+		}
+		m.deregister()
+		if usesSSDP {
+			ssdp.Release()
+		}
+		if mappingCount() == 0 {
+			upnp.CloseIdleConnections()
+		}
+		close(m.doneChan)
+		if cfg.sim != nil {
+			cfg.sim.mutex.Lock()
+			cfg.sim.exit()
+			cfg.sim.mutex.Unlock()
+		}
+	}()
+
+	return ref, nil
+}
+
+// Returns the gateways a new mapping for cfg is to use, including any gateway
+// hints, or an error if it can't be created for want of a gateway. Must be
+// called without registryMutex held.
+func gatherGateways(cfg *Config) ([]net.IP, error) {
+	if cfg.Backend != nil {
+		return nil, nil
+	}
+
 	if IsGloballyRoutable() {
 		return nil, ErrGlobalIP
 	}
 
-	gwa, err := gateway.GetIPs()
+	gwa, err := ipv4Gateways()
 	if err != nil {
-		return nil, err
+		if !cfg.WaitForGateway {
+			return nil, &classifiedError{class: ErrNoGateway, err: err}
+		}
+
+		gwa = nil
 	}
 
-	if cfg.Lifetime == 0 {
-		cfg.Lifetime = DefaultLifetime
+	gwa = append(gwa, cfg.GatewayHints...)
+	gwa = append(gwa, resolveGatewayHints(cfg)...)
+	return gwa, nil
+}
+
+// Returns the registered mapping for cfg, with shared set, if there is one,
+// having counted the new reference to it. Otherwise, creates and registers a
+// new mapping and returns it with the gateways it is to use, which are those
+// returned by gatherGateways. Must be called with registryMutex held.
+func registerMapping(cfg Config, h *Handle, gwa []net.IP, gwErr error) (m *mapping, _ []net.IP, shared bool, err error) {
+	// Simulated mappings are kept out of the registry so that they cannot be
+	// confused with the mappings of the process.
+	key := mappingKey{Protocol: cfg.Protocol, InternalPort: cfg.InternalPort}
+	if m := registry[key]; m != nil && cfg.sim == nil {
+		m.mutex.Lock()
+		m.refs++
+		m.mutex.Unlock()
+		return m, nil, true, nil
 	}
 
-	m := &mapping{
-		cfg:        cfg,
-		abortChan:  make(chan struct{}),
-		notifyChan: make(chan struct{}, 1),
+	if maxMappings > 0 && len(registry) >= maxMappings && cfg.sim == nil {
+		return nil, nil, false, ErrTooManyMappings
 	}
 
-	ssdp.Start()
-	go m.portMappingLoop(gwa)
+	if gwErr != nil {
+		return nil, nil, false, gwErr
+	}
 
-	return m, nil
+	m = &mapping{
+		cfg:             cfg,
+		rkey:            key,
+		state:           negotiated{internalPort: cfg.InternalPort, externalPort: cfg.ExternalPort, lifetime: cfg.Lifetime},
+		backoff:         cfg.Backoff,
+		updatePort:      cfg.InternalPort,
+		created:         cfg.now(),
+		ports:           newPortSource(&cfg),
+		deactivatedTime: cfg.now(),
+		abortChan:       make(chan struct{}),
+		doneChan:        make(chan struct{}),
+		signalChan:      make(chan struct{}, 1),
+		refs:            1,
+		pending:         len(gwa) == 0 && cfg.WaitForGateway && cfg.Backend == nil,
+	}
+
+	if h != nil {
+		m.restore(h)
+	}
+
+	if cfg.sim == nil {
+		registry[key] = m
+	}
+
+	if cfg.AllGateways && len(gwa) > 1 {
+		for _, gw := range gwa {
+			m.children = append(m.children, m.newChild())
+			m.childGWs = append(m.childGWs, gw)
+		}
+	} else if cfg.Standby && cfg.Backend == nil && len(gwa) > 1 {
+		for i, gw := range gwa[:2] {
+			c := m.newChild()
+			c.standby = i == 1
+			m.children = append(m.children, c)
+			m.childGWs = append(m.childGWs, gw)
+		}
+	}
+
+	return m, gwa, false, nil
+}
+
+func newPortSource(cfg *Config) *upnp.PortSource {
+	src := upnp.NewPortSource(cfg.Name, cfg.InternalPort)
+	if cfg.ExcludedExternalPorts != nil {
+		src.SetExcluded(cfg.ExcludedExternalPorts)
+	}
+
+	return src
 }
 
 var ErrGlobalIP = fmt.Errorf("machine is on global internet, port mapping not required")
 
+var ErrInvalidLifetime = fmt.Errorf("MinLifetime exceeds MaxLifetime")
+
+// Fills in the lifetime defaults and brings Lifetime within MinLifetime and
+// MaxLifetime.
+func setLifetimeDefaults(cfg *Config) error {
+	if cfg.Lifetime == 0 {
+		cfg.Lifetime = DefaultLifetime
+	}
+
+	if cfg.MinGrantedLifetime == 0 {
+		cfg.MinGrantedLifetime = DefaultMinGrantedLifetime
+	}
+
+	if cfg.MinLifetime == 0 {
+		cfg.MinLifetime = DefaultMinLifetime
+	}
+
+	if cfg.MaxLifetime == 0 {
+		cfg.MaxLifetime = DefaultMaxLifetime
+	}
+
+	if cfg.MinLifetime > cfg.MaxLifetime {
+		return ErrInvalidLifetime
+	}
+
+	if cfg.Lifetime < cfg.MinLifetime {
+		log.Infof("lifetime %v is too short, using %v", cfg.Lifetime, cfg.MinLifetime)
+		cfg.Lifetime = cfg.MinLifetime
+	} else if cfg.Lifetime > cfg.MaxLifetime {
+		log.Infof("lifetime %v is too long, using %v", cfg.Lifetime, cfg.MaxLifetime)
+		cfg.Lifetime = cfg.MaxLifetime
+	}
+
+	return nil
+}
+
 // Returns true if the machine has a globally routable IP and port mapping is
 // thus not required.
 func IsGloballyRoutable() bool {
@@ -146,9 +649,25 @@ func isGloballyRoutable() (bool, net.IP) {
 	return ip.IsGlobalUnicast(), ip
 }
 
-// Figure out our own IP.
+// Figure out our own IP. In local-only mode, this is relative to the default
+// gateway rather than a public address.
 func determineSelfIP() (net.IP, error) {
-	c, err := net.Dial("udp", "4.2.2.1")
+	dst := "4.2.2.1"
+	if localnet.Enabled() {
+		gwa, err := ipv4Gateways()
+		if err != nil {
+			return nil, err
+		}
+		if len(gwa) == 0 {
+			return nil, ErrNoGateway
+		}
+		if err := localnet.CheckIP(gwa[0]); err != nil {
+			return nil, err
+		}
+		dst = net.JoinHostPort(gwa[0].String(), "5351")
+	}
+
+	c, err := net.Dial("udp", dst)
 	if err != nil {
 		return nil, err
 	}
@@ -165,24 +684,226 @@ type mapping struct {
 
 	// m: Protected by mutex
 
-	cfg Config // m(ExternalPort)
+	// The configuration given to New, with defaults filled in. Not modified
+	// once the mapping is created; values negotiated with the gateway are
+	// kept in state instead.
+	cfg   Config
+	state negotiated // m
+
+	// The backoff state, initially Config.Backoff. Used only by the loop.
+	backoff denet.Backoff
 
-	expireTime time.Time // m
+	// The key under which the mapping is registered. Guarded by
+	// registryMutex.
+	rkey mappingKey
 
+	// The internal port requested by Update, which the loop applies to state
+	// before its next attempt.
+	updatePort uint16 // m
+
+	expireTime      time.Time // m
+	deactivatedTime time.Time // m
+	method          Method    // m
+	scopeEnforced   bool      // m
+	grantedPort     uint16    // m
+	gateway         net.IP    // m
+	pending         bool      // m
+	detached        bool      // m
+
+	// The transition mechanism found by the last failed attempt.
+	transition Transition // m
+
+	// The error from the most recent attempt, or nil if it succeeded.
+	lastErr error // m
+
+	// Why the mapping stopped being maintained, if it has.
+	stopReason InactiveReason // m
+
+	// The timings of the attempt in progress, and of the last one completed.
+	timings     Timings // m
+	lastTimings Timings // m
+
+	// Set if the mapping was created by Attach.
+	attached *Handle
+
+	created      time.Time
+	gatewayWait  time.Duration // m
+	timeToActive time.Duration // m
+
+	refs      int           // m
 	aborted   bool          // m
 	abortChan chan struct{} // m
 
-	notifyChan chan struct{} // m
+	// Closed once the mapping has been torn down after being deleted.
+	doneChan chan struct{}
+
+	signalChan chan struct{}
+	lastSignal time.Time // m
+
+	// The subscriptions of the references to the mapping, to which
+	// notifications and events are sent.
+	subsMutex sync.Mutex
+	subs      []*subscription // subsMutex
+
+	externalAddr string       // m
+	upnpService  *UPnPService // m
+
+	// The state as of the last notification, and the number of times it has
+	// changed.
+	notified notifyState // m
+	version  uint64      // m
+
+	// Signalled alongside the subscriptions, for AddrChan.
+	watchers watchers // m
+
+	backendResult BackendResult // m
+
+	// The source of external ports chosen when none is specified.
+	ports *upnp.PortSource
+
+	// Set if Config.AllGateways is used. The children each maintain the
+	// mapping on a single gateway, and the parent mirrors the state of the
+	// first active child.
+	parent   *mapping
+	children []*mapping
+	childGWs []net.IP
+
+	// Set if Config.Standby is used. standby is set on the second child while
+	// it is to maintain a standby mapping, and standbyMapped is set if the
+	// mapping it currently holds is a standby mapping. primaryDown is set on
+	// the parent while the first gateway is failing to respond to probes,
+	// and attemptFailed on a child if its last attempt to acquire the
+	// mapping failed.
+	standby       bool // m
+	standbyMapped bool // m
+	primaryDown   bool // m
+	attemptFailed bool // m
+
+	// Set by Mapping.Disable until Mapping.Enable is called.
+	disabled bool // m
+
+	// Set if the gateway refused to map the port because this host is its
+	// DMZ host, so that nothing was mapped.
+	dmz bool // m
+
+	// The result of the hairpin test requested by Config.DetectHairpin, and
+	// the external address tested.
+	hairpin     Hairpin // m
+	hairpinAddr string  // m
+}
+
+func (m *mapping) SignalConnectivityChange() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.now()
+	if now.Sub(m.lastSignal) < SignalMinInterval {
+		return
+	}
+
+	m.lastSignal = now
+	m.revalidate()
+}
+
+// Causes the mapping to be re-validated immediately, without rate limiting.
+// Doesn't block.
+func (m *mapping) revalidate() {
+	select {
+	case m.signalChan <- struct{}{}:
+	default:
+	}
+}
+
+// Each call to New returns a distinct mappingRef, so that each caller can
+// release its own reference exactly once, and has its own notification and
+// event channels.
+type mappingRef struct {
+	*mapping
+	once sync.Once
+	tags map[string]string
+	sub  *subscription
+
+	// Closed when the reference is released, and the channels this
+	// reference added to the mapping's watchers for AddrChan.
+	done     chan struct{}
+	watchers []<-chan struct{} // mapping's m
+}
+
+// Returns a new reference to the mapping. The caller must already have
+// counted the reference in refs.
+func (m *mapping) newRef(tags map[string]string) *mappingRef {
+	return &mappingRef{
+		mapping: m,
+		tags:    copyTags(tags),
+		sub:     m.subscribe(),
+		done:    make(chan struct{}),
+	}
+}
+
+func (r *mappingRef) NotifyChan() <-chan struct{} {
+	return r.sub.notifyChan
+}
+
+func (r *mappingRef) Events() <-chan Event {
+	return r.sub.eventChan
+}
+
+func (r *mappingRef) Delete() {
+	r.once.Do(func() {
+		r.detachStreams()
+		r.mapping.release()
+	})
+}
+
+// Stops sending notifications, events and endpoints to this reference, so
+// that its streams end without affecting those of other references.
+func (r *mappingRef) detachStreams() {
+	m := r.mapping
+	m.unsubscribe(r.sub)
+
+	m.mutex.Lock()
+	for _, c := range r.watchers {
+		m.watchers.remove(c)
+	}
+	r.watchers = nil
+	m.mutex.Unlock()
+
+	close(r.done)
+}
+
+func (r *mappingRef) Close() error {
+	r.Delete()
+	return nil
+}
 
-	externalAddr string // m
-	prevValue    string
+func (r *mappingRef) Tags() map[string]string {
+	return r.tags
 }
 
-func (m *mapping) NotifyChan() <-chan struct{} {
-	return m.notifyChan
+func (r *mappingRef) Status() Status {
+	s := r.mapping.Status()
+	s.Tags = r.tags
+	return s
 }
 
-func (m *mapping) Delete() {
+func copyTags(tags map[string]string) map[string]string {
+	if tags == nil {
+		return nil
+	}
+
+	c := make(map[string]string, len(tags))
+	for k, v := range tags {
+		c[k] = v
+	}
+
+	return c
+}
+
+// Releases a reference to the mapping, deleting it if no references remain.
+func (m *mapping) release() {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
@@ -190,6 +911,15 @@ func (m *mapping) Delete() {
 		return
 	}
 
+	m.refs--
+	if m.refs > 0 {
+		return
+	}
+
+	if registry[m.key()] == m {
+		delete(registry, m.key())
+	}
+
 	close(m.abortChan)
 	m.aborted = true
 }
@@ -198,15 +928,106 @@ func (m *mapping) ExternalAddr() string {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	if !m.isActive() || m.cfg.ExternalPort == 0 {
+	return m.externalAddrStr()
+}
+
+// The address is formed from the port most recently granted by the gateway,
+// not the port in cfg, which is only the port to be requested next and may
+// be changed while an attempt is in progress.
+func (m *mapping) externalAddrStr() string {
+	if !m.isActive() || m.grantedPort == 0 {
 		return ""
 	}
 
-	return net.JoinHostPort(m.externalAddr, strconv.FormatUint(uint64(m.cfg.ExternalPort), 10))
+	return net.JoinHostPort(externalHost(m.externalAddr), strconv.FormatUint(uint64(m.grantedPort), 10))
 }
 
+// Returns addr, the external address reported by a gateway, in the form used
+// by ExternalAddr, or an empty string if it is of no use to a remote peer.
+// A gateway with no external address may report an unspecified, loopback or
+// link-local address, which is treated as unknown rather than offered as if
+// it were reachable, as is a scoped address.
+func externalHost(addr string) string {
+	if strings.IndexByte(addr, '%') >= 0 {
+		return ""
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return addr
+	}
+
+	if ip.IsUnspecified() || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return ""
+	}
+
+	// an IPv4-mapped address is given in dotted form
+	return ip.String()
+}
+
+func (m *mapping) UPnPService() (svc UPnPService, ok bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.upnpService == nil {
+		return
+	}
+
+	return *m.upnpService, true
+}
+
+// Records the external port granted by a gateway, emitting
+// ExternalPortChanged if it differs from the port previously granted. A zero
+// port means the gateway did not say which port was granted, so the previous
+// port, if any, is retained. Must be called with the mutex held.
+func (m *mapping) setGrantedPort(method Method, port uint16) {
+	if port == 0 {
+		return
+	}
+
+	if m.grantedPort != 0 && m.grantedPort != port {
+		log.Infof("%v gateway changed external port from %d to %d", method, m.grantedPort, port)
+		m.emit(ExternalPortChanged{Method: method, From: m.grantedPort, To: port})
+	}
+
+	m.grantedPort = port
+	m.state.externalPort = port
+}
+
+// Records the lifetime granted by a gateway, emitting LifetimeCapped if it is
+// below Config.MinGrantedLifetime and differs from the lifetime previously
+// granted. Must be called with the mutex held.
+func (m *mapping) setGrantedLifetime(method Method, lifetime time.Duration) {
+	min := m.cfg.MinGrantedLifetime
+	if min > m.cfg.Lifetime {
+		min = m.cfg.Lifetime
+	}
+
+	if lifetime < min && lifetime != m.state.lifetime {
+		log.Infof("%v gateway granted a lifetime of %v, less than the %v requested", method, lifetime, m.cfg.Lifetime)
+		m.emit(LifetimeCapped{Method: method, Requested: m.cfg.Lifetime, Granted: lifetime})
+	}
+
+	m.state.lifetime = lifetime
+}
+
+// Expiry is judged by the wall clock, since the monotonic clock may not have
+// advanced while the system was suspended, whereas the gateway's clock did.
 func (m *mapping) isActive() bool {
-	return !m.expireTime.IsZero() && m.expireTime.After(time.Now())
+	return !m.expireTime.IsZero() && m.expireTime.After(m.now().Round(0))
+}
+
+// Returns the current time, which is virtual time for a simulated mapping.
+func (m *mapping) now() time.Time {
+	return m.cfg.now()
+}
+
+func (cfg *Config) now() time.Time {
+	if cfg.sim != nil {
+		return cfg.sim.Now()
+	}
+
+	return time.Now()
 }
 
 func (m *mapping) lIsActive() bool {
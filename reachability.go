@@ -0,0 +1,228 @@
+package portmap
+
+import "context"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "net"
+import "net/http"
+import "net/url"
+import "sync"
+import "time"
+import "github.com/hlandau/portmap/internal/localnet"
+import "github.com/hlandau/portmap/internal/parse"
+
+// The result of TestReachability.
+type Reachability int
+
+const (
+	// Returned alongside an error, when the test could not be carried out.
+	ReachabilityUnknown Reachability = iota
+
+	// The address was reached from outside the local network.
+	ReachabilityOpen
+
+	// Attempts to reach the address from outside the local network went
+	// unanswered, which usually means a firewall upstream of the gateway,
+	// such as that of a carrier-grade NAT, is dropping the traffic.
+	ReachabilityFiltered
+
+	// Attempts to reach the address from outside the local network were
+	// refused. Either the gateway did not forward the traffic, or nothing is
+	// listening on the internal port.
+	ReachabilityRefused
+
+	// The address could not be reached from outside the local network, but
+	// could be reached from this host, because the gateway supports hairpin
+	// NAT. The mapping exists on the gateway, but something beyond it
+	// prevents traffic arriving, usually carrier-grade NAT.
+	ReachabilityHairpinOnly
+)
+
+func (r Reachability) String() string {
+	switch r {
+	case ReachabilityUnknown:
+		return "unknown"
+	case ReachabilityOpen:
+		return "open"
+	case ReachabilityFiltered:
+		return "filtered"
+	case ReachabilityRefused:
+		return "refused"
+	case ReachabilityHairpinOnly:
+		return "hairpin-only"
+	default:
+		return fmt.Sprintf("Reachability(%d)", int(r))
+	}
+}
+
+// Returned by TestReachability if no endpoint has been set with
+// SetReachabilityEndpoint.
+var ErrNoReachabilityEndpoint = errors.New("no reachability endpoint has been set")
+
+var reachabilityMutex sync.Mutex
+var reachabilityEndpoint string
+
+// Sets the URL of the service used by TestReachability. The service must run
+// outside the local network, and is usually run by the application's
+// developers alongside their other servers.
+//
+// The service is sent a GET request with the query parameters "addr", the
+// address to test in "IP:port" format, and "proto", either "tcp" or "udp".
+// It should attempt to reach the address and respond with status 200 and a
+// JSON object whose "result" member is "open", "refused" or "filtered". For
+// TCP, the address is open if a connection can be established. For UDP, the
+// service should send a datagram and report the address open if any reply
+// is received, and filtered otherwise.
+//
+// Pass an empty string to clear the endpoint.
+func SetReachabilityEndpoint(endpoint string) {
+	reachabilityMutex.Lock()
+	defer reachabilityMutex.Unlock()
+	reachabilityEndpoint = endpoint
+}
+
+// Time allowed for this host to reach an external address itself, to detect
+// hairpin NAT.
+const hairpinTimeout = 3 * time.Second
+
+// Maximum size of a response from the reachability endpoint which will be
+// accepted.
+const reachabilityMaxResponse = 64 << 10
+
+// Returned when the reachability endpoint responds with an unsuccessful
+// status or a response which can't be understood.
+var errReachabilityResponse = errors.New("unexpected response from reachability endpoint")
+
+// Verifies that externalAddr, in "IP:port" format as returned by
+// Mapping.ExternalAddr, can be reached from outside the local network, using
+// the service set with SetReachabilityEndpoint. A mapping being active only
+// shows that the gateway accepted it; this shows that traffic actually
+// arrives, which it may not behind carrier-grade NAT or an upstream firewall.
+//
+// Something must be listening on the mapping's internal port. For UDP, it
+// must reply to datagrams, since otherwise there is no way to tell that a
+// datagram arrived.
+//
+// If the address can't be reached from outside, this host tries to reach it
+// itself, and ReachabilityHairpinOnly is returned if it can. Returns
+// ErrNoReachabilityEndpoint if no endpoint has been set.
+func TestReachability(ctx context.Context, externalAddr string, proto Protocol) (Reachability, error) {
+	reachabilityMutex.Lock()
+	endpoint := reachabilityEndpoint
+	reachabilityMutex.Unlock()
+
+	if endpoint == "" {
+		return ReachabilityUnknown, ErrNoReachabilityEndpoint
+	}
+
+	if localnet.Enabled() {
+		return ReachabilityUnknown, ErrNotLocal
+	}
+
+	if proto != TCP && proto != UDP {
+		return ReachabilityUnknown, fmt.Errorf("cannot test reachability for protocol %v", proto)
+	}
+
+	if _, _, err := net.SplitHostPort(externalAddr); err != nil {
+		return ReachabilityUnknown, err
+	}
+
+	r, err := queryReachability(ctx, endpoint, externalAddr, proto)
+	if err != nil || r == ReachabilityOpen {
+		return r, err
+	}
+
+	if reachableLocally(ctx, externalAddr, proto) {
+		return ReachabilityHairpinOnly, nil
+	}
+
+	return r, nil
+}
+
+type reachabilityResponse struct {
+	Result string `json:"result"`
+}
+
+// Asks the reachability endpoint to reach addr.
+func queryReachability(ctx context.Context, endpoint, addr string, proto Protocol) (Reachability, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return ReachabilityUnknown, err
+	}
+
+	q := u.Query()
+	q.Set("addr", addr)
+	q.Set("proto", proto.String())
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return ReachabilityUnknown, err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return ReachabilityUnknown, err
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return ReachabilityUnknown, fmt.Errorf("%w: HTTP status %d", errReachabilityResponse, res.StatusCode)
+	}
+
+	b, err := parse.ReadLimited(res.Body, reachabilityMaxResponse)
+	if err != nil {
+		return ReachabilityUnknown, err
+	}
+
+	var rr reachabilityResponse
+	err = json.Unmarshal(b, &rr)
+	if err != nil {
+		return ReachabilityUnknown, fmt.Errorf("%w: %v", errReachabilityResponse, err)
+	}
+
+	switch rr.Result {
+	case "open":
+		return ReachabilityOpen, nil
+	case "refused":
+		return ReachabilityRefused, nil
+	case "filtered":
+		return ReachabilityFiltered, nil
+	default:
+		return ReachabilityUnknown, fmt.Errorf("%w: result %q", errReachabilityResponse, rr.Result)
+	}
+}
+
+// Returns true if this host can reach addr, which is only possible for an
+// external address if the gateway supports hairpin NAT.
+func reachableLocally(ctx context.Context, addr string, proto Protocol) bool {
+	ctx, cancel := context.WithTimeout(ctx, hairpinTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, proto.String(), addr)
+	if err != nil {
+		return false
+	}
+
+	defer conn.Close()
+	if proto == TCP {
+		return true
+	}
+
+	deadline, _ := ctx.Deadline()
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		return false
+	}
+
+	_, err = conn.Write([]byte("portmap reachability test"))
+	if err != nil {
+		return false
+	}
+
+	var buf [1]byte
+	_, err = conn.Read(buf[:])
+	return err == nil
+}
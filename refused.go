@@ -0,0 +1,12 @@
+// +build !plan9
+
+package portmap
+
+import "errors"
+import "syscall"
+
+// Returns true if err reports that the connection was refused, as when an
+// ICMP port unreachable message is received in reply to a datagram.
+func isConnRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
@@ -0,0 +1,6 @@
+package portmap
+
+// Plan 9 has no ECONNREFUSED, so such errors are not recognised.
+func isConnRefused(err error) bool {
+	return false
+}
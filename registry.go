@@ -0,0 +1,99 @@
+package portmap
+
+import "errors"
+import "sync"
+import "github.com/hlandau/portmap/ssdp"
+
+// Mappings are coalesced by protocol and internal port.
+type mappingKey struct {
+	Protocol     Protocol
+	InternalPort uint16
+}
+
+var registryMutex sync.Mutex
+var registry = map[mappingKey]*mapping{}
+var maxMappings int
+
+var ErrTooManyMappings = errors.New("maximum number of port mappings for this process reached")
+
+// Sets the maximum number of distinct mappings which may exist in the
+// process at once. Calls to New which would create a mapping beyond this
+// limit fail with ErrTooManyMappings. Calls to New which are coalesced with
+// an existing mapping are not affected. Zero, the default, means no limit.
+func SetMaxMappings(n int) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	maxMappings = n
+}
+
+// Removes the mapping from the registry so that later calls to New create a
+// new mapping.
+func (m *mapping) deregister() {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if registry[m.key()] == m {
+		delete(registry, m.key())
+	}
+}
+
+// Returns the number of distinct mappings in the process.
+func mappingCount() int {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	return len(registry)
+}
+
+func (m *mapping) key() mappingKey {
+	return m.rkey
+}
+
+func init() {
+	ssdp.AddDeviceChangeHandler(deviceChanged)
+	ssdp.AddStateHandler(discoveryStateChanged)
+}
+
+// Informs every mapping which uses SSDP that discovery has stopped working or
+// recovered.
+func discoveryStateChanged(err error) {
+	var ev Event = DiscoveryRestored{}
+	if err != nil {
+		log.Infof("SSDP discovery degraded: %v", err)
+		ev = DiscoveryDegraded{Err: err}
+	}
+
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	for _, m := range registry {
+		if m.cfg.Backend == nil {
+			m.emit(ev)
+		}
+	}
+}
+
+// Re-validates the mappings maintained via a UPnP service whose device has
+// rebooted or changed its configuration, since the device may have lost them.
+func deviceChanged(svc ssdp.Service) {
+	registryMutex.Lock()
+	var ms []*mapping
+	for _, m := range registry {
+		if len(m.children) > 0 {
+			ms = append(ms, m.children...)
+		} else {
+			ms = append(ms, m)
+		}
+	}
+	registryMutex.Unlock()
+
+	for _, m := range ms {
+		m.mutex.Lock()
+		uses := m.method == MethodUPnP && m.upnpService != nil && m.upnpService.USN == svc.USN
+		m.mutex.Unlock()
+
+		if uses {
+			log.Infof("UPnP device for %q has rebooted or changed configuration, re-validating mapping", svc.USN)
+			m.revalidate()
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package portmap
+
+import "context"
+import "runtime"
+import "testing"
+import "time"
+
+// Verifies that no background goroutines remain once the last reference to a
+// mapping has been released, including those of SSDP discovery.
+func TestNoGoroutinesAfterDelete(t *testing.T) {
+	SetLocalOnly(true)
+	defer SetLocalOnly(false)
+
+	before := runtime.NumGoroutine()
+
+	var ms []Mapping
+	for i := 0; i < 2; i++ {
+		m, err := New(Config{
+			Protocol:       UDP,
+			Name:           "test",
+			InternalPort:   40123,
+			WaitForGateway: true,
+		})
+		if err == ErrGlobalIP {
+			t.Skip("host is globally routable")
+		}
+		if err != nil {
+			t.Fatalf("cannot create mapping: %v", err)
+		}
+
+		ms = append(ms, m)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for _, m := range ms {
+		err := m.DeleteWait(ctx)
+		if err != nil {
+			t.Fatalf("mapping was not deleted: %v", err)
+		}
+	}
+
+	// Goroutines which have been told to exit may take a moment to do so.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := runtime.NumGoroutine(); n > before {
+		buf := make([]byte, 1<<20)
+		buf = buf[:runtime.Stack(buf, true)]
+		t.Fatalf("%d goroutines before New, %d after the last Delete:\n%s", before, n, buf)
+	}
+}
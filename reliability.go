@@ -0,0 +1,286 @@
+package portmap
+
+import "encoding/json"
+import "io/ioutil"
+import "sort"
+import "sync"
+import "time"
+
+// The reliability of a gateway as learned from renewing mappings made with
+// it. Gateways which fail renewals or lose mappings before their lifetime
+// elapses have their mappings renewed earlier, so that there is time to
+// retry before the mapping lapses. See GatewayReliabilities.
+type GatewayReliability struct {
+	// The gateway: the IP address of a NAT-PMP gateway, the device URL of a
+	// UPnP service, or the name of a Backend.
+	Gateway string `json:"gateway"`
+
+	// The number of renewals attempted and the number which succeeded. Older
+	// attempts are given progressively less weight, so that a gateway which
+	// improves is eventually treated as reliable again.
+	Renewals  float64 `json:"renewals"`
+	Successes float64 `json:"successes"`
+
+	// The number of successful renewals in which the gateway granted a
+	// different external port, which means it did not honour the lease and
+	// lost the mapping before its lifetime elapsed.
+	LeasesBroken float64 `json:"leasesBroken"`
+
+	// The time of the most recent renewal.
+	Updated time.Time `json:"updated"`
+}
+
+// Returns the fraction of renewals which succeeded, or 1 if none have been
+// attempted.
+func (r *GatewayReliability) SuccessRatio() float64 {
+	if r.Renewals == 0 {
+		return 1
+	}
+
+	return r.Successes / r.Renewals
+}
+
+// Returns the fraction of the granted lifetime after which mappings with the
+// gateway are renewed. This is one half for a reliable gateway, or for one
+// with too little history to judge, and less for one which fails renewals
+// or loses mappings.
+func (r *GatewayReliability) RenewFraction() float64 {
+	if r.Renewals < minReliabilitySamples {
+		return 0.5
+	}
+
+	ratio := r.SuccessRatio()
+	broken := r.LeasesBroken / r.Renewals
+	switch {
+	case ratio < 0.5 || broken > 0.2:
+		return 0.25
+	case ratio < 0.9 || broken > 0:
+		return 0.4
+	default:
+		return 0.5
+	}
+}
+
+// The number of renewals needed before a gateway's reliability is judged.
+const minReliabilitySamples = 5
+
+// Once this many renewals have been counted for a gateway, the counts are
+// halved, which bounds the weight given to old attempts.
+const reliabilityWindow = 100
+
+// Records older than this are discarded.
+const reliabilityMaxAge = 90 * 24 * time.Hour
+
+var reliabilityMutex sync.Mutex
+var reliabilityPath string
+var reliabilityTable map[string]*GatewayReliability // reliabilityMutex; nil if not loaded
+var reliabilityWritten time.Time                    // reliabilityMutex
+
+// The longest the reliability file goes without being rewritten while
+// renewals are being recorded.
+const reliabilityWriteInterval = 1 * time.Hour
+
+// Sets a file in which gateway reliability is recorded, so that what has
+// been learned about a gateway survives restarts of the program. Pass an
+// empty string to keep reliability in memory only, which is the default.
+func SetReliabilityFile(path string) {
+	reliabilityMutex.Lock()
+	defer reliabilityMutex.Unlock()
+
+	reliabilityPath = path
+	reliabilityTable = nil
+	reliabilityWritten = time.Time{}
+}
+
+// Returns what has been learned about the reliability of each gateway with
+// which mappings have been renewed, ordered by gateway.
+func GatewayReliabilities() []GatewayReliability {
+	reliabilityMutex.Lock()
+	defer reliabilityMutex.Unlock()
+
+	loadReliability()
+
+	return reliabilityList(reliabilityTable)
+}
+
+func reliabilityList(table map[string]*GatewayReliability) []GatewayReliability {
+	rs := make([]GatewayReliability, 0, len(table))
+	for _, r := range table {
+		rs = append(rs, *r)
+	}
+
+	sort.Slice(rs, func(i, j int) bool {
+		return rs[i].Gateway < rs[j].Gateway
+	})
+	return rs
+}
+
+// Must be called with reliabilityMutex held.
+func loadReliability() {
+	if reliabilityTable != nil {
+		return
+	}
+
+	reliabilityTable = map[string]*GatewayReliability{}
+	if reliabilityPath == "" {
+		return
+	}
+
+	b, err := ioutil.ReadFile(reliabilityPath)
+	if err != nil {
+		return
+	}
+
+	var rs []GatewayReliability
+	err = json.Unmarshal(b, &rs)
+	if err != nil {
+		log.Infof("ignoring malformed reliability file: %v", err)
+		return
+	}
+
+	for i := range rs {
+		if rs[i].Gateway != "" && time.Since(rs[i].Updated) < reliabilityMaxAge {
+			reliabilityTable[rs[i].Gateway] = &rs[i]
+		}
+	}
+}
+
+// Must be called with reliabilityMutex held.
+func writeReliability() {
+	if reliabilityPath == "" {
+		return
+	}
+
+	rs := make([]GatewayReliability, 0, len(reliabilityTable))
+	for _, r := range reliabilityTable {
+		rs = append(rs, *r)
+	}
+
+	b, err := json.Marshal(rs)
+	if err != nil {
+		return
+	}
+
+	err = writeFileAtomic(reliabilityPath, ".portmap-reliability", b)
+	if err != nil {
+		log.Infof("cannot write reliability file: %v", err)
+		return
+	}
+
+	reliabilityWritten = time.Now()
+}
+
+// Returns the fraction of the lifetime after which mappings with the given
+// gateway should be renewed.
+func renewFraction(gateway string) float64 {
+	reliabilityMutex.Lock()
+	defer reliabilityMutex.Unlock()
+
+	loadReliability()
+	if r := reliabilityTable[gateway]; r != nil {
+		return r.RenewFraction()
+	}
+
+	return 0.5
+}
+
+// Records the outcome of a renewal with the given gateway.
+func recordRenewal(gateway string, ok, leaseBroken bool) {
+	reliabilityMutex.Lock()
+	defer reliabilityMutex.Unlock()
+
+	loadReliability()
+	r := reliabilityTable[gateway]
+	if r == nil {
+		r = &GatewayReliability{Gateway: gateway}
+		reliabilityTable[gateway] = r
+	}
+
+	// Renewals are frequent, so the file is only rewritten when the renewal
+	// schedule changes, or occasionally to keep the counts current.
+	fraction := r.RenewFraction()
+	r.record(ok, leaseBroken, time.Now())
+	if r.RenewFraction() != fraction || time.Since(reliabilityWritten) >= reliabilityWriteInterval {
+		writeReliability()
+	}
+}
+
+func (r *GatewayReliability) record(ok, leaseBroken bool, now time.Time) {
+	if r.Renewals >= reliabilityWindow {
+		r.Renewals /= 2
+		r.Successes /= 2
+		r.LeasesBroken /= 2
+	}
+
+	r.Renewals++
+	if ok {
+		r.Successes++
+	}
+	if leaseBroken {
+		r.LeasesBroken++
+	}
+	r.Updated = now.UTC()
+}
+
+// The gateway with which a mapping is active, and the port it granted.
+type renewalState struct {
+	gateway string
+	port    uint16
+}
+
+// Returns the gateway with which the mapping is currently active, or an empty
+// string if it is not active. Must be called with the mutex held.
+func (m *mapping) reliabilityKey() string {
+	if !m.isActive() {
+		return ""
+	}
+
+	switch m.method {
+	case MethodNATPMP:
+		if m.gateway != nil {
+			return m.gateway.String()
+		}
+	case MethodUPnP:
+		if m.upnpService != nil {
+			return m.upnpService.PreferredLocation().String()
+		}
+	case MethodBackend:
+		return m.backend().Name()
+	}
+
+	return ""
+}
+
+func (m *mapping) lRenewalState() renewalState {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return renewalState{gateway: m.reliabilityKey(), port: m.grantedPort}
+}
+
+// Records the outcome of an attempt made while the mapping was active as
+// described by before. An attempt which succeeded only by moving the mapping
+// to another gateway counts as a failure of the original one.
+func (m *mapping) recordRenewal(before renewalState, ok bool) {
+	if before.gateway == "" {
+		return
+	}
+
+	after := m.lRenewalState()
+	ok = ok && after.gateway == before.gateway
+	leaseBroken := ok && after.port != before.port
+	if m.cfg.sim != nil {
+		m.cfg.sim.recordRenewal(before.gateway, ok, leaseBroken)
+		return
+	}
+
+	recordRenewal(before.gateway, ok, leaseBroken)
+}
+
+func (m *mapping) renewFraction(gateway string) float64 {
+	if m.cfg.sim != nil {
+		return m.cfg.sim.renewFraction(gateway)
+	}
+
+	return renewFraction(gateway)
+}
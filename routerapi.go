@@ -0,0 +1,199 @@
+package portmap
+
+import "bytes"
+import "crypto/tls"
+import "encoding/json"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net"
+import "net/http"
+import "net/url"
+import "time"
+import "github.com/hlandau/portmap/internal/localnet"
+
+// Addressing and credentials for a router's management API, used by the
+// backends which create port forwards through such APIs. These are for
+// networks where NAT-PMP and UPnP are administratively disabled but API
+// access is available. Set the backend as Config.Backend, or as
+// Config.Fallback to use it only when NAT-PMP and UPnP fail.
+type RouterAPIConfig struct {
+	// The base URL of the router, e.g. "https://192.168.88.1".
+	URL string
+
+	// The credentials to authenticate with. Which are used depends on the
+	// backend.
+	Username string
+	Password string
+	APIKey   string
+
+	// The WAN interface on which forwarded traffic arrives. The meaning and
+	// default depend on the backend.
+	WANInterface string
+
+	// The address to forward to. If nil, the address this host uses to reach
+	// the router is used.
+	InternalIP net.IP
+
+	// Used for HTTPS connections to the router. Routers commonly present
+	// self-signed certificates, in which case a configuration with a suitable
+	// RootCAs pool or certificate check must be given. If nil, certificates
+	// are verified against the system roots.
+	TLSConfig *tls.Config
+}
+
+// Timeout for each request to a router API.
+const routerAPITimeout = 15 * time.Second
+
+// Maximum size of a router API response which will be accepted.
+const routerAPIMaxResponse = 4 << 20
+
+type routerAPIClient struct {
+	cfg    RouterAPIConfig
+	base   *url.URL
+	client *http.Client
+	auth   func(req *http.Request)
+}
+
+func newRouterAPIClient(cfg RouterAPIConfig, auth func(cfg *RouterAPIConfig, req *http.Request)) (*routerAPIClient, error) {
+	base, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if base.Host == "" {
+		return nil, fmt.Errorf("router API URL %q has no host", cfg.URL)
+	}
+
+	// Proxy settings from the environment are not used, since the router is
+	// on the local network.
+	tr := &http.Transport{
+		DialContext:     localnet.DialContext,
+		TLSClientConfig: cfg.TLSConfig,
+		IdleConnTimeout: 90 * time.Second,
+	}
+
+	c := &routerAPIClient{
+		cfg:    cfg,
+		base:   base,
+		client: &http.Client{Transport: tr, Timeout: routerAPITimeout},
+	}
+	c.auth = func(req *http.Request) { auth(&c.cfg, req) }
+	return c, nil
+}
+
+// An error response from a router API.
+type RouterAPIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *RouterAPIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("router API: HTTP status %d", e.StatusCode)
+	}
+
+	return fmt.Sprintf("router API: HTTP status %d: %s", e.StatusCode, e.Message)
+}
+
+// Makes a request to the API. If in is not nil, it is sent as JSON. If out is
+// not nil, the response is decoded into it. Requests with a non-2xx status are
+// returned as a *RouterAPIError whose message is the response body.
+func (c *routerAPIClient) do(method, path string, in, out interface{}) error {
+	u := *c.base
+	ref, err := url.Parse(path)
+	if err != nil {
+		return err
+	}
+	u.Path = c.base.Path + ref.Path
+	u.RawQuery = ref.RawQuery
+
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	c.auth(req)
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, routerAPIMaxResponse))
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &RouterAPIError{StatusCode: res.StatusCode, Message: string(bytes.TrimSpace(b))}
+	}
+
+	if out == nil || len(b) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(b, out)
+}
+
+// Returns the address to forward to: RouterAPIConfig.InternalIP if set, or
+// else the address this host uses to reach the router.
+func (c *routerAPIClient) internalIP() (net.IP, error) {
+	if c.cfg.InternalIP != nil {
+		return c.cfg.InternalIP, nil
+	}
+
+	host := c.base.Hostname()
+	port := c.base.Port()
+	if port == "" {
+		port = "80"
+	}
+
+	err := localnet.Check(host)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial("udp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// Router APIs don't choose external ports, so the requested port is used, or
+// the internal port if any port is acceptable.
+func routerAPIExternalPort(req *BackendRequest) uint16 {
+	if req.ExternalPort != 0 {
+		return req.ExternalPort
+	}
+
+	return req.InternalPort
+}
+
+// The description given to forwards created through router APIs, by which
+// they are found again.
+func routerAPIDescription(req *BackendRequest) string {
+	name := req.Name
+	if name == "" {
+		name = "portmap"
+	}
+
+	return fmt.Sprintf("%s (%v %d)", name, req.Protocol, req.InternalPort)
+}
@@ -0,0 +1,211 @@
+package portmap
+
+import "errors"
+import "net"
+import "net/http"
+import "net/url"
+import "strconv"
+import "strings"
+import "sync"
+
+// A Backend which creates dstnat rules on a MikroTik router through the REST
+// API of RouterOS 7. RouterAPIConfig.Username and Password are used with
+// basic authentication; the user needs write access to /ip/firewall/nat.
+//
+// RouterAPIConfig.WANInterface gives the name of the interface on which
+// forwarded traffic arrives. If it is empty, the interface list "WAN" from
+// the RouterOS default configuration is matched instead.
+//
+// RouterOS rules have no lifetime, so the rule persists until Unmap is
+// called. Each renewal checks that the rule still exists and recreates it if
+// not. A RouterOSBackend maintains a single rule and must not be shared
+// between mappings.
+type RouterOSBackend struct {
+	api *routerAPIClient
+
+	mutex  sync.Mutex
+	ruleID string
+}
+
+// Creates a RouterOS backend for the given router.
+func NewRouterOSBackend(cfg RouterAPIConfig) (*RouterOSBackend, error) {
+	api, err := newRouterAPIClient(cfg, func(cfg *RouterAPIConfig, req *http.Request) {
+		req.SetBasicAuth(cfg.Username, cfg.Password)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &RouterOSBackend{api: api}, nil
+}
+
+func (b *RouterOSBackend) Name() string {
+	return "RouterOS"
+}
+
+// The fields of a firewall NAT rule used here. RouterOS represents all values
+// as strings.
+type routerOSRule struct {
+	ID              string `json:".id,omitempty"`
+	Chain           string `json:"chain"`
+	Action          string `json:"action"`
+	Protocol        string `json:"protocol"`
+	DstPort         string `json:"dst-port"`
+	ToAddresses     string `json:"to-addresses"`
+	ToPorts         string `json:"to-ports"`
+	InInterface     string `json:"in-interface,omitempty"`
+	InInterfaceList string `json:"in-interface-list,omitempty"`
+	Comment         string `json:"comment"`
+}
+
+var errRouterOSNoID = errors.New("RouterOS did not return the ID of the new rule")
+
+func (b *RouterOSBackend) Map(req BackendRequest) (BackendResult, error) {
+	ip, err := b.api.internalIP()
+	if err != nil {
+		return BackendResult{}, err
+	}
+
+	want := b.rule(&req, ip)
+
+	b.mutex.Lock()
+	id := b.ruleID
+	b.mutex.Unlock()
+
+	if id == "" {
+		// A rule left behind by a previous run can be reused.
+		id, err = b.find(want.Comment)
+		if err != nil {
+			return BackendResult{}, err
+		}
+	}
+
+	if id != "" {
+		var have routerOSRule
+		err = b.api.do("GET", "/rest/ip/firewall/nat/"+url.PathEscape(id), nil, &have)
+		if err == nil && !sameRouterOSRule(&have, &want) {
+			err = b.api.do("PATCH", "/rest/ip/firewall/nat/"+url.PathEscape(id), &want, nil)
+		}
+		if err != nil {
+			log.Infof("RouterOS rule %s missing or not updatable, recreating: %v", id, err)
+			id = ""
+		}
+	}
+
+	if id == "" {
+		var created routerOSRule
+		err = b.api.do("PUT", "/rest/ip/firewall/nat", &want, &created)
+		if err != nil {
+			return BackendResult{}, err
+		}
+
+		if created.ID == "" {
+			return BackendResult{}, errRouterOSNoID
+		}
+
+		id = created.ID
+	}
+
+	b.mutex.Lock()
+	b.ruleID = id
+	b.mutex.Unlock()
+
+	port, _ := strconv.ParseUint(want.DstPort, 10, 16)
+	return BackendResult{ExternalIP: b.externalIP(), ExternalPort: uint16(port)}, nil
+}
+
+func (b *RouterOSBackend) Unmap(req BackendRequest, prev BackendResult) error {
+	b.mutex.Lock()
+	id := b.ruleID
+	b.ruleID = ""
+	b.mutex.Unlock()
+
+	if id == "" {
+		return nil
+	}
+
+	return b.api.do("DELETE", "/rest/ip/firewall/nat/"+url.PathEscape(id), nil, nil)
+}
+
+func (b *RouterOSBackend) rule(req *BackendRequest, ip net.IP) routerOSRule {
+	r := routerOSRule{
+		Chain:       "dstnat",
+		Action:      "dst-nat",
+		Protocol:    req.Protocol.String(),
+		DstPort:     strconv.Itoa(int(routerAPIExternalPort(req))),
+		ToAddresses: ip.String(),
+		ToPorts:     strconv.Itoa(int(req.InternalPort)),
+		Comment:     routerAPIDescription(req),
+	}
+
+	if b.api.cfg.WANInterface != "" {
+		r.InInterface = b.api.cfg.WANInterface
+	} else {
+		r.InInterfaceList = "WAN"
+	}
+
+	return r
+}
+
+func sameRouterOSRule(a, b *routerOSRule) bool {
+	return a.Chain == b.Chain && a.Action == b.Action && a.Protocol == b.Protocol &&
+		a.DstPort == b.DstPort && a.ToAddresses == b.ToAddresses && a.ToPorts == b.ToPorts &&
+		a.InInterface == b.InInterface && a.InInterfaceList == b.InInterfaceList
+}
+
+// Returns the ID of the rule with the given comment, or an empty string.
+func (b *RouterOSBackend) find(comment string) (string, error) {
+	var rules []routerOSRule
+	err := b.api.do("GET", "/rest/ip/firewall/nat?comment="+url.QueryEscape(comment), nil, &rules)
+	if err != nil {
+		return "", err
+	}
+
+	for _, r := range rules {
+		if r.Comment == comment {
+			return r.ID, nil
+		}
+	}
+
+	return "", nil
+}
+
+// Returns the address of the WAN interface, or nil if it cannot be
+// determined. With the interface list, the first member with an address is
+// used.
+func (b *RouterOSBackend) externalIP() net.IP {
+	ifaces := []string{b.api.cfg.WANInterface}
+	if ifaces[0] == "" {
+		var members []struct {
+			Interface string `json:"interface"`
+		}
+		err := b.api.do("GET", "/rest/interface/list/member?list=WAN", nil, &members)
+		if err != nil {
+			return nil
+		}
+
+		ifaces = ifaces[:0]
+		for _, m := range members {
+			ifaces = append(ifaces, m.Interface)
+		}
+	}
+
+	for _, ifname := range ifaces {
+		var addrs []struct {
+			Address string `json:"address"`
+		}
+		err := b.api.do("GET", "/rest/ip/address?interface="+url.QueryEscape(ifname), nil, &addrs)
+		if err != nil {
+			continue
+		}
+
+		for _, a := range addrs {
+			// addresses are given in CIDR notation
+			if ip := net.ParseIP(strings.SplitN(a.Address, "/", 2)[0]); ip != nil {
+				return ip
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package portmap
+
+import "net"
+
+// Identifies the kind of restriction placed on which remote hosts may use a
+// mapping.
+type ScopeKind int
+
+const (
+	// Any remote host may use the mapping. This is the default.
+	ScopeAny ScopeKind = iota
+
+	// Only the host given by Scope.Peer may use the mapping.
+	ScopePeer
+
+	// Only hosts on the local network may use the mapping, for example via
+	// NAT loopback.
+	ScopeLAN
+)
+
+// Restricts which remote hosts may use a mapping.
+//
+// Not all methods can enforce all scopes. UPnP can restrict a mapping to a
+// single peer; NAT-PMP cannot restrict mappings at all, and no method can
+// restrict a mapping to the local network. If the scope cannot be enforced,
+// the mapping is created without the restriction, and Status.ScopeEnforced
+// is false. Applications which require the restriction should check it.
+type Scope struct {
+	Kind ScopeKind
+
+	// The single remote host permitted to use the mapping, if Kind is
+	// ScopePeer.
+	Peer net.IP
+}
+
+// Returns the remote host to request from a UPnP gateway, and whether the
+// scope is enforced by doing so.
+func (s Scope) upnpRemoteHost() (net.IP, bool) {
+	switch s.Kind {
+	case ScopeAny:
+		return nil, true
+	case ScopePeer:
+		return s.Peer, s.Peer != nil
+	default:
+		return nil, false
+	}
+}
+
+// Returns whether the scope is enforced for NAT-PMP mappings.
+func (s Scope) natpmpEnforced() bool {
+	return s.Kind == ScopeAny
+}
@@ -0,0 +1,533 @@
+package portmap
+
+import "errors"
+import "net"
+import "sort"
+import "sync"
+import "time"
+
+// A deterministic simulation in which mappings run against scripted fake
+// gateways in virtual time. The renewal, backoff and notification logic used
+// is that of real mappings, but virtual time only advances when Run or Step
+// is called and every simulated mapping is waiting, so weeks of operation
+// can be simulated in milliseconds, and a simulation with the same script
+// always unfolds the same way. This allows applications to test how they
+// react to mappings failing, lapsing and changing address.
+//
+// Virtual time starts at midnight UTC on 1 January 2000. Simulated mappings
+// are independent of the mappings in the rest of the process, and what they
+// learn about the reliability of their gateways is kept by the simulation.
+type Simulation struct {
+	mutex       sync.Mutex
+	settled     *sync.Cond
+	now         time.Time                      // m
+	busy        int                            // m; goroutines not waiting on virtual time
+	sleepers    []*simSleeper                  // m
+	reliability map[string]*GatewayReliability // m
+}
+
+// The outcome of waiting on virtual time.
+type simWake int
+
+const (
+	simElapsed simWake = iota
+	simAborted
+	simSignalled
+)
+
+type simSleeper struct {
+	when       time.Time
+	abortChan  <-chan struct{}
+	signalChan <-chan struct{}
+	wake       chan simWake
+}
+
+var simEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Creates a simulation.
+func NewSimulation() *Simulation {
+	s := &Simulation{
+		now:         simEpoch,
+		reliability: map[string]*GatewayReliability{},
+	}
+	s.settled = sync.NewCond(&s.mutex)
+	return s
+}
+
+// Returns the current virtual time.
+func (s *Simulation) Now() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.now
+}
+
+// Returns the virtual time which has elapsed since the simulation began.
+func (s *Simulation) Elapsed() time.Duration {
+	return s.Now().Sub(simEpoch)
+}
+
+// Creates a simulated mapping. cfg.Backend must be set, normally to a
+// SimBackend created by NewBackend; no NAT-PMP or UPnP traffic is generated.
+// The first attempt to create the mapping has been made by the time New
+// returns.
+//
+// The mapping is used as any other. It is only deleted once Run or Step is
+// next called, so DeleteWait blocks unless they are being called
+// concurrently.
+func (s *Simulation) New(cfg Config) (Mapping, error) {
+	if cfg.Backend == nil {
+		return nil, ErrSimulationBackend
+	}
+
+	cfg.sim = s
+	m, err := newLocal(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	s.settle()
+	s.mutex.Unlock()
+	return m, nil
+}
+
+var ErrSimulationBackend = errors.New("a simulated mapping requires Config.Backend")
+
+// Advances virtual time by d, letting every simulated mapping run until
+// then.
+func (s *Simulation) Run(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	until := s.now.Add(d)
+	for s.advance(until) {
+	}
+	s.now = until
+}
+
+// Advances virtual time to the next time at which a simulated mapping is
+// due to act, and lets it act. Returns false if no mapping is waiting, in
+// which case virtual time does not advance.
+func (s *Simulation) Step() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.advance(time.Time{})
+}
+
+// Wakes one waiting goroutine, either because it was aborted or signalled
+// or because its wait ends no later than until, and waits for every
+// goroutine to wait again. If until is zero, any wait may be ended. Returns
+// false if there was nothing to wake. Must be called with the mutex held.
+func (s *Simulation) advance(until time.Time) bool {
+	s.settle()
+
+	sl, w := s.next(until)
+	if sl == nil {
+		return false
+	}
+
+	if w == simElapsed {
+		s.now = sl.when
+	}
+
+	s.wake(sl, w)
+	s.settle()
+	return true
+}
+
+// Returns the goroutine to wake next and why. Goroutines which have been
+// aborted or signalled are woken before time advances. Must be called with
+// the mutex held.
+func (s *Simulation) next(until time.Time) (*simSleeper, simWake) {
+	for _, sl := range s.sleepers {
+		select {
+		case <-sl.abortChan:
+			return sl, simAborted
+		default:
+		}
+
+		select {
+		case <-sl.signalChan:
+			return sl, simSignalled
+		default:
+		}
+	}
+
+	if len(s.sleepers) == 0 {
+		return nil, simElapsed
+	}
+
+	sl := s.sleepers[0]
+	if !until.IsZero() && sl.when.After(until) {
+		return nil, simElapsed
+	}
+
+	return sl, simElapsed
+}
+
+// Waits until every goroutine is waiting on virtual time. Must be called
+// with the mutex held.
+func (s *Simulation) settle() {
+	for s.busy > 0 {
+		s.settled.Wait()
+	}
+}
+
+// Must be called with the mutex held.
+func (s *Simulation) wake(sl *simSleeper, w simWake) {
+	for i := range s.sleepers {
+		if s.sleepers[i] == sl {
+			s.sleepers = append(s.sleepers[:i], s.sleepers[i+1:]...)
+			break
+		}
+	}
+
+	s.busy++
+	sl.wake <- w
+}
+
+// Waits for d of virtual time, or until abortChan is closed or a value is
+// received from signalChan. Either channel may be nil.
+func (s *Simulation) sleep(d time.Duration, abortChan, signalChan <-chan struct{}) simWake {
+	s.mutex.Lock()
+	sl := &simSleeper{
+		when:       s.now.Add(d),
+		abortChan:  abortChan,
+		signalChan: signalChan,
+		wake:       make(chan simWake, 1),
+	}
+	s.sleepers = append(s.sleepers, sl)
+	sort.SliceStable(s.sleepers, func(i, j int) bool {
+		return s.sleepers[i].when.Before(s.sleepers[j].when)
+	})
+	s.exit()
+	s.mutex.Unlock()
+
+	return <-sl.wake
+}
+
+// Called with the mutex held when a goroutine which takes part in the
+// simulation starts, and when it stops.
+func (s *Simulation) enter() {
+	s.busy++
+}
+
+func (s *Simulation) exit() {
+	s.busy--
+	if s.busy == 0 {
+		s.settled.Broadcast()
+	}
+}
+
+// Returns what simulated mappings have learned about the reliability of
+// their gateways, as for GatewayReliabilities.
+func (s *Simulation) Reliabilities() []GatewayReliability {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return reliabilityList(s.reliability)
+}
+
+func (s *Simulation) renewFraction(gateway string) float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if r := s.reliability[gateway]; r != nil {
+		return r.RenewFraction()
+	}
+
+	return 0.5
+}
+
+func (s *Simulation) recordRenewal(gateway string, ok, leaseBroken bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	r := s.reliability[gateway]
+	if r == nil {
+		r = &GatewayReliability{Gateway: gateway}
+		s.reliability[gateway] = r
+	}
+
+	r.record(ok, leaseBroken, s.now)
+}
+
+// A scripted fake gateway for use with a Simulation. It grants mappings
+// as a well-behaved gateway would, except as scheduled by Fail, Timeout,
+// Conflict and Reboot. Times given to these are measured from the start of
+// the simulation.
+type SimBackend struct {
+	sim  *Simulation
+	name string
+	ip   net.IP
+
+	mutex       sync.Mutex
+	maxLifetime time.Duration       // m
+	faults      []simFault          // m
+	reboots     []simReboot         // m
+	mappings    map[simKey]simGrant // m
+	nextPort    uint16              // m
+	calls       int                 // m
+	failures    int                 // m
+}
+
+type simFaultKind int
+
+const (
+	simFail simFaultKind = iota
+	simTimeout
+	simConflict
+)
+
+type simFault struct {
+	kind     simFaultKind
+	from, to time.Duration
+	err      error
+}
+
+type simReboot struct {
+	at, downtime time.Duration
+}
+
+type simKey struct {
+	protocol     Protocol
+	internalPort uint16
+}
+
+type simGrant struct {
+	port    uint16
+	granted time.Time
+	expires time.Time
+}
+
+// How long a request to a SimBackend takes to time out.
+const SimTimeout = 10 * time.Second
+
+// The first external port granted by a SimBackend when any port is
+// acceptable.
+const simFirstPort = 20000
+
+// Creates a fake gateway with the given name and external IP address.
+func (s *Simulation) NewBackend(name string, ip net.IP) *SimBackend {
+	return &SimBackend{
+		sim:      s,
+		name:     name,
+		ip:       ip,
+		mappings: map[simKey]simGrant{},
+		nextPort: simFirstPort,
+	}
+}
+
+func (b *SimBackend) Name() string {
+	return b.name
+}
+
+// Limits the lifetime the gateway grants. Zero, the default, grants the
+// lifetime requested.
+func (b *SimBackend) SetMaxLifetime(d time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.maxLifetime = d
+}
+
+// Makes requests made between from and to fail immediately with err.
+func (b *SimBackend) Fail(from, to time.Duration, err error) {
+	b.addFault(simFault{kind: simFail, from: from, to: to, err: err})
+}
+
+// Makes requests made between from and to fail with an error wrapping
+// ErrTimeout after SimTimeout.
+func (b *SimBackend) Timeout(from, to time.Duration) {
+	b.addFault(simFault{kind: simTimeout, from: from, to: to})
+}
+
+// Makes the gateway behave between from and to as if another host holds
+// every external port requested, so that a different port is granted to any
+// mapping the gateway does not already hold, such as one lost in a reboot.
+func (b *SimBackend) Conflict(from, to time.Duration) {
+	b.addFault(simFault{kind: simConflict, from: from, to: to})
+}
+
+// Makes the gateway reboot at the given time. It forgets its mappings,
+// obtains a new external IP address, and times out requests made in the
+// downtime which follows.
+func (b *SimBackend) Reboot(at, downtime time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.reboots = append(b.reboots, simReboot{at: at, downtime: downtime})
+	b.faults = append(b.faults, simFault{kind: simTimeout, from: at, to: at + downtime})
+}
+
+func (b *SimBackend) addFault(f simFault) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.faults = append(b.faults, f)
+}
+
+// Returns the number of requests the gateway has received to create or
+// renew mappings, and how many of them failed.
+func (b *SimBackend) Stats() (calls, failures int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.calls, b.failures
+}
+
+// Returns the mapping the gateway currently holds for the given internal
+// port. ok is false if it holds none.
+func (b *SimBackend) Mapped(protocol Protocol, internalPort uint16) (res BackendResult, ok bool) {
+	now := b.sim.Now()
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	g, ok := b.grant(simKey{protocol, internalPort}, now)
+	if !ok {
+		return BackendResult{}, false
+	}
+
+	return BackendResult{
+		ExternalIP:   b.externalIP(now),
+		ExternalPort: g.port,
+		Lifetime:     g.expires.Sub(now),
+	}, true
+}
+
+func (b *SimBackend) Map(req BackendRequest) (BackendResult, error) {
+	now := b.sim.Now()
+	elapsed := now.Sub(simEpoch)
+
+	b.mutex.Lock()
+	b.calls++
+	var conflict bool
+	for _, f := range b.faults {
+		if elapsed < f.from || elapsed >= f.to {
+			continue
+		}
+
+		switch f.kind {
+		case simFail:
+			b.failures++
+			b.mutex.Unlock()
+			return BackendResult{}, f.err
+
+		case simTimeout:
+			b.failures++
+			b.mutex.Unlock()
+			b.sim.sleep(SimTimeout, nil, nil)
+			return BackendResult{}, &classifiedError{class: ErrTimeout, err: errSimTimeout}
+
+		case simConflict:
+			conflict = true
+		}
+	}
+	defer b.mutex.Unlock()
+
+	key := simKey{req.Protocol, req.InternalPort}
+	g, held := b.grant(key, now)
+	if !held || (req.ExternalPort != 0 && req.ExternalPort != g.port) {
+		g.port = req.ExternalPort
+		if g.port == 0 || conflict || b.portInUse(key, g.port, now) {
+			g.port = b.allocatePort(now)
+		}
+		g.granted = now
+	}
+
+	lifetime := req.Lifetime
+	if b.maxLifetime != 0 && lifetime > b.maxLifetime {
+		lifetime = b.maxLifetime
+	}
+
+	g.expires = now.Add(lifetime)
+	b.mappings[key] = g
+	return BackendResult{
+		ExternalIP:   b.externalIP(now),
+		ExternalPort: g.port,
+		Lifetime:     lifetime,
+	}, nil
+}
+
+func (b *SimBackend) Unmap(req BackendRequest, prev BackendResult) error {
+	now := b.sim.Now()
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	key := simKey{req.Protocol, req.InternalPort}
+	if g, ok := b.grant(key, now); ok && g.port == prev.ExternalPort {
+		delete(b.mappings, key)
+	}
+
+	return nil
+}
+
+var errSimTimeout = errors.New("simulated gateway did not respond")
+
+// Returns the mapping held for key, unless it has expired or been lost in a
+// reboot. Must be called with the mutex held.
+func (b *SimBackend) grant(key simKey, now time.Time) (simGrant, bool) {
+	g, ok := b.mappings[key]
+	if !ok {
+		return simGrant{}, false
+	}
+
+	lost := !g.expires.After(now)
+	for _, r := range b.reboots {
+		at := simEpoch.Add(r.at)
+		if at.After(g.granted) && !at.After(now) {
+			lost = true
+		}
+	}
+
+	if lost {
+		delete(b.mappings, key)
+		return simGrant{}, false
+	}
+
+	return g, true
+}
+
+// Must be called with the mutex held.
+func (b *SimBackend) portInUse(except simKey, port uint16, now time.Time) bool {
+	for key := range b.mappings {
+		if key == except {
+			continue
+		}
+
+		if g, ok := b.grant(key, now); ok && g.port == port {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Must be called with the mutex held.
+func (b *SimBackend) allocatePort(now time.Time) uint16 {
+	for b.portInUse(simKey{}, b.nextPort, now) {
+		b.nextPort++
+	}
+
+	port := b.nextPort
+	b.nextPort++
+	return port
+}
+
+// Returns the external IP address, which is incremented by each reboot.
+// Must be called with the mutex held.
+func (b *SimBackend) externalIP(now time.Time) net.IP {
+	ip := append(net.IP(nil), b.ip...)
+	for _, r := range b.reboots {
+		if !simEpoch.Add(r.at).After(now) {
+			for i := len(ip) - 1; i >= 0; i-- {
+				ip[i]++
+				if ip[i] != 0 {
+					break
+				}
+			}
+		}
+	}
+
+	return ip
+}
@@ -0,0 +1,281 @@
+package portmap
+
+import "errors"
+import "net"
+import "testing"
+import "time"
+
+const simWeek = 7 * 24 * time.Hour
+
+func newSimMapping(t *testing.T, s *Simulation, b *SimBackend, lifetime time.Duration) Mapping {
+	m, err := s.New(Config{
+		Protocol:     TCP,
+		Name:         "test",
+		InternalPort: 8080,
+		Backend:      b,
+		Lifetime:     lifetime,
+	})
+	if err != nil {
+		t.Fatalf("cannot create simulated mapping: %v", err)
+	}
+
+	return m
+}
+
+// A mapping on a well-behaved gateway should be renewed at half its lifetime
+// for weeks on end without ever lapsing or changing address.
+func TestSimSteadyRenewal(t *testing.T) {
+	s := NewSimulation()
+	b := s.NewBackend("gw", net.IPv4(203, 0, 113, 1))
+	m := newSimMapping(t, s, b, time.Hour)
+	defer m.Delete()
+
+	addr := m.ExternalAddr()
+	if addr != "203.0.113.1:20000" {
+		t.Fatalf("unexpected external address %q", addr)
+	}
+
+	for day := 0; day < 14; day++ {
+		s.Run(24 * time.Hour)
+		if got := m.ExternalAddr(); got != addr {
+			t.Fatalf("day %d: external address changed from %q to %q", day, addr, got)
+		}
+		if _, ok := b.Mapped(TCP, 8080); !ok {
+			t.Fatalf("day %d: gateway does not hold the mapping", day)
+		}
+	}
+
+	calls, failures := b.Stats()
+	if failures != 0 {
+		t.Errorf("%d requests failed", failures)
+	}
+
+	// one request at creation and one every half hour thereafter
+	want := int(2*simWeek/(30*time.Minute)) + 1
+	if calls < want-2 || calls > want+2 {
+		t.Errorf("%d requests made over two weeks, expected about %d", calls, want)
+	}
+
+	if st := m.Status(); !st.Active || !st.ExpireTime.After(s.Now()) {
+		t.Errorf("mapping not active at the end of the simulation: %+v", st)
+	}
+}
+
+// A gateway which caps lifetimes should cause the mapping to be renewed at
+// half the capped lifetime rather than lapse.
+func TestSimCappedLifetime(t *testing.T) {
+	s := NewSimulation()
+	b := s.NewBackend("gw", net.IPv4(203, 0, 113, 1))
+	b.SetMaxLifetime(20 * time.Minute)
+	m := newSimMapping(t, s, b, 2*time.Hour)
+	defer m.Delete()
+
+	s.Run(simWeek)
+
+	calls, failures := b.Stats()
+	if failures != 0 {
+		t.Errorf("%d requests failed", failures)
+	}
+
+	// renewed about every ten minutes, or more often if the gateway is
+	// judged unreliable, but never at the requested lifetime
+	if min := int(simWeek / (10 * time.Minute)); calls < min {
+		t.Errorf("%d requests made over a week, expected at least %d", calls, min)
+	}
+
+	if !m.Status().Active {
+		t.Error("mapping not active at the end of the simulation")
+	}
+}
+
+// After a gateway reboots, the mapping should be recreated once the gateway
+// responds again, with the gateway's new external address.
+func TestSimReboot(t *testing.T) {
+	s := NewSimulation()
+	b := s.NewBackend("gw", net.IPv4(203, 0, 113, 1))
+	b.Reboot(3*24*time.Hour, 10*time.Minute)
+	m := newSimMapping(t, s, b, time.Hour)
+	defer m.Delete()
+
+	s.Run(3 * 24 * time.Hour)
+	if got := m.ExternalAddr(); got != "203.0.113.1:20000" {
+		t.Fatalf("unexpected external address %q before the reboot", got)
+	}
+
+	s.Run(simWeek)
+	if got := m.ExternalAddr(); got != "203.0.113.2:20000" {
+		t.Errorf("unexpected external address %q after the reboot", got)
+	}
+
+	if _, ok := b.Mapped(TCP, 8080); !ok {
+		t.Error("gateway does not hold the mapping after the reboot")
+	}
+}
+
+// A mapping whose renewals fail for longer than its lifetime should lapse,
+// and should be re-established once the gateway recovers.
+func TestSimOutage(t *testing.T) {
+	s := NewSimulation()
+	b := s.NewBackend("gw", net.IPv4(203, 0, 113, 1))
+	errOutage := errors.New("gateway out of order")
+	b.Fail(24*time.Hour, 27*time.Hour, errOutage)
+	m := newSimMapping(t, s, b, time.Hour)
+	defer m.Delete()
+
+	s.Run(26 * time.Hour)
+	st := m.Status()
+	if st.Active {
+		t.Fatal("mapping still active after its gateway failed for longer than its lifetime")
+	}
+	if !errors.Is(st.LastError, errOutage) {
+		t.Errorf("LastError is %v, expected the gateway's error", st.LastError)
+	}
+
+	s.Run(simWeek)
+	if !m.Status().Active {
+		t.Error("mapping not re-established after the gateway recovered")
+	}
+}
+
+// Simulations with the same script should unfold identically.
+func TestSimDeterministic(t *testing.T) {
+	run := func() (int, int, string) {
+		s := NewSimulation()
+		b := s.NewBackend("gw", net.IPv4(203, 0, 113, 1))
+		b.Reboot(2*24*time.Hour, time.Hour)
+		b.Timeout(5*24*time.Hour, 5*24*time.Hour+3*time.Hour)
+		b.Conflict(2*24*time.Hour, 3*24*time.Hour)
+		m := newSimMapping(t, s, b, time.Hour)
+		defer m.Delete()
+
+		s.Run(2 * simWeek)
+		calls, failures := b.Stats()
+		return calls, failures, m.ExternalAddr()
+	}
+
+	c1, f1, a1 := run()
+	c2, f2, a2 := run()
+	if c1 != c2 || f1 != f2 || a1 != a2 {
+		t.Errorf("simulations differ: %d/%d/%q and %d/%d/%q", c1, f1, a1, c2, f2, a2)
+	}
+}
+
+// A gateway which grants unusably short lifetimes should be reported in
+// Status.LastError rather than leave the previous error, or none, in place.
+func TestSimLifetimeTooShort(t *testing.T) {
+	s := NewSimulation()
+	b := s.NewBackend("gw", net.IPv4(203, 0, 113, 1))
+	b.SetMaxLifetime(5 * time.Second)
+	m := newSimMapping(t, s, b, time.Hour)
+	defer m.Delete()
+
+	st := m.Status()
+	if st.Active {
+		t.Fatal("mapping active with an unusable lifetime")
+	}
+	if !errors.Is(st.LastError, ErrLifetimeTooShort) {
+		t.Errorf("LastError is %v, expected ErrLifetimeTooShort", st.LastError)
+	}
+}
+
+// A mapping should be reported inactive as soon as it lapses, even while the
+// loop is backing off between attempts, and reading its status should not
+// change it.
+func TestSimLapseNotified(t *testing.T) {
+	s := NewSimulation()
+	b := s.NewBackend("gw", net.IPv4(203, 0, 113, 1))
+	b.Fail(24*time.Hour, 30*time.Hour, errors.New("gateway out of order"))
+	m := newSimMapping(t, s, b, time.Hour)
+	defer m.Delete()
+
+	// the last renewal before the outage, at 23h30m, expires at 24h30m
+	s.Run(24*time.Hour + 30*time.Minute - time.Second)
+	before := m.Status()
+	if !before.Active {
+		t.Fatal("mapping lapsed early")
+	}
+
+	for len(m.NotifyChan()) > 0 {
+		<-m.NotifyChan()
+	}
+
+	s.Run(time.Second)
+	st := m.Status()
+	if st.Active {
+		t.Fatal("mapping still active after its expiry time")
+	}
+	if st.Version != before.Version+1 {
+		t.Errorf("version went from %d to %d, expected one increment", before.Version, st.Version)
+	}
+	if again := m.Status(); again.Version != st.Version {
+		t.Errorf("reading status changed the version from %d to %d", st.Version, again.Version)
+	}
+
+	select {
+	case <-m.NotifyChan():
+	default:
+		t.Error("lapse was not notified")
+	}
+
+	var inactive bool
+	for len(m.Events()) > 0 {
+		if _, ok := (<-m.Events()).(Inactive); ok {
+			inactive = true
+		}
+	}
+	if !inactive {
+		t.Error("no Inactive event was sent at the lapse")
+	}
+}
+
+// A SimBackend whose requests take delay of virtual time to succeed once
+// from has elapsed.
+type slowSimBackend struct {
+	*SimBackend
+	from, delay time.Duration
+}
+
+func (b *slowSimBackend) Map(req BackendRequest) (BackendResult, error) {
+	if b.sim.Elapsed() >= b.from {
+		b.sim.sleep(b.delay, nil, nil)
+	}
+
+	return b.SimBackend.Map(req)
+}
+
+// A renewal which is still in progress when the mapping expires, and then
+// succeeds, should never cause the version to go backwards or be reused for
+// a different state.
+func TestSimRenewalCrossesExpiry(t *testing.T) {
+	s := NewSimulation()
+	b := &slowSimBackend{
+		SimBackend: s.NewBackend("gw", net.IPv4(203, 0, 113, 1)),
+		from:       time.Minute,
+		delay:      40 * time.Minute,
+	}
+	m, err := s.New(Config{
+		Protocol:     TCP,
+		Name:         "test",
+		InternalPort: 8080,
+		Backend:      b,
+		Lifetime:     time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("cannot create simulated mapping: %v", err)
+	}
+	defer m.Delete()
+
+	// the renewal starts at 30m and completes at 70m, after the expiry at 60m
+	var prev Status
+	for i := 0; i < 16; i++ {
+		s.Run(5 * time.Minute)
+		st := m.Status()
+		if st.Version < prev.Version {
+			t.Fatalf("at %v: version went backwards from %d to %d", s.Elapsed(), prev.Version, st.Version)
+		}
+		if st.Version == prev.Version && (st.Active != prev.Active || st.ExternalAddr != prev.ExternalAddr) {
+			t.Fatalf("at %v: version %d reused for a different state", s.Elapsed(), st.Version)
+		}
+		prev = st
+	}
+}
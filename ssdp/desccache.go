@@ -0,0 +1,80 @@
+package ssdp
+
+import "sync"
+import "time"
+
+// Device descriptions fetched less than this long ago are used without
+// revalidation. This prevents a burst of mappings from fetching the same
+// description repeatedly.
+const descCacheFreshness = 1 * time.Minute
+
+type descCacheEntry struct {
+	Desc         *Description
+	ETag         string
+	LastModified string
+	Validated    time.Time
+}
+
+var descCacheMutex sync.Mutex
+var descCache = map[string]*descCacheEntry{}
+
+// Returns the device description at the given URL, using the cache where
+// possible.
+//
+// Cached descriptions are revalidated using ETag and Last-Modified where the
+// device supports them, so that the full document is only transferred when it
+// has changed. Devices which provide neither validator have their description
+// refetched once the cached copy is no longer fresh.
+func getDescription(location string) (*Description, error) {
+	descCacheMutex.Lock()
+	e := descCache[location]
+	descCacheMutex.Unlock()
+
+	if e != nil && time.Since(e.Validated) < descCacheFreshness {
+		return e.Desc, nil
+	}
+
+	var cond *descCacheEntry
+	if e != nil && (e.ETag != "" || e.LastModified != "") {
+		cond = e
+	}
+
+	ne, err := fetchDescription(location, cond)
+	if err != nil {
+		return nil, err
+	}
+
+	if ne == nil {
+		// not modified
+		ne = &descCacheEntry{
+			Desc:         e.Desc,
+			ETag:         e.ETag,
+			LastModified: e.LastModified,
+		}
+	}
+
+	ne.Validated = time.Now()
+
+	descCacheMutex.Lock()
+	descCache[location] = ne
+	descCacheMutex.Unlock()
+
+	return ne.Desc, nil
+}
+
+// Fetches the device description for an SSDP service and stores it in the
+// description cache, so that subsequent operations against the device do not
+// need to wait for it. Slow devices may take several seconds to serve their
+// description.
+func Prefetch(svc Service) error {
+	_, err := Describe(svc)
+	return err
+}
+
+// Removes the device description at the given location from the cache, if
+// it is present.
+func ForgetDescription(location string) {
+	descCacheMutex.Lock()
+	defer descCacheMutex.Unlock()
+	delete(descCache, location)
+}
@@ -0,0 +1,222 @@
+package ssdp
+
+import "encoding/xml"
+import "errors"
+import "fmt"
+import "io"
+import "net/http"
+import "net/url"
+import "github.com/hlandau/portmap/internal/parse"
+
+const upnpDeviceNS = "urn:schemas-upnp-org:device-1-0"
+
+// A UPnP device description, as retrieved from the LOCATION of an SSDP
+// advertisement.
+//
+// URL fields are resolved relative to the description's URLBase, if any, or
+// else its location. They are nil if the description did not specify them or
+// they could not be parsed; the raw values are also available.
+type Description struct {
+	XMLName xml.Name `xml:"root"`
+
+	// The URL from which the description was retrieved.
+	Location *url.URL `xml:"-"`
+
+	SpecVersion struct {
+		Major int `xml:"major"`
+		Minor int `xml:"minor"`
+	} `xml:"specVersion"`
+
+	// Deprecated in UPnP 1.1, but still sent by many devices.
+	URLBase string `xml:"URLBase"`
+
+	// The root device.
+	Device Device `xml:"device"`
+}
+
+// A device within a device description.
+type Device struct {
+	DeviceType       string `xml:"deviceType"`
+	FriendlyName     string `xml:"friendlyName"`
+	Manufacturer     string `xml:"manufacturer"`
+	ManufacturerURL  string `xml:"manufacturerURL"`
+	ModelDescription string `xml:"modelDescription"`
+	ModelName        string `xml:"modelName"`
+	ModelNumber      string `xml:"modelNumber"`
+	ModelURL         string `xml:"modelURL"`
+	SerialNumber     string `xml:"serialNumber"`
+	UDN              string `xml:"UDN"`
+
+	RawPresentationURL string   `xml:"presentationURL"`
+	PresentationURL    *url.URL `xml:"-"`
+
+	Icons    []Icon          `xml:"iconList>icon"`
+	Services []DeviceService `xml:"serviceList>service"`
+	Devices  []Device        `xml:"deviceList>device"`
+}
+
+// An icon within a device description.
+type Icon struct {
+	MIMEType string `xml:"mimetype"`
+	Width    int    `xml:"width"`
+	Height   int    `xml:"height"`
+	Depth    int    `xml:"depth"`
+
+	RawURL string   `xml:"url"`
+	URL    *url.URL `xml:"-"`
+}
+
+// A service within a device description.
+type DeviceService struct {
+	ServiceType string `xml:"serviceType"`
+	ServiceID   string `xml:"serviceId"`
+
+	RawSCPDURL     string `xml:"SCPDURL"`
+	RawControlURL  string `xml:"controlURL"`
+	RawEventSubURL string `xml:"eventSubURL"`
+
+	SCPDURL     *url.URL `xml:"-"`
+	ControlURL  *url.URL `xml:"-"`
+	EventSubURL *url.URL `xml:"-"`
+}
+
+// Calls f for every service of the device and of its embedded devices,
+// recursively. dev is the device providing the service.
+func (d *Device) VisitServices(f func(dev *Device, svc *DeviceService)) {
+	for i := range d.Services {
+		f(d, &d.Services[i])
+	}
+	for i := range d.Devices {
+		d.Devices[i].VisitServices(f)
+	}
+}
+
+// Calls f for the device and every embedded device, recursively.
+func (d *Device) VisitDevices(f func(dev *Device)) {
+	f(d)
+	for i := range d.Devices {
+		d.Devices[i].VisitDevices(f)
+	}
+}
+
+func (d *Device) resolveURLs(base *url.URL) {
+	d.PresentationURL = resolveURL(base, d.RawPresentationURL)
+	for i := range d.Icons {
+		d.Icons[i].URL = resolveURL(base, d.Icons[i].RawURL)
+	}
+	for i := range d.Services {
+		s := &d.Services[i]
+		s.SCPDURL = resolveURL(base, s.RawSCPDURL)
+		s.ControlURL = resolveURL(base, s.RawControlURL)
+		s.EventSubURL = resolveURL(base, s.RawEventSubURL)
+	}
+	for i := range d.Devices {
+		d.Devices[i].resolveURLs(base)
+	}
+}
+
+func resolveURL(base *url.URL, s string) *url.URL {
+	if s == "" {
+		return nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil
+	}
+
+	return base.ResolveReference(u)
+}
+
+// Retrieves and parses the device description for an SSDP service.
+//
+// Descriptions are cached, so calling this repeatedly for the same service
+// is inexpensive. The returned value is shared and must not be modified.
+func Describe(svc Service) (*Description, error) {
+	if svc.Location == nil {
+		return nil, errors.New("service has no location")
+	}
+
+	return DescribeURL(svc.Location.String())
+}
+
+// Like Describe, but takes the URL of the device description directly.
+func DescribeURL(location string) (*Description, error) {
+	return getDescription(location)
+}
+
+// Parses a device description retrieved from location. This allows a
+// description to be retrieved by other means than DescribeURL, for example
+// with an HTTP client having its own TLS configuration.
+func ParseDescription(location *url.URL, r io.Reader) (*Description, error) {
+	b, err := parse.ReadLimited(r, parse.MaxDocumentSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var desc Description
+	err = parse.Description(b, upnpDeviceNS, &desc)
+	if err != nil {
+		return nil, err
+	}
+
+	base := location
+	if desc.URLBase != "" {
+		if u, err := url.Parse(desc.URLBase); err == nil {
+			base = location.ResolveReference(u)
+		}
+	}
+
+	desc.Location = location
+	desc.Device.resolveURLs(base)
+	return &desc, nil
+}
+
+// Retrieves and parses the device description at location. If e is non-nil,
+// its validators are sent and nil is returned with a nil error if the server
+// indicates that the description has not been modified.
+func fetchDescription(location string, e *descCacheEntry) (*descCacheEntry, error) {
+	urlp, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", location, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if e != nil {
+		if e.ETag != "" {
+			req.Header.Set("If-None-Match", e.ETag)
+		}
+		if e.LastModified != "" {
+			req.Header.Set("If-Modified-Since", e.LastModified)
+		}
+	}
+
+	res, err := deviceClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotModified && e != nil {
+		return nil, nil
+	}
+
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("status %d when retrieving UPnP device description", res.StatusCode)
+	}
+
+	desc, err := ParseDescription(urlp, res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &descCacheEntry{
+		Desc:         desc,
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+	}, nil
+}
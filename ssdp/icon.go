@@ -0,0 +1,90 @@
+package ssdp
+
+import "errors"
+import "fmt"
+import "net/http"
+import "strings"
+import "time"
+import "github.com/hlandau/portmap/internal/parse"
+import "github.com/hlandau/portmap/internal/localnet"
+
+// Timeout for each request made to a device by deviceClient.
+const deviceRequestTimeout = 15 * time.Second
+
+// Maximum number of redirects followed by deviceClient.
+const maxDeviceRedirects = 3
+
+// Maximum size of an icon which will be retrieved.
+const maxIconSize = 256 << 10
+
+// Returned when a device redirects a request to another host, or supplies a
+// URL on another host, which is refused since it may be an attempt to make
+// this host request something the device could not reach itself.
+var ErrForeignHost = errors.New("UPnP device URL refers to another host")
+
+var errTooManyRedirects = errors.New("too many redirects from UPnP device")
+
+// The HTTP client used to retrieve device descriptions and icons. The URLs
+// requested are supplied by devices on the local network, so redirects are
+// only followed within the same host, and proxy settings from the
+// environment are not used.
+var deviceClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext:     localnet.DialContext,
+		IdleConnTimeout: 90 * time.Second,
+	},
+	Timeout: deviceRequestTimeout,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxDeviceRedirects {
+			return errTooManyRedirects
+		}
+
+		if req.URL.Host != via[0].URL.Host {
+			return ErrForeignHost
+		}
+
+		return nil
+	},
+}
+
+// Retrieves the image data of an icon listed in a device description, and
+// returns it with its MIME type. The icon must be on the same host as the
+// description, and no larger than 256 KiB.
+func FetchIcon(desc *Description, icon *Icon) (data []byte, mimeType string, err error) {
+	if icon.URL == nil {
+		return nil, "", errors.New("icon has no URL")
+	}
+
+	if desc.Location == nil || icon.URL.Host != desc.Location.Host {
+		return nil, "", ErrForeignHost
+	}
+
+	req, err := http.NewRequest("GET", icon.URL.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	res, err := deviceClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, "", fmt.Errorf("status %d when retrieving UPnP device icon", res.StatusCode)
+	}
+
+	data, err = parse.ReadLimited(res.Body, maxIconSize)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The type in the description is preferred to whatever the device's web
+	// server guesses, unless the description omits it.
+	mimeType = icon.MIMEType
+	if ct := res.Header.Get("Content-Type"); mimeType == "" && strings.HasPrefix(ct, "image/") {
+		mimeType = ct
+	}
+
+	return data, mimeType, nil
+}
@@ -1,7 +1,13 @@
-// SSDP registry. Receives SSDP events from package ssdp and stores them for
-// retrieval. You can use this package to discover services using SSDP.
+// SSDP registry. Receives SSDP events from package ssdpbase and stores them
+// for retrieval. You can use this package to discover services using SSDP.
+//
+// The registry is not specific to port mapping and may be used to discover
+// any kind of SSDP-advertised device or service (media renderers, smart
+// lighting bridges, and so on). The API of this package is stable. All
+// functions are safe for concurrent use.
 package ssdp
 
+import "net"
 import "net/url"
 import "github.com/hlandau/portmap/ssdp/ssdpbase"
 import "github.com/hlandau/degoutils/log"
@@ -21,38 +27,388 @@ type Service struct {
 
 	// The time at which a notice for this service was last seen.
 	LastSeen time.Time
+
+	// The SERVER header most recently sent for the service. This usually
+	// identifies the device's operating system and UPnP implementation. May
+	// be empty.
+	Server string
+
+	// The period for which the most recent advertisement is valid, as
+	// indicated by the device. Zero if not specified.
+	MaxAge time.Duration
+
+	// The boot ID most recently advertised by a UPnP 1.1 device. This changes
+	// whenever the device reboots. -1 if the device does not send it.
+	BootID int64
+
+	// The configuration ID most recently advertised by a UPnP 1.1 device.
+	// This changes whenever the device's description changes. -1 if the
+	// device does not send it.
+	ConfigID int64
+
+	// The port on which a UPnP 1.1 device accepts unicast searches, if other
+	// than 1900. Zero if not specified.
+	SearchPort int
+
+	// The IP address from which the most recent advertisement was received.
+	Responder net.IP
+
+	// True if the host of Location is not the responder's IP address. This
+	// may indicate a misconfigured or malicious device.
+	LocationMismatch bool
+}
+
+// Returns the URL which should be used to contact the service. This is
+// normally Location, but if LocationMismatch is set, the host of Location is
+// replaced with the responder's address, so that requests go to the device
+// which actually answered.
+func (s *Service) PreferredLocation() *url.URL {
+	if !s.LocationMismatch || s.Responder == nil || s.Location == nil {
+		return s.Location
+	}
+
+	u := *s.Location
+	host := s.Responder.String()
+	if port := s.Location.Port(); port != "" {
+		host = net.JoinHostPort(host, port)
+	} else if s.Responder.To4() == nil {
+		host = "[" + host + "]"
+	}
+
+	u.Host = host
+	return &u
+}
+
+// Determines whether the host of u is the given IP address.
+func locationMatches(u *url.URL, ip net.IP) bool {
+	if u == nil || ip == nil {
+		return true
+	}
+
+	hip := net.ParseIP(u.Hostname())
+	return hip != nil && hip.Equal(ip)
 }
 
-var once sync.Once
-var client ssdpbase.Client
+var clientMutex sync.Mutex
+var client ssdpbase.Client // clientMutex
+var clientRefs int         // clientMutex
+var clientPinned bool      // clientMutex
+var loopDone chan struct{} // clientMutex
+var configMutex sync.RWMutex
+var config ssdpbase.Config // configMutex
+var registryMutex sync.RWMutex
 var byUSN = map[string]*Service{}
+var lastPruned time.Time // registryMutex
 
-func loop() {
-	for ev := range client.Chan() {
-		if _, already := byUSN[ev.USN]; !already {
-			byUSN[ev.USN] = &Service{USN: ev.USN}
-		}
+// Waits for the client to stop. Events are recorded by record, which is the
+// client's handler.
+func loop(client ssdpbase.Client, done chan<- struct{}) {
+	defer close(done)
+
+	for range client.Chan() {
+	}
+}
+
+// Records an event in the registry. Called concurrently by the client's
+// workers.
+func record(ev ssdpbase.Event) {
+	registryMutex.Lock()
+	if _, already := byUSN[ev.USN]; !already {
+		prune()
+		byUSN[ev.USN] = &Service{USN: ev.USN}
+	}
 
-		svc := byUSN[ev.USN]
-		svc.ST = ev.ST
-		svc.Location = ev.Location
+	svc := byUSN[ev.USN]
+	if isDuplicate(svc, &ev) {
 		svc.LastSeen = time.Now()
+		registryMutex.Unlock()
+		return
+	}
+
+	changed := deviceChanged(svc, &ev)
+	oldLocation := svc.Location
+	svc.ST = ev.ST
+	svc.Location = ev.Location
+	svc.LastSeen = time.Now()
+	svc.Server = ev.Server
+	svc.MaxAge = ev.MaxAge
+	svc.BootID = ev.BootID
+	svc.ConfigID = ev.ConfigID
+	svc.SearchPort = ev.SearchPort
+	svc.Responder = nil
+	if ev.Source != nil {
+		svc.Responder = ev.Source.IP
+	}
+	svc.LocationMismatch = !locationMatches(svc.Location, svc.Responder)
+	changedSvc := *svc
+	registryMutex.Unlock()
 
-		//log.Info("Registering SSDP service: ", svc)
+	if changed {
+		// The description may have changed with the reboot, and mappings
+		// may have been lost.
+		if oldLocation != nil {
+			ForgetDescription(oldLocation.String())
+		}
+		ForgetDescription(changedSvc.Location.String())
+		callDeviceChangeHandlers(changedSvc)
+	}
+}
+
+// Minimum interval between removals of stale services from the registry.
+const pruneInterval = 1 * time.Minute
+
+// Removes services which have become stale from the registry, so that it does
+// not grow without bound as devices come and go, or as hosts send responses
+// with arbitrary USNs. Runs at most once per pruneInterval. Must be called
+// with registryMutex held for writing.
+func prune() {
+	now := time.Now()
+	if now.Sub(lastPruned) < pruneInterval {
+		return
+	}
+
+	lastPruned = now
+	limit := now.Add(-staleAfter())
+	for usn, svc := range byUSN {
+		if !svc.LastSeen.After(limit) {
+			delete(byUSN, usn)
+		}
+	}
+}
+
+// Devices usually send several identical responses to each beacon. Responses
+// which repeat one received within this window only update LastSeen.
+const duplicateWindow = 5 * time.Second
+
+// Determines whether an event merely repeats the most recent one for the
+// service.
+func isDuplicate(svc *Service, ev *ssdpbase.Event) bool {
+	if svc.LastSeen.IsZero() || time.Since(svc.LastSeen) >= duplicateWindow {
+		return false
+	}
+
+	if svc.BootID != ev.BootID || svc.ST != ev.ST || svc.Location == nil || ev.Location == nil ||
+		svc.Location.String() != ev.Location.String() {
+		return false
+	}
+
+	if ev.Source == nil {
+		return svc.Responder == nil
+	}
+
+	return svc.Responder.Equal(ev.Source.IP)
+}
+
+// Determines whether the device providing a known service has rebooted or
+// changed its configuration, as indicated by the BOOTID.UPNP.ORG and
+// CONFIGID.UPNP.ORG headers of a new advertisement for it.
+func deviceChanged(svc *Service, ev *ssdpbase.Event) bool {
+	if svc.LastSeen.IsZero() {
+		// newly discovered
+		return false
+	}
+
+	return (svc.BootID >= 0 && ev.BootID >= 0 && svc.BootID != ev.BootID) ||
+		(svc.ConfigID >= 0 && ev.ConfigID >= 0 && svc.ConfigID != ev.ConfigID)
+}
+
+var handlerMutex sync.Mutex
+var deviceChangeHandlers []func(Service) // handlerMutex
+
+// Registers a function to be called when the device providing a known service
+// is seen to have rebooted or changed its configuration. Cached descriptions
+// of the device have been discarded by the time the function is called, and
+// it is called once for each of the device's services. Functions are called
+// from the discovery goroutine and must not block. They cannot be removed.
+func AddDeviceChangeHandler(fn func(svc Service)) {
+	handlerMutex.Lock()
+	defer handlerMutex.Unlock()
+	deviceChangeHandlers = append(deviceChangeHandlers, fn)
+}
+
+func callDeviceChangeHandlers(svc Service) {
+	handlerMutex.Lock()
+	handlers := deviceChangeHandlers
+	handlerMutex.Unlock()
+
+	for _, fn := range handlers {
+		fn(svc)
 	}
 }
 
 // Starts the SSDP discovery broadcast and notice reception process, if it has
 // not already started. You may call this function multiple times without
-// consequence.
+// consequence. Once Start has been called, discovery continues for the
+// lifetime of the process.
+//
+// The configuration set by SetConfig, if any, is used.
 func Start() {
-	once.Do(func() {
-		var err error
-		client, err = ssdpbase.NewClient()
-		log.Panice(err)
+	clientMutex.Lock()
+	defer clientMutex.Unlock()
+
+	clientPinned = true
+	log.Panice(startLocked())
+}
+
+// Like Start, but discovery only continues until every call to Acquire has
+// been matched by a call to Release, unless Start has also been called. This
+// allows discovery traffic to cease when it is no longer needed.
+//
+// If discovery cannot be started, the error is returned, but the reference
+// is still taken and must be released; a later call to Acquire will try to
+// start discovery again.
+func Acquire() error {
+	clientMutex.Lock()
+	defer clientMutex.Unlock()
+
+	clientRefs++
+	return startLocked()
+}
+
+// Releases a reference taken by Acquire. When the last reference is released,
+// discovery is stopped, and Release blocks until all background activity has
+// ceased. Services already discovered remain known until they become stale.
+func Release() {
+	clientMutex.Lock()
+	if clientRefs == 0 {
+		clientMutex.Unlock()
+		return
+	}
+
+	clientRefs--
+	if clientRefs > 0 || clientPinned || client == nil {
+		clientMutex.Unlock()
+		return
+	}
+
+	// The client's handlers call into the mapping registry, whose users call
+	// Acquire with their own locks held, so the loop is waited for without
+	// clientMutex held.
+	client.Stop()
+	done := loopDone
+	client = nil
+	clientMutex.Unlock()
+
+	<-done
+}
+
+func startLocked() error {
+	if client != nil {
+		return nil
+	}
+
+	configMutex.RLock()
+	cfg := config
+	configMutex.RUnlock()
+
+	cfg.Handler = record
+	cfg.StateHandler = callStateHandlers
+	c, err := ssdpbase.NewClientConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	client = c
+	loopDone = make(chan struct{})
+	go loop(c, loopDone)
+	return nil
+}
+
+// Sets the configuration used for SSDP discovery. This must be called before
+// Start() or Acquire() is first called (including indirectly, by creating a
+// port mapping) to have any effect. If discovery is stopped by Release and
+// later restarted, the most recent configuration is used. The Handler and
+// StateHandler fields are ignored.
+func SetConfig(cfg ssdpbase.Config) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config = cfg
+}
+
+// Services not seen for this long are considered to have disappeared.
+func staleAfter() time.Duration {
+	configMutex.RLock()
+	interval := config.BroadcastInterval
+	configMutex.RUnlock()
 
-		go loop()
-	})
+	if interval == 0 {
+		interval = ssdpbase.BroadcastInterval
+	}
+
+	return interval * 3
+}
+
+// Requests that a discovery broadcast be sent as soon as possible, rather
+// than waiting for the next periodic broadcast. This is useful when a
+// service is needed but none is currently known. Has no effect if discovery
+// is not running.
+func Search() {
+	clientMutex.Lock()
+	defer clientMutex.Unlock()
+
+	if client != nil {
+		client.Search()
+	}
+}
+
+// Like Search, but asks devices to respond within mx seconds. See
+// ssdpbase.Client.SearchMX.
+func SearchMX(mx int) {
+	clientMutex.Lock()
+	defer clientMutex.Unlock()
+
+	if client != nil {
+		client.SearchMX(mx)
+	}
+}
+
+// Returns the error which caused discovery to stop working, if it is
+// currently not working because its socket failed, and nil otherwise.
+// Discovery recovers automatically. See ssdpbase.Client.Degraded.
+func Degraded() error {
+	clientMutex.Lock()
+	defer clientMutex.Unlock()
+
+	if client == nil {
+		return nil
+	}
+
+	return client.Degraded()
+}
+
+var stateHandlers []func(error) // handlerMutex
+
+// Registers a function to be called with the error when discovery stops
+// working because its socket failed, and with nil when it recovers. Functions
+// are called from the discovery goroutine and must not block. They cannot be
+// removed.
+func AddStateHandler(fn func(err error)) {
+	handlerMutex.Lock()
+	defer handlerMutex.Unlock()
+	stateHandlers = append(stateHandlers, fn)
+}
+
+func callStateHandlers(err error) {
+	handlerMutex.Lock()
+	handlers := stateHandlers
+	handlerMutex.Unlock()
+
+	for _, fn := range handlers {
+		fn(err)
+	}
+}
+
+// Returns receive counters for the SSDP client, for diagnostic purposes.
+// Returns zero counters if discovery is not running.
+func Stats() ssdpbase.Stats {
+	clientMutex.Lock()
+	defer clientMutex.Unlock()
+
+	if client == nil {
+		return ssdpbase.Stats{}
+	}
+
+	return client.Stats()
 }
 
 // Obtains a list of Services matching the provided Service Type string.
@@ -65,7 +421,10 @@ func Start() {
 // Services which were last seen more than three SSDP broadcast intervals ago
 // are not yielded by this function.
 func GetServicesByType(st string) (svcs []Service) {
-	limit := time.Now().Add(ssdpbase.BroadcastInterval * -3)
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	limit := time.Now().Add(-staleAfter())
 	for _, v := range byUSN {
 		if v.ST == st && v.LastSeen.After(limit) {
 			svcs = append(svcs, *v)
@@ -73,3 +432,46 @@ func GetServicesByType(st string) (svcs []Service) {
 	}
 	return
 }
+
+// Like GetServicesByType, but only returns services whose responder is on a
+// subnet of the named interface, so that a caller on a host attached to
+// several networks can prefer devices on a particular one. Returns nil if the
+// interface does not exist.
+func GetServicesByTypeOnInterface(st, ifName string) (svcs []Service) {
+	ifi, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return nil
+	}
+
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+
+	for _, svc := range GetServicesByType(st) {
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok && svc.Responder != nil && ipn.Contains(svc.Responder) {
+				svcs = append(svcs, svc)
+				break
+			}
+		}
+	}
+
+	return
+}
+
+// Obtains a list of all Services currently known, of any type.
+//
+// The same caveats as for GetServicesByType apply.
+func GetAllServices() (svcs []Service) {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	limit := time.Now().Add(-staleAfter())
+	for _, v := range byUSN {
+		if v.LastSeen.After(limit) {
+			svcs = append(svcs, *v)
+		}
+	}
+	return
+}
@@ -0,0 +1,106 @@
+package ssdpbase
+
+import "context"
+import gnet "net"
+import "time"
+import "github.com/hlandau/portmap/internal/parse"
+
+// The range of MX values sent by Search. The UPnP Device Architecture
+// requires MX to be between 1 and 5.
+const (
+	minSearchMX = 1
+	maxSearchMX = 5
+)
+
+// Performs a single search for devices or services of type st, such as
+// "urn:schemas-upnp-org:service:WANIPConnection:1", and returns the responses
+// received within timeout, or before ctx is done. If st is empty, "ssdp:all"
+// is used. Repeated responses with the same USN and ST are only returned
+// once.
+//
+// Unlike a Client, no goroutines remain once Search returns, which suits
+// command-line tools and tests. The error is nil if the search was sent,
+// even if no responses were received; if ctx is done first, the responses
+// received so far are returned along with ctx.Err().
+func Search(ctx context.Context, st string, timeout time.Duration) ([]Event, error) {
+	if st == "" {
+		st = "ssdp:all"
+	}
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	cfg := Config{}
+	cfg.setDefaults()
+
+	ssdpAddr, err := gnet.ResolveUDPAddr("udp4", cfg.MulticastAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := openConn(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Devices delay their responses by up to MX seconds, so MX is chosen to
+	// fit within the timeout.
+	mx := int(time.Until(deadline) / time.Second)
+	if mx < minSearchMX {
+		mx = minSearchMX
+	} else if mx > maxSearchMX {
+		mx = maxSearchMX
+	}
+
+	_, err = conn.WriteToUDP(searchBeacon(cfg.MulticastAddr, st, mx), ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(deadline)
+
+	// Cancellation interrupts the read by moving the deadline.
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-stopChan:
+		}
+	}()
+
+	type key struct{ usn, st string }
+	seen := map[key]bool{}
+
+	var events []Event
+	buf := make([]byte, recvBufferSize)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+
+		if n > cfg.MaxDatagramSize {
+			continue
+		}
+
+		res, err := parse.SSDP(buf[0:n])
+		if err != nil {
+			continue
+		}
+
+		ev := responseEvent(res, src)
+		if seen[key{ev.USN, ev.ST}] {
+			continue
+		}
+
+		seen[key{ev.USN, ev.ST}] = true
+		events = append(events, ev)
+	}
+
+	return events, ctx.Err()
+}
@@ -0,0 +1,17 @@
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd,!windows
+
+package ssdpbase
+
+import gnet "net"
+import "errors"
+
+var errTTLNotSupported = errors.New("setting the multicast TTL is not supported on this platform")
+var errIFNotSupported = errors.New("setting the multicast interface is not supported on this platform")
+
+func setMulticastTTL(conn *gnet.UDPConn, ttl int) error {
+	return errTTLNotSupported
+}
+
+func setMulticastInterface(conn *gnet.UDPConn, ip gnet.IP) error {
+	return errIFNotSupported
+}
@@ -0,0 +1,50 @@
+// +build windows
+
+package ssdpbase
+
+import gnet "net"
+import "syscall"
+
+func setMulticastTTL(conn *gnet.UDPConn, ttl int) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, ttl)
+	})
+	if err != nil {
+		return err
+	}
+
+	return serr
+}
+
+// Sets the interface out of which multicast datagrams are sent to the one
+// with the given IPv4 address.
+func setMulticastInterface(conn *gnet.UDPConn, ip gnet.IP) error {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return errNotIPv4
+	}
+
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var addr [4]byte
+	copy(addr[:], ip4)
+
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInet4Addr(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, addr)
+	})
+	if err != nil {
+		return err
+	}
+
+	return serr
+}
@@ -4,136 +4,594 @@
 package ssdpbase
 
 import gnet "net"
+import "errors"
 import "time"
-import "github.com/hlandau/degoutils/net"
-import "net/http"
-import "bytes"
 import "net/url"
-import "bufio"
+import "strconv"
+import "sync"
+import "sync/atomic"
+import "github.com/hlandau/portmap/internal/parse"
 
 // Interval at which discovery beacons are sent.
 const BroadcastInterval = 60 * time.Second
 
+// Minimum interval between discovery beacons sent on demand via Search.
+const MinSearchInterval = 5 * time.Second
+
 // Represents a received SSDP beacon.
 type Event struct {
 	Location *url.URL
 	ST       string
 	USN      string
+
+	// The SERVER header, which usually identifies the device's operating
+	// system and UPnP implementation. May be empty.
+	Server string
+
+	// The period for which the advertisement is valid, as given by the
+	// CACHE-CONTROL max-age directive. Zero if not specified.
+	MaxAge time.Duration
+
+	// The BOOTID.UPNP.ORG header sent by UPnP 1.1 devices, which changes each
+	// time the device reboots. -1 if not specified.
+	BootID int64
+
+	// The CONFIGID.UPNP.ORG header sent by UPnP 1.1 devices, which changes
+	// whenever the device's description changes. -1 if not specified.
+	ConfigID int64
+
+	// The SEARCHPORT.UPNP.ORG header sent by UPnP 1.1 devices which listen
+	// for unicast searches on a port other than 1900. Zero if not specified.
+	SearchPort int
+
+	// The address from which the response was received.
+	Source *gnet.UDPAddr
 }
 
 // SSDP event receiver.
 type Client interface {
-	// Returns a channel used to receive events.
+	// Returns a channel used to receive events. If Config.Handler is set, no
+	// events are sent on the channel, but it is still closed once the
+	// receiver has stopped.
 	Chan() <-chan Event
 
-	// Stops the receiver.
+	// Stops the receiver. The event channel is closed once the receiver has
+	// stopped. Doesn't block.
 	Stop()
+
+	// Requests that a discovery beacon be sent immediately rather than at the
+	// next broadcast interval. Doesn't block. Requests made less than
+	// MinSearchInterval after the previous beacon are ignored.
+	Search()
+
+	// Like Search, but the beacon carries the given MX value rather than the
+	// configured one, so that devices respond within mx seconds. A request
+	// with a smaller MX than the previous beacon is not subject to
+	// MinSearchInterval, so an urgent search is not held up by a beacon
+	// which was just sent.
+	SearchMX(mx int)
+
+	// Returns counters describing the datagrams received so far.
+	Stats() Stats
+
+	// Returns the error which caused the socket to fail if discovery is
+	// currently not working, and nil otherwise. If the socket fails, for
+	// example because an interface went down or the system was suspended, it
+	// is recreated automatically with backoff.
+	Degraded() error
+}
+
+// Counters describing the datagrams received by a Client.
+type Stats struct {
+	// Number of datagrams received.
+	Received uint64
+
+	// Number of datagrams which were parsed, whether or not successfully.
+	Processed uint64
+
+	// Number of datagrams which could not be parsed as SSDP responses.
+	Malformed uint64
+
+	// Number of datagrams which were dropped because the workers were busy,
+	// plus, if no Handler is configured, the number of events which were
+	// dropped because the event channel was full.
+	Dropped uint64
+
+	// Number of datagrams which were dropped because they exceeded
+	// Config.MaxDatagramSize.
+	Oversized uint64
+}
+
+// Configuration for a Client. The zero value is a valid configuration and
+// results in the defaults described for each field.
+type Config struct {
+	// The number of received datagrams which may await parsing before further
+	// datagrams are dropped, and, if no Handler is set, the number of events
+	// which may be queued on the event channel before further events are
+	// dropped. If zero, DefaultQueueSize is used.
+	QueueSize int
+
+	// If set, each event is passed to this function rather than sent on the
+	// event channel, so that no events are lost to a slow consumer. It is
+	// called concurrently from up to Workers goroutines. The event channel is
+	// still closed once the client has stopped.
+	Handler func(Event)
+
+	// The number of goroutines which parse received datagrams. If zero,
+	// DefaultWorkers is used.
+	Workers int
+
+	// Datagrams larger than this are dropped without being parsed. If zero,
+	// DefaultMaxDatagramSize is used.
+	MaxDatagramSize int
+
+	// If set, called with the error when the socket fails, and with nil once
+	// it has been recreated. See Client.Degraded.
+	StateHandler func(err error)
+
+	// Interval at which discovery beacons are sent. If zero,
+	// BroadcastInterval is used.
+	BroadcastInterval time.Duration
+
+	// The MX value sent in discovery beacons, which is the maximum number of
+	// seconds devices may wait before responding. If zero, DefaultMX is used.
+	MX int
+
+	// The local UDP port to listen on. If zero, an ephemeral port is used.
+	ListenPort int
+
+	// The multicast TTL of discovery beacons. If zero, the system default
+	// (usually 1) is used.
+	TTL int
+
+	// The names of the interfaces out of which each discovery beacon is sent.
+	// If empty, beacons are sent out of the system's default multicast
+	// interface only, unless AllInterfaces is set. Specifying interfaces
+	// fixes discovery on hosts where the default multicast interface is a
+	// virtual adapter, such as a VPN or container bridge.
+	Interfaces []string
+
+	// If set and Interfaces is empty, each beacon is sent out of every
+	// interface which is up, supports multicast, is not a loopback interface
+	// and has an IPv4 address.
+	AllInterfaces bool
+
+	// The address to which discovery beacons are sent. If empty,
+	// DefaultMulticastAddr is used. This can be changed for testing, for
+	// example to the unicast address of a simulated device.
+	MulticastAddr string
+}
+
+// Default MX value used in discovery beacons.
+const DefaultMX = 2
+
+// The standard SSDP multicast group and port.
+const DefaultMulticastAddr = "239.255.255.250:1900"
+
+func (cfg *Config) setDefaults() {
+	if cfg.QueueSize == 0 {
+		cfg.QueueSize = DefaultQueueSize
+	}
+	if cfg.Workers == 0 {
+		cfg.Workers = DefaultWorkers
+	}
+	if cfg.MaxDatagramSize == 0 {
+		cfg.MaxDatagramSize = DefaultMaxDatagramSize
+	}
+	if cfg.BroadcastInterval == 0 {
+		cfg.BroadcastInterval = BroadcastInterval
+	}
+	if cfg.MX == 0 {
+		cfg.MX = DefaultMX
+	}
+	if cfg.MulticastAddr == "" {
+		cfg.MulticastAddr = DefaultMulticastAddr
+	}
+}
+
+// Default number of events which may be queued by a Client.
+const DefaultQueueSize = 64
+
+// Default number of goroutines which parse received datagrams.
+const DefaultWorkers = 2
+
+// Default maximum size of a datagram which will be parsed. SSDP responses are
+// generally well under 1 KiB.
+const DefaultMaxDatagramSize = 8192
+
+// Size of the receive buffer, which is large enough for any UDP datagram so
+// that oversized datagrams can be detected rather than truncated.
+const recvBufferSize = 65536
+
+// A received datagram awaiting parsing. buf is taken from the client's pool
+// and is returned to it once the datagram has been parsed.
+type datagram struct {
+	buf *[]byte
+	n   int
+	src *gnet.UDPAddr
 }
 
 type client struct {
-	conn      *gnet.UDPConn
-	eventChan chan Event
-	stopChan  chan struct{}
+	stats Stats // atomic; must be first for alignment
+
+	cfg        Config
+	connMutex  sync.Mutex
+	conn       *gnet.UDPConn // connMutex
+	degraded   error         // connMutex
+	eventChan  chan Event
+	stopChan   chan struct{}
+	searchChan chan int
+	stopOnce   sync.Once
+	buf        []byte
+	jobs       chan datagram
+
+	// Buffers of MaxDatagramSize bytes holding datagrams awaiting parsing.
+	pool    sync.Pool
+	workers sync.WaitGroup
 }
 
 func (c *client) Stop() {
-	close(c.stopChan)
-	close(c.eventChan)
-	c.conn.Close()
+	c.stopOnce.Do(func() {
+		close(c.stopChan)
+		c.getConn().Close()
+	})
+}
+
+func (c *client) getConn() *gnet.UDPConn {
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+	return c.conn
+}
+
+func (c *client) Degraded() error {
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+	return c.degraded
 }
 
 func (c *client) Chan() <-chan Event {
 	return c.eventChan
 }
 
-func (c *client) broadcastLoop() {
-	defer c.conn.Close()
+func (c *client) Stats() Stats {
+	return Stats{
+		Received:  atomic.LoadUint64(&c.stats.Received),
+		Processed: atomic.LoadUint64(&c.stats.Processed),
+		Malformed: atomic.LoadUint64(&c.stats.Malformed),
+		Dropped:   atomic.LoadUint64(&c.stats.Dropped),
+		Oversized: atomic.LoadUint64(&c.stats.Oversized),
+	}
+}
+
+func (c *client) Search() {
+	c.SearchMX(0)
+}
+
+func (c *client) SearchMX(mx int) {
+	select {
+	case c.searchChan <- mx:
+	default:
+	}
+}
 
-	ssdpAddr, err := gnet.ResolveUDPAddr("udp4", "239.255.255.250:1900")
+func (c *client) broadcastLoop() {
+	ssdpAddr, err := gnet.ResolveUDPAddr("udp4", c.cfg.MulticastAddr)
 	if err != nil {
 		return
 	}
 
-	ticker := time.NewTicker(BroadcastInterval)
+	ticker := time.NewTicker(c.cfg.BroadcastInterval)
 	defer ticker.Stop()
 
-	discoBuf := []byte(
-		"M-SEARCH * HTTP/1.1\r\n" +
-			"HOST: 239.255.255.250:1900\r\n" +
-			"ST: ssdp:all\r\n" +
-			"MAN: \"ssdp:discover\"\r\n" +
-			"MX: 2\r\n\r\n")
-
+	mx := c.cfg.MX
 	for {
-		c.conn.WriteToUDP(discoBuf, ssdpAddr) // ignore errors
-		select {
-		case <-ticker.C:
-		case <-c.stopChan:
-			return
+		c.sendBeacon(c.discoveryBeacon(mx), ssdpAddr)
+		lastSent := time.Now()
+		lastMX := mx
+
+	wait:
+		for {
+			select {
+			case <-ticker.C:
+				mx = c.cfg.MX
+				break wait
+			case reqMX := <-c.searchChan:
+				if reqMX <= 0 {
+					reqMX = c.cfg.MX
+				}
+				if time.Since(lastSent) >= MinSearchInterval || reqMX < lastMX {
+					mx = reqMX
+					break wait
+				}
+			case <-c.stopChan:
+				return
+			}
 		}
 	}
 }
 
-func (c *client) handleResponse(res *http.Response) {
-	if res.StatusCode != 200 {
+// Sends a beacon out of each configured interface, or out of the default
+// interface if none are configured. Errors are ignored.
+func (c *client) sendBeacon(beacon []byte, ssdpAddr *gnet.UDPAddr) {
+	conn := c.getConn()
+
+	ips := c.beaconInterfaceIPs()
+	if ips == nil {
+		conn.WriteToUDP(beacon, ssdpAddr)
 		return
 	}
 
-	st := res.Header.Get("ST")
-	if st == "" {
-		return
+	for _, ip := range ips {
+		if setMulticastInterface(conn, ip) == nil {
+			conn.WriteToUDP(beacon, ssdpAddr)
+		}
+	}
+}
+
+// Returns an IPv4 address of each interface out of which beacons should be
+// sent, or nil if the default interface should be used. Interfaces are
+// enumerated afresh each time, since they may come and go.
+func (c *client) beaconInterfaceIPs() []gnet.IP {
+	if len(c.cfg.Interfaces) == 0 && !c.cfg.AllInterfaces {
+		return nil
 	}
 
-	loc, err := res.Location()
+	ifs, err := gnet.Interfaces()
 	if err != nil {
-		return
+		return nil
 	}
 
-	usn := res.Header.Get("USN")
-	if usn == "" {
-		usn = loc.String()
+	ips := []gnet.IP{}
+	for i := range ifs {
+		ifi := &ifs[i]
+		if len(c.cfg.Interfaces) > 0 {
+			if !containsString(c.cfg.Interfaces, ifi.Name) {
+				continue
+			}
+		} else if ifi.Flags&gnet.FlagUp == 0 || ifi.Flags&gnet.FlagMulticast == 0 || ifi.Flags&gnet.FlagLoopback != 0 {
+			continue
+		}
+
+		if ip := interfaceIPv4(ifi); ip != nil {
+			ips = append(ips, ip)
+		}
 	}
 
-	ev := Event{
-		Location: loc,
-		ST:       st,
-		USN:      usn,
+	if len(ips) == 0 && len(c.cfg.Interfaces) == 0 {
+		// no suitable interfaces, so let the system choose
+		return nil
+	}
+
+	return ips
+}
+
+var errNotIPv4 = errors.New("interface address is not an IPv4 address")
+
+func interfaceIPv4(ifi *gnet.Interface) gnet.IP {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+
+	for _, a := range addrs {
+		if ipn, ok := a.(*gnet.IPNet); ok && ipn.IP.To4() != nil {
+			return ipn.IP.To4()
+		}
+	}
+
+	return nil
+}
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *client) discoveryBeacon(mx int) []byte {
+	return searchBeacon(c.cfg.MulticastAddr, "ssdp:all", mx)
+}
+
+func searchBeacon(host, st string, mx int) []byte {
+	return []byte(
+		"M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: " + host + "\r\n" +
+			"ST: " + st + "\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: " + strconv.Itoa(mx) + "\r\n\r\n")
+}
+
+func (c *client) handleResponse(res *parse.SSDPResponse, src *gnet.UDPAddr) {
+	ev := responseEvent(res, src)
+	if c.cfg.Handler != nil {
+		c.cfg.Handler(ev)
+		return
 	}
 
 	select {
 	// events not being waited for are simply dropped
 	case c.eventChan <- ev:
 	default:
+		atomic.AddUint64(&c.stats.Dropped, 1)
+	}
+}
+
+// Converts a search response to an event.
+func responseEvent(res *parse.SSDPResponse, src *gnet.UDPAddr) Event {
+	return Event{
+		Location:   res.Location,
+		ST:         res.ST,
+		USN:        res.USN,
+		Server:     res.Server,
+		MaxAge:     res.MaxAge,
+		BootID:     res.BootID,
+		ConfigID:   res.ConfigID,
+		SearchPort: res.SearchPort,
+		Source:     src,
 	}
 }
 
 func (c *client) recvLoop() {
+	// Only the workers send on the event channel, so it is closed once they
+	// have finished.
+	defer func() {
+		c.getConn().Close()
+		close(c.jobs)
+		c.workers.Wait()
+		close(c.eventChan)
+	}()
+
 	for {
-		buf, _, err := net.ReadDatagramFromUDP(c.conn)
+		n, src, err := c.getConn().ReadFromUDP(c.buf)
 		if err != nil {
-			return
+			if !c.recover(err) {
+				return
+			}
+			continue
+		}
+
+		atomic.AddUint64(&c.stats.Received, 1)
+		if n > c.cfg.MaxDatagramSize {
+			atomic.AddUint64(&c.stats.Oversized, 1)
+			continue
+		}
+
+		bp := c.pool.Get().(*[]byte)
+		d := datagram{buf: bp, n: copy(*bp, c.buf[0:n]), src: src}
+		select {
+		case c.jobs <- d:
+		default:
+			c.pool.Put(bp)
+			atomic.AddUint64(&c.stats.Dropped, 1)
 		}
+	}
+}
+
+// Delays between attempts to recreate a failed socket.
+const (
+	minRecoveryDelay = 1 * time.Second
+	maxRecoveryDelay = 60 * time.Second
+)
+
+// Recreates the socket after it fails with err. Returns false if the client
+// is stopped first.
+func (c *client) recover(err error) bool {
+	select {
+	case <-c.stopChan:
+		return false
+	default:
+	}
+
+	c.setDegraded(err)
+	c.getConn().Close()
 
-		rbio := bufio.NewReader(bytes.NewReader(buf))
-		res, err := http.ReadResponse(rbio, nil)
+	delay := minRecoveryDelay
+	for {
+		select {
+		case <-c.stopChan:
+			return false
+		case <-time.After(delay):
+		}
+
+		conn, err := openConn(&c.cfg)
 		if err == nil {
-			c.handleResponse(res)
+			c.connMutex.Lock()
+			c.conn = conn
+			c.connMutex.Unlock()
+
+			// Stop may have closed the old socket after the check above.
+			select {
+			case <-c.stopChan:
+				conn.Close()
+				return false
+			default:
+			}
+
+			c.setDegraded(nil)
+
+			// Responses to beacons sent while the socket was down were lost.
+			c.Search()
+			return true
+		}
+
+		c.setDegraded(err)
+		delay *= 2
+		if delay > maxRecoveryDelay {
+			delay = maxRecoveryDelay
 		}
 	}
 }
 
+func (c *client) setDegraded(err error) {
+	c.connMutex.Lock()
+	wasDegraded := c.degraded != nil
+	c.degraded = err
+	c.connMutex.Unlock()
+
+	if c.cfg.StateHandler != nil && (err != nil) != wasDegraded {
+		c.cfg.StateHandler(err)
+	}
+}
+
+func (c *client) worker() {
+	defer c.workers.Done()
+
+	for d := range c.jobs {
+		// Nothing parsed from the datagram refers to the buffer afterwards.
+		c.handleDatagram((*d.buf)[0:d.n], d.src)
+		c.pool.Put(d.buf)
+		atomic.AddUint64(&c.stats.Processed, 1)
+	}
+}
+
+// Parses a received datagram.
+func (c *client) handleDatagram(buf []byte, src *gnet.UDPAddr) {
+	res, err := parse.SSDP(buf)
+	if err != nil {
+		atomic.AddUint64(&c.stats.Malformed, 1)
+		return
+	}
+
+	c.handleResponse(res, src)
+}
+
+// Creates a client with the default configuration.
 func NewClient() (Client, error) {
-	conng, err := gnet.ListenPacket("udp4", ":0")
+	return NewClientConfig(Config{})
+}
+
+// Creates a client with the given configuration.
+func NewClientConfig(cfg Config) (Client, error) {
+	cfg.setDefaults()
+
+	conn, err := openConn(&cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	conn := conng.(*gnet.UDPConn)
-
 	c := &client{
-		stopChan:  make(chan struct{}),
-		eventChan: make(chan Event, 10),
-		conn:      conn,
+		cfg:        cfg,
+		stopChan:   make(chan struct{}),
+		eventChan:  make(chan Event, cfg.QueueSize),
+		searchChan: make(chan int, 1),
+		conn:       conn,
+		buf:        make([]byte, recvBufferSize),
+		jobs:       make(chan datagram, cfg.QueueSize),
+	}
+
+	size := cfg.MaxDatagramSize
+	c.pool.New = func() interface{} {
+		b := make([]byte, size)
+		return &b
+	}
+
+	c.workers.Add(cfg.Workers)
+	for i := 0; i < cfg.Workers; i++ {
+		go c.worker()
 	}
 
 	go c.broadcastLoop()
@@ -141,3 +599,20 @@ func NewClient() (Client, error) {
 
 	return c, nil
 }
+
+func openConn(cfg *Config) (*gnet.UDPConn, error) {
+	conn, err := gnet.ListenUDP("udp4", &gnet.UDPAddr{Port: cfg.ListenPort})
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.TTL != 0 {
+		err = setMulticastTTL(conn, cfg.TTL)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
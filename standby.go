@@ -0,0 +1,153 @@
+package portmap
+
+import "net"
+import "time"
+import "github.com/hlandau/portmap/internal/localnet"
+import "github.com/hlandau/portmap/natpmp"
+
+// Interval at which the first gateway of a mapping using Config.Standby is
+// probed, the time allowed for it to respond, and the number of consecutive
+// probes which must fail before the standby mapping is promoted.
+const (
+	standbyProbeInterval = 5 * time.Second
+	standbyProbeTimeout  = 2 * time.Second
+	standbyProbeFailures = 2
+)
+
+// The lifetime requested for a standby mapping made via NAT-PMP. NAT-PMP
+// mappings can't be disabled, so the standby mapping is kept short-lived
+// instead, and is renewed with the usual lifetime once promoted.
+const standbyLifetime = 2 * time.Minute
+
+func (m *mapping) lIsStandby() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.standby
+}
+
+func (m *mapping) lIsStandbyMapped() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.standbyMapped
+}
+
+// Returns the lifetime to request from a gateway, which is standbyLifetime
+// for a standby mapping made via NAT-PMP.
+func (m *mapping) requestLifetime(method Method, standby bool) time.Duration {
+	if standby && method == MethodNATPMP && m.cfg.Lifetime > standbyLifetime {
+		return standbyLifetime
+	}
+
+	return m.cfg.Lifetime
+}
+
+// Checks whether the gateway on which the first child holds the mapping is
+// still responding. Returns true if the child doesn't currently hold the
+// mapping, since its own attempts then show whether the gateway is working.
+func (m *mapping) probePrimary() bool {
+	c := m.children[0]
+	c.mutex.Lock()
+	active := c.isActive()
+	method := c.method
+	gw := c.gateway
+	svc := c.upnpService
+	c.mutex.Unlock()
+
+	if !active {
+		return true
+	}
+
+	switch method {
+	case MethodNATPMP:
+		// a response with an error code still shows the gateway is alive
+		_, err := natpmp.Ping(gw, standbyProbeTimeout)
+		return err == nil
+
+	case MethodUPnP:
+		if svc == nil {
+			return true
+		}
+
+		loc := svc.PreferredLocation()
+		host := loc.Host
+		if loc.Port() == "" {
+			host = net.JoinHostPort(loc.Hostname(), "80")
+		}
+
+		if localnet.Check(host) != nil {
+			return true
+		}
+
+		conn, err := net.DialTimeout("tcp", host, standbyProbeTimeout)
+		if err != nil {
+			return false
+		}
+
+		conn.Close()
+		return true
+	}
+
+	return true
+}
+
+// Records whether the first gateway is failing to respond to probes, and
+// fails over or back if that has changed.
+func (m *mapping) setPrimaryDown(down bool) {
+	m.mutex.Lock()
+	changed := m.primaryDown != down
+	m.primaryDown = down
+	m.mutex.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if !down {
+		// A renewal may have failed while the gateway was down, so the
+		// mapping is retried now rather than at the end of the backoff.
+		m.children[0].revalidate()
+	}
+
+	m.syncChildren()
+}
+
+// Promotes the standby mapping if the first gateway is failing, and demotes
+// it once the first gateway holds the mapping again. The second child is
+// signalled so that its mapping is enabled or disabled straight away.
+// Returns true if the standby mapping is promoted.
+func (m *mapping) failover() bool {
+	primary, standby := m.children[0], m.children[1]
+
+	m.mutex.Lock()
+	down := m.primaryDown
+	m.mutex.Unlock()
+
+	primary.mutex.Lock()
+	down = down || primary.attemptFailed
+	recovered := !down && primary.isActive()
+	primary.mutex.Unlock()
+
+	standby.mutex.Lock()
+	promote := standby.standby && down
+	demote := !standby.standby && recovered
+	if promote || demote {
+		standby.standby = demote
+	}
+	promoted := !standby.standby
+	standby.mutex.Unlock()
+
+	from, to := m.childGWs[0], m.childGWs[1]
+	switch {
+	case promote:
+		log.Infof("gateway %v is failing, moving mapping to standby gateway %v", from, to)
+	case demote:
+		log.Infof("gateway %v has recovered, moving mapping back from %v", from, to)
+		from, to = to, from
+	default:
+		return promoted
+	}
+
+	standby.revalidate()
+	m.emit(FailedOver{From: from, To: to})
+	return promoted
+}
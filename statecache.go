@@ -0,0 +1,200 @@
+package portmap
+
+import "encoding/json"
+import "io/ioutil"
+import "net"
+import "os"
+import "path/filepath"
+import "sync"
+import "time"
+
+var stateCacheMutex sync.Mutex
+var stateCachePath string
+var stateCacheEntries []stateCacheEntry // stateCacheMutex; nil if not loaded
+
+// Sets a file in which the outcome of successful mapping attempts is
+// recorded, so that later runs of the program can recreate the same mappings
+// quickly. When a mapping is created and the file records that the same
+// internal port was last mapped via NAT-PMP, the same request is made
+// immediately, in parallel with the usual probing of gateways. On an
+// unchanged network this typically makes the mapping active in well under a
+// second. The external port last granted is also requested again, unless
+// Config.ExternalPort is set.
+//
+// Pass an empty string to disable the cache, which is the default.
+func SetStateCache(path string) {
+	stateCacheMutex.Lock()
+	defer stateCacheMutex.Unlock()
+	stateCachePath = path
+	stateCacheEntries = nil
+}
+
+type stateCacheEntry struct {
+	Protocol     string    `json:"protocol"`
+	InternalPort uint16    `json:"internalPort"`
+	ExternalPort uint16    `json:"externalPort"`
+	Method       string    `json:"method"`
+	Gateway      string    `json:"gateway"`
+	Time         time.Time `json:"time"`
+}
+
+// Entries older than this are ignored.
+const stateCacheMaxAge = 30 * 24 * time.Hour
+
+// Must be called with stateCacheMutex held.
+func loadStateCache() {
+	if stateCacheEntries != nil || stateCachePath == "" {
+		return
+	}
+
+	stateCacheEntries = []stateCacheEntry{}
+
+	b, err := ioutil.ReadFile(stateCachePath)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(b, &stateCacheEntries)
+	if err != nil {
+		log.Infof("ignoring malformed state cache: %v", err)
+		stateCacheEntries = []stateCacheEntry{}
+	}
+}
+
+// Returns the cached outcome for the given mapping, if any.
+func stateCacheLookup(proto Protocol, internalPort uint16) (stateCacheEntry, bool) {
+	stateCacheMutex.Lock()
+	defer stateCacheMutex.Unlock()
+
+	loadStateCache()
+	for _, e := range stateCacheEntries {
+		if e.Protocol == proto.String() && e.InternalPort == internalPort && time.Since(e.Time) < stateCacheMaxAge {
+			return e, true
+		}
+	}
+
+	return stateCacheEntry{}, false
+}
+
+// Records the outcome of a successful mapping attempt. The file is only
+// rewritten if the outcome differs from that recorded.
+func stateCacheStore(proto Protocol, internalPort, externalPort uint16, method Method, gateway string) {
+	stateCacheMutex.Lock()
+	defer stateCacheMutex.Unlock()
+
+	if stateCachePath == "" {
+		return
+	}
+
+	loadStateCache()
+
+	e := stateCacheEntry{
+		Protocol:     proto.String(),
+		InternalPort: internalPort,
+		ExternalPort: externalPort,
+		Method:       method.String(),
+		Gateway:      gateway,
+		Time:         time.Now().UTC(),
+	}
+
+	for i := range stateCacheEntries {
+		ce := &stateCacheEntries[i]
+		if ce.Protocol != e.Protocol || ce.InternalPort != e.InternalPort {
+			continue
+		}
+
+		if ce.ExternalPort == e.ExternalPort && ce.Method == e.Method && ce.Gateway == e.Gateway &&
+			time.Since(ce.Time) < stateCacheMaxAge/2 {
+			return
+		}
+
+		*ce = e
+		writeStateCache()
+		return
+	}
+
+	stateCacheEntries = append(stateCacheEntries, e)
+	writeStateCache()
+}
+
+// Must be called with stateCacheMutex held.
+func writeStateCache() {
+	b, err := json.Marshal(stateCacheEntries)
+	if err != nil {
+		return
+	}
+
+	err = writeFileAtomic(stateCachePath, ".portmap-state", b)
+	if err != nil {
+		log.Infof("cannot write state cache: %v", err)
+	}
+}
+
+// Replaces the file at path with b. The data is written to a temporary file
+// in the same directory, named with the given prefix, which is then renamed
+// over path, so that a concurrent reader never sees a partial file.
+func writeFileAtomic(path, prefix string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), prefix)
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+// If the state cache records that the mapping was last made via NAT-PMP using
+// one of the given gateways, starts the same request in the background and
+// returns a channel which yields whether it succeeded. Returns nil otherwise.
+//
+// A mapping created by Attach is renewed in the same way via the gateway
+// recorded in the handle, whether or not a state cache is in use.
+func (m *mapping) fastStart(gwa []net.IP) <-chan bool {
+	if h := m.attached; h != nil {
+		gw := net.ParseIP(h.Gateway)
+		if h.Method != MethodNATPMP || gw == nil {
+			return nil
+		}
+
+		return m.startNATPMP(gw)
+	}
+
+	e, ok := stateCacheLookup(m.cfg.Protocol, m.state.internalPort)
+	if !ok {
+		return nil
+	}
+
+	if m.state.externalPort == 0 {
+		m.mutex.Lock()
+		m.state.externalPort = e.ExternalPort
+		m.mutex.Unlock()
+	}
+
+	gw := net.ParseIP(e.Gateway)
+	if e.Method != MethodNATPMP.String() || gw == nil || !isGatewayIP(gw, gwa) {
+		return nil
+	}
+
+	return m.startNATPMP(gw)
+}
+
+// Starts a NAT-PMP request to the given gateway in the background and returns
+// a channel which yields whether it succeeded.
+func (m *mapping) startNATPMP(gw net.IP) <-chan bool {
+	ch := make(chan bool, 1)
+	go func() {
+		ch <- m.tryNATPMPGW(gw, false)
+	}()
+
+	return ch
+}
@@ -0,0 +1,169 @@
+package portmap
+
+import "time"
+
+// Describes the state of a Mapping at a point in time.
+type Status struct {
+	// Incremented each time the mapping becomes active or inactive or its
+	// external address changes. Two Status values with the same Version have
+	// the same Active and ExternalAddr. Starts at zero, for an inactive
+	// mapping.
+	Version uint64
+
+	// Whether the mapping is currently active.
+	Active bool
+
+	// The value which ExternalAddr() would return.
+	ExternalAddr string
+
+	// The local port to which the mapping forwards. This is Config.InternalPort
+	// unless the mapping has been moved by Mapping.Update.
+	InternalPort uint16
+
+	// The external port most recently granted by the gateway. Zero if the
+	// port is not yet known, which can be the case even if Active is true.
+	ExternalPort uint16
+
+	// The lifetime most recently granted by the gateway, which may differ from
+	// Config.Lifetime. Only meaningful if Active is true.
+	Lifetime time.Duration
+
+	// The method by which the mapping was most recently created or renewed.
+	// Only meaningful if Active is true.
+	Method Method
+
+	// The time at which the mapping will expire if it is not renewed. Zero if
+	// the mapping is not active.
+	ExpireTime time.Time
+
+	// Whether the restriction requested by Config.Scope is enforced by the
+	// gateway. Always true if no restriction was requested. Only meaningful
+	// if Active is true.
+	ScopeEnforced bool
+
+	// Whether forwarding has been stopped by Mapping.Disable.
+	Disabled bool
+
+	// Whether connecting to ExternalAddr from this host reaches the mapping.
+	// Always HairpinUnknown unless Config.DetectHairpin is set.
+	Hairpin Hairpin
+
+	// Whether the UPnP gateway refused to map the port because this host is
+	// its DMZ host, which receives traffic on every port already. No mapping
+	// was made, and ExternalPort is the internal port. Only meaningful if
+	// Active is true.
+	DMZ bool
+
+	// Whether the mapping is waiting for a default gateway to appear before
+	// any attempt is made. See Config.WaitForGateway.
+	Pending bool
+
+	// The time taken from the creation of the mapping until it first became
+	// active, including any time spent pending. Zero if the mapping has never
+	// been active.
+	TimeToActive time.Duration
+
+	// The time the mapping spent pending before a default gateway appeared.
+	// Zero if the mapping was never pending.
+	GatewayWait time.Duration
+
+	// The IPv4 transition mechanism which was found to make IPv4 port mapping
+	// impossible when the last attempt failed. While this is set, attempts
+	// are only made occasionally, and applications should accept incoming
+	// connections over IPv6 instead. Only meaningful if Active is false.
+	Transition Transition
+
+	// Why the mapping is inactive. InactiveNone if Active is true.
+	InactiveReason InactiveReason
+
+	// The error from the most recent attempt to create or renew the mapping,
+	// or nil if it succeeded. Where the failure falls into one of the classes
+	// ErrNoGateway, ErrTimeout and ErrUnsupported, errors.Is reports it. Not
+	// reported for mappings maintained by a broker.
+	LastError error `json:"-"`
+
+	// The tags given in Config.Tags.
+	Tags map[string]string
+
+	// How long the steps of the most recent attempt to create or renew the
+	// mapping took, whether or not it succeeded. For a mapping maintained by
+	// a broker, these are as of the broker's last change of status. Not
+	// reported for mappings using Config.AllGateways or Config.Standby.
+	Timings Timings
+
+	// The time at which the mapping became inactive, or at which it was
+	// created if it has never been active. Zero if the mapping is active.
+	InactiveSince time.Time
+}
+
+func (m *mapping) Status() Status {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// Active and ExternalAddr are those of the current version, so that they
+	// always agree with it. A change not yet noticed by the loop, such as the
+	// mapping having lapsed during a renewal, is reported with the next
+	// version.
+	s := Status{
+		Version:       m.version,
+		Active:        m.notified.active,
+		ExternalAddr:  m.notified.addr,
+		InternalPort:  m.state.internalPort,
+		ExternalPort:  m.grantedPort,
+		Lifetime:      m.state.lifetime,
+		Method:        m.method,
+		ScopeEnforced: m.scopeEnforced,
+		Disabled:      m.disabled,
+		DMZ:           m.dmz,
+		Hairpin:       m.hairpin,
+		Pending:       m.pending,
+		TimeToActive:  m.timeToActive,
+		GatewayWait:   m.gatewayWait,
+		LastError:     m.lastErr,
+	}
+	s.Timings = m.lastTimings
+	if s.Active {
+		s.ExpireTime = m.expireTime
+	} else {
+		s.Transition = m.transition
+		s.InactiveReason = m.inactiveReason()
+		s.InactiveSince = m.inactiveSince()
+		if s.InactiveSince.IsZero() {
+			// became active since the version was last incremented
+			s.InactiveSince = m.deactivatedTime
+		}
+	}
+
+	return s
+}
+
+// The values negotiated with the gateway. These start out as those requested
+// in the Config and are replaced by those the gateway grants, or by those
+// given to Mapping.Update.
+type negotiated struct {
+	// The local port to forward to, which only changes on Mapping.Update.
+	internalPort uint16
+
+	// The external port to request when the mapping is next created or
+	// renewed. Zero to let the gateway choose.
+	externalPort uint16
+
+	// The lifetime most recently granted, from which renewal is scheduled.
+	// Config.Lifetime is always requested, in case a gateway which capped the
+	// lifetime stops doing so.
+	lifetime time.Duration
+}
+
+func (m *mapping) inactiveSince() time.Time {
+	if m.isActive() {
+		return time.Time{}
+	}
+
+	// If the mapping was active and lapsed without being explicitly made
+	// inactive, it became inactive when it expired.
+	if m.expireTime.After(m.deactivatedTime) {
+		return m.expireTime
+	}
+
+	return m.deactivatedTime
+}
@@ -0,0 +1,83 @@
+package portmap
+
+import "time"
+
+// How long the steps of an attempt to create or renew a mapping took, for
+// diagnosing slow mapping. The time of each step is summed over the gateways
+// tried and any retransmissions; steps which were not performed took zero
+// time. See Status.Timings.
+type Timings struct {
+	// The whole attempt.
+	Total time.Duration
+
+	// Waiting for a UPnP device to be discovered by SSDP.
+	SSDPWait time.Duration
+
+	// Retrieving UPnP device descriptions. Descriptions are cached, so this
+	// is usually zero on renewal.
+	DescriptionFetch time.Duration
+
+	// Requests to UPnP devices, once their descriptions had been retrieved.
+	SOAP time.Duration
+
+	// NAT-PMP transactions, including retransmissions.
+	NATPMP time.Duration
+
+	// Calls to Config.Backend or Config.Fallback.
+	Backend time.Duration
+}
+
+// A step of an attempt, as recorded in Timings.
+type timingStep int
+
+const (
+	stepSSDPWait timingStep = iota
+	stepDescription
+	stepSOAP
+	stepNATPMP
+	stepBackend
+)
+
+// Adds the time elapsed since start to a step of the attempt in progress.
+// Intended to be deferred.
+func (m *mapping) recordTiming(step timingStep, start time.Time) {
+	d := m.now().Sub(start)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	t := &m.timings
+	switch step {
+	case stepSSDPWait:
+		t.SSDPWait += d
+	case stepDescription:
+		t.DescriptionFetch += d
+	case stepSOAP:
+		t.SOAP += d
+	case stepNATPMP:
+		t.NATPMP += d
+	case stepBackend:
+		t.Backend += d
+	}
+}
+
+// Starts timing an attempt. Returns the time at which it started.
+func (m *mapping) beginAttempt() time.Time {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.timings = Timings{}
+	return m.now()
+}
+
+// Finishes timing the attempt begun at start, making its timings those
+// reported by Status.
+func (m *mapping) endAttempt(start time.Time) {
+	now := m.now()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.timings.Total = now.Sub(start)
+	m.lastTimings = m.timings
+}
@@ -0,0 +1,175 @@
+package tr064
+
+import "crypto/md5"
+import "crypto/rand"
+import "encoding/hex"
+import "fmt"
+import "net/http"
+import "strings"
+import "sync"
+
+// HTTP digest authentication (RFC 2617) as required by TR-064. Only MD5 with
+// qop=auth is implemented, which is what TR-064 devices use.
+type digestAuth struct {
+	username, password string
+
+	mutex     sync.Mutex
+	challenge *digestChallenge // m
+	nc        uint32           // m
+}
+
+type digestChallenge struct {
+	realm, nonce, opaque, algorithm string
+	qopAuth                         bool
+}
+
+// Parses a WWW-Authenticate header. Returns nil if it is not a digest
+// challenge.
+func parseDigestChallenge(h string) *digestChallenge {
+	const prefix = "digest "
+	if len(h) < len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return nil
+	}
+
+	c := &digestChallenge{}
+	for _, kv := range splitDigestParams(h[len(prefix):]) {
+		switch strings.ToLower(kv[0]) {
+		case "realm":
+			c.realm = kv[1]
+		case "nonce":
+			c.nonce = kv[1]
+		case "opaque":
+			c.opaque = kv[1]
+		case "algorithm":
+			c.algorithm = kv[1]
+		case "qop":
+			for _, q := range strings.Split(kv[1], ",") {
+				if strings.TrimSpace(q) == "auth" {
+					c.qopAuth = true
+				}
+			}
+		}
+	}
+
+	if c.nonce == "" {
+		return nil
+	}
+
+	return c
+}
+
+// Splits a comma-separated list of key=value parameters, where values may be
+// quoted strings containing commas.
+func splitDigestParams(s string) [][2]string {
+	var params [][2]string
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params
+		}
+
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return params
+		}
+
+		key := strings.TrimSpace(s[:eq])
+		s = strings.TrimLeft(s[eq+1:], " \t")
+
+		var val string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			val = b.String()
+			if i < len(s) {
+				i++
+			}
+			s = s[i:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			val = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+
+		params = append(params, [2]string{key, val})
+	}
+}
+
+func md5Hex(s string) string {
+	h := md5.Sum([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+// Records the challenge from a 401 response. Returns false if the response
+// carries no usable challenge.
+func (a *digestAuth) setChallenge(res *http.Response) bool {
+	for _, h := range res.Header["Www-Authenticate"] {
+		if c := parseDigestChallenge(h); c != nil {
+			if c.algorithm != "" && !strings.EqualFold(c.algorithm, "MD5") {
+				continue
+			}
+
+			a.mutex.Lock()
+			a.challenge = c
+			a.nc = 0
+			a.mutex.Unlock()
+			return true
+		}
+	}
+
+	return false
+}
+
+// Adds an Authorization header answering the last challenge, if any.
+func (a *digestAuth) authorize(req *http.Request) {
+	a.mutex.Lock()
+	c := a.challenge
+	a.nc++
+	nc := a.nc
+	a.mutex.Unlock()
+
+	if c == nil {
+		return
+	}
+
+	uri := req.URL.RequestURI()
+	ha1 := md5Hex(a.username + ":" + c.realm + ":" + a.password)
+	ha2 := md5Hex(req.Method + ":" + uri)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `Digest username="%s", realm="%s", nonce="%s", uri="%s"`,
+		quoteEscape(a.username), quoteEscape(c.realm), quoteEscape(c.nonce), quoteEscape(uri))
+
+	if c.qopAuth {
+		var cb [8]byte
+		rand.Read(cb[:])
+		cnonce := hex.EncodeToString(cb[:])
+		ncs := fmt.Sprintf("%08x", nc)
+		resp := md5Hex(ha1 + ":" + c.nonce + ":" + ncs + ":" + cnonce + ":auth:" + ha2)
+		fmt.Fprintf(&b, `, qop=auth, nc=%s, cnonce="%s", response="%s"`, ncs, cnonce, resp)
+	} else {
+		fmt.Fprintf(&b, `, response="%s"`, md5Hex(ha1+":"+c.nonce+":"+ha2))
+	}
+
+	if c.algorithm != "" {
+		fmt.Fprintf(&b, `, algorithm=%s`, c.algorithm)
+	}
+	if c.opaque != "" {
+		fmt.Fprintf(&b, `, opaque="%s"`, quoteEscape(c.opaque))
+	}
+
+	req.Header.Set("Authorization", b.String())
+}
+
+func quoteEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
@@ -0,0 +1,380 @@
+// Package tr064 implements the parts of the TR-064 LAN-side CPE management
+// protocol needed to create port mappings, as provided by AVM FRITZ!Box
+// routers. These frequently ship with UPnP IGD disabled but TR-064 enabled.
+//
+// TR-064 uses the same SOAP actions as UPnP IGD, but on a separate port with
+// HTTP digest authentication, and with services in the urn:dslforum-org
+// namespace.
+package tr064
+
+import "bytes"
+import "crypto/tls"
+import "encoding/xml"
+import "errors"
+import "fmt"
+import "html"
+import "net"
+import "net/http"
+import "net/url"
+import "strconv"
+import "sync"
+import "time"
+import "github.com/hlandau/portmap/internal/localnet"
+import "github.com/hlandau/portmap/internal/parse"
+import "github.com/hlandau/portmap/ssdp"
+
+// The ports on which TR-064 is served over HTTP and HTTPS.
+const (
+	DefaultPort    = 49000
+	DefaultTLSPort = 49443
+)
+
+// The path of the device description.
+const descriptionPath = "/tr64desc.xml"
+
+// Services through which port mappings can be made. A FRITZ!Box connected by
+// PPPoE uses WANPPPConnection; one connected to a cable or fibre modem uses
+// WANIPConnection. Both are usually described, so the one which reports an
+// external address is used.
+const (
+	WANIPConnection1  = "urn:dslforum-org:service:WANIPConnection:1"
+	WANPPPConnection1 = "urn:dslforum-org:service:WANPPPConnection:1"
+)
+
+// Configures a TR-064 client.
+type Config struct {
+	// The hostname or IP address of the device, optionally with a port. If no
+	// port is given, DefaultPort is used, or DefaultTLSPort if TLSConfig is
+	// set.
+	Host string
+
+	// Credentials for the device. On a FRITZ!Box, the user needs the "FRITZ!Box
+	// settings" right, and "Allow access for applications" must be enabled.
+	Username, Password string
+
+	// If set, the device is contacted over HTTPS with this configuration.
+	// Devices present self-signed certificates, so this usually needs a
+	// suitable RootCAs pool.
+	TLSConfig *tls.Config
+}
+
+// An error returned by a TR-064 device in response to an action. The codes
+// are those of UPnP.
+type Error struct {
+	Code        int
+	Description string
+}
+
+func (e *Error) Error() string {
+	if e.Description == "" {
+		return fmt.Sprintf("TR-064 error %d", e.Code)
+	}
+
+	return fmt.Sprintf("TR-064 error %d: %s", e.Code, e.Description)
+}
+
+// Error codes used by this package.
+const (
+	ErrCodeNotAuthorized          = 606
+	ErrCodeNoSuchEntryInArray     = 714
+	ErrCodeConflictInMappingEntry = 718
+	ErrCodeOnlyPermanentLeases    = 725
+)
+
+// Returns true if err is a TR-064 error with the given code.
+func IsErrorCode(err error, code int) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == code
+}
+
+var errUnauthorized = errors.New("TR-064 authentication failed")
+var errNoService = errors.New("TR-064 device does not provide a WAN connection service")
+
+// Timeout for each request to the device.
+const requestTimeout = 15 * time.Second
+
+// A TR-064 client for a single device. Methods may be called concurrently.
+type Client struct {
+	base   *url.URL
+	client *http.Client
+	auth   digestAuth
+
+	mutex sync.Mutex
+	svc   *service // m
+}
+
+type service struct {
+	serviceType string
+	controlURL  *url.URL
+}
+
+// Creates a client for the device described by cfg. No requests are made
+// until a method is called.
+func New(cfg Config) (*Client, error) {
+	scheme, port := "http", DefaultPort
+	if cfg.TLSConfig != nil {
+		scheme, port = "https", DefaultTLSPort
+	}
+
+	host := cfg.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+
+	base, err := url.Parse(scheme + "://" + host)
+	if err != nil {
+		return nil, err
+	}
+
+	// Proxy settings from the environment are not used, since the device is
+	// on the local network.
+	tr := &http.Transport{
+		DialContext:     localnet.DialContext,
+		TLSClientConfig: cfg.TLSConfig,
+		IdleConnTimeout: 90 * time.Second,
+	}
+
+	return &Client{
+		base:   base,
+		client: &http.Client{Transport: tr, Timeout: requestTimeout},
+		auth:   digestAuth{username: cfg.Username, password: cfg.Password},
+	}, nil
+}
+
+// Describes a port mapping to create with AddPortMapping.
+type PortMapping struct {
+	// The remote host the mapping is restricted to, or nil to admit any.
+	RemoteHost net.IP
+
+	ExternalPort uint16
+
+	// "TCP" or "UDP".
+	Protocol string
+
+	InternalPort   uint16
+	InternalClient net.IP
+	Description    string
+
+	// Zero for a permanent mapping.
+	LeaseDuration time.Duration
+}
+
+// Creates or replaces a port mapping. If the device only supports permanent
+// mappings, a permanent mapping is created instead, and the lease duration
+// actually used is returned.
+func (c *Client) AddPortMapping(pm *PortMapping) (time.Duration, error) {
+	svc, err := c.service()
+	if err != nil {
+		return 0, err
+	}
+
+	lease := pm.LeaseDuration
+	for {
+		args := fmt.Sprintf(`<NewRemoteHost>%s</NewRemoteHost><NewExternalPort>%d</NewExternalPort><NewProtocol>%s</NewProtocol><NewInternalPort>%d</NewInternalPort><NewInternalClient>%s</NewInternalClient><NewEnabled>1</NewEnabled><NewPortMappingDescription>%s</NewPortMappingDescription><NewLeaseDuration>%d</NewLeaseDuration>`,
+			remoteHostString(pm.RemoteHost), pm.ExternalPort, pm.Protocol, pm.InternalPort,
+			pm.InternalClient.String(), html.EscapeString(pm.Description), uint32(lease.Seconds()))
+
+		err = c.call(svc, "AddPortMapping", args, nil)
+		if IsErrorCode(err, ErrCodeOnlyPermanentLeases) && lease != 0 {
+			lease = 0
+			continue
+		}
+
+		return lease, err
+	}
+}
+
+// Deletes a port mapping.
+func (c *Client) DeletePortMapping(remoteHost net.IP, externalPort uint16, protocol string) error {
+	svc, err := c.service()
+	if err != nil {
+		return err
+	}
+
+	args := fmt.Sprintf(`<NewRemoteHost>%s</NewRemoteHost><NewExternalPort>%d</NewExternalPort><NewProtocol>%s</NewProtocol>`,
+		remoteHostString(remoteHost), externalPort, protocol)
+	return c.call(svc, "DeletePortMapping", args, nil)
+}
+
+type xGetExternalIPAddressResponse struct {
+	XMLName           xml.Name `xml:"GetExternalIPAddressResponse"`
+	ExternalIPAddress string   `xml:"NewExternalIPAddress"`
+}
+
+// Returns the external address of the device's WAN connection.
+func (c *Client) GetExternalIPAddress() (net.IP, error) {
+	svc, err := c.service()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.externalIP(svc)
+}
+
+func (c *Client) externalIP(svc *service) (net.IP, error) {
+	var reply xGetExternalIPAddressResponse
+	err := c.call(svc, "GetExternalIPAddress", "", &reply)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(reply.ExternalIPAddress)
+	if ip == nil {
+		return nil, fmt.Errorf("TR-064 device returned invalid external address %q", reply.ExternalIPAddress)
+	}
+
+	return ip, nil
+}
+
+// Returns the address this host uses to reach the device, which is the
+// address mappings should point to.
+func (c *Client) LocalIP() (net.IP, error) {
+	err := localnet.Check(c.base.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial("udp", c.base.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// Returns the WAN connection service to use, determining it from the device
+// description the first time.
+func (c *Client) service() (*service, error) {
+	c.mutex.Lock()
+	svc := c.svc
+	c.mutex.Unlock()
+
+	if svc != nil {
+		return svc, nil
+	}
+
+	desc, err := c.describe()
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []*service
+	for _, t := range []string{WANIPConnection1, WANPPPConnection1} {
+		desc.Device.VisitServices(func(d *ssdp.Device, s *ssdp.DeviceService) {
+			if s.ServiceType == t && s.ControlURL != nil {
+				candidates = append(candidates, &service{serviceType: t, controlURL: s.ControlURL})
+			}
+		})
+	}
+
+	if len(candidates) == 0 {
+		return nil, errNoService
+	}
+
+	// The connection which is up reports a usable external address.
+	svc = candidates[0]
+	for _, cand := range candidates {
+		ip, err := c.externalIP(cand)
+		if err == errUnauthorized {
+			return nil, err
+		} else if err == nil && !ip.IsUnspecified() {
+			svc = cand
+			break
+		}
+	}
+
+	c.mutex.Lock()
+	c.svc = svc
+	c.mutex.Unlock()
+	return svc, nil
+}
+
+// Retrieves the device description. This uses the client's own HTTP client
+// rather than ssdp.DescribeURL, so that Config.TLSConfig applies to it.
+func (c *Client) describe() (*ssdp.Description, error) {
+	u := *c.base
+	u.Path = descriptionPath
+
+	res, err := c.client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("TR-064 device description request failed with HTTP status %d", res.StatusCode)
+	}
+
+	return ssdp.ParseDescription(&u, res.Body)
+}
+
+// Invokes an action. If the device asks for authentication, the request is
+// repeated once with digest credentials answering its challenge; the
+// challenge is reused for later requests until the device issues another.
+func (c *Client) call(svc *service, action, args string, v interface{}) error {
+	body := `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:` +
+		action + ` xmlns:u="` + svc.serviceType + `">` + args + `</u:` + action + `></s:Body></s:Envelope>`
+
+	var res *http.Response
+	for try := 0; ; try++ {
+		req, err := http.NewRequest("POST", svc.controlURL.String(), bytes.NewReader([]byte(body)))
+		if err != nil {
+			return err
+		}
+
+		req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+		req.Header.Set("SOAPAction", svc.serviceType+"#"+action)
+		c.auth.authorize(req)
+
+		res, err = c.client.Do(req)
+		if err != nil {
+			return err
+		}
+
+		if res.StatusCode != http.StatusUnauthorized {
+			break
+		}
+
+		res.Body.Close()
+		if try > 0 || !c.auth.setChallenge(res) {
+			return errUnauthorized
+		}
+	}
+	defer res.Body.Close()
+
+	b, err := parse.ReadLimited(res.Body, parse.MaxDocumentSize)
+	if err != nil {
+		return err
+	}
+
+	env, err := parse.SOAP(b)
+	if err != nil {
+		if res.StatusCode != 200 {
+			return fmt.Errorf("TR-064 request failed with HTTP status %d", res.StatusCode)
+		}
+		return err
+	}
+
+	if env.FaultCode != 0 {
+		return &Error{Code: env.FaultCode, Description: env.FaultDescription}
+	}
+
+	if res.StatusCode != 200 {
+		return fmt.Errorf("TR-064 request failed with HTTP status %d", res.StatusCode)
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	return parse.SOAPBody(env.Body, v)
+}
+
+func remoteHostString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+
+	return ip.String()
+}
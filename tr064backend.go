@@ -0,0 +1,63 @@
+package portmap
+
+import "strings"
+import "github.com/hlandau/portmap/tr064"
+
+// A Backend which creates port mappings through TR-064, for AVM FRITZ!Box
+// routers and others which have UPnP IGD disabled but TR-064 enabled. Set it
+// as Config.Backend, or as Config.Fallback to use it only when NAT-PMP and
+// UPnP fail.
+//
+// The requested external port is used, or the internal port if any port is
+// acceptable, since TR-064 devices don't choose ports. Devices which only
+// support permanent mappings are given one, which is removed by Unmap.
+type TR064Backend struct {
+	client *tr064.Client
+}
+
+// Creates a TR-064 backend for the given device.
+func NewTR064Backend(cfg tr064.Config) (*TR064Backend, error) {
+	c, err := tr064.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TR064Backend{client: c}, nil
+}
+
+func (b *TR064Backend) Name() string {
+	return "TR-064"
+}
+
+func (b *TR064Backend) Map(req BackendRequest) (BackendResult, error) {
+	ip, err := b.client.LocalIP()
+	if err != nil {
+		return BackendResult{}, err
+	}
+
+	port := routerAPIExternalPort(&req)
+	_, err = b.client.AddPortMapping(&tr064.PortMapping{
+		ExternalPort:   port,
+		Protocol:       strings.ToUpper(req.Protocol.String()),
+		InternalPort:   req.InternalPort,
+		InternalClient: ip,
+		Description:    routerAPIDescription(&req),
+		LeaseDuration:  req.Lifetime,
+	})
+	if err != nil {
+		return BackendResult{}, err
+	}
+
+	res := BackendResult{ExternalPort: port}
+	res.ExternalIP, _ = b.client.GetExternalIPAddress()
+	return res, nil
+}
+
+func (b *TR064Backend) Unmap(req BackendRequest, prev BackendResult) error {
+	err := b.client.DeletePortMapping(nil, prev.ExternalPort, strings.ToUpper(req.Protocol.String()))
+	if tr064.IsErrorCode(err, tr064.ErrCodeNoSuchEntryInArray) {
+		return nil
+	}
+
+	return err
+}
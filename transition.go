@@ -0,0 +1,205 @@
+package portmap
+
+import "context"
+import "fmt"
+import "net"
+import "strings"
+import "sync"
+import "time"
+import "github.com/hlandau/portmap/gateway"
+import "github.com/hlandau/portmap/internal/localnet"
+
+// Identifies an IPv4 transition mechanism under which the host's IPv4 traffic
+// is translated by carrier equipment rather than a local gateway, so that
+// IPv4 port mapping is impossible. On such networks, incoming connections
+// must be accepted over IPv6 instead, for example by opening a pinhole with
+// upnp.AddPinhole.
+type Transition int
+
+const (
+	TransitionNone   Transition = iota // None detected
+	TransitionDSLite                   // DS-Lite (RFC 6333)
+	TransitionNAT64                    // NAT64, possibly with 464XLAT (RFC 6146, RFC 6877)
+)
+
+func (t Transition) String() string {
+	switch t {
+	case TransitionNone:
+		return "none"
+	case TransitionDSLite:
+		return "DS-Lite"
+	case TransitionNAT64:
+		return "NAT64"
+	default:
+		return fmt.Sprintf("Transition(%d)", int(t))
+	}
+}
+
+// The range from which DS-Lite B4 and 464XLAT CLAT addresses are assigned
+// (RFC 6333, RFC 7335).
+var transitionNet = net.IPNet{IP: net.IPv4(192, 0, 0, 0).To4(), Mask: net.CIDRMask(29, 32)}
+
+// Name prefixes of the tunnel interfaces used by DS-Lite and 464XLAT.
+var transitionIfPrefixes = []string{"dslite", "ds-lite", "ip6tnl", "clat", "v4-"}
+
+// The well-known name which DNS64 resolvers synthesize AAAA records for
+// (RFC 7050), and the IPv4 addresses it resolves to.
+const nat64DiscoveryName = "ipv4only.arpa."
+
+var nat64DiscoveryIPs = []net.IP{net.IPv4(192, 0, 0, 170), net.IPv4(192, 0, 0, 171)}
+
+// Maximum time to wait for the DNS64 lookup.
+const nat64LookupTimeout = 2 * time.Second
+
+// How long a detection result is reused.
+const transitionCacheTime = 5 * time.Minute
+
+// Interval at which a mapping under a transition mechanism checks whether it
+// still applies, rather than retrying with the usual backoff. The check is
+// made immediately if a connectivity change is signalled.
+const transitionRecheckInterval = 10 * time.Minute
+
+var transitionMutex sync.Mutex
+var transitionCache struct {
+	t      Transition
+	prefix *net.IPNet
+	time   time.Time
+}
+
+// Returns the transition mechanism in use, if any, and for NAT64, the
+// translation prefix. Results are cached for transitionCacheTime.
+func detectTransition() (Transition, *net.IPNet) {
+	transitionMutex.Lock()
+	defer transitionMutex.Unlock()
+
+	if !transitionCache.time.IsZero() && time.Since(transitionCache.time) < transitionCacheTime {
+		return transitionCache.t, transitionCache.prefix
+	}
+
+	t, prefix := probeTransition()
+	transitionCache.t, transitionCache.prefix, transitionCache.time = t, prefix, time.Now()
+	return t, prefix
+}
+
+func probeTransition() (Transition, *net.IPNet) {
+	tunnel, nativeIPv4 := examineInterfaces()
+
+	// A host with ordinary IPv4 connectivity may still use a DNS64 resolver,
+	// so NAT64 only matters if there is no other IPv4 path.
+	if !nativeIPv4 {
+		if prefix := lookupNAT64Prefix(); prefix != nil {
+			return TransitionNAT64, prefix
+		}
+	}
+
+	if tunnel {
+		return TransitionDSLite, nil
+	}
+
+	gwa, _ := gateway.GetIPs()
+	for _, gw := range gwa {
+		if transitionNet.Contains(gw) {
+			return TransitionDSLite, nil
+		}
+	}
+
+	return TransitionNone, nil
+}
+
+// Reports whether any interface looks like a DS-Lite or 464XLAT tunnel,
+// either by name or by having an address in transitionNet, and whether any
+// interface has some other non-loopback, non-link-local IPv4 address.
+func examineInterfaces() (tunnel, nativeIPv4 bool) {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return false, true
+	}
+
+	for _, ifi := range ifs {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		for _, p := range transitionIfPrefixes {
+			if strings.HasPrefix(ifi.Name, p) {
+				tunnel = true
+			}
+		}
+
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if !ok || ipn.IP.To4() == nil || ipn.IP.IsLinkLocalUnicast() {
+				continue
+			}
+
+			if transitionNet.Contains(ipn.IP) {
+				tunnel = true
+			} else {
+				nativeIPv4 = true
+			}
+		}
+	}
+
+	return
+}
+
+// Looks up the NAT64 prefix using the heuristic of RFC 7050. Returns nil if
+// the resolver does not perform DNS64. Only the common /96 prefix is
+// recognised.
+func lookupNAT64Prefix() *net.IPNet {
+	if localnet.Enabled() {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), nat64LookupTimeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, nat64DiscoveryName)
+	if err != nil {
+		return nil
+	}
+
+	for _, a := range addrs {
+		if a.IP.To4() != nil || len(a.IP) != net.IPv6len {
+			continue
+		}
+
+		for _, wk := range nat64DiscoveryIPs {
+			if net.IP(a.IP[12:]).Equal(wk) {
+				prefix := make(net.IP, net.IPv6len)
+				copy(prefix, a.IP[:12])
+				return &net.IPNet{IP: prefix, Mask: net.CIDRMask(96, 128)}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Called when every method has failed. If a transition mechanism is in use,
+// records it in the mapping's status and returns true, in which case the
+// mapping should be rechecked after transitionRecheckInterval rather than
+// retried.
+func (m *mapping) checkTransition() bool {
+	t, _ := detectTransition()
+
+	m.mutex.Lock()
+	changed := m.transition != t
+	m.transition = t
+	m.mutex.Unlock()
+
+	if t == TransitionNone {
+		return false
+	}
+
+	if changed {
+		log.Infof("host is behind %v, so IPv4 port mapping is impossible; use an IPv6 pinhole instead", t)
+	}
+
+	return true
+}
@@ -0,0 +1,126 @@
+package portmap
+
+import "net"
+import "github.com/hlandau/portmap/ssdp"
+import "github.com/hlandau/portmap/upnp"
+
+// Determines which UPnP services discovered via SSDP may be used to create
+// mappings. Any device on the local network can answer an SSDP search, so
+// without a check a rogue device could pose as a gateway.
+type UPnPTrust int
+
+const (
+	// Only use services for which the host which will actually be contacted
+	// is one of this host's default gateways. This is the host of the
+	// advertised LOCATION, unless it differs from the SSDP responder address,
+	// in which case the responder is contacted instead and must be a gateway.
+	// This is the default.
+	UPnPTrustGateway UPnPTrust = iota
+
+	// Only use services for which both the SSDP responder address and the
+	// host of the advertised LOCATION are default gateways of this host.
+	UPnPTrustStrict
+
+	// Use any service which is discovered, regardless of where it is located.
+	// This may be necessary in unusual network configurations, for example
+	// where the router providing UPnP is not the default gateway.
+	UPnPTrustAny
+)
+
+// Returns the WANIPConnection services which may be used to create mappings
+// given the configured trust level, ranked as described for
+// DiscoverGateways.
+func (m *mapping) upnpServices(gwa []net.IP) []ssdp.Service {
+	svcs := ssdp.GetServicesByType(upnp.WANIPConnection1)
+	svcs = append(svcs, ssdp.GetServicesByType(upnp.WANIPConnection2)...)
+	if len(svcs) > 1 {
+		cands := rankServices(svcs, gwa)
+		for i := range cands {
+			svcs[i] = cands[i].Service
+		}
+	}
+
+	if m.cfg.UPnPTrust == UPnPTrustAny {
+		return svcs
+	}
+
+	var trusted []ssdp.Service
+	for _, svc := range svcs {
+		if m.isTrustedService(&svc, gwa) {
+			trusted = append(trusted, svc)
+		} else {
+			log.Debugf("ignoring untrusted UPnP service %q (responder %v, location %v)", svc.USN, svc.Responder, svc.Location)
+		}
+	}
+
+	return trusted
+}
+
+// Returns the index in gwa of the gateway which provides the service, as
+// determined by the SSDP responder address or, failing that, the host of the
+// advertised LOCATION. Returns len(gwa) if the service is not provided by any
+// of the gateways.
+func serviceGateway(svc *ssdp.Service, gwa []net.IP) int {
+	var locIP net.IP
+	if svc.Location != nil {
+		locIP = net.ParseIP(svc.Location.Hostname())
+	}
+
+	for i, gw := range gwa {
+		if gw.Equal(svc.Responder) {
+			return i
+		}
+	}
+
+	for i, gw := range gwa {
+		if locIP != nil && gw.Equal(locIP) {
+			return i
+		}
+	}
+
+	return len(gwa)
+}
+
+// Returns the USNs of the services discovered on the named interface.
+func servicesOnInterface(ifName string) map[string]bool {
+	onIf := map[string]bool{}
+	if ifName == "" {
+		return onIf
+	}
+
+	for _, st := range []string{upnp.WANIPConnection1, upnp.WANIPConnection2} {
+		for _, svc := range ssdp.GetServicesByTypeOnInterface(st, ifName) {
+			onIf[svc.USN] = true
+		}
+	}
+
+	return onIf
+}
+
+func (m *mapping) isTrustedService(svc *ssdp.Service, gwa []net.IP) bool {
+	responderOK := isGatewayIP(svc.Responder, gwa)
+	locationOK := svc.Location != nil && isGatewayIP(net.ParseIP(svc.Location.Hostname()), gwa)
+
+	if m.cfg.UPnPTrust == UPnPTrustStrict {
+		return responderOK && locationOK
+	}
+
+	// Requests go to PreferredLocation, which substitutes the responder when
+	// it disagrees with LOCATION, so judge trust by the host contacted.
+	loc := svc.PreferredLocation()
+	return loc != nil && isGatewayIP(net.ParseIP(loc.Hostname()), gwa)
+}
+
+func isGatewayIP(ip net.IP, gwa []net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, gw := range gwa {
+		if gw.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
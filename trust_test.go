@@ -0,0 +1,34 @@
+package portmap
+
+import "net"
+import "net/url"
+import "testing"
+import "github.com/hlandau/portmap/ssdp"
+
+// A service whose LOCATION names a gateway but which was announced by some
+// other host must not be trusted, since requests are sent to the responder.
+func TestUntrustedMismatchedResponder(t *testing.T) {
+	gwa := []net.IP{net.ParseIP("192.168.1.1")}
+	m := &mapping{}
+
+	loc, _ := url.Parse("http://192.168.1.1:5000/rootDesc.xml")
+	tests := []struct {
+		responder string
+		trusted   bool
+	}{
+		{"192.168.1.1", true},
+		{"192.168.1.66", false},
+	}
+
+	for _, tt := range tests {
+		svc := ssdp.Service{
+			Location:  loc,
+			Responder: net.ParseIP(tt.responder),
+		}
+		svc.LocationMismatch = !svc.Responder.Equal(net.ParseIP(loc.Hostname()))
+
+		if got := m.isTrustedService(&svc, gwa); got != tt.trusted {
+			t.Errorf("responder %v: trusted = %v, expected %v", tt.responder, got, tt.trusted)
+		}
+	}
+}
@@ -0,0 +1,525 @@
+// Package turn implements a minimal TURN (RFC 8656) client, sufficient to
+// obtain and maintain a UDP relay allocation and to exchange data with peers
+// via it.
+package turn
+
+import "crypto/hmac"
+import "crypto/md5"
+import "crypto/rand"
+import "crypto/sha1"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "net"
+import "sync"
+import "time"
+import "github.com/hlandau/portmap/internal/localnet"
+
+// STUN message types.
+const (
+	methodAllocate         = 0x003
+	methodRefresh          = 0x004
+	methodSend             = 0x006
+	methodData             = 0x007
+	methodCreatePermission = 0x008
+
+	classRequest    = 0x000
+	classIndication = 0x010
+	classSuccess    = 0x100
+	classError      = 0x110
+)
+
+// STUN attribute types.
+const (
+	attrUsername           = 0x0006
+	attrMessageIntegrity   = 0x0008
+	attrErrorCode          = 0x0009
+	attrLifetime           = 0x000D
+	attrXORPeerAddress     = 0x0012
+	attrData               = 0x0013
+	attrRealm              = 0x0014
+	attrNonce              = 0x0015
+	attrXORRelayedAddress  = 0x0016
+	attrRequestedTransport = 0x0019
+)
+
+const magicCookie = 0x2112A442
+const headerLen = 20
+const protoUDP = 17
+
+// Configures a TURN client.
+type Config struct {
+	// The address of the TURN server, in "host:port" form. The server is
+	// contacted over UDP.
+	Server string
+
+	// Long-term credentials for the server.
+	Username, Password string
+}
+
+// An error response from a TURN server.
+type Error struct {
+	Code   int
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("TURN error %d: %s", e.Code, e.Reason)
+}
+
+// Error codes used by this package.
+const (
+	ErrCodeUnauthorized = 401
+	ErrCodeStaleNonce   = 438
+)
+
+var errTimeout = errors.New("TURN request timed out")
+var errMalformed = errors.New("malformed TURN message")
+
+// A TURN client holding a single allocation.
+type Client struct {
+	cfg  Config
+	conn *net.UDPConn
+
+	mutex   sync.Mutex
+	realm   string
+	nonce   string
+	key     []byte
+	pending map[[12]byte]chan *message
+
+	dataChan chan Datagram
+	stopOnce sync.Once
+}
+
+// Data received from a peer via the relay.
+type Datagram struct {
+	Peer *net.UDPAddr
+	Data []byte
+}
+
+// Connects to the TURN server given in cfg. No allocation is made until
+// Allocate is called.
+func Dial(cfg Config) (*Client, error) {
+	err := localnet.Check(cfg.Server)
+	if err != nil {
+		return nil, err
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", cfg.Server)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		cfg:      cfg,
+		conn:     conn,
+		pending:  map[[12]byte]chan *message{},
+		dataChan: make(chan Datagram, 64),
+	}
+
+	go c.recvLoop()
+	return c, nil
+}
+
+// Closes the connection to the server. This does not delete the allocation;
+// call Refresh with a zero lifetime first to do so.
+func (c *Client) Close() error {
+	var err error
+	c.stopOnce.Do(func() {
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// Returns a channel on which data received from peers is delivered. Data
+// which is not consumed promptly is dropped. The channel is closed when the
+// client is closed.
+func (c *Client) Data() <-chan Datagram {
+	return c.dataChan
+}
+
+// Requests a UDP relay allocation with the given lifetime. Returns the
+// relayed transport address and the lifetime granted.
+func (c *Client) Allocate(lifetime time.Duration) (relayed *net.UDPAddr, granted time.Duration, err error) {
+	res, err := c.request(methodAllocate, func(m *message) {
+		m.add(attrRequestedTransport, []byte{protoUDP, 0, 0, 0})
+		m.addUint32(attrLifetime, uint32(lifetime/time.Second))
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	v, ok := res.get(attrXORRelayedAddress)
+	if !ok {
+		return nil, 0, errMalformed
+	}
+
+	relayed, err = decodeXORAddr(v, res.tid)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return relayed, res.lifetime(), nil
+}
+
+// Refreshes the allocation. A zero lifetime deletes the allocation. Returns
+// the lifetime granted.
+func (c *Client) Refresh(lifetime time.Duration) (time.Duration, error) {
+	res, err := c.request(methodRefresh, func(m *message) {
+		m.addUint32(attrLifetime, uint32(lifetime/time.Second))
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return res.lifetime(), nil
+}
+
+// Installs or refreshes permissions for the given peers to send data via the
+// relay. Permissions last five minutes and must be refreshed to be kept.
+func (c *Client) CreatePermission(peers ...net.IP) error {
+	_, err := c.request(methodCreatePermission, func(m *message) {
+		for _, p := range peers {
+			m.add(attrXORPeerAddress, encodeXORAddr(&net.UDPAddr{IP: p}, m.tid))
+		}
+	})
+	return err
+}
+
+// Sends data to a peer via the relay. A permission must exist for the peer.
+func (c *Client) Send(peer *net.UDPAddr, data []byte) error {
+	m := newMessage(methodSend | classIndication)
+	m.add(attrXORPeerAddress, encodeXORAddr(peer, m.tid))
+	m.add(attrData, data)
+	_, err := c.conn.Write(m.encode(nil))
+	return err
+}
+
+// Request timeouts. The request is retransmitted with doubling timeouts, as
+// recommended by RFC 8489.
+var retransmitTimeouts = []time.Duration{
+	500 * time.Millisecond, 1 * time.Second, 2 * time.Second, 4 * time.Second,
+}
+
+// Performs an authenticated request. If the server requires a fresh nonce,
+// the request is made again with it.
+func (c *Client) request(method int, build func(m *message)) (*message, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		m := newMessage(method | classRequest)
+		build(m)
+
+		c.mutex.Lock()
+		key := c.key
+		if key != nil {
+			m.add(attrUsername, []byte(c.cfg.Username))
+			m.add(attrRealm, []byte(c.realm))
+			m.add(attrNonce, []byte(c.nonce))
+		}
+		c.mutex.Unlock()
+
+		res, err := c.transact(m, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if res.typ == method|classSuccess {
+			return res, nil
+		}
+
+		terr := res.errorCode()
+		if terr.Code == ErrCodeUnauthorized || terr.Code == ErrCodeStaleNonce {
+			realm, _ := res.get(attrRealm)
+			nonce, _ := res.get(attrNonce)
+			if nonce == nil {
+				return nil, terr
+			}
+
+			c.mutex.Lock()
+			if realm != nil {
+				c.realm = string(realm)
+			}
+			c.nonce = string(nonce)
+			k := md5.Sum([]byte(c.cfg.Username + ":" + c.realm + ":" + c.cfg.Password))
+			c.key = k[:]
+			c.mutex.Unlock()
+
+			if terr.Code == ErrCodeUnauthorized && key != nil && realm != nil {
+				// credentials were rejected, not merely stale
+				return nil, terr
+			}
+
+			continue
+		}
+
+		return nil, terr
+	}
+
+	return nil, &Error{Code: ErrCodeUnauthorized, Reason: "authentication failed"}
+}
+
+func (c *Client) transact(m *message, key []byte) (*message, error) {
+	ch := make(chan *message, 1)
+	c.mutex.Lock()
+	c.pending[m.tid] = ch
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.pending, m.tid)
+		c.mutex.Unlock()
+	}()
+
+	b := m.encode(key)
+	for _, t := range retransmitTimeouts {
+		_, err := c.conn.Write(b)
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case res := <-ch:
+			return res, nil
+		case <-time.After(t):
+		}
+	}
+
+	return nil, errTimeout
+}
+
+func (c *Client) recvLoop() {
+	defer close(c.dataChan)
+
+	buf := make([]byte, 65536)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return
+		}
+
+		m, err := parseMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		if m.typ == methodData|classIndication {
+			c.handleData(m)
+			continue
+		}
+
+		c.mutex.Lock()
+		ch := c.pending[m.tid]
+		c.mutex.Unlock()
+
+		if ch != nil {
+			select {
+			case ch <- m:
+			default:
+			}
+		}
+	}
+}
+
+func (c *Client) handleData(m *message) {
+	pa, ok := m.get(attrXORPeerAddress)
+	if !ok {
+		return
+	}
+
+	data, ok := m.get(attrData)
+	if !ok {
+		return
+	}
+
+	peer, err := decodeXORAddr(pa, m.tid)
+	if err != nil {
+		return
+	}
+
+	select {
+	case c.dataChan <- Datagram{Peer: peer, Data: append([]byte(nil), data...)}:
+	default:
+	}
+}
+
+// Messages
+
+type attr struct {
+	typ   int
+	value []byte
+}
+
+type message struct {
+	typ   int
+	tid   [12]byte
+	attrs []attr
+}
+
+func newMessage(typ int) *message {
+	m := &message{typ: typ}
+	rand.Read(m.tid[:])
+	return m
+}
+
+func (m *message) add(typ int, value []byte) {
+	m.attrs = append(m.attrs, attr{typ, value})
+}
+
+func (m *message) addUint32(typ int, v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	m.add(typ, b[:])
+}
+
+func (m *message) get(typ int) ([]byte, bool) {
+	for _, a := range m.attrs {
+		if a.typ == typ {
+			return a.value, true
+		}
+	}
+	return nil, false
+}
+
+func (m *message) lifetime() time.Duration {
+	v, ok := m.get(attrLifetime)
+	if !ok || len(v) < 4 {
+		return 0
+	}
+	return time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+}
+
+func (m *message) errorCode() *Error {
+	v, ok := m.get(attrErrorCode)
+	if !ok || len(v) < 4 {
+		return &Error{Reason: "unexpected response"}
+	}
+	return &Error{Code: int(v[2]&7)*100 + int(v[3]), Reason: string(v[4:])}
+}
+
+// Encodes the message, appending MESSAGE-INTEGRITY if key is not nil.
+func (m *message) encode(key []byte) []byte {
+	b := make([]byte, headerLen, 512)
+	binary.BigEndian.PutUint16(b[0:2], uint16(m.typ))
+	binary.BigEndian.PutUint32(b[4:8], magicCookie)
+	copy(b[8:20], m.tid[:])
+
+	for _, a := range m.attrs {
+		b = appendAttr(b, a.typ, a.value)
+	}
+
+	if key != nil {
+		// The length used when computing the HMAC includes the
+		// MESSAGE-INTEGRITY attribute itself.
+		binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-headerLen+24))
+		h := hmac.New(sha1.New, key)
+		h.Write(b)
+		b = appendAttr(b, attrMessageIntegrity, h.Sum(nil))
+	}
+
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-headerLen))
+	return b
+}
+
+func appendAttr(b []byte, typ int, value []byte) []byte {
+	var h [4]byte
+	binary.BigEndian.PutUint16(h[0:2], uint16(typ))
+	binary.BigEndian.PutUint16(h[2:4], uint16(len(value)))
+	b = append(b, h[:]...)
+	b = append(b, value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func parseMessage(b []byte) (*message, error) {
+	if len(b) < headerLen || b[0]&0xC0 != 0 || binary.BigEndian.Uint32(b[4:8]) != magicCookie {
+		return nil, errMalformed
+	}
+
+	n := int(binary.BigEndian.Uint16(b[2:4]))
+	if n%4 != 0 || headerLen+n > len(b) {
+		return nil, errMalformed
+	}
+
+	m := &message{typ: int(binary.BigEndian.Uint16(b[0:2]))}
+	copy(m.tid[:], b[8:20])
+
+	body := b[headerLen : headerLen+n]
+	for len(body) > 0 {
+		if len(body) < 4 {
+			return nil, errMalformed
+		}
+
+		typ := int(binary.BigEndian.Uint16(body[0:2]))
+		l := int(binary.BigEndian.Uint16(body[2:4]))
+		padded := (l + 3) &^ 3
+		if 4+padded > len(body) {
+			return nil, errMalformed
+		}
+
+		m.add(typ, body[4:4+l])
+		body = body[4+padded:]
+	}
+
+	return m, nil
+}
+
+func encodeXORAddr(a *net.UDPAddr, tid [12]byte) []byte {
+	var cookie [4]byte
+	binary.BigEndian.PutUint32(cookie[:], magicCookie)
+
+	ip := a.IP.To4()
+	family := byte(1)
+	if ip == nil {
+		ip = a.IP.To16()
+		family = 2
+	}
+
+	b := make([]byte, 4+len(ip))
+	b[1] = family
+	binary.BigEndian.PutUint16(b[2:4], uint16(a.Port)^uint16(magicCookie>>16))
+
+	pad := append(cookie[:], tid[:]...)
+	for i := range ip {
+		b[4+i] = ip[i] ^ pad[i]
+	}
+
+	return b
+}
+
+func decodeXORAddr(b []byte, tid [12]byte) (*net.UDPAddr, error) {
+	if len(b) < 8 {
+		return nil, errMalformed
+	}
+
+	var l int
+	switch b[1] {
+	case 1:
+		l = 4
+	case 2:
+		l = 16
+	default:
+		return nil, errMalformed
+	}
+
+	if len(b) < 4+l {
+		return nil, errMalformed
+	}
+
+	var cookie [4]byte
+	binary.BigEndian.PutUint32(cookie[:], magicCookie)
+	pad := append(cookie[:], tid[:]...)
+
+	ip := make(net.IP, l)
+	for i := range ip {
+		ip[i] = b[4+i] ^ pad[i]
+	}
+
+	port := binary.BigEndian.Uint16(b[2:4]) ^ uint16(magicCookie>>16)
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,245 @@
+package portmap
+
+import "errors"
+import "net"
+import "sync"
+import "time"
+import "github.com/hlandau/portmap/turn"
+
+// A Backend which obtains a relay allocation from a TURN server and reports
+// the relayed address as the external address. It is intended for use as
+// Config.Fallback, so that an application has a reachable endpoint even when
+// NAT traversal fails. Only UDP mappings are supported.
+//
+// Data relayed from a peer is forwarded to the internal port on the loopback
+// interface from a local socket dedicated to that peer, and data sent back to
+// that socket is relayed to the peer. TURN servers only relay data from peers
+// for which a permission has been installed, so the application must call
+// Permit with the addresses of the peers it expects to hear from.
+//
+// A TURNBackend maintains a single allocation and must not be shared between
+// mappings.
+type TURNBackend struct {
+	cfg turn.Config
+
+	mutex        sync.Mutex
+	client       *turn.Client
+	relayed      *net.UDPAddr
+	permitted    []net.IP
+	peers        map[string]*turnPeer
+	internalPort uint16
+	stopChan     chan struct{}
+}
+
+// A peer for which data is being relayed.
+type turnPeer struct {
+	addr     *net.UDPAddr
+	conn     *net.UDPConn
+	lastUsed time.Time // TURNBackend.mutex
+}
+
+// TURN permissions expire after five minutes, so are refreshed more often
+// than that. Peers not heard from for this long are also forgotten.
+const turnPermissionInterval = 4 * time.Minute
+
+var errTURNUDPOnly = errors.New("TURN relays only support UDP")
+
+// Creates a TURN backend using the given server and credentials.
+func NewTURNBackend(cfg turn.Config) *TURNBackend {
+	return &TURNBackend{cfg: cfg}
+}
+
+func (b *TURNBackend) Name() string {
+	return "TURN"
+}
+
+// Permits the given peers to send data via the relay. Permissions persist
+// for as long as the allocation, including across reallocation. Permitting a
+// peer more than once has no further effect.
+func (b *TURNBackend) Permit(peers ...net.IP) error {
+	b.mutex.Lock()
+	for _, ip := range peers {
+		if !isGatewayIP(ip, b.permitted) {
+			b.permitted = append(b.permitted, ip)
+		}
+	}
+	c := b.client
+	b.mutex.Unlock()
+
+	if c == nil {
+		return nil
+	}
+
+	return c.CreatePermission(peers...)
+}
+
+func (b *TURNBackend) Map(req BackendRequest) (BackendResult, error) {
+	if req.Protocol != UDP {
+		return BackendResult{}, errTURNUDPOnly
+	}
+
+	b.mutex.Lock()
+	c := b.client
+	b.mutex.Unlock()
+
+	if c != nil && req.Renewal {
+		granted, err := c.Refresh(req.Lifetime)
+		if err == nil {
+			b.mutex.Lock()
+			relayed := b.relayed
+			b.mutex.Unlock()
+			return BackendResult{ExternalIP: relayed.IP, ExternalPort: uint16(relayed.Port), Lifetime: granted}, nil
+		}
+
+		// The allocation may have been lost, so make a new one.
+		log.Infof("TURN refresh failed, reallocating: %v", err)
+	}
+
+	b.stop()
+
+	c, err := turn.Dial(b.cfg)
+	if err != nil {
+		return BackendResult{}, err
+	}
+
+	relayed, granted, err := c.Allocate(req.Lifetime)
+	if err != nil {
+		c.Close()
+		return BackendResult{}, err
+	}
+
+	b.mutex.Lock()
+	b.client = c
+	b.relayed = relayed
+	b.internalPort = req.InternalPort
+	b.peers = map[string]*turnPeer{}
+	b.stopChan = make(chan struct{})
+	permitted := b.permitted
+	stopChan := b.stopChan
+	b.mutex.Unlock()
+
+	if len(permitted) > 0 {
+		err = c.CreatePermission(permitted...)
+		if err != nil {
+			log.Infof("TURN permission request failed: %v", err)
+		}
+	}
+
+	go b.relayLoop(c, stopChan)
+
+	return BackendResult{ExternalIP: relayed.IP, ExternalPort: uint16(relayed.Port), Lifetime: granted}, nil
+}
+
+func (b *TURNBackend) Unmap(req BackendRequest, prev BackendResult) error {
+	b.mutex.Lock()
+	c := b.client
+	b.mutex.Unlock()
+
+	var err error
+	if c != nil {
+		_, err = c.Refresh(0)
+	}
+
+	b.stop()
+	return err
+}
+
+// Closes the current allocation's client and peer sockets, if any.
+func (b *TURNBackend) stop() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.client == nil {
+		return
+	}
+
+	close(b.stopChan)
+	b.client.Close()
+	for _, p := range b.peers {
+		p.conn.Close()
+	}
+
+	b.client = nil
+	b.peers = nil
+}
+
+func (b *TURNBackend) relayLoop(c *turn.Client, stopChan <-chan struct{}) {
+	ticker := time.NewTicker(turnPermissionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case dg, ok := <-c.Data():
+			if !ok {
+				return
+			}
+
+			p := b.peer(c, dg.Peer)
+			if p != nil {
+				p.conn.Write(dg.Data) // ignore errors
+			}
+
+		case <-ticker.C:
+			b.mutex.Lock()
+			permitted := b.permitted
+			for k, p := range b.peers {
+				if time.Since(p.lastUsed) > turnPermissionInterval {
+					p.conn.Close()
+					delete(b.peers, k)
+				}
+			}
+			b.mutex.Unlock()
+
+			if len(permitted) > 0 {
+				c.CreatePermission(permitted...) // ignore errors
+			}
+
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// Returns the local socket used for the given peer, creating it if
+// necessary.
+func (b *TURNBackend) peer(c *turn.Client, addr *net.UDPAddr) *turnPeer {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.peers == nil {
+		return nil
+	}
+
+	k := addr.String()
+	if p, ok := b.peers[k]; ok {
+		p.lastUsed = time.Now()
+		return p
+	}
+
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(b.internalPort)})
+	if err != nil {
+		return nil
+	}
+
+	p := &turnPeer{addr: addr, conn: conn, lastUsed: time.Now()}
+	b.peers[k] = p
+
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+
+			// Replies keep the peer alive as much as data from it does.
+			b.mutex.Lock()
+			p.lastUsed = time.Now()
+			b.mutex.Unlock()
+
+			c.Send(addr, buf[:n]) // ignore errors
+		}
+	}()
+
+	return p
+}
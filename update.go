@@ -0,0 +1,96 @@
+package portmap
+
+import "errors"
+import "net"
+
+var ErrInternalPortInUse = errors.New("a mapping already exists for the internal port")
+var ErrCannotUpdate = errors.New("mapping cannot be updated")
+
+// Mappings shared between several callers of New cannot be updated, since
+// the other callers still expect the old internal port to be forwarded.
+func (r *mappingRef) Update(internalPort uint16) error {
+	m := r.mapping
+
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if internalPort == m.updatePort {
+		return nil
+	}
+
+	if m.aborted || m.detached || m.refs > 1 {
+		return ErrCannotUpdate
+	}
+
+	// Simulated mappings are kept out of the registry, as in registerMapping.
+	key := mappingKey{Protocol: m.cfg.Protocol, InternalPort: internalPort}
+	if m.cfg.sim == nil {
+		if registry[key] != nil {
+			return ErrInternalPortInUse
+		}
+
+		if registry[m.rkey] == m {
+			delete(registry, m.rkey)
+		}
+		registry[key] = m
+	}
+	m.rkey = key
+
+	log.Infof("moving mapping from internal port %d to %d", m.updatePort, internalPort)
+	m.updatePort = internalPort
+	if len(m.children) == 0 {
+		m.revalidate()
+		return nil
+	}
+
+	m.state.internalPort = internalPort
+	for _, c := range m.children {
+		c.mutex.Lock()
+		c.updatePort = internalPort
+		c.revalidate()
+		c.mutex.Unlock()
+	}
+
+	return nil
+}
+
+// Applies a change of internal port requested by Update, if any. Called by
+// the loop before each attempt.
+//
+// The mapping for the old internal port is removed first where the protocol
+// keys mappings by internal port, as NAT-PMP does. With UPnP, adding the
+// mapping for the new internal port replaces the old one in place, so the
+// external port is kept.
+func (m *mapping) applyUpdate(gwa []net.IP) {
+	m.mutex.Lock()
+	port := m.updatePort
+	prev := m.state.internalPort
+	active := m.isActive()
+	method := m.method
+	us := m.upnpService
+	m.mutex.Unlock()
+
+	if port == prev {
+		return
+	}
+
+	if active {
+		switch method {
+		case MethodNATPMP:
+			m.tryNATPMP(gwa, true)
+		case MethodUPnP:
+			if us != nil {
+				coordRelease(coordGateway(us.PreferredLocation().String()), m.cfg.Protocol, prev)
+			}
+		case MethodBackend:
+			m.teardownBackend()
+		}
+	}
+
+	m.mutex.Lock()
+	m.state.internalPort = port
+	m.mutex.Unlock()
+}
@@ -0,0 +1,159 @@
+package upnp
+
+import "errors"
+import "sort"
+import "sync"
+import "time"
+
+// Controls the circuit breakers which stop requests to a device which keeps
+// failing to respond, so that a router which times out on every request does
+// not delay every renewal of every mapping by the full request timeout.
+//
+// After Threshold consecutive requests to a device fail without a response,
+// the breaker for the device opens and further requests fail immediately
+// with ErrCircuitOpen. Once Cooldown has passed, a single request is let
+// through; if it succeeds the breaker closes, and otherwise it stays open for
+// another Cooldown. A UPnP error counts as a response, since the device is
+// evidently working.
+type BreakerConfig struct {
+	// If zero, DefaultBreakerThreshold is used. If negative, breakers never
+	// open.
+	Threshold int
+
+	// If zero, DefaultBreakerCooldown is used.
+	Cooldown time.Duration
+}
+
+const (
+	DefaultBreakerThreshold = 3
+	DefaultBreakerCooldown  = 2 * time.Minute
+)
+
+// Returned for requests to a device whose circuit breaker is open.
+var ErrCircuitOpen = errors.New("UPnP device is not responding, requests suspended")
+
+// Describes the circuit breaker for a device, as returned by BreakerStates.
+type BreakerState struct {
+	// The host and port of the device's control URL.
+	Host string
+
+	// Whether requests to the device are currently suspended.
+	Open bool
+
+	// The number of consecutive requests which have failed.
+	Failures int
+
+	// The most recent failure.
+	LastErr error
+
+	// The time after which a request will next be let through, if Open.
+	RetryAt time.Time
+}
+
+type breaker struct {
+	failures int
+	lastErr  error
+	openedAt time.Time
+	probing  bool
+}
+
+var breakerMutex sync.Mutex
+var breakerConfig BreakerConfig
+var breakers = map[string]*breaker{}
+
+// Sets the configuration of the circuit breakers. Breakers which are already
+// open are not closed.
+func SetBreakerConfig(cfg BreakerConfig) {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+
+	breakerConfig = cfg
+}
+
+// Returns the state of the circuit breaker for each device which has failed
+// to respond since it last responded, ordered by host.
+func BreakerStates() []BreakerState {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+
+	var states []BreakerState
+	for host, b := range breakers {
+		st := BreakerState{Host: host, Failures: b.failures, LastErr: b.lastErr}
+		if !b.openedAt.IsZero() {
+			st.Open = true
+			st.RetryAt = b.openedAt.Add(breakerCooldown())
+		}
+		states = append(states, st)
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Host < states[j].Host
+	})
+	return states
+}
+
+// Must be called with breakerMutex held.
+func breakerCooldown() time.Duration {
+	if breakerConfig.Cooldown == 0 {
+		return DefaultBreakerCooldown
+	}
+
+	return breakerConfig.Cooldown
+}
+
+// Must be called with breakerMutex held.
+func breakerThreshold() int {
+	if breakerConfig.Threshold == 0 {
+		return DefaultBreakerThreshold
+	}
+
+	return breakerConfig.Threshold
+}
+
+// Returns ErrCircuitOpen if a request to host should not be made. Otherwise,
+// the caller must make the request and pass the result to breakerRecord.
+func breakerAllow(host string) error {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+
+	b := breakers[host]
+	if b == nil || b.openedAt.IsZero() {
+		return nil
+	}
+
+	if b.probing || time.Since(b.openedAt) < breakerCooldown() {
+		return ErrCircuitOpen
+	}
+
+	// half open: let one request through to see whether the device has
+	// recovered
+	b.probing = true
+	return nil
+}
+
+// Records the result of a request to host. err must be nil if the device
+// responded, even with an error.
+func breakerRecord(host string, err error) {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+
+	if err == nil {
+		delete(breakers, host)
+		return
+	}
+
+	b := breakers[host]
+	if b == nil {
+		b = &breaker{}
+		breakers[host] = b
+	}
+
+	b.failures++
+	b.lastErr = err
+	b.probing = false
+
+	threshold := breakerThreshold()
+	if threshold > 0 && b.failures >= threshold {
+		b.openedAt = time.Now()
+	}
+}
@@ -0,0 +1,135 @@
+package upnp
+
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/base64"
+import "encoding/binary"
+import "encoding/xml"
+
+// Service type of the DeviceProtection service.
+const DeviceProtection1 = "urn:schemas-upnp-org:service:DeviceProtection:1"
+
+// Parameters of the PKCS5 login protocol defined by DeviceProtection:1.
+const (
+	dpProtocolType      = "PKCS5"
+	dpIterations        = 5000
+	dpStoredSize        = 16
+	dpAuthenticatorSize = 20
+)
+
+type xGetUserLoginChallengeResponse struct {
+	XMLName   xml.Name `xml:"GetUserLoginChallengeResponse"`
+	Salt      string   `xml:"Salt"`
+	Challenge string   `xml:"Challenge"`
+}
+
+// Logs in to a device implementing DeviceProtection, using the PKCS5
+// password-based login protocol.
+//
+// Pass a UPnP device URL. The DeviceProtection endpoint will be located
+// automatically. DeviceProtection associates the login with the TLS session
+// over which it was performed, so this is only useful with devices whose
+// control URLs use HTTPS (see SetTLSConfig); subsequent requests reuse the
+// session where the device permits it.
+func Login(upnpURL, username, password string) error {
+	svc, err := getService(upnpURL, DeviceProtection1)
+	if err != nil {
+		return err
+	}
+
+	if svc == nil {
+		return noServiceError("DeviceProtection")
+	}
+
+	msg := actionGetUserLoginChallenge.begin(svc.Type, len(username)+16).
+		str(dpProtocolType).
+		str(username).
+		message()
+
+	var ch xGetUserLoginChallengeResponse
+	err = soapCall(svc, msg, &ch)
+	if err != nil {
+		return err
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(ch.Salt)
+	if err != nil {
+		return err
+	}
+
+	challenge, err := base64.StdEncoding.DecodeString(ch.Challenge)
+	if err != nil {
+		return err
+	}
+
+	stored := pbkdf2SHA256([]byte(password), salt, dpIterations, dpStoredSize)
+	mac := hmac.New(sha256.New, stored)
+	mac.Write(challenge)
+	authenticator := mac.Sum(nil)[0:dpAuthenticatorSize]
+
+	msg = actionUserLogin.begin(svc.Type, len(ch.Challenge)+64).
+		str(dpProtocolType).
+		str(ch.Challenge).
+		str(base64.StdEncoding.EncodeToString(authenticator)).
+		message()
+
+	res, err := soapRequest(svc, msg)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	return nil
+}
+
+// Logs out of a device previously logged in to with Login.
+func Logout(upnpURL string) error {
+	svc, err := getService(upnpURL, DeviceProtection1)
+	if err != nil {
+		return err
+	}
+
+	if svc == nil {
+		return noServiceError("DeviceProtection")
+	}
+
+	msg := actionUserLogout.begin(svc.Type, 0).message()
+	res, err := soapRequest(svc, msg)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	return nil
+}
+
+// PBKDF2 (RFC 8018) with HMAC-SHA256 as the pseudorandom function.
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	var ctr [4]byte
+	dk := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(ctr[:], uint32(block))
+		prf.Write(ctr[:])
+		dk = prf.Sum(dk)
+
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+		for n := 2; n <= iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range u {
+				t[i] ^= u[i]
+			}
+		}
+	}
+
+	return dk[0:keyLen]
+}
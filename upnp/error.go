@@ -0,0 +1,77 @@
+package upnp
+
+import "errors"
+import "fmt"
+import "io"
+import "github.com/hlandau/portmap/internal/parse"
+
+// An error returned by a UPnP device in response to an action.
+type Error struct {
+	// The UPnP error code, e.g. 718 (ConflictInMappingEntry).
+	Code int
+
+	// The description given by the device. May be empty.
+	Description string
+}
+
+func (e *Error) Error() string {
+	if e.Description == "" {
+		return fmt.Sprintf("UPnP error %d", e.Code)
+	}
+
+	return fmt.Sprintf("UPnP error %d: %s", e.Code, e.Description)
+}
+
+// UPnP error codes used by the WANIPConnection service.
+const (
+	ErrCodeInvalidAction              = 401
+	ErrCodeInvalidArgs                = 402
+	ErrCodeActionFailed               = 501
+	ErrCodeNotAuthorized              = 606
+	ErrCodeSpecifiedArrayIndexInvalid = 713
+	ErrCodeNoSuchEntryInArray         = 714
+	ErrCodeConflictInMappingEntry     = 718
+	ErrCodeSamePortValuesRequired     = 724
+	ErrCodeOnlyPermanentLeases        = 725
+)
+
+// Parses a SOAP fault containing a UPnP error. Returns nil if the body does
+// not contain one.
+func parseFault(r io.Reader) *Error {
+	b, err := parse.ReadLimited(r, parse.MaxDocumentSize)
+	if err != nil {
+		return nil
+	}
+
+	env, err := parse.SOAP(b)
+	if err != nil || env.FaultCode == 0 {
+		return nil
+	}
+
+	return &Error{Code: env.FaultCode, Description: env.FaultDescription}
+}
+
+// Returns true if err is a UPnP error with the given code.
+func IsErrorCode(err error, code int) bool {
+	var ue *Error
+	return errors.As(err, &ue) && ue.Code == code
+}
+
+// Returned when a device does not provide a service required for the
+// operation requested. The error returned wraps ErrNoService and names the
+// service.
+var ErrNoService = errors.New("UPnP device does not provide the required service")
+
+func noServiceError(name string) error {
+	return fmt.Errorf("%w: %s", ErrNoService, name)
+}
+
+// Returned when a device responds to a SOAP request with an HTTP error status
+// and no UPnP error.
+type HTTPError struct {
+	StatusCode int
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("UPnP device responded with HTTP status %d", e.StatusCode)
+}
@@ -0,0 +1,257 @@
+package upnp
+
+import "encoding/xml"
+import gnet "net"
+import "time"
+import "github.com/hlandau/portmap/internal/parse"
+
+// Describes a port mapping which exists on a gateway.
+type PortMapping struct {
+	// The remote host the mapping is restricted to, or nil if any remote host
+	// is admitted.
+	RemoteHost gnet.IP
+
+	ExternalPort uint16
+	Protocol     Protocol
+	InternalPort uint16
+
+	// The internal host the mapping points to, as reported by the gateway.
+	InternalClient string
+
+	Enabled     bool
+	Description string
+
+	// The remaining lease duration. Zero for a permanent mapping.
+	LeaseDuration time.Duration
+}
+
+// Maximum number of entries which will be retrieved from a gateway.
+const maxListEntries = 4096
+
+// Number of entries requested per GetListOfPortMappings call.
+const listPageSize = 1000
+
+// Retrieves all port mappings on the gateway.
+//
+// Pass a UPnP device URL. The WANIPConnection endpoint will be located
+// automatically. If the device supports IGDv2, GetListOfPortMappings is used
+// to retrieve the mappings in bulk. Otherwise, GetGenericPortMappingEntry is
+// called for each mapping in turn, which can be slow on gateways with many
+// mappings.
+func ListPortMappings(upnpURL string) ([]PortMapping, error) {
+	wsvc, err := getWANIPService(upnpURL, WANIPConnection2, WANIPConnection1)
+	if err != nil {
+		return nil, err
+	}
+
+	if wsvc.Type == WANIPConnection2 {
+		pms, err := listPortMappingsV2(wsvc)
+		if err == nil || !IsErrorCode(err, ErrCodeInvalidAction) {
+			return pms, err
+		}
+		// some devices advertise version 2 without implementing the action
+	}
+
+	return listPortMappingsV1(wsvc)
+}
+
+// Returns the host to which the gateway forwards traffic of the given
+// protocol which matches no port mapping, usually called the DMZ host, or nil
+// if there is none. Gateways are not required to report their DMZ host, but
+// some list it as an enabled mapping with the wildcard external port 0, which
+// is what is looked for; nil is returned for a gateway which doesn't.
+func DMZHost(upnpURL string, protocol Protocol) (gnet.IP, error) {
+	pms, err := ListPortMappings(upnpURL)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pm := range pms {
+		if pm.ExternalPort != 0 || pm.Protocol != protocol || !pm.Enabled {
+			continue
+		}
+
+		if pm.RemoteHost != nil && !pm.RemoteHost.IsUnspecified() {
+			continue
+		}
+
+		if ip := gnet.ParseIP(pm.InternalClient); ip != nil {
+			return ip, nil
+		}
+	}
+
+	return nil, nil
+}
+
+type xPortMappingEntry struct {
+	RemoteHost     string `xml:"NewRemoteHost"`
+	ExternalPort   uint16 `xml:"NewExternalPort"`
+	Protocol       string `xml:"NewProtocol"`
+	InternalPort   uint16 `xml:"NewInternalPort"`
+	InternalClient string `xml:"NewInternalClient"`
+	Enabled        string `xml:"NewEnabled"`
+	Description    string `xml:"NewDescription"`
+	LeaseTime      uint32 `xml:"NewLeaseTime"`
+}
+
+type xGetGenericPortMappingEntryResponse struct {
+	XMLName        xml.Name `xml:"GetGenericPortMappingEntryResponse"`
+	RemoteHost     string   `xml:"NewRemoteHost"`
+	ExternalPort   uint16   `xml:"NewExternalPort"`
+	Protocol       string   `xml:"NewProtocol"`
+	InternalPort   uint16   `xml:"NewInternalPort"`
+	InternalClient string   `xml:"NewInternalClient"`
+	Enabled        string   `xml:"NewEnabled"`
+	Description    string   `xml:"NewPortMappingDescription"`
+	LeaseDuration  uint32   `xml:"NewLeaseDuration"`
+}
+
+type xGetListOfPortMappingsResponse struct {
+	XMLName     xml.Name `xml:"GetListOfPortMappingsResponse"`
+	PortListing string   `xml:"NewPortListing"`
+}
+
+type xPortMappingList struct {
+	XMLName xml.Name            `xml:"PortMappingList"`
+	Entries []xPortMappingEntry `xml:"PortMappingEntry"`
+}
+
+func makePortMapping(remoteHost string, externalPort uint16, protocol string, internalPort uint16,
+	internalClient, enabled, description string, lease uint32) (PortMapping, bool) {
+	proto, ok := parseProtocol(protocol)
+	if !ok {
+		return PortMapping{}, false
+	}
+
+	return PortMapping{
+		RemoteHost:     gnet.ParseIP(remoteHost),
+		ExternalPort:   externalPort,
+		Protocol:       proto,
+		InternalPort:   internalPort,
+		InternalClient: internalClient,
+		Enabled:        parseBoolean(enabled),
+		Description:    description,
+		LeaseDuration:  time.Duration(lease) * time.Second,
+	}, true
+}
+
+func listPortMappingsV1(wsvc *serviceEndpoint) ([]PortMapping, error) {
+	var pms []PortMapping
+	for i := 0; i < maxListEntries; i++ {
+		msg := actionGetGenericPortMappingEntry.begin(wsvc.Type, 8).uint(uint64(i)).message()
+
+		var r xGetGenericPortMappingEntryResponse
+		err := soapCall(wsvc, msg, &r)
+		if err != nil {
+			if IsErrorCode(err, ErrCodeSpecifiedArrayIndexInvalid) || IsErrorCode(err, ErrCodeNoSuchEntryInArray) {
+				break
+			}
+			return pms, err
+		}
+
+		pm, ok := makePortMapping(r.RemoteHost, r.ExternalPort, r.Protocol, r.InternalPort,
+			r.InternalClient, r.Enabled, r.Description, r.LeaseDuration)
+		if ok {
+			pms = append(pms, pm)
+		}
+	}
+
+	return pms, nil
+}
+
+func listPortMappingsV2(wsvc *serviceEndpoint) ([]PortMapping, error) {
+	var pms []PortMapping
+	for _, proto := range []Protocol{TCP, UDP} {
+		startPort := 0
+		for startPort <= 65535 && len(pms) < maxListEntries {
+			msg := actionGetListOfPortMappings.begin(wsvc.Type, 32).
+				uint(uint64(startPort)).
+				uint(65535).
+				str(proto.String()).
+				bool(false).
+				uint(listPageSize).
+				message()
+
+			var r xGetListOfPortMappingsResponse
+			err := soapCall(wsvc, msg, &r)
+			if err != nil {
+				if IsErrorCode(err, ErrCodeSpecifiedArrayIndexInvalid) || IsErrorCode(err, ErrCodeNoSuchEntryInArray) {
+					// no mappings in range
+					break
+				}
+				return nil, err
+			}
+
+			var list xPortMappingList
+			err = parse.SOAPBody([]byte(r.PortListing), &list)
+			if err != nil {
+				return nil, err
+			}
+
+			lastPort := -1
+			for _, e := range list.Entries {
+				pm, ok := makePortMapping(e.RemoteHost, e.ExternalPort, e.Protocol, e.InternalPort,
+					e.InternalClient, e.Enabled, e.Description, e.LeaseTime)
+				if ok {
+					pms = append(pms, pm)
+				}
+				if int(e.ExternalPort) > lastPort {
+					lastPort = int(e.ExternalPort)
+				}
+			}
+
+			if len(list.Entries) < listPageSize || lastPort < startPort {
+				break
+			}
+
+			startPort = lastPort + 1
+		}
+	}
+
+	return pms, nil
+}
+
+// Retrieves the port mapping with the given protocol, remote host and
+// external port, using GetSpecificPortMappingEntry. Pass a nil remoteHost for
+// a mapping which admits any remote host.
+//
+// If there is no such mapping, an *Error with code ErrCodeNoSuchEntryInArray
+// is returned.
+func GetPortMapping(upnpURL string, protocol Protocol, remoteHost gnet.IP, externalPort uint16) (*PortMapping, error) {
+	wsvc, err := getWANIPService(upnpURL)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := actionGetSpecificPortMappingEntry.begin(wsvc.Type, 64).
+		str(remoteHostString(remoteHost)).
+		uint(uint64(externalPort)).
+		str(protocol.String()).
+		message()
+
+	var r xGetSpecificPortMappingEntryResponse
+	err = soapCall(wsvc, msg, &r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PortMapping{
+		RemoteHost:     remoteHost,
+		ExternalPort:   externalPort,
+		Protocol:       protocol,
+		InternalPort:   r.InternalPort,
+		InternalClient: r.InternalClient,
+		Enabled:        parseBoolean(r.Enabled),
+		Description:    r.Description,
+		LeaseDuration:  time.Duration(r.LeaseDuration) * time.Second,
+	}, nil
+}
+
+type xGetSpecificPortMappingEntryResponse struct {
+	XMLName        xml.Name `xml:"GetSpecificPortMappingEntryResponse"`
+	InternalPort   uint16   `xml:"NewInternalPort"`
+	InternalClient string   `xml:"NewInternalClient"`
+	Enabled        string   `xml:"NewEnabled"`
+	Description    string   `xml:"NewPortMappingDescription"`
+	LeaseDuration  uint32   `xml:"NewLeaseDuration"`
+}
@@ -0,0 +1,229 @@
+package upnp
+
+import "encoding/xml"
+import "errors"
+import "fmt"
+import gnet "net"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+// Service type of the WANIPv6FirewallControl service, which controls inbound
+// IPv6 pinholes rather than NAT port mappings.
+const WANIPv6FirewallControl1 = "urn:schemas-upnp-org:service:WANIPv6FirewallControl:1"
+
+// The longest pinhole lease permitted by WANIPv6FirewallControl:1. Devices
+// reject longer leases rather than capping them.
+const MaxPinholeLease = 86400 * time.Second
+
+// UPnP error codes used by the WANIPv6FirewallControl service.
+const (
+	ErrCodePinholeSpaceExhausted    = 701
+	ErrCodeFirewallDisabled         = 702
+	ErrCodeInboundPinholeNotAllowed = 703
+	ErrCodeNoSuchPinhole            = 704
+)
+
+type xAddPinholeResponse struct {
+	XMLName  xml.Name `xml:"AddPinholeResponse"`
+	UniqueID string   `xml:"UniqueID"`
+}
+
+type xGetFirewallStatusResponse struct {
+	XMLName               xml.Name `xml:"GetFirewallStatusResponse"`
+	FirewallEnabled       string   `xml:"FirewallEnabled"`
+	InboundPinholeAllowed string   `xml:"InboundPinholeAllowed"`
+}
+
+// Describes a pinhole created by AddPinhole.
+type Pinhole struct {
+	// The identifier assigned by the device, used to update or delete the
+	// pinhole.
+	UniqueID uint16
+
+	// The lease requested, after capping to what the device permits.
+	Lease time.Duration
+}
+
+func getFirewallService(upnpURL string) (*serviceEndpoint, error) {
+	svc, err := getService(upnpURL, WANIPv6FirewallControl1)
+	if err != nil {
+		return nil, err
+	}
+
+	if svc == nil {
+		return nil, noServiceError("WANIPv6FirewallControl")
+	}
+
+	return svc, nil
+}
+
+// Returns the lease to request, which must be between one second and the
+// maximum the device permits.
+func (q *Quirks) pinholeLease(lease time.Duration) time.Duration {
+	max := MaxPinholeLease
+	if q.MaxPinholeLease > 0 && q.MaxPinholeLease < max {
+		max = q.MaxPinholeLease
+	}
+
+	switch {
+	case lease < time.Second:
+		return time.Second
+	case lease > max:
+		return max
+	default:
+		return lease
+	}
+}
+
+// Parses a UniqueID. Some devices pad the value with whitespace.
+func parseUniqueID(s string) (uint16, error) {
+	n, err := strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid pinhole UniqueID %q", s)
+	}
+
+	return uint16(n), nil
+}
+
+// Reports whether the device's firewall is enabled, and if so, whether it
+// permits pinholes to be created.
+//
+// Pass a UPnP device URL. The WANIPv6FirewallControl endpoint will be located
+// automatically.
+func GetFirewallStatus(upnpURL string) (enabled, pinholesAllowed bool, err error) {
+	svc, err := getFirewallService(upnpURL)
+	if err != nil {
+		return
+	}
+
+	msg := actionGetFirewallStatus.begin(svc.Type, 0).message()
+
+	var reply xGetFirewallStatusResponse
+	err = soapCall(svc, msg, &reply)
+	if err != nil {
+		return
+	}
+
+	return parseBoolean(reply.FirewallEnabled), parseBoolean(reply.InboundPinholeAllowed), nil
+}
+
+// Pinholes which a device with the PinholeReused quirk has returned more than
+// once, and the number of times each has been returned but not yet deleted.
+var pinholeRefsMutex sync.Mutex
+var pinholeRefs = map[pinholeRef]int{}
+
+type pinholeRef struct {
+	upnpURL  string
+	uniqueID uint16
+}
+
+// Performs a single UPnP transaction to open an inbound IPv6 pinhole to
+// internalClient, which must be an IPv6 address of this host.
+//
+// Pass a UPnP device URL. The WANIPv6FirewallControl endpoint will be located
+// automatically. A nil remoteHost or zero remotePort admits any remote host
+// or port. The lease is capped to what the device permits; the pinhole must be
+// renewed with UpdatePinhole before it expires.
+func AddPinhole(upnpURL string, protocol Protocol, remoteHost gnet.IP, remotePort uint16,
+	internalClient gnet.IP, internalPort uint16, lease time.Duration) (*Pinhole, error) {
+	if internalClient.To4() != nil || internalClient.To16() == nil {
+		return nil, errors.New("pinhole internal client must be an IPv6 address")
+	}
+
+	svc, err := getFirewallService(upnpURL)
+	if err != nil {
+		return nil, err
+	}
+
+	lease = svc.Quirks.pinholeLease(lease)
+	msg := actionAddPinhole.begin(svc.Type, 128).
+		str(remoteHostString(remoteHost)).
+		uint(uint64(remotePort)).
+		str(internalClient.String()).
+		uint(uint64(internalPort)).
+		uint(uint64(protocol)).
+		uint(uint64(uint32(lease.Seconds()))).
+		message()
+
+	var reply xAddPinholeResponse
+	err = soapCall(svc, msg, &reply)
+	if err != nil {
+		return nil, err
+	}
+
+	uid, err := parseUniqueID(reply.UniqueID)
+	if err != nil {
+		return nil, err
+	}
+
+	if svc.Quirks.PinholeReused {
+		pinholeRefsMutex.Lock()
+		pinholeRefs[pinholeRef{upnpURL, uid}]++
+		pinholeRefsMutex.Unlock()
+	}
+
+	return &Pinhole{UniqueID: uid, Lease: lease}, nil
+}
+
+// Performs a single UPnP transaction to renew a pinhole created by AddPinhole.
+// The lease is capped as for AddPinhole.
+func UpdatePinhole(upnpURL string, uniqueID uint16, lease time.Duration) error {
+	svc, err := getFirewallService(upnpURL)
+	if err != nil {
+		return err
+	}
+
+	msg := actionUpdatePinhole.begin(svc.Type, 16).
+		uint(uint64(uniqueID)).
+		uint(uint64(uint32(svc.Quirks.pinholeLease(lease).Seconds()))).
+		message()
+
+	res, err := soapRequest(svc, msg)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	return nil
+}
+
+// Performs a single UPnP transaction to delete a pinhole created by
+// AddPinhole.
+//
+// On devices with the PinholeReused quirk, AddPinhole may have returned the
+// same pinhole more than once, in which case the pinhole is only deleted once
+// DeletePinhole has been called for each time it was returned.
+func DeletePinhole(upnpURL string, uniqueID uint16) error {
+	svc, err := getFirewallService(upnpURL)
+	if err != nil {
+		return err
+	}
+
+	if svc.Quirks.PinholeReused {
+		ref := pinholeRef{upnpURL, uniqueID}
+		pinholeRefsMutex.Lock()
+		n := pinholeRefs[ref] - 1
+		if n > 0 {
+			pinholeRefs[ref] = n
+		} else {
+			delete(pinholeRefs, ref)
+		}
+		pinholeRefsMutex.Unlock()
+
+		if n > 0 {
+			return nil
+		}
+	}
+
+	msg := actionDeletePinhole.begin(svc.Type, 8).uint(uint64(uniqueID)).message()
+
+	res, err := soapRequest(svc, msg)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package upnp
+
+import "hash/fnv"
+import "io/ioutil"
+import "math/rand"
+import "os"
+import "strconv"
+import "strings"
+import "sync"
+
+// The range from which external ports are chosen when none is specified.
+const (
+	minRandomPort = 1025
+	maxRandomPort = 65000
+)
+
+// A source of pseudo-random external ports. The sequence of ports is
+// determined by the identity of this host, the mapping name and the internal
+// port, so the same application on the same host obtains the same port on
+// each run, while different applications obtain different ports. Safe for
+// concurrent use.
+type PortSource struct {
+	mutex    sync.Mutex
+	r        *rand.Rand
+	excluded map[uint16]bool
+}
+
+// Ports in the range from which ports are chosen which are commonly blocked
+// by ISPs or refused by web browsers, and so are not chosen by a PortSource
+// unless SetExcluded is used to change the list. This comprises the ports
+// above 1024 on the browser unsafe port list, Microsoft SQL Server, and the
+// BitTorrent ports throttled by some ISPs.
+var DefaultExcludedPorts = []uint16{
+	1433, 1434, 1719, 1720, 1723, 2049, 3659, 4045, 5060, 5061, 6000, 6566,
+	6665, 6666, 6667, 6668, 6669, 6697, 6881, 6882, 6883, 6884, 6885, 6886,
+	6887, 6888, 6889, 10080,
+}
+
+// Creates a port source for a mapping with the given name and internal port.
+// DefaultExcludedPorts are excluded.
+func NewPortSource(name string, internalPort uint16) *PortSource {
+	h := fnv.New64a()
+	h.Write([]byte(hostID()))
+	h.Write([]byte{0})
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.Itoa(int(internalPort))))
+
+	s := &PortSource{r: rand.New(rand.NewSource(int64(h.Sum64())))}
+	s.SetExcluded(DefaultExcludedPorts)
+	return s
+}
+
+// Sets the ports which are never returned by Next, replacing the previous
+// list. Pass nil to exclude no ports.
+func (s *PortSource) SetExcluded(ports []uint16) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.excluded = map[uint16]bool{}
+	for _, p := range ports {
+		if p >= minRandomPort && p < maxRandomPort {
+			s.excluded[p] = true
+		}
+	}
+}
+
+// Returns the next port in the sequence which is not excluded.
+func (s *PortSource) Next() uint16 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for {
+		port := uint16(s.r.Int31n(maxRandomPort-minRandomPort) + minRandomPort)
+		if !s.excluded[port] || len(s.excluded) >= maxRandomPort-minRandomPort {
+			return port
+		}
+	}
+}
+
+var hostIDOnce sync.Once
+var hostIDValue string
+
+// Returns a string which identifies this host and is stable across reboots.
+// The systemd/D-Bus machine ID is used where available, and the hostname
+// otherwise.
+func hostID() string {
+	hostIDOnce.Do(func() {
+		for _, fn := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+			b, err := ioutil.ReadFile(fn)
+			if err == nil && len(strings.TrimSpace(string(b))) > 0 {
+				hostIDValue = strings.TrimSpace(string(b))
+				return
+			}
+		}
+
+		hostIDValue, _ = os.Hostname()
+	})
+
+	return hostIDValue
+}
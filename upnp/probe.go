@@ -0,0 +1,83 @@
+package upnp
+
+import gnet "net"
+import "time"
+import "github.com/hlandau/portmap/ssdp"
+
+// Describes a UPnP device as examined by Probe.
+type ProbeResult struct {
+	// From the description of the root device.
+	DeviceName   string
+	Manufacturer string
+	ModelName    string
+
+	// The WANIPConnection service types the device provides, in the order
+	// they appear in its description.
+	ServiceTypes []string
+
+	// Whether the device provides the DeviceProtection service, in which case
+	// Login may be required before mappings can be created.
+	DeviceProtection bool
+
+	// The quirks which would be in effect for requests to the device.
+	Quirks Quirks
+
+	// The address of this host as seen by the device. nil if it could not be
+	// determined.
+	LocalIP gnet.IP
+
+	// The external address reported by GetExternalIPAddress, and the time
+	// taken for the request. ExternalIP is nil if the request failed, in
+	// which case ExternalIPErr is set.
+	ExternalIP    gnet.IP
+	ExternalIPErr error
+	RTT           time.Duration
+}
+
+// Examines the device at the given UPnP device URL without creating or
+// changing any mappings. The device description is fetched and
+// GetExternalIPAddress is called, so that applications can show whether the
+// device supports port mapping and how quickly it responds.
+//
+// Returns an error if the description cannot be fetched or the device does
+// not provide a WANIPConnection service.
+func Probe(upnpURL string) (*ProbeResult, error) {
+	desc, err := ssdp.DescribeURL(upnpURL)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ProbeResult{
+		DeviceName:   desc.Device.FriendlyName,
+		Manufacturer: desc.Device.Manufacturer,
+		ModelName:    desc.Device.ModelName,
+	}
+
+	desc.Device.VisitServices(func(d *ssdp.Device, s *ssdp.DeviceService) {
+		switch s.ServiceType {
+		case WANIPConnection1, WANIPConnection2:
+			for _, t := range r.ServiceTypes {
+				if t == s.ServiceType {
+					return
+				}
+			}
+			r.ServiceTypes = append(r.ServiceTypes, s.ServiceType)
+		case DeviceProtection1:
+			r.DeviceProtection = true
+		}
+	})
+
+	wsvc, err := getWANIPService(upnpURL)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Quirks = wsvc.Quirks
+	r.LocalIP, _ = determineSelfIP(wsvc.ControlURL)
+
+	start := time.Now()
+	r.ExternalIP, r.ExternalIPErr = getExternalAddr(wsvc)
+	r.RTT = time.Since(start)
+
+	return r, nil
+}
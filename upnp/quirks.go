@@ -0,0 +1,290 @@
+package upnp
+
+import "net/http"
+import "runtime"
+import "strings"
+import "sync"
+import "time"
+import "github.com/hlandau/portmap/ssdp"
+
+// Adjustments made to requests sent to a device, for devices which only
+// respond correctly to requests of a particular form.
+type Quirks struct {
+	// If non-empty, sent as the User-Agent header instead of DefaultUserAgent.
+	UserAgent string
+
+	// If true, the SOAPAction header is sent without surrounding quotes, as
+	// some devices require, despite the specification mandating them.
+	UnquotedSOAPAction bool
+
+	// Additional headers to set on each request, overriding any set by
+	// default.
+	Headers map[string]string
+
+	// The device only supports permanent mappings, so a lease duration of zero
+	// is always requested.
+	PermanentLeaseOnly bool
+
+	// The device requires the external port of a mapping to equal the
+	// internal port.
+	RequireMatchingPorts bool
+
+	// If nonzero, mapping descriptions are truncated to this many bytes.
+	MaxDescriptionLength int
+
+	// The device misbehaves if it receives more than one request at a time,
+	// so requests to it are serialized.
+	SerializeRequests bool
+
+	// If nonzero, pinhole leases are capped to this rather than to
+	// MaxPinholeLease.
+	MaxPinholeLease time.Duration
+
+	// AddPinhole returns the UniqueID of an existing pinhole with the same
+	// parameters instead of creating another, as MiniUPnPd does, so the same
+	// pinhole may be returned to several callers. See DeletePinhole.
+	PinholeReused bool
+}
+
+// Returns the names of the behavioural quirks which are enabled, for
+// diagnostic purposes.
+func (q Quirks) Names() []string {
+	var names []string
+	if q.UserAgent != "" {
+		names = append(names, "UserAgent")
+	}
+	if q.UnquotedSOAPAction {
+		names = append(names, "UnquotedSOAPAction")
+	}
+	if len(q.Headers) > 0 {
+		names = append(names, "Headers")
+	}
+	if q.PermanentLeaseOnly {
+		names = append(names, "PermanentLeaseOnly")
+	}
+	if q.RequireMatchingPorts {
+		names = append(names, "RequireMatchingPorts")
+	}
+	if q.MaxDescriptionLength != 0 {
+		names = append(names, "MaxDescriptionLength")
+	}
+	if q.SerializeRequests {
+		names = append(names, "SerializeRequests")
+	}
+	if q.MaxPinholeLease != 0 {
+		names = append(names, "MaxPinholeLease")
+	}
+	if q.PinholeReused {
+		names = append(names, "PinholeReused")
+	}
+	return names
+}
+
+// Returns the combination of q and o. Flags set in either are set in the
+// result; string and length values from o take precedence where set.
+func (q Quirks) merge(o Quirks) Quirks {
+	if o.UserAgent != "" {
+		q.UserAgent = o.UserAgent
+	}
+	q.UnquotedSOAPAction = q.UnquotedSOAPAction || o.UnquotedSOAPAction
+	if len(o.Headers) > 0 {
+		h := make(map[string]string, len(q.Headers)+len(o.Headers))
+		for k, v := range q.Headers {
+			h[k] = v
+		}
+		for k, v := range o.Headers {
+			h[k] = v
+		}
+		q.Headers = h
+	}
+	q.PermanentLeaseOnly = q.PermanentLeaseOnly || o.PermanentLeaseOnly
+	q.RequireMatchingPorts = q.RequireMatchingPorts || o.RequireMatchingPorts
+	if o.MaxDescriptionLength != 0 && (q.MaxDescriptionLength == 0 || o.MaxDescriptionLength < q.MaxDescriptionLength) {
+		q.MaxDescriptionLength = o.MaxDescriptionLength
+	}
+	q.SerializeRequests = q.SerializeRequests || o.SerializeRequests
+	if o.MaxPinholeLease != 0 && (q.MaxPinholeLease == 0 || o.MaxPinholeLease < q.MaxPinholeLease) {
+		q.MaxPinholeLease = o.MaxPinholeLease
+	}
+	q.PinholeReused = q.PinholeReused || o.PinholeReused
+	return q
+}
+
+// Truncates a mapping description as required.
+func (q *Quirks) description(name string) string {
+	if q.MaxDescriptionLength > 0 && len(name) > q.MaxDescriptionLength {
+		return name[0:q.MaxDescriptionLength]
+	}
+
+	return name
+}
+
+// The User-Agent sent to devices by default, in the form recommended by the
+// UPnP Device Architecture.
+var DefaultUserAgent = runtime.GOOS + "/1.0 UPnP/1.1 portmap/1.0"
+
+func (q *Quirks) apply(req *http.Request, serviceType, method string) {
+	ua := q.UserAgent
+	if ua == "" {
+		ua = DefaultUserAgent
+	}
+	req.Header.Set("User-Agent", ua)
+
+	if q.UnquotedSOAPAction {
+		req.Header.Set("SOAPAction", serviceType+"#"+method)
+	}
+
+	for k, v := range q.Headers {
+		req.Header.Set(k, v)
+	}
+}
+
+type quirksPreset struct {
+	server string
+	quirks Quirks
+}
+
+// Built-in quirks for devices identified by their SERVER header, which
+// RegisterQuirks can override. MiniUPnPd, the most common open-source IGD,
+// announces itself as "MiniUPnPd/<version>".
+var builtinPresets = []quirksPreset{
+	{"miniupnpd", Quirks{PinholeReused: true}},
+}
+
+var quirksMutex sync.RWMutex
+var quirksPresets = builtinPresets
+var quirksByURL = map[string]Quirks{}
+var serverByURL = map[string]string{}
+
+// Registers quirks to be used for devices whose SSDP SERVER header contains
+// the given string (compared case-insensitively). Presets registered later
+// take precedence over those registered earlier.
+func RegisterQuirks(server string, q Quirks) {
+	quirksMutex.Lock()
+	defer quirksMutex.Unlock()
+
+	quirksPresets = append(quirksPresets, quirksPreset{strings.ToLower(server), q})
+}
+
+// Returns the quirks registered for the given SSDP SERVER header, and
+// whether any were found.
+func QuirksForServer(server string) (Quirks, bool) {
+	quirksMutex.RLock()
+	defer quirksMutex.RUnlock()
+
+	server = strings.ToLower(server)
+	for i := len(quirksPresets) - 1; i >= 0; i-- {
+		if strings.Contains(server, quirksPresets[i].server) {
+			return quirksPresets[i].quirks, true
+		}
+	}
+
+	return Quirks{}, false
+}
+
+// Sets the quirks to be used for the device at the given UPnP device URL.
+// These take precedence over any registered presets.
+func SetQuirks(upnpURL string, q Quirks) {
+	quirksMutex.Lock()
+	defer quirksMutex.Unlock()
+
+	quirksByURL[upnpURL] = q
+}
+
+// Records the SSDP SERVER header sent by the device at the given UPnP device
+// URL, so that registered presets matching it are applied to requests sent
+// to the device.
+func SetServerHeader(upnpURL, server string) {
+	quirksMutex.Lock()
+	defer quirksMutex.Unlock()
+
+	serverByURL[upnpURL] = server
+}
+
+// A quirk table entry matching devices by the manufacturer and model name
+// given in their device description.
+type modelQuirks struct {
+	manufacturer string
+	model        string
+	quirks       Quirks
+}
+
+// Built-in quirks for specific devices. Matching is by case-insensitive
+// substring; an empty model matches any model from the manufacturer. Entries
+// should be added here as misbehaving devices are reported. Quirks which can
+// be recognised from a device's responses are detected automatically and
+// need not be listed.
+var builtinQuirks = []modelQuirks{}
+
+// Registers quirks to be used for devices whose description gives a
+// manufacturer and model name containing the given strings (compared
+// case-insensitively). An empty model matches any model.
+func RegisterModelQuirks(manufacturer, model string, q Quirks) {
+	quirksMutex.Lock()
+	defer quirksMutex.Unlock()
+
+	modelQuirksTable = append(modelQuirksTable, modelQuirks{strings.ToLower(manufacturer), strings.ToLower(model), q})
+}
+
+var modelQuirksTable = builtinQuirks
+
+// Quirks learned from the responses of each device, keyed by UPnP device URL.
+var learnedQuirks = map[string]Quirks{}
+
+func learnQuirks(upnpURL string, q Quirks) {
+	quirksMutex.Lock()
+	defer quirksMutex.Unlock()
+
+	learnedQuirks[upnpURL] = learnedQuirks[upnpURL].merge(q)
+}
+
+// Returns the quirks which are in effect for the device at the given UPnP
+// device URL: those set with SetQuirks if any, or else the combination of
+// registered presets matching the device's SERVER header and description and
+// any quirks detected automatically from its responses.
+func EffectiveQuirks(upnpURL string) Quirks {
+	desc, _ := ssdp.DescribeURL(upnpURL)
+	return getQuirks(upnpURL, desc)
+}
+
+func getQuirks(upnpURL string, desc *ssdp.Description) Quirks {
+	quirksMutex.RLock()
+	q, ok := quirksByURL[upnpURL]
+	server := serverByURL[upnpURL]
+	learned := learnedQuirks[upnpURL]
+	var mq Quirks
+	if desc != nil {
+		mfr := strings.ToLower(desc.Device.Manufacturer)
+		model := strings.ToLower(desc.Device.ModelName)
+		for _, e := range modelQuirksTable {
+			if strings.Contains(mfr, e.manufacturer) && strings.Contains(model, e.model) {
+				mq = mq.merge(e.quirks)
+			}
+		}
+	}
+	quirksMutex.RUnlock()
+
+	if ok {
+		return q
+	}
+
+	q, _ = QuirksForServer(server)
+	return q.merge(mq).merge(learned)
+}
+
+var deviceLocksMutex sync.Mutex
+var deviceLocks = map[string]*sync.Mutex{}
+
+// Returns a mutex used to serialize requests to the given host.
+func deviceLock(host string) *sync.Mutex {
+	deviceLocksMutex.Lock()
+	defer deviceLocksMutex.Unlock()
+
+	l := deviceLocks[host]
+	if l == nil {
+		l = &sync.Mutex{}
+		deviceLocks[host] = l
+	}
+
+	return l
+}
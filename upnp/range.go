@@ -0,0 +1,89 @@
+package upnp
+
+import "errors"
+
+// Deletes all port mappings for the given protocol with external ports in
+// the range [startPort, endPort] which point to this host.
+//
+// Pass a UPnP device URL. The WANIPConnection endpoint will be located
+// automatically. On IGDv2 devices, this is done with a single
+// DeletePortMappingRange call. On IGDv1 devices, the existing mappings are
+// enumerated and those in range are deleted one at a time.
+//
+// If manage is true, mappings pointing to other hosts are also deleted. IGDv2
+// devices generally only permit this for authorized control points.
+func UnmapRange(upnpURL string, protocol Protocol, startPort, endPort uint16, manage bool) error {
+	if startPort > endPort {
+		return errors.New("invalid port range")
+	}
+
+	wsvc, err := getWANIPService(upnpURL, WANIPConnection2, WANIPConnection1)
+	if err != nil {
+		return err
+	}
+
+	if wsvc.Type == WANIPConnection2 {
+		err = unmapRangeV2(wsvc, protocol, startPort, endPort, manage)
+		if err == nil || !IsErrorCode(err, ErrCodeInvalidAction) {
+			return err
+		}
+	}
+
+	return unmapRangeV1(wsvc, protocol, startPort, endPort, manage)
+}
+
+func unmapRangeV2(wsvc *serviceEndpoint, protocol Protocol, startPort, endPort uint16, manage bool) error {
+	msg := actionDeletePortMappingRange.begin(wsvc.Type, 32).
+		uint(uint64(startPort)).
+		uint(uint64(endPort)).
+		str(protocol.String()).
+		bool(manage).
+		message()
+
+	res, err := soapRequest(wsvc, msg)
+	if err != nil {
+		if IsErrorCode(err, ErrCodeNoSuchEntryInArray) {
+			// nothing to delete
+			return nil
+		}
+		return err
+	}
+	res.Body.Close()
+
+	return nil
+}
+
+func unmapRangeV1(wsvc *serviceEndpoint, protocol Protocol, startPort, endPort uint16, manage bool) error {
+	pms, err := listPortMappingsV1(wsvc)
+	if err != nil {
+		return err
+	}
+
+	selfIP, err := determineSelfIP(wsvc.ControlURL)
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, pm := range pms {
+		if pm.Protocol != protocol || pm.ExternalPort < startPort || pm.ExternalPort > endPort {
+			continue
+		}
+
+		if !manage && pm.InternalClient != selfIP.String() {
+			continue
+		}
+
+		msg := deletePortMappingMessage(wsvc, pm.RemoteHost, pm.ExternalPort, protocol)
+		res, err := soapRequest(wsvc, msg)
+		if err != nil {
+			if firstErr == nil && !IsErrorCode(err, ErrCodeNoSuchEntryInArray) {
+				firstErr = err
+			}
+			continue
+		}
+		res.Body.Close()
+	}
+
+	return firstErr
+}
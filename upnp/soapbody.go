@@ -0,0 +1,171 @@
+package upnp
+
+import "strconv"
+import "strings"
+
+const soapEnvelopeStart = `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`
+const soapEnvelopeEnd = `</s:Body></s:Envelope>`
+
+// A SOAP action whose request envelope is assembled from fragments computed
+// once, so that a request is built by concatenating them with the argument
+// values rather than by formatting a template each time. Values are always
+// escaped, so the envelope is well-formed whatever they contain.
+type soapAction struct {
+	name string
+
+	// The envelope up to the service type.
+	head string
+
+	// For each argument, the text preceding its value: the end of the
+	// previous element and the start of its own.
+	fragments []string
+
+	// The text following the last value.
+	tail string
+
+	// The length of the fixed text.
+	size int
+}
+
+// Defines an action taking the named arguments, which must be given in
+// order when a request is built.
+func newSOAPAction(name string, args ...string) *soapAction {
+	a := &soapAction{
+		name: name,
+		head: soapEnvelopeStart + `<u:` + name + ` xmlns:u="`,
+	}
+
+	if len(args) == 0 {
+		a.tail = `"/>` + soapEnvelopeEnd
+	} else {
+		prev := `">`
+		for _, arg := range args {
+			a.fragments = append(a.fragments, prev+`<`+arg+`>`)
+			prev = `</` + arg + `>`
+		}
+		a.tail = prev + `</u:` + name + `>` + soapEnvelopeEnd
+	}
+
+	a.size = len(a.head) + len(a.tail)
+	for _, f := range a.fragments {
+		a.size += len(f)
+	}
+
+	return a
+}
+
+// The actions used, with their arguments in the order the UPnP standards
+// give them.
+var (
+	actionAddPortMapping = newSOAPAction("AddPortMapping", "NewRemoteHost", "NewExternalPort", "NewProtocol",
+		"NewInternalPort", "NewInternalClient", "NewEnabled", "NewPortMappingDescription", "NewLeaseDuration")
+	actionDeletePortMapping           = newSOAPAction("DeletePortMapping", "NewRemoteHost", "NewExternalPort", "NewProtocol")
+	actionDeletePortMappingRange      = newSOAPAction("DeletePortMappingRange", "NewStartPort", "NewEndPort", "NewProtocol", "NewManage")
+	actionGetExternalIPAddress        = newSOAPAction("GetExternalIPAddress")
+	actionGetStatusInfo               = newSOAPAction("GetStatusInfo")
+	actionGetGenericPortMappingEntry  = newSOAPAction("GetGenericPortMappingEntry", "NewPortMappingIndex")
+	actionGetSpecificPortMappingEntry = newSOAPAction("GetSpecificPortMappingEntry", "NewRemoteHost", "NewExternalPort", "NewProtocol")
+	actionGetListOfPortMappings       = newSOAPAction("GetListOfPortMappings", "NewStartPort", "NewEndPort", "NewProtocol", "NewManage", "NewNumberOfPorts")
+	actionGetFirewallStatus           = newSOAPAction("GetFirewallStatus")
+	actionAddPinhole                  = newSOAPAction("AddPinhole", "RemoteHost", "RemotePort", "InternalClient", "InternalPort", "Protocol", "LeaseTime")
+	actionUpdatePinhole               = newSOAPAction("UpdatePinhole", "UniqueID", "NewLeaseTime")
+	actionDeletePinhole               = newSOAPAction("DeletePinhole", "UniqueID")
+	actionGetUserLoginChallenge       = newSOAPAction("GetUserLoginChallenge", "ProtocolType", "Name")
+	actionUserLogin                   = newSOAPAction("UserLogin", "ProtocolType", "Challenge", "Authenticator")
+	actionUserLogout                  = newSOAPAction("UserLogout")
+)
+
+// A request envelope ready to be sent.
+type soapMessage struct {
+	action   string
+	envelope string
+}
+
+// Builds a request envelope for a soapAction. Each argument is added with
+// str, uint or bool, in order, and then message returns the envelope.
+type soapBuilder struct {
+	a *soapAction
+	b strings.Builder
+	i int
+}
+
+// Begins a request for the action of the given service type. extra is an
+// estimate of the total length of the argument values.
+func (a *soapAction) begin(serviceType string, extra int) *soapBuilder {
+	sb := &soapBuilder{a: a}
+	sb.b.Grow(a.size + len(serviceType) + extra)
+	sb.b.WriteString(a.head)
+	writeEscaped(&sb.b, serviceType)
+	return sb
+}
+
+func (sb *soapBuilder) next() {
+	if sb.i == len(sb.a.fragments) {
+		panic("upnp: too many arguments for " + sb.a.name)
+	}
+
+	sb.b.WriteString(sb.a.fragments[sb.i])
+	sb.i++
+}
+
+func (sb *soapBuilder) str(v string) *soapBuilder {
+	sb.next()
+	writeEscaped(&sb.b, v)
+	return sb
+}
+
+func (sb *soapBuilder) uint(v uint64) *soapBuilder {
+	sb.next()
+	var buf [20]byte
+	sb.b.Write(strconv.AppendUint(buf[:0], v, 10))
+	return sb
+}
+
+// Adds a UPnP boolean, which is sent as 0 or 1.
+func (sb *soapBuilder) bool(v bool) *soapBuilder {
+	sb.next()
+	if v {
+		sb.b.WriteByte('1')
+	} else {
+		sb.b.WriteByte('0')
+	}
+	return sb
+}
+
+func (sb *soapBuilder) message() soapMessage {
+	if sb.i != len(sb.a.fragments) {
+		panic("upnp: too few arguments for " + sb.a.name)
+	}
+
+	sb.b.WriteString(sb.a.tail)
+	return soapMessage{action: sb.a.name, envelope: sb.b.String()}
+}
+
+// Writes s with the characters which are special in XML escaped, as for
+// html.EscapeString, without allocating.
+func writeEscaped(b *strings.Builder, s string) {
+	last := 0
+	for i := 0; i < len(s); i++ {
+		var esc string
+		switch s[i] {
+		case '&':
+			esc = "&amp;"
+		case '<':
+			esc = "&lt;"
+		case '>':
+			esc = "&gt;"
+		case '"':
+			esc = "&#34;"
+		case '\'':
+			esc = "&#39;"
+		default:
+			continue
+		}
+
+		b.WriteString(s[last:i])
+		b.WriteString(esc)
+		last = i + 1
+	}
+
+	b.WriteString(s[last:])
+}
@@ -0,0 +1,103 @@
+package upnp
+
+import "fmt"
+import "html"
+import "testing"
+
+const testServiceType = "urn:schemas-upnp-org:service:WANIPConnection:1"
+
+// Builds envelopes as they were built before soapAction was introduced, by
+// formatting a template for each request.
+func oldEnvelope(msg string) string {
+	return `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` + msg + `</s:Body></s:Envelope>`
+}
+
+func oldAddPortMapping(desc string) string {
+	return oldEnvelope(fmt.Sprintf(`<u:AddPortMapping xmlns:u="%s"><NewRemoteHost>%s</NewRemoteHost><NewExternalPort>%d</NewExternalPort><NewProtocol>%s</NewProtocol><NewInternalPort>%d</NewInternalPort><NewInternalClient>%s</NewInternalClient><NewEnabled>1</NewEnabled><NewPortMappingDescription>%s</NewPortMappingDescription><NewLeaseDuration>%d</NewLeaseDuration></u:AddPortMapping>`,
+		testServiceType, "", 51234, "TCP", 8080, "192.168.1.10", html.EscapeString(desc), 7200))
+}
+
+func newAddPortMapping(desc string) soapMessage {
+	return actionAddPortMapping.begin(testServiceType, len(desc)+64).
+		str("").
+		uint(51234).
+		str("TCP").
+		uint(8080).
+		str("192.168.1.10").
+		bool(true).
+		str(desc).
+		uint(7200).
+		message()
+}
+
+func TestSOAPEnvelope(t *testing.T) {
+	tests := []struct {
+		name string
+		old  string
+		new  soapMessage
+	}{
+		{
+			name: "AddPortMapping",
+			old:  oldAddPortMapping("web server"),
+			new:  newAddPortMapping("web server"),
+		},
+		{
+			name: "AddPortMapping escaped",
+			old:  oldAddPortMapping(`<"Tom & Jerry's">`),
+			new:  newAddPortMapping(`<"Tom & Jerry's">`),
+		},
+		{
+			name: "DeletePortMapping",
+			old: oldEnvelope(fmt.Sprintf(`<u:DeletePortMapping xmlns:u="%s"><NewRemoteHost>%s</NewRemoteHost><NewExternalPort>%d</NewExternalPort><NewProtocol>%s</NewProtocol></u:DeletePortMapping>`,
+				testServiceType, "", 51234, "UDP")),
+			new: deletePortMappingMessage(&serviceEndpoint{Type: testServiceType}, nil, 51234, UDP),
+		},
+		{
+			name: "GetListOfPortMappings",
+			old: oldEnvelope(fmt.Sprintf(`<u:GetListOfPortMappings xmlns:u="%s"><NewStartPort>%d</NewStartPort><NewEndPort>65535</NewEndPort><NewProtocol>%s</NewProtocol><NewManage>0</NewManage><NewNumberOfPorts>%d</NewNumberOfPorts></u:GetListOfPortMappings>`,
+				testServiceType, 0, "TCP", 100)),
+			new: actionGetListOfPortMappings.begin(testServiceType, 32).uint(0).uint(65535).str("TCP").bool(false).uint(100).message(),
+		},
+		{
+			name: "GetExternalIPAddress",
+			old:  oldEnvelope(`<u:GetExternalIPAddress xmlns:u="` + testServiceType + `"/>`),
+			new:  actionGetExternalIPAddress.begin(testServiceType, 0).message(),
+		},
+	}
+
+	for _, tt := range tests {
+		if tt.new.envelope != tt.old {
+			t.Errorf("%s: envelope differs from previous format:\ngot  %s\nwant %s", tt.name, tt.new.envelope, tt.old)
+		}
+	}
+}
+
+func TestSOAPBuilderArgumentCount(t *testing.T) {
+	for _, f := range []func(){
+		func() { actionDeletePinhole.begin(testServiceType, 0).message() },
+		func() { actionDeletePinhole.begin(testServiceType, 0).str("1").str("2") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("wrong number of arguments did not panic")
+				}
+			}()
+			f()
+		}()
+	}
+}
+
+func BenchmarkSOAPEnvelopeOld(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		oldAddPortMapping("web server")
+	}
+}
+
+func BenchmarkSOAPEnvelope(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		newAddPortMapping("web server")
+	}
+}
@@ -0,0 +1,55 @@
+package upnp
+
+import "encoding/xml"
+import "strings"
+import "time"
+
+type xGetStatusInfoResponse struct {
+	XMLName             xml.Name `xml:"GetStatusInfoResponse"`
+	ConnectionStatus    string   `xml:"NewConnectionStatus"`
+	LastConnectionError string   `xml:"NewLastConnectionError"`
+	Uptime              uint32   `xml:"NewUptime"`
+}
+
+// The state of a device's WAN connection, as reported by GetStatusInfo.
+type StatusInfo struct {
+	// The connection status, such as "Connected", "Disconnected" or
+	// "Connecting".
+	ConnectionStatus string
+
+	// The cause of the last connection failure, such as "ERROR_NONE". May be
+	// empty.
+	LastConnectionError string
+
+	// The time for which the connection has been up.
+	Uptime time.Duration
+}
+
+// Returns true if the WAN connection is up.
+func (s *StatusInfo) Connected() bool {
+	return strings.EqualFold(strings.TrimSpace(s.ConnectionStatus), "Connected")
+}
+
+// Calls GetStatusInfo on the WANIPConnection service of the device at the
+// given UPnP device URL. A device which is not connected to the WAN cannot
+// usefully create mappings, even though it may accept them.
+func GetStatusInfo(upnpURL string) (*StatusInfo, error) {
+	wsvc, err := getWANIPService(upnpURL)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := actionGetStatusInfo.begin(wsvc.Type, 0).message()
+
+	var reply xGetStatusInfoResponse
+	err = soapCall(wsvc, msg, &reply)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatusInfo{
+		ConnectionStatus:    reply.ConnectionStatus,
+		LastConnectionError: reply.LastConnectionError,
+		Uptime:              time.Duration(reply.Uptime) * time.Second,
+	}, nil
+}
@@ -0,0 +1,213 @@
+package upnp
+
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import "crypto/rand"
+import "crypto/sha256"
+import "crypto/tls"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import "errors"
+import "math/big"
+import gnet "net"
+import "net/http"
+import "sync"
+import "time"
+import "github.com/hlandau/portmap/internal/localnet"
+
+// Options for communicating with devices whose control URLs use HTTPS, as is
+// common with IGDv2 devices which implement DeviceProtection.
+type TLSConfig struct {
+	// Devices usually present self-signed certificates, which cannot be
+	// verified in the ordinary way. If this is true, the certificate presented
+	// by a device the first time it is contacted is accepted and pinned, and
+	// subsequent connections to the same host and port are only accepted if
+	// the device presents the same certificate. Otherwise, certificates are
+	// verified against the system roots.
+	PinOnFirstUse bool
+
+	// The certificate presented to devices to identify this control point.
+	// DeviceProtection uses it to associate logins and permissions with the
+	// control point. If nil, a self-signed certificate is generated the first
+	// time one is needed.
+	Certificate *tls.Certificate
+}
+
+var tlsMutex sync.Mutex
+var tlsConfig TLSConfig
+var tlsPins = map[string][32]byte{}
+var httpClient *http.Client
+
+// Sets the options used for HTTPS control URLs. This replaces any previous
+// configuration but does not clear pinned certificates.
+func SetTLSConfig(cfg TLSConfig) {
+	tlsMutex.Lock()
+	defer tlsMutex.Unlock()
+
+	tlsConfig = cfg
+	httpClient = nil
+}
+
+// Returns the SHA-256 fingerprints of the certificates which have been pinned,
+// keyed by "host:port". This can be used to persist pins across runs.
+func Pins() map[string][32]byte {
+	tlsMutex.Lock()
+	defer tlsMutex.Unlock()
+
+	pins := make(map[string][32]byte, len(tlsPins))
+	for k, v := range tlsPins {
+		pins[k] = v
+	}
+
+	return pins
+}
+
+// Adds pinned certificate fingerprints, as previously returned by Pins.
+func SetPins(pins map[string][32]byte) {
+	tlsMutex.Lock()
+	defer tlsMutex.Unlock()
+
+	for k, v := range pins {
+		tlsPins[k] = v
+	}
+}
+
+var errPinMismatch = errors.New("device presented a certificate which does not match the pinned certificate")
+
+// Returns the HTTP client used for requests to devices. Proxy settings from
+// the environment are not used, since devices are on the local network.
+func getHTTPClient() *http.Client {
+	tlsMutex.Lock()
+	defer tlsMutex.Unlock()
+
+	if httpClient != nil {
+		return httpClient
+	}
+
+	cfg := tlsConfig
+	tr := &http.Transport{
+		DialContext: localnet.DialContext,
+		DialTLS: func(network, addr string) (gnet.Conn, error) {
+			return dialTLS(&cfg, network, addr)
+		},
+		MaxIdleConnsPerHost: 1,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	httpClient = &http.Client{Transport: tr, Timeout: 30 * time.Second}
+	return httpClient
+}
+
+// Closes idle connections to devices, so that no connections or associated
+// goroutines remain once mapping activity has ceased.
+func CloseIdleConnections() {
+	tlsMutex.Lock()
+	c := httpClient
+	tlsMutex.Unlock()
+
+	if c != nil {
+		c.Transport.(*http.Transport).CloseIdleConnections()
+	}
+}
+
+func dialTLS(cfg *TLSConfig, network, addr string) (gnet.Conn, error) {
+	err := localnet.Check(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, err := gnet.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tc := &tls.Config{
+		ServerName:           host,
+		GetClientCertificate: getClientCertificate,
+	}
+
+	if cfg.PinOnFirstUse {
+		tc.InsecureSkipVerify = true
+		tc.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPin(addr, rawCerts)
+		}
+	}
+
+	return tls.DialWithDialer(&gnet.Dialer{Timeout: 10 * time.Second}, network, addr, tc)
+}
+
+func verifyPin(addr string, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errPinMismatch
+	}
+
+	fp := sha256.Sum256(rawCerts[0])
+
+	tlsMutex.Lock()
+	defer tlsMutex.Unlock()
+
+	pin, ok := tlsPins[addr]
+	if !ok {
+		tlsPins[addr] = fp
+		return nil
+	}
+
+	if pin != fp {
+		return errPinMismatch
+	}
+
+	return nil
+}
+
+var generatedCertOnce sync.Once
+var generatedCert *tls.Certificate
+var generatedCertErr error
+
+func getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	tlsMutex.Lock()
+	cert := tlsConfig.Certificate
+	tlsMutex.Unlock()
+
+	if cert != nil {
+		return cert, nil
+	}
+
+	generatedCertOnce.Do(func() {
+		generatedCert, generatedCertErr = generateCertificate()
+	})
+
+	return generatedCert, generatedCertErr
+}
+
+// Generates a self-signed certificate identifying this control point.
+func generateCertificate() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "portmap control point"},
+		NotBefore:    now.Add(-1 * time.Hour),
+		NotAfter:     now.AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
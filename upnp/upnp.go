@@ -5,157 +5,190 @@ import "net/http"
 import "net/url"
 import gnet "net"
 import "encoding/xml"
-import "errors"
 import "fmt"
-import "math/rand"
 import "strings"
 import "time"
-import "html"
+import "github.com/hlandau/portmap/internal/localnet"
+import "github.com/hlandau/portmap/internal/parse"
+import "github.com/hlandau/portmap/ssdp"
 
 // Protocol Structures
 
-const upnpDeviceNS = "urn:schemas-upnp-org:device-1-0"
-
-type xRootDevice struct {
-	XMLName xml.Name `xml:"root"`
-	Device  xDevice  `xml:"device"`
+type xGetExternalAddrResponse struct {
+	XMLName           xml.Name `xml:"GetExternalIPAddressResponse"`
+	ExternalIPAddress string   `xml:"NewExternalIPAddress"`
 }
 
-type xDevice struct {
-	Services []xService `xml:"serviceList>service,omitempty"`
-	Devices  []xDevice  `xml:"deviceList>device,omitempty"`
-}
+// Service types for the WANIPConnection service defined by IGDv1 and IGDv2
+// respectively.
+const (
+	WANIPConnection1 = "urn:schemas-upnp-org:service:WANIPConnection:1"
+	WANIPConnection2 = "urn:schemas-upnp-org:service:WANIPConnection:2"
+)
 
-func (self *xDevice) InitURLFields(base *url.URL) {
-	for i := range self.Services {
-		self.Services[i].InitURLFields(base)
-	}
-	for i := range self.Devices {
-		self.Devices[i].InitURLFields(base)
-	}
+// A service located via a device description.
+type serviceEndpoint struct {
+	ControlURL *url.URL
+	Type       string
+	Quirks     Quirks
 }
 
-type servicesVisitorFunc func(s *xService)
-
-func (self *xDevice) VisitServices(f servicesVisitorFunc) {
-	for i := range self.Services {
-		f(&self.Services[i])
+// Gets the WANIPConnection service from the main UPnP control URL. Services
+// of the given types are searched for in order of preference; if none are
+// specified, either version of WANIPConnection is accepted, preferring
+// version 1.
+func getWANIPService(upnpURL string, types ...string) (*serviceEndpoint, error) {
+	if len(types) == 0 {
+		types = []string{WANIPConnection1, WANIPConnection2}
 	}
-	for i := range self.Devices {
-		self.Devices[i].VisitServices(f)
-	}
-}
 
-type xService struct {
-	ServiceType string    `xml:"serviceType"`
-	ServiceID   string    `xml:"serviceId"`
-	ControlURL  xURLField `xml:"controlURL"`
-}
+	wsvc, err := getService(upnpURL, types...)
+	if err != nil {
+		return nil, err
+	}
 
-func (self *xService) InitURLFields(base *url.URL) {
-	self.ControlURL.InitURLFields(base)
-}
+	if wsvc == nil {
+		return nil, noServiceError("WANIPConnection")
+	}
 
-type xURLField struct {
-	URL url.URL `xml:"-"`
-	OK  bool    `xml:"-"`
-	Str string  `xml:",chardata"`
+	return wsvc, nil
 }
 
-func (self *xURLField) InitURLFields(base *url.URL) {
-	u, err := url.Parse(self.Str)
+// Finds the first service of the given types, in order of preference, in the
+// description at the main UPnP control URL. Returns nil with a nil error if
+// no such service exists.
+func getService(upnpURL string, types ...string) (*serviceEndpoint, error) {
+	desc, err := ssdp.DescribeURL(upnpURL)
 	if err != nil {
-		self.URL = url.URL{}
-		self.OK = false
-		return
+		return nil, err
 	}
 
-	self.URL = *base.ResolveReference(u)
-	self.OK = true
-}
+	for _, t := range types {
+		var svc *serviceEndpoint
+		desc.Device.VisitServices(func(d *ssdp.Device, s *ssdp.DeviceService) {
+			if s.ServiceType != t || svc != nil || s.ControlURL == nil {
+				return
+			}
 
-type xSoapEnvelope struct {
-	XMLName xml.Name  `xml:"Envelope"`
-	Body    xSoapBody `xml:"Body"`
-}
+			svc = &serviceEndpoint{ControlURL: s.ControlURL, Type: t, Quirks: getQuirks(upnpURL, desc)}
+		})
 
-type xSoapBody struct {
-	XMLName xml.Name `xml:"Body"`
-	Data    []byte   `xml:",innerxml"`
-}
+		if svc != nil {
+			return svc, nil
+		}
+	}
 
-type xGetExternalAddrResponse struct {
-	XMLName           xml.Name `xml:"GetExternalIPAddressResponse"`
-	ExternalIPAddress string   `xml:"NewExternalIPAddress"`
+	return nil, nil
 }
 
-// Gets the WANIPConnection control URL from the main UPnP control URL.
-func getWANIPControlURL(upnpURL string) (*url.URL, error) {
-	urlp, err := url.Parse(upnpURL)
+// Gets the friendly name of the root device described at the given UPnP
+// device URL.
+func GetDeviceName(upnpURL string) (string, error) {
+	desc, err := ssdp.DescribeURL(upnpURL)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	res, err := http.Get(upnpURL)
+	return desc.Device.FriendlyName, nil
+}
+
+// Make a SOAP request for an action of a service.
+//
+// If the device responds with a UPnP error, it is returned as an *Error. If
+// the device has stopped responding, ErrCircuitOpen is returned without a
+// request being made; see BreakerConfig.
+func soapRequest(svc *serviceEndpoint, msg soapMessage) (*http.Response, error) {
+	method := msg.action
+	req, err := http.NewRequest("POST", svc.ControlURL.String(), strings.NewReader(msg.envelope))
 	if err != nil {
 		return nil, err
 	}
 
-	if res.StatusCode != 200 {
-		return nil, errors.New("non-200 status code when retrieving UPnP device description")
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+svc.Type+`#`+method+`"`)
+	svc.Quirks.apply(req, svc.Type, method)
+
+	if svc.Quirks.SerializeRequests {
+		l := deviceLock(svc.ControlURL.Host)
+		l.Lock()
+		defer l.Unlock()
+		req.Close = true
 	}
 
-	defer res.Body.Close()
-	d := xml.NewDecoder(res.Body)
-	d.DefaultSpace = upnpDeviceNS
+	host := svc.ControlURL.Host
+	if err := breakerAllow(host); err != nil {
+		return nil, err
+	}
 
-	var root xRootDevice
-	err = d.Decode(&root)
+	res, err := getHTTPClient().Do(req)
+	breakerRecord(host, err)
 	if err != nil {
 		return nil, err
 	}
 
-	root.Device.InitURLFields(urlp)
-
-	var wurl *url.URL
-	root.Device.VisitServices(func(s *xService) {
-		if s.ServiceType != "urn:schemas-upnp-org:service:WANIPConnection:1" || wurl != nil || !s.ControlURL.OK {
-			return
+	if res.StatusCode != 200 {
+		defer res.Body.Close()
+		if uerr := parseFault(res.Body); uerr != nil {
+			return nil, uerr
 		}
 
-		wurl = &s.ControlURL.URL
-	})
+		return nil, &HTTPError{StatusCode: res.StatusCode}
+	}
 
-	return wurl, nil
+	return res, nil
 }
 
-// Make a SOAP request to an URL.
-func soapRequest(url, method, msg string) (*http.Response, error) {
-	fm := `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` + msg + `</s:Body></s:Envelope>`
-
-	req, err := http.NewRequest("POST", url, strings.NewReader(fm))
+// Make a SOAP request for an action of a service and decode the response
+// body into v.
+func soapCall(wsvc *serviceEndpoint, msg soapMessage, v interface{}) error {
+	res, err := soapRequest(wsvc, msg)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer res.Body.Close()
 
-	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
-	req.Header.Set("SOAPAction", `"urn:schemas-upnp-org:service:WANIPConnection:1#`+method+`"`)
+	b, err := parse.ReadLimited(res.Body, parse.MaxDocumentSize)
+	if err != nil {
+		return err
+	}
 
-	res, err := http.DefaultClient.Do(req)
+	reply, err := parse.SOAP(b)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if res.StatusCode != 200 {
-		res.Body.Close()
-		return nil, errors.New("Non-successful HTTP error code")
+	return parse.SOAPBody(reply.Body, v)
+}
+
+// Parses a UPnP boolean value.
+func parseBoolean(s string) bool {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "1", "true", "yes":
+		return true
+	default:
+		return false
 	}
+}
 
-	return res, nil
+// Returns the local IP address of this host which is used to communicate with
+// the device at the given UPnP device URL. This is the address mappings are
+// created for.
+func LocalIP(upnpURL string) (gnet.IP, error) {
+	wsvc, err := getWANIPService(upnpURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return determineSelfIP(wsvc.ControlURL)
 }
 
 // Figure out our own local IP relative to the gateway.
 func determineSelfIP(u *url.URL) (gnet.IP, error) {
+	err := localnet.Check(u.Host)
+	if err != nil {
+		return nil, err
+	}
+
 	c, err := gnet.Dial("udp", u.Host)
 	if err != nil {
 		return nil, err
@@ -167,48 +200,174 @@ func determineSelfIP(u *url.URL) (gnet.IP, error) {
 	return uaddr.IP, nil
 }
 
-func randInRange(low, high uint16) uint16 {
-	return uint16(rand.Int31n(int32(high-low)) + int32(low))
+func remoteHostString(remoteHost gnet.IP) string {
+	if remoteHost == nil {
+		return ""
+	}
+
+	return remoteHost.String()
 }
 
 // Performs a single UPnP transaction to map a port.
 //
 // Pass a UPnP device URL. The WANIPConnection endpoint will be located automatically.
+//
+// If externalPort is 0, the first port of the PortSource for the name and
+// internal port is used, so that the same port is requested on each run.
 func Map(upnpURL string, protocol Protocol, internalPort uint16,
 	externalPort uint16, name string, duration time.Duration) (actualExternalPort uint16, err error) {
-	wurl, err := getWANIPControlURL(upnpURL)
+	return MapRemoteHost(upnpURL, protocol, nil, internalPort, externalPort, name, duration)
+}
 
-	if externalPort == 0 {
-		externalPort = randInRange(1025, 65000)
+// Like Map, but the mapping only admits traffic from remoteHost. If
+// remoteHost is nil, traffic from any host is admitted. Not all gateways
+// support restricting mappings in this way.
+func MapRemoteHost(upnpURL string, protocol Protocol, remoteHost gnet.IP, internalPort uint16,
+	externalPort uint16, name string, duration time.Duration) (actualExternalPort uint16, err error) {
+	res, err := MapDetailed(upnpURL, protocol, remoteHost, internalPort, externalPort, name, duration)
+	if err != nil {
+		return 0, err
 	}
 
-	selfIP, err := determineSelfIP(wurl)
+	return res.ExternalPort, nil
+}
+
+// Like MapRemoteHost, but the mapping is added with NewEnabled set to 0, so
+// that the gateway reserves the external port without forwarding traffic to
+// it. Map the same port with MapRemoteHost to enable the mapping. Some
+// gateways ignore NewEnabled and forward traffic regardless.
+func MapDisabled(upnpURL string, protocol Protocol, remoteHost gnet.IP, internalPort uint16,
+	externalPort uint16, name string, duration time.Duration) (actualExternalPort uint16, err error) {
+	res, err := mapDetailed(upnpURL, protocol, remoteHost, internalPort, externalPort, name, duration, false)
 	if err != nil {
 		return 0, err
 	}
 
-	s := fmt.Sprintf(`<u:AddPortMapping xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"><NewRemoteHost></NewRemoteHost><NewExternalPort>%d</NewExternalPort><NewProtocol>%s</NewProtocol><NewInternalPort>%d</NewInternalPort><NewInternalClient>%s</NewInternalClient><NewEnabled>1</NewEnabled><NewPortMappingDescription>%s</NewPortMappingDescription><NewLeaseDuration>%d</NewLeaseDuration></u:AddPortMapping>`, externalPort, protocol.String(), internalPort, selfIP.String(), html.EscapeString(name), uint32(duration.Seconds()))
+	return res.ExternalPort, nil
+}
+
+// Describes the AddPortMapping request which succeeded, after any quirks of
+// the device were applied.
+type MapResult struct {
+	ExternalPort uint16
 
-	res, err := soapRequest(wurl.String(), "AddPortMapping", s)
+	// The address of this host to which the port was mapped.
+	InternalClient gnet.IP
+
+	// The lease duration requested. Zero if the device only supports
+	// permanent leases, in which case the mapping does not expire.
+	LeaseDuration time.Duration
+
+	// The description sent to the device.
+	Description string
+
+	// The type of the WANIPConnection service used.
+	ServiceType string
+
+	// The quirks in effect for the request.
+	Quirks Quirks
+}
+
+// Like MapRemoteHost, but describes the request which succeeded. If the device
+// responds with a UPnP error, it is returned as an *Error.
+func MapDetailed(upnpURL string, protocol Protocol, remoteHost gnet.IP, internalPort uint16,
+	externalPort uint16, name string, duration time.Duration) (*MapResult, error) {
+	return mapDetailed(upnpURL, protocol, remoteHost, internalPort, externalPort, name, duration, true)
+}
+
+func mapDetailed(upnpURL string, protocol Protocol, remoteHost gnet.IP, internalPort uint16,
+	externalPort uint16, name string, duration time.Duration, enabled bool) (*MapResult, error) {
+	wsvc, err := getWANIPService(upnpURL)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+
+	if externalPort == 0 {
+		externalPort = NewPortSource(name, internalPort).Next()
 	}
-	defer res.Body.Close()
-	// HTTP Status Code is non-200 if there was an error, so do we even need to check the body?
 
-	return externalPort, nil
+	selfIP, err := determineSelfIP(wsvc.ControlURL)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		q := &wsvc.Quirks
+		if q.RequireMatchingPorts {
+			externalPort = internalPort
+		}
+
+		lease := uint32(duration.Seconds())
+		if q.PermanentLeaseOnly {
+			lease = 0
+		}
+
+		desc := q.description(name)
+		msg := actionAddPortMapping.begin(wsvc.Type, len(desc)+64).
+			str(remoteHostString(remoteHost)).
+			uint(uint64(externalPort)).
+			str(protocol.String()).
+			uint(uint64(internalPort)).
+			str(selfIP.String()).
+			bool(enabled).
+			str(desc).
+			uint(uint64(lease)).
+			message()
+
+		res, err := soapRequest(wsvc, msg)
+		if err != nil {
+			// Some quirks can be recognised from the error returned, in which case
+			// they are recorded for future requests and the request is retried.
+			if learned, ok := quirksFromError(err); ok && len(wsvc.Quirks.merge(learned).Names()) > len(q.Names()) {
+				learnQuirks(upnpURL, learned)
+				wsvc.Quirks = wsvc.Quirks.merge(learned)
+				continue
+			}
+
+			return nil, err
+		}
+		res.Body.Close()
+		// HTTP Status Code is non-200 if there was an error, so do we even need to check the body?
+
+		return &MapResult{
+			ExternalPort:   externalPort,
+			InternalClient: selfIP,
+			LeaseDuration:  time.Duration(lease) * time.Second,
+			Description:    desc,
+			ServiceType:    wsvc.Type,
+			Quirks:         wsvc.Quirks,
+		}, nil
+	}
+}
+
+// Determines the quirks indicated by an error returned by AddPortMapping.
+func quirksFromError(err error) (Quirks, bool) {
+	switch {
+	case IsErrorCode(err, ErrCodeOnlyPermanentLeases):
+		return Quirks{PermanentLeaseOnly: true}, true
+	case IsErrorCode(err, ErrCodeSamePortValuesRequired):
+		return Quirks{RequireMatchingPorts: true}, true
+	default:
+		return Quirks{}, false
+	}
 }
 
 // Performs a single UPnP transaction to unmap a port.
 //
 // Pass a UPnP device URL. The WANIPConnection endpoint will be located automatically.
 func Unmap(upnpURL string, protocol Protocol, externalPort uint16) error {
-	wurl, err := getWANIPControlURL(upnpURL)
+	return UnmapRemoteHost(upnpURL, protocol, nil, externalPort)
+}
 
-	s := fmt.Sprintf(`<u:DeletePortMapping xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"><NewRemoteHost></NewRemoteHost><NewExternalPort>%d</NewExternalPort><NewProtocol>%s</NewProtocol></u:DeletePortMapping></s:Body></s:Envelope>`,
-		externalPort, protocol.String())
+// Like Unmap, but for a mapping created with MapRemoteHost.
+func UnmapRemoteHost(upnpURL string, protocol Protocol, remoteHost gnet.IP, externalPort uint16) error {
+	wsvc, err := getWANIPService(upnpURL)
+	if err != nil {
+		return err
+	}
 
-	res, err := soapRequest(wurl.String(), "DeletePortMapping", s)
+	msg := deletePortMappingMessage(wsvc, remoteHost, externalPort, protocol)
+	res, err := soapRequest(wsvc, msg)
 	if err != nil {
 		return err
 	}
@@ -217,36 +376,39 @@ func Unmap(upnpURL string, protocol Protocol, externalPort uint16) error {
 	return nil
 }
 
+func deletePortMappingMessage(wsvc *serviceEndpoint, remoteHost gnet.IP, externalPort uint16, protocol Protocol) soapMessage {
+	return actionDeletePortMapping.begin(wsvc.Type, 64).
+		str(remoteHostString(remoteHost)).
+		uint(uint64(externalPort)).
+		str(protocol.String()).
+		message()
+}
+
 // Performs a single UPnP transaction to get the external address.
 //
 // Pass the UPnP device URL. The WANIPConnection endpoint will be located
 // automatically.
 func GetExternalAddr(upnpURL string) (ip gnet.IP, err error) {
-	wurl, err := getWANIPControlURL(upnpURL)
-
-	s := `<u:GetExternalIPAddress xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"/>`
-
-	res, err := soapRequest(wurl.String(), "GetExternalIPAddress", s)
+	wsvc, err := getWANIPService(upnpURL)
 	if err != nil {
 		return
 	}
-	defer res.Body.Close()
 
-	var reply xSoapEnvelope
-	err = xml.NewDecoder(res.Body).Decode(&reply)
-	if err != nil {
-		return
-	}
+	return getExternalAddr(wsvc)
+}
+
+func getExternalAddr(wsvc *serviceEndpoint) (ip gnet.IP, err error) {
+	msg := actionGetExternalIPAddress.begin(wsvc.Type, 0).message()
 
 	var reply2 xGetExternalAddrResponse
-	err = xml.Unmarshal(reply.Body.Data, &reply2)
+	err = soapCall(wsvc, msg, &reply2)
 	if err != nil {
 		return
 	}
 
 	ip = gnet.ParseIP(reply2.ExternalIPAddress)
 	if ip == nil {
-		err = fmt.Errorf("Unable to parse IP address")
+		err = fmt.Errorf("invalid external IP address %q", reply2.ExternalIPAddress)
 		return
 	}
 
@@ -270,3 +432,14 @@ func (p Protocol) String() string {
 		panic("unknown protocol value")
 	}
 }
+
+func parseProtocol(s string) (Protocol, bool) {
+	switch strings.ToUpper(strings.TrimSpace(s)) {
+	case "TCP":
+		return TCP, true
+	case "UDP":
+		return UDP, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,82 @@
+package portmap
+
+// Channels signalled whenever the state of a mapping changes, one for each
+// call to AddrChan. Protected by the owner's mutex.
+type watchers []chan struct{}
+
+func (w *watchers) add() <-chan struct{} {
+	c := make(chan struct{}, 1)
+	*w = append(*w, c)
+	return c
+}
+
+// Removes a channel returned by add.
+func (w *watchers) remove(c <-chan struct{}) {
+	for i, x := range *w {
+		if x == c {
+			*w = append((*w)[:i:i], (*w)[i+1:]...)
+			return
+		}
+	}
+}
+
+func (w watchers) signal() {
+	for _, c := range w {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// The notification and event channels of one reference to a mapping. Each
+// reference returned by New has its own, so that callers sharing a mapping
+// don't consume each other's notifications and events.
+type subscription struct {
+	notifyChan chan struct{}
+	eventChan  chan Event
+}
+
+func newSubscription() *subscription {
+	return &subscription{
+		notifyChan: make(chan struct{}, 1),
+		eventChan:  make(chan Event, eventBufferSize),
+	}
+}
+
+// Adds a subscription to the notifications and events of the mapping.
+func (m *mapping) subscribe() *subscription {
+	s := newSubscription()
+
+	m.subsMutex.Lock()
+	defer m.subsMutex.Unlock()
+	m.subs = append(m.subs, s)
+	return s
+}
+
+// Removes a subscription added by subscribe, so that nothing more is sent on
+// its channels.
+func (m *mapping) unsubscribe(s *subscription) {
+	m.subsMutex.Lock()
+	defer m.subsMutex.Unlock()
+
+	for i, x := range m.subs {
+		if x == s {
+			m.subs = append(m.subs[:i:i], m.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+// Signals the notification channel of every subscription. Doesn't block.
+func (m *mapping) signalNotify() {
+	m.subsMutex.Lock()
+	defer m.subsMutex.Unlock()
+
+	for _, s := range m.subs {
+		select {
+		case s.notifyChan <- struct{}{}:
+		default:
+		}
+	}
+}